@@ -0,0 +1,376 @@
+// Package client lets Go programs take part in DrizLink: log in to a server,
+// list the online users and the files they share, send and download files
+// and folders, and follow transfers as they happen.
+//
+//	c, err := client.Dial("localhost:8080")
+//	if err != nil {
+//		return err
+//	}
+//	defer c.Close()
+//	if err := c.Login("backup-bot", "/srv/share"); err != nil {
+//		return err
+//	}
+//	err = c.SendFile("alice", "report.pdf")
+//
+// Transfers, settings and output belong to the process, so only one Client
+// can be open at a time and Dial fails while another is. Whatever other
+// users send is saved in the store path, as it would be for the command
+// line client.
+package client
+
+import (
+	connection "drizlink/client/internal"
+	"drizlink/protocol"
+	"drizlink/utils"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+)
+
+// AllUsers sends to every online user when given as the recipient
+const AllUsers = connection.AllUsers
+
+var (
+	// ErrNotLoggedIn is returned by operations made before Login
+	ErrNotLoggedIn = errors.New("not logged in")
+	// ErrDisconnected is returned once the connection to the server is gone
+	ErrDisconnected = connection.ErrConnectionLost
+	// ErrClientOpen is returned by Dial while another Client is open
+	ErrClientOpen = errors.New("another client is open in this process")
+)
+
+var (
+	// open is the Client between Dial and Close, if any
+	open   *Client
+	output io.Writer = io.Discard
+	// stateMutex guards open and output
+	stateMutex sync.Mutex
+)
+
+// SetOutput sets where the progress messages and bars shown to users of the
+// command line client are written. They are discarded unless this is called.
+func SetOutput(w io.Writer) {
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+	output = w
+	utils.SetOutput(w)
+}
+
+// LoadConfig applies the settings saved by the command line client's /set.
+// Without it the defaults are used.
+func LoadConfig() error {
+	return connection.LoadConfig()
+}
+
+// User is an online user
+type User struct {
+	Name string `json:"name"`
+	ID   string `json:"id"`
+}
+
+// Entry is a file or folder another user shares
+type Entry struct {
+	Kind string `json:"kind"` // "FILE" or "FOLDER"
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+// Client is a connection to a DrizLink server
+type Client struct {
+	conn     *protocol.Conn
+	events   chan Event
+	lost     chan struct{}
+	mutex    sync.Mutex
+	loggedIn bool
+	// credentialsNeeded is set once Rejoin found no session to continue,
+	// after which the server waits for the username and store path
+	credentialsNeeded bool
+	closeOnce         sync.Once
+}
+
+// Dial connects to the server at address, in format host:port. Login must
+// follow before anything else. It returns ErrClientOpen until the Client
+// dialled before is closed.
+func Dial(address string) (*Client, error) {
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+	if open != nil {
+		return nil, ErrClientOpen
+	}
+	utils.SetOutput(output)
+
+	conn, err := connection.Connect(address)
+	if err != nil {
+		return nil, err
+	}
+	open = &Client{
+		conn:   conn,
+		events: make(chan Event, eventBuffer),
+		lost:   make(chan struct{}),
+	}
+	return open, nil
+}
+
+// Login logs in as name, sharing the folder storePath with other users. It
+// starts a session of its own, so it never takes over the session of another
+// client on this machine, unless Rejoin was tried first.
+func (c *Client) Login(name, storePath string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.loggedIn {
+		return errors.New("already logged in")
+	}
+	var err error
+	if c.credentialsNeeded {
+		err = connection.SendCredentials(c.conn, name, storePath)
+	} else {
+		err = connection.Authenticate(c.conn, name, storePath)
+	}
+	if err != nil {
+		return err
+	}
+	c.start()
+	return nil
+}
+
+// Rejoin continues the session the command line client on this machine
+// last held, if the server still has it and it is offline, and returns its
+// username. When it reports false, Login must follow; the session it starts
+// is the one the next Rejoin continues.
+func (c *Client) Rejoin() (string, bool, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.loggedIn || c.credentialsNeeded {
+		return "", false, errors.New("already logged in or rejoined")
+	}
+	name, rejoined, err := connection.Rejoin(c.conn)
+	if err != nil {
+		return "", false, err
+	}
+	if !rejoined {
+		c.credentialsNeeded = true
+		return "", false, nil
+	}
+	c.start()
+	return name, true, nil
+}
+
+// start follows the connection once logged in. Callers hold c.mutex.
+func (c *Client) start() {
+	c.loggedIn = true
+	events, stop := connection.Subscribe()
+	go func() {
+		connection.ReadLoop(c.conn)
+		close(c.lost)
+	}()
+	go c.forward(events, stop)
+}
+
+// Interact runs the command line client's prompt on standard input. Every
+// line is a command such as /sendfile or a chat message, until exit closes
+// the connection.
+func (c *Client) Interact() error {
+	c.mutex.Lock()
+	loggedIn := c.loggedIn
+	c.mutex.Unlock()
+	if !loggedIn {
+		return ErrNotLoggedIn
+	}
+	connection.WriteLoop(c.conn)
+	return nil
+}
+
+// Close disconnects from the server. Transfers still running fail.
+func (c *Client) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		err = c.conn.Close()
+		c.mutex.Lock()
+		loggedIn := c.loggedIn
+		c.mutex.Unlock()
+		if !loggedIn {
+			close(c.events)
+		}
+
+		stateMutex.Lock()
+		if open == c {
+			open = nil
+		}
+		stateMutex.Unlock()
+	})
+	return err
+}
+
+// perform runs operation once logged in. It returns ErrDisconnected without
+// running operation when the connection to the server is already gone, and
+// when it is lost first it returns ErrDisconnected after waiting for
+// operation: losing the connection fails whatever the operation waits for,
+// so it ends soon after and nothing outlives the call.
+func (c *Client) perform(operation func() error) error {
+	c.mutex.Lock()
+	loggedIn := c.loggedIn
+	c.mutex.Unlock()
+	if !loggedIn {
+		return ErrNotLoggedIn
+	}
+	select {
+	case <-c.lost:
+		return ErrDisconnected
+	default:
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- operation() }()
+	select {
+	case err := <-done:
+		return err
+	case <-c.lost:
+		<-done
+		return ErrDisconnected
+	}
+}
+
+// Users returns the users online now
+func (c *Client) Users() ([]User, error) {
+	var users []User
+	err := c.perform(func() error {
+		online, err := connection.RequestUsers(c.conn)
+		for _, user := range online {
+			users = append(users, User{Name: user.Name, ID: user.ID})
+		}
+		return err
+	})
+	return users, err
+}
+
+// Lookup returns the files and folders user, a username or user ID, shares
+func (c *Client) Lookup(user string) ([]Entry, error) {
+	var entries []Entry
+	err := c.perform(func() error {
+		userId, err := connection.ResolveUser(c.conn, user)
+		if err != nil {
+			return err
+		}
+		listing, err := connection.Lookup(c.conn, userId)
+		for _, entry := range listing {
+			entries = append(entries, Entry{Kind: entry.Kind, Path: entry.Path, Size: entry.Size})
+		}
+		return err
+	})
+	return entries, err
+}
+
+// SendFile sends the file at path and returns once it has been delivered.
+// to is a username or user ID, several of them comma separated, or
+// AllUsers.
+func (c *Client) SendFile(to, path string) error {
+	return c.perform(func() error {
+		recipientId, err := connection.ResolveUsers(c.conn, to)
+		if err != nil {
+			return err
+		}
+		return connection.SendFile(c.conn, recipientId, path)
+	})
+}
+
+// SendFolder sends the folder at path to one user, a username or user ID,
+// and returns once it has been delivered
+func (c *Client) SendFolder(to, path string) error {
+	return c.perform(func() error {
+		recipientId, err := connection.ResolveUsers(c.conn, to)
+		if err != nil {
+			return err
+		}
+		return connection.SendFolder(c.conn, recipientId, path)
+	})
+}
+
+// Send sends files, folders and the matches of glob patterns side by side,
+// returning once all of them are done. to is given as for SendFile.
+func (c *Client) Send(to string, paths ...string) error {
+	return c.perform(func() error {
+		recipientId, err := connection.ResolveUsers(c.conn, to)
+		if err != nil {
+			return err
+		}
+		return connection.SendPaths(c.conn, recipientId, paths)
+	})
+}
+
+// SendStream sends everything read from r to one user as a stream called
+// name, without knowing its length up front
+func (c *Client) SendStream(to, name string, r io.Reader) error {
+	return c.perform(func() error {
+		recipientId, err := connection.ResolveUser(c.conn, to)
+		if err != nil {
+			return err
+		}
+		return connection.SendPipe(c.conn, recipientId, name, r)
+	})
+}
+
+// ReceiveStream writes the next stream sent by from, a username or user ID,
+// or by anyone when from is empty, to w instead of the store path. It
+// returns once the stream has ended.
+func (c *Client) ReceiveStream(from string, w io.Writer) error {
+	return c.perform(func() error {
+		select {
+		case err := <-connection.ReceivePipe(from, w):
+			return err
+		case <-c.lost:
+			// The stream can no longer arrive
+			return ErrDisconnected
+		}
+	})
+}
+
+// Download asks user, a username or user ID, for the file or folder at path
+// on their machine and returns where it was saved once it has arrived
+func (c *Client) Download(user, path string) (string, error) {
+	var savedPath string
+	err := c.perform(func() error {
+		userId, err := connection.ResolveUser(c.conn, user)
+		if err != nil {
+			return err
+		}
+		savedPath, err = connection.Download(c.conn, userId, path)
+		return err
+	})
+	return savedPath, err
+}
+
+// Chat sends a one line message to every online user
+func (c *Client) Chat(text string) error {
+	text = strings.TrimSpace(text)
+	if text == "" || strings.HasPrefix(text, "/") || strings.ContainsAny(text, "\r\n") {
+		return errors.New("a chat message must be one line and cannot start with /")
+	}
+	return c.perform(func() error {
+		return c.conn.WriteLine(text)
+	})
+}
+
+// Transfers returns the transfers that are queued, running or paused
+func (c *Client) Transfers() []Transfer {
+	transfers := []Transfer{}
+	for _, transfer := range connection.ListTransfers() {
+		transfers = append(transfers, newTransfer(transfer.Info()))
+	}
+	return transfers
+}
+
+// Pause pauses the transfer with the given ID
+func (c *Client) Pause(id string) error {
+	return connection.PauseTransfer(id)
+}
+
+// Resume resumes the paused transfer with the given ID
+func (c *Client) Resume(id string) error {
+	return connection.ResumeTransfer(id)
+}
+
+// Cancel stops the transfer with the given ID, which then fails
+func (c *Client) Cancel(id string) error {
+	return connection.CancelTransfer(id)
+}
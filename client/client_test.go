@@ -0,0 +1,207 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"drizlink/helper"
+	"drizlink/protocol"
+	"drizlink/server"
+	"errors"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testTimeout bounds every wait in these tests
+const testTimeout = 5 * time.Second
+
+// startServer serves an in-process server on a loopback port until the
+// test ends and returns it with its address
+func startServer(t *testing.T) (*server.Server, string) {
+	t.Helper()
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	srv, err := server.New(server.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(context.Background(), listener)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+		defer cancel()
+		srv.Shutdown(ctx)
+	})
+	return srv, listener.Addr().String()
+}
+
+// login dials address and logs in as name, closing the client when the
+// test ends
+func login(t *testing.T, address, name string) *Client {
+	t.Helper()
+	c, err := Dial(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	if err := c.Login(name, t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// rawPeer logs in to the server at address as name without the client
+// package, so a test can answer transfers itself
+func rawPeer(t *testing.T, address, name string) *protocol.Conn {
+	t.Helper()
+	netConn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := protocol.NewConn(netConn)
+	t.Cleanup(func() { conn.Close() })
+	conn.WriteLine(protocol.Format("/LOGIN", "new"))
+	conn.WriteLine(name)
+	conn.WriteLine(t.TempDir())
+	expect(t, conn, "/SESSION")
+	return conn
+}
+
+// expect reads messages from conn until one with command arrives and
+// returns its arguments, with the command first, and its payload
+func expect(t *testing.T, conn *protocol.Conn, command string) ([]string, []byte) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(testTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	for {
+		line, err := conn.ReadLine()
+		if err != nil {
+			t.Fatalf("waiting for %s: %v", command, err)
+		}
+		args, err := protocol.SplitArgs(line)
+		if err != nil || len(args) == 0 {
+			continue
+		}
+		var payload []byte
+		if args[0] == "/CHUNK" {
+			size, err := protocol.ParseSize(args[len(args)-1])
+			if err != nil {
+				t.Fatalf("invalid chunk: %v", err)
+			}
+			if payload, err = conn.ReadPayload(size); err != nil {
+				t.Fatalf("error reading chunk: %v", err)
+			}
+		}
+		if args[0] == command {
+			return args, payload
+		}
+	}
+}
+
+func TestDial(t *testing.T) {
+	_, address := startServer(t)
+	c, err := Dial(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Dial(address); err != ErrClientOpen {
+		t.Errorf("second Dial returned %v, want ErrClientOpen", err)
+	}
+	if _, err := c.Users(); err != ErrNotLoggedIn {
+		t.Errorf("Users before Login returned %v, want ErrNotLoggedIn", err)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, open := <-c.Events(); open {
+		t.Error("Events is still open after Close")
+	}
+
+	c = login(t, address, "alice")
+	users, err := c.Users()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 || users[0].Name != "alice" {
+		t.Errorf("Users returned %v, want only alice", users)
+	}
+}
+
+func TestSendFile(t *testing.T) {
+	_, address := startServer(t)
+	c := login(t, address, "alice")
+	bob := rawPeer(t, address, "bob")
+
+	data := make([]byte, 300<<10)
+	rand.New(rand.NewSource(1)).Read(data)
+	path := filepath.Join(t.TempDir(), "report.bin")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	checksum, err := helper.CalculateFileChecksum(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sent := make(chan error, 1)
+	go func() { sent <- c.SendFile("bob", path) }()
+
+	args, _ := expect(t, bob, "/FILE_RESPONSE")
+	aliceId, transferId := args[1], args[5]
+	if args[2] != "report.bin" || args[4] != checksum {
+		t.Fatalf("bob was offered %v", args)
+	}
+	bob.WriteLine(protocol.Format("/TRANSFER_ACCEPT", aliceId, transferId, "report.bin", "0"))
+	var received []byte
+	for len(received) < len(data) {
+		_, payload := expect(t, bob, "/CHUNK")
+		received = append(received, payload...)
+	}
+	if !bytes.Equal(received, data) {
+		t.Fatalf("bob received %d bytes that differ from the %d sent", len(received), len(data))
+	}
+	bob.WriteLine(protocol.Format("/RECEIPT", aliceId, transferId, "report.bin", checksum))
+
+	select {
+	case err := <-sent:
+		if err != nil {
+			t.Fatalf("SendFile returned %v", err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("SendFile did not return after the receipt")
+	}
+	for _, transfer := range c.Transfers() {
+		if transfer.Name == "report.bin" && transfer.Status != "Completed" {
+			t.Errorf("the transfer is %s after delivery, want Completed", transfer.Status)
+		}
+	}
+}
+
+func TestDisconnected(t *testing.T) {
+	srv, address := startServer(t)
+	c := login(t, address, "alice")
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	timeout := time.After(testTimeout)
+	for disconnected := false; !disconnected; {
+		select {
+		case event := <-c.Events():
+			_, disconnected = event.(Disconnected)
+		case <-timeout:
+			t.Fatal("no Disconnected event after the server shut down")
+		}
+	}
+	if _, err := c.Users(); !errors.Is(err, ErrDisconnected) {
+		t.Errorf("Users returned %v once disconnected, want ErrDisconnected", err)
+	}
+}
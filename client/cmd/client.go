@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"drizlink/client"
 	connection "drizlink/client/internal"
 	"drizlink/helper"
 	"drizlink/utils"
@@ -9,55 +10,73 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"time"
 )
 
 func promptForServerAddress() string {
 	reader := bufio.NewReader(os.Stdin)
-	
+
 	for {
 		fmt.Println(utils.InfoColor("Enter server address (format host:port):"))
 		fmt.Print(utils.CommandColor(">>> "))
 		address, _ := reader.ReadString('\n')
 		address = strings.TrimSpace(address)
-		
+
 		if !strings.Contains(address, ":") {
 			fmt.Println(utils.ErrorColor("❌ Invalid address format. Please use host:port (e.g., localhost:8080)"))
 			continue
 		}
-		
+
 		// Check if server is available at this address
 		available, errMsg := helper.CheckServerAvailability(address)
 		if !available {
 			fmt.Println(utils.ErrorColor("❌ No server available at " + address + ": " + errMsg))
 			fmt.Println(utils.InfoColor("Would you like to try another address? (y/n)"))
 			fmt.Print(utils.CommandColor(">>> "))
-			
+
 			retry, _ := reader.ReadString('\n')
 			retry = strings.TrimSpace(strings.ToLower(retry))
-			
+
 			if retry != "y" && retry != "yes" {
 				os.Exit(1)
 			}
 			continue
 		}
-		
+
 		return address
 	}
 }
 
 func main() {
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		name := os.Args[1]
+		command, exists := commands[name]
+		if !exists {
+			fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", name)
+			os.Stdout = os.Stderr
+			runHelp("help", nil)
+			os.Exit(exitUsage)
+		}
+		os.Exit(command.run(name, os.Args[2:]))
+	}
+
 	serverAddr := flag.String("server", "", "Server address in format host:port")
 	flag.Parse()
-	
+
 	utils.PrintBanner()
-	
+	client.SetOutput(os.Stdout)
+
+	if err := client.LoadConfig(); err != nil {
+		fmt.Println(utils.WarningColor("⚠ Using default settings:"), err)
+	}
+
 	// If server address not provided via command line, ask user
 	address := *serverAddr
 	if address == "" {
 		address = promptForServerAddress()
 	} else {
 		fmt.Println(utils.InfoColor("Connecting to server at " + address + "..."))
-		
+
 		// Check if server is available
 		available, errMsg := helper.CheckServerAvailability(address)
 		if !available {
@@ -67,48 +86,63 @@ func main() {
 			return
 		}
 	}
-	
-	conn, err := connection.Connect(address)
-	if err != nil {
-		if err.Error() == "reconnect" {
-			goto startChat
-		} else {
-			fmt.Println(utils.ErrorColor("❌ Error connecting to server:"), err)
-			return
-		}
-	}
 
-	defer connection.Close(conn)
-
-	fmt.Println(utils.InfoColor("Please login to continue:"))
-	err = connection.UserInput("Username", conn)
+	c, err := client.Dial(address)
 	if err != nil {
-		if err.Error() == "reconnect" {
-			goto startChat
-		} else {
-			fmt.Println(utils.ErrorColor("❌ Error during login:"), err)
-			return
-		}
+		fmt.Println(utils.ErrorColor("❌ Error connecting to server:"), err)
+		return
 	}
+	defer c.Close()
 
-
-	err = connection.UserInput("Store File Path", conn)
+	name, rejoined, err := c.Rejoin()
 	if err != nil {
-		if err.Error() == "reconnect" {
-			goto startChat
-		} else {
-			fmt.Println(utils.ErrorColor("❌ Error setting file path:"), err)
-			return
-		}
+		fmt.Println(utils.ErrorColor("❌ Error during login:"), err)
+		return
+	}
+	if rejoined {
+		fmt.Printf("Welcome back %s!\n", name)
+	} else if err := promptLogin(c); err != nil {
+		fmt.Println(utils.ErrorColor("❌ Error during login:"), err)
+		return
 	}
 
-startChat:
 	fmt.Println(utils.HeaderColor("\n✨ Welcome to DrizLink - P2P File Sharing! ✨"))
 	fmt.Println(utils.InfoColor("------------------------------------------------"))
 	fmt.Println(utils.SuccessColor("✅ Successfully connected to server!"))
 	fmt.Println(utils.InfoColor("Type /help to see available commands"))
 	fmt.Println(utils.InfoColor("------------------------------------------------"))
 
-	go connection.ReadLoop(conn)
-	connection.WriteLoop(conn)
+	if err := connection.LoadJournal(); err != nil {
+		fmt.Println(utils.WarningColor("⚠ Could not read the transfer journal:"), err)
+	}
+	connection.StartJournal(2 * time.Second)
+	go connection.CleanChunkStore()
+
+	c.Interact()
+}
+
+// promptLogin asks for a username and a store path and logs in with them.
+// A store path that is not a directory is asked for again.
+func promptLogin(c *client.Client) error {
+	reader := bufio.NewReader(os.Stdin)
+	fmt.Println(utils.InfoColor("Please login to continue:"))
+	fmt.Println("Enter your Username: ")
+	username, _ := reader.ReadString('\n')
+	username = strings.TrimSpace(username)
+
+	fmt.Println("Enter your Store File Path: ")
+	for {
+		storePath, _ := reader.ReadString('\n')
+		storePath = strings.TrimSpace(storePath)
+		info, err := os.Stat(storePath)
+		switch {
+		case os.IsNotExist(err):
+			fmt.Println(utils.ErrorColor("❌ Error: Directory does not exist"))
+		case err != nil || !info.IsDir():
+			fmt.Println(utils.ErrorColor("❌ Error: Path is not a directory"))
+		default:
+			return c.Login(username, storePath)
+		}
+		fmt.Println("Enter a valid Store File Path: ")
+	}
 }
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"drizlink/client"
+	connection "drizlink/client/internal"
+	"drizlink/utils"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Exit codes of the non-interactive commands
+const (
+	exitOK      = 0
+	exitFailed  = 1
+	exitUsage   = 2
+	exitNoLogin = 3
+)
+
+// command is a subcommand that connects, performs one operation and exits
+type command struct {
+	args    string // what follows the flags in the usage line
+	summary string
+	run     func(name string, args []string) int
+}
+
+var commands map[string]command
+
+// commandOrder is the order commands are listed in by help
+var commandOrder = []string{"send", "recv", "download", "ls", "users", "chat", "transfers", "pause", "resume", "cancel", "events", "help"}
+
+func init() {
+	commands = map[string]command{
+		"send":      {"--to <user> <path>... | -", "Send files and folders, or standard input with -", runSend},
+		"recv":      {"[--from <user>] -", "Write the next stream sent to you to standard output", runRecv},
+		"download":  {"--from <user> <path>", "Download a file or folder from a user", runDownload},
+		"ls":        {"--user <user>", "List the files a user shares", runList},
+		"users":     {"", "List the online users", runUsers},
+		"chat":      {"<message>...", "Send a message to every online user", runChat},
+		"transfers": {"", "List the daemon's transfers", runTransfers},
+		"pause":     {"<transferId>", "Pause one of the daemon's transfers", runTransferControl},
+		"resume":    {"<transferId>", "Resume one of the daemon's transfers", runTransferControl},
+		"cancel":    {"<transferId>", "Cancel one of the daemon's transfers", runTransferControl},
+		"events":    {"", "Print the daemon's events as JSON lines until it stops", runEvents},
+		"help":      {"", "Show this help", runHelp},
+	}
+}
+
+// runHelp lists the non-interactive commands
+func runHelp(name string, args []string) int {
+	fmt.Println("Usage: drizlink [--server host:port]    start an interactive session")
+	fmt.Println("       drizlink <command> [flags] ...   run one command and exit")
+	fmt.Println()
+	fmt.Println("Commands:")
+	for _, name := range commandOrder {
+		fmt.Printf("  %-10s %s\n", name, commands[name].summary)
+	}
+	fmt.Println()
+	fmt.Println("Run drizlink <command> -h for the flags of a command. users, ls, send, download")
+	fmt.Println("and chat go through a running drizlinkd with --daemon; transfers, pause, resume,")
+	fmt.Println("cancel and events always do.")
+	fmt.Println("Exit codes: 0 success, 1 operation failed, 2 invalid usage, 3 could not log in")
+	return exitOK
+}
+
+// session holds the flags every command shares and the connection made
+// with them
+type session struct {
+	flags   *flag.FlagSet
+	server  *string
+	name    *string
+	store   *string
+	daemon  *bool
+	socket  *string
+	out     *os.File // the real standard output, for results
+	client  *client.Client
+	control *connection.ControlClient // set instead of client when driving the daemon
+}
+
+// newSession creates the flag set of the named command
+func newSession(name string) *session {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: drizlink %s [flags] %s\n", name, commands[name].args)
+		flags.PrintDefaults()
+	}
+	return &session{
+		flags:  flags,
+		server: flags.String("server", "localhost:8080", "Server address in format host:port"),
+		name:   flags.String("name", connection.DefaultUsername(), "Username to log in as"),
+		store:  flags.String("store", ".", "Store path other users see, and where their files are saved"),
+		out:    os.Stdout,
+	}
+}
+
+// offerDaemon lets the command go through a running drizlinkd instead of
+// logging in itself
+func (s *session) offerDaemon() {
+	s.daemon = s.flags.Bool("daemon", false, "Use the running drizlinkd instead of logging in")
+	s.socket = s.flags.String("socket", "", "Control socket of drizlinkd (default drizlinkd.sock in the config directory)")
+}
+
+// newControlSession creates the flag set of a command that only the daemon
+// can perform
+func newControlSession(name string) *session {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: drizlink %s [flags] %s\n", name, commands[name].args)
+		flags.PrintDefaults()
+	}
+	daemon := true
+	return &session{
+		flags:  flags,
+		daemon: &daemon,
+		socket: flags.String("socket", "", "Control socket of drizlinkd (default drizlinkd.sock in the config directory)"),
+		out:    os.Stdout,
+	}
+}
+
+// usageError reports a malformed command line
+func (s *session) usageError(message string) int {
+	fmt.Fprintln(os.Stderr, message)
+	s.flags.Usage()
+	return exitUsage
+}
+
+// connect logs in and starts reading from the server. Standard output is
+// kept for results, so every message goes to standard error from here on.
+func (s *session) connect() bool {
+	os.Stdout = os.Stderr
+	client.SetOutput(os.Stderr)
+
+	if s.daemon != nil && *s.daemon {
+		path := *s.socket
+		if path == "" {
+			var err error
+			if path, err = connection.DefaultControlSocket(); err != nil {
+				fmt.Println(utils.ErrorColor("❌ Error locating control socket:"), err)
+				return false
+			}
+		}
+		control, err := connection.DialControl(path)
+		if err != nil {
+			fmt.Println(utils.ErrorColor("❌ Error connecting to drizlinkd:"), err)
+			return false
+		}
+		s.control = control
+		return true
+	}
+
+	if err := client.LoadConfig(); err != nil {
+		fmt.Println(utils.WarningColor("⚠ Using default settings:"), err)
+	}
+	c, err := client.Dial(*s.server)
+	if err == nil {
+		if err = c.Login(*s.name, *s.store); err != nil {
+			c.Close()
+		}
+	}
+	if err != nil {
+		fmt.Println(utils.ErrorColor("❌ Error connecting to server:"), err)
+		return false
+	}
+	s.client = c
+	return true
+}
+
+// fail reports the error of a command that could not finish
+func fail(what string, err error) int {
+	fmt.Println(utils.ErrorColor("❌ Error "+what+":"), err)
+	return exitFailed
+}
+
+// runSend handles `send --to <user> <path>...`, and `send --to <user> -`
+// which streams standard input
+func runSend(name string, args []string) int {
+	s := newSession(name)
+	to := s.flags.String("to", "", "Usernames or user IDs to send to, comma separated, or @all")
+	as := s.flags.String("as", "stdin", "Name a stream from standard input is saved under")
+	s.offerDaemon()
+	if err := s.flags.Parse(args); err != nil {
+		return exitUsage
+	}
+	paths := s.flags.Args()
+	if *to == "" {
+		return s.usageError("send needs --to <user>")
+	}
+	if len(paths) == 0 {
+		return s.usageError("send needs at least one path, or - for standard input")
+	}
+	stream := false
+	for _, path := range paths {
+		if path == "-" {
+			stream = true
+		}
+	}
+	if stream && (len(paths) > 1 || *to == connection.AllUsers || strings.Contains(*to, ",")) {
+		return s.usageError("standard input can only be sent on its own to one user")
+	}
+	if stream && *s.daemon {
+		return s.usageError("standard input cannot be sent through the daemon")
+	}
+
+	if !s.connect() {
+		return exitNoLogin
+	}
+	var err error
+	switch {
+	case s.control != nil:
+		// The daemon resolves paths from its own working directory
+		for i, path := range paths {
+			if absolute, err := filepath.Abs(path); err == nil {
+				paths[i] = absolute
+			}
+		}
+		err = s.control.Call(connection.ControlRequest{Op: "send", User: *to, Paths: paths}, nil)
+	case stream:
+		err = s.client.SendStream(*to, *as, os.Stdin)
+	default:
+		err = s.client.Send(*to, paths...)
+	}
+	if err != nil {
+		return fail("sending", err)
+	}
+	return exitOK
+}
+
+// runRecv handles `recv [--from <user>] -`, which writes the next stream a
+// user sends to standard output
+func runRecv(name string, args []string) int {
+	s := newSession(name)
+	from := s.flags.String("from", "", "Username or user ID to accept the stream from (default anyone)")
+	if err := s.flags.Parse(args); err != nil {
+		return exitUsage
+	}
+	if s.flags.NArg() != 1 || s.flags.Arg(0) != "-" {
+		return s.usageError("recv only writes to standard output, given as -")
+	}
+
+	if !s.connect() {
+		return exitNoLogin
+	}
+	// The outcome of the stream itself is already reported when it ends
+	err := s.client.ReceiveStream(*from, s.out)
+	if errors.Is(err, client.ErrDisconnected) {
+		return fail("receiving stream", err)
+	}
+	if err != nil {
+		return exitFailed
+	}
+	return exitOK
+}
+
+// runDownload handles `download --from <user> <path>` and prints where the
+// download was saved
+func runDownload(name string, args []string) int {
+	s := newSession(name)
+	from := s.flags.String("from", "", "Username or user ID to download from")
+	s.offerDaemon()
+	if err := s.flags.Parse(args); err != nil {
+		return exitUsage
+	}
+	if *from == "" {
+		return s.usageError("download needs --from <user>")
+	}
+	if s.flags.NArg() != 1 {
+		return s.usageError("download needs exactly one path")
+	}
+
+	if !s.connect() {
+		return exitNoLogin
+	}
+	var savedPath string
+	var err error
+	if s.control != nil {
+		var result struct{ Path string }
+		err = s.control.Call(connection.ControlRequest{Op: "download", User: *from, Path: s.flags.Arg(0)}, &result)
+		savedPath = result.Path
+	} else {
+		savedPath, err = s.client.Download(*from, s.flags.Arg(0))
+	}
+	if err != nil {
+		return fail("downloading", err)
+	}
+	fmt.Fprintln(s.out, savedPath)
+	return exitOK
+}
+
+// runList handles `ls --user <user>` and prints one tab separated kind, size
+// and path per line
+func runList(name string, args []string) int {
+	s := newSession(name)
+	owner := s.flags.String("user", "", "Username or user ID whose files to list")
+	s.offerDaemon()
+	if err := s.flags.Parse(args); err != nil {
+		return exitUsage
+	}
+	if *owner == "" {
+		return s.usageError("ls needs --user <user>")
+	}
+	if s.flags.NArg() != 0 {
+		return s.usageError("ls takes no arguments")
+	}
+
+	if !s.connect() {
+		return exitNoLogin
+	}
+	var entries []client.Entry
+	var err error
+	if s.control != nil {
+		err = s.control.Call(connection.ControlRequest{Op: "ls", User: *owner}, &entries)
+	} else {
+		entries, err = s.client.Lookup(*owner)
+	}
+	if err != nil {
+		return fail("listing files", err)
+	}
+	for _, entry := range entries {
+		fmt.Fprintf(s.out, "%s\t%d\t%s\n", strings.ToLower(entry.Kind), entry.Size, entry.Path)
+	}
+	return exitOK
+}
+
+// runUsers handles `users` and prints one tab separated username and user
+// ID per line
+func runUsers(name string, args []string) int {
+	s := newSession(name)
+	s.offerDaemon()
+	if err := s.flags.Parse(args); err != nil {
+		return exitUsage
+	}
+	if s.flags.NArg() != 0 {
+		return s.usageError("users takes no arguments")
+	}
+
+	if !s.connect() {
+		return exitNoLogin
+	}
+	var users []client.User
+	var err error
+	if s.control != nil {
+		err = s.control.Call(connection.ControlRequest{Op: "users"}, &users)
+	} else {
+		users, err = s.client.Users()
+	}
+	if err != nil {
+		return fail("listing users", err)
+	}
+	for _, online := range users {
+		fmt.Fprintf(s.out, "%s\t%s\n", online.Name, online.ID)
+	}
+	return exitOK
+}
+
+// runChat handles `chat <message>...`, which sends the words as one message
+// to every online user
+func runChat(name string, args []string) int {
+	s := newSession(name)
+	s.offerDaemon()
+	if err := s.flags.Parse(args); err != nil {
+		return exitUsage
+	}
+	message := strings.TrimSpace(strings.Join(s.flags.Args(), " "))
+	if message == "" {
+		return s.usageError("chat needs a message")
+	}
+	if strings.HasPrefix(message, "/") || strings.ContainsAny(message, "\r\n") {
+		return s.usageError("a chat message must be one line and cannot start with /")
+	}
+
+	if !s.connect() {
+		return exitNoLogin
+	}
+	var err error
+	if s.control != nil {
+		err = s.control.Call(connection.ControlRequest{Op: "chat", Text: message}, nil)
+	} else {
+		err = s.client.Chat(message)
+	}
+	if err != nil {
+		return fail("sending message", err)
+	}
+	return exitOK
+}
+
+// runTransfers handles `transfers` and prints one tab separated ID,
+// direction, type, status, delivered bytes, size, peer and name per line
+func runTransfers(name string, args []string) int {
+	s := newControlSession(name)
+	if err := s.flags.Parse(args); err != nil {
+		return exitUsage
+	}
+	if s.flags.NArg() != 0 {
+		return s.usageError("transfers takes no arguments")
+	}
+
+	if !s.connect() {
+		return exitNoLogin
+	}
+	var transfers []client.Transfer
+	if err := s.control.Call(connection.ControlRequest{Op: "transfers"}, &transfers); err != nil {
+		return fail("listing transfers", err)
+	}
+	for _, transfer := range transfers {
+		fmt.Fprintf(s.out, "%s\t%s\t%s\t%s\t%d\t%d\t%s\t%s\n",
+			transfer.ID, transfer.Direction, strings.ToLower(transfer.Type), transfer.Status,
+			transfer.Delivered, transfer.Size, transfer.Peer, transfer.Name)
+	}
+	return exitOK
+}
+
+// controlVerbs names what each transfer control command is doing
+var controlVerbs = map[string]string{"pause": "pausing", "resume": "resuming", "cancel": "cancelling"}
+
+// runTransferControl handles `pause`, `resume` and `cancel`, which act on
+// one of the daemon's transfers
+func runTransferControl(name string, args []string) int {
+	s := newControlSession(name)
+	if err := s.flags.Parse(args); err != nil {
+		return exitUsage
+	}
+	if s.flags.NArg() != 1 {
+		return s.usageError(name + " needs a transfer ID")
+	}
+
+	if !s.connect() {
+		return exitNoLogin
+	}
+	if err := s.control.Call(connection.ControlRequest{Op: name, Transfer: s.flags.Arg(0)}, nil); err != nil {
+		return fail(controlVerbs[name]+" transfer", err)
+	}
+	return exitOK
+}
+
+// runEvents handles `events`, which prints every event of the daemon as a
+// line of JSON until the daemon stops
+func runEvents(name string, args []string) int {
+	s := newControlSession(name)
+	if err := s.flags.Parse(args); err != nil {
+		return exitUsage
+	}
+	if s.flags.NArg() != 0 {
+		return s.usageError("events takes no arguments")
+	}
+
+	if !s.connect() {
+		return exitNoLogin
+	}
+	events, err := s.control.Subscribe()
+	if err != nil {
+		return fail("subscribing to events", err)
+	}
+	encoder := json.NewEncoder(s.out)
+	for event := range events {
+		if encoder.Encode(event) != nil {
+			return exitFailed
+		}
+	}
+	return fail("following events", errors.New("drizlinkd closed the connection"))
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	connection "drizlink/client/internal"
+	"drizlink/protocol"
+	"drizlink/utils"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// reconnectDelay is how long the daemon waits between attempts to log in
+// again after losing the server
+const reconnectDelay = 5 * time.Second
+
+// drizlinkd stays logged in without a terminal, receives whatever is sent to
+// it into the store path and is driven through a Unix socket
+func main() {
+	serverAddr := flag.String("server", "localhost:8080", "Server address in format host:port")
+	name := flag.String("name", connection.DefaultUsername(), "Username to log in as")
+	store := flag.String("store", ".", "Store path other users see, and where their files are saved")
+	socket := flag.String("socket", "", "Control socket path (default drizlinkd.sock in the config directory)")
+	flag.Parse()
+
+	if err := connection.LoadConfig(); err != nil {
+		fmt.Println(utils.WarningColor("⚠ Using default settings:"), err)
+	}
+	socketPath := *socket
+	if socketPath == "" {
+		path, err := connection.DefaultControlSocket()
+		if err != nil {
+			fmt.Println(utils.ErrorColor("❌ Error locating control socket:"), err)
+			os.Exit(1)
+		}
+		socketPath = path
+	}
+
+	// The socket is claimed first so a second daemon never logs in
+	listener, err := connection.ListenControl(socketPath)
+	if err != nil {
+		fmt.Println(utils.ErrorColor("❌ Error opening control socket:"), err)
+		os.Exit(1)
+	}
+	conn, err := connection.Login(*serverAddr, *name, *store)
+	if err != nil {
+		fmt.Println(utils.ErrorColor("❌ Error connecting to server:"), err)
+		listener.Close()
+		os.Remove(socketPath)
+		os.Exit(1)
+	}
+	fmt.Println(utils.SuccessColor("✅ Connected to"), utils.InfoColor(*serverAddr), utils.SuccessColor("as"), utils.UserColor(*name))
+	fmt.Println(utils.InfoColor("🎛 Control socket:"), utils.InfoColor(socketPath))
+
+	if err := connection.LoadJournal(); err != nil {
+		fmt.Println(utils.WarningColor("⚠ Could not read the transfer journal:"), err)
+	}
+	connection.StartJournal(2 * time.Second)
+	go connection.CleanChunkStore()
+
+	control := &connection.ControlServer{}
+	control.SetConnection(conn)
+	go stayConnected(control, conn, *serverAddr, *name, *store)
+	go func() {
+		if err := control.Serve(listener); err != nil {
+			fmt.Println(utils.ErrorColor("❌ Control socket failed:"), err)
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+	fmt.Println(utils.InfoColor("👋 Shutting down"))
+	listener.Close()
+	os.Remove(socketPath)
+}
+
+// stayConnected reads from the server and continues the session whenever
+// the connection is lost. Transfers running at the time fail.
+func stayConnected(control *connection.ControlServer, conn *protocol.Conn, address, name, store string) {
+	for {
+		connection.ReadLoop(conn)
+		control.SetConnection(nil)
+
+		for {
+			time.Sleep(reconnectDelay)
+			var err error
+			conn, err = connection.Relogin(address, name, store)
+			if err == nil {
+				break
+			}
+			fmt.Println(utils.WarningColor("⚠ Could not reconnect:"), err)
+		}
+		fmt.Println(utils.SuccessColor("✅ Reconnected to"), utils.InfoColor(address))
+		control.SetConnection(conn)
+	}
+}
@@ -0,0 +1,148 @@
+package client
+
+import (
+	connection "drizlink/client/internal"
+	"time"
+)
+
+// eventBuffer is how many events may wait in the Events channel. The last
+// place is kept for Disconnected, so other events are dropped once
+// eventBuffer-1 of them are waiting.
+const eventBuffer = 256
+
+// Event is one of TransferAdded, TransferUpdated, TransferFinished, Message,
+// Presence and Disconnected
+type Event interface {
+	isEvent()
+}
+
+// TransferAdded reports a transfer that was queued or started
+type TransferAdded struct {
+	Time     time.Time
+	Transfer Transfer
+}
+
+// TransferUpdated reports a transfer that was paused, resumed or changed
+// status
+type TransferUpdated struct {
+	Time     time.Time
+	Transfer Transfer
+}
+
+// TransferFinished reports a transfer that completed, failed or was
+// cancelled
+type TransferFinished struct {
+	Time     time.Time
+	Transfer Transfer
+}
+
+// Message is a line from the server that is not part of a transfer, such as
+// a chat message
+type Message struct {
+	Time time.Time
+	Text string
+}
+
+// Presence reports a user coming online or going offline
+type Presence struct {
+	Time   time.Time
+	UserID string
+	Online bool
+}
+
+// Disconnected is the last event, sent once the connection to the server is
+// gone
+type Disconnected struct {
+	Time time.Time
+}
+
+func (TransferAdded) isEvent()    {}
+func (TransferUpdated) isEvent()  {}
+func (TransferFinished) isEvent() {}
+func (Message) isEvent()          {}
+func (Presence) isEvent()         {}
+func (Disconnected) isEvent()     {}
+
+// Transfer is a snapshot of a transfer
+type Transfer struct {
+	ID        string    `json:"id"`
+	Type      string    `json:"type"` // "File", "Folder" or "Stream"
+	Name      string    `json:"name"`
+	Direction string    `json:"direction"` // "send" or "receive"
+	Peer      string    `json:"peer"`      // the other user's ID
+	Status    string    `json:"status"`
+	Size      int64     `json:"size"`
+	Delivered int64     `json:"delivered"`
+	Path      string    `json:"path"`
+	SavePath  string    `json:"savePath,omitempty"`
+	Checksum  string    `json:"checksum,omitempty"`
+	Started   time.Time `json:"started"`
+}
+
+func newTransfer(info connection.TransferInfo) Transfer {
+	return Transfer{
+		ID:        info.ID,
+		Type:      info.Type,
+		Name:      info.Name,
+		Direction: info.Direction,
+		Peer:      info.Peer,
+		Status:    info.Status,
+		Size:      info.Size,
+		Delivered: info.Delivered,
+		Path:      info.Path,
+		SavePath:  info.SavePath,
+		Checksum:  info.Checksum,
+		Started:   info.Started,
+	}
+}
+
+// Events returns the channel events are delivered on from Login on. It is
+// closed after Disconnected, or on Close when the client never logged in.
+// Events are dropped while the channel is full, so a client that does not
+// read them loses nothing else, but Disconnected is always delivered.
+func (c *Client) Events() <-chan Event {
+	return c.events
+}
+
+// forward turns the events of the transfer machinery into typed events
+// until the connection is lost
+func (c *Client) forward(events <-chan connection.Event, stop func()) {
+	defer close(c.events)
+	for {
+		select {
+		case event := <-events:
+			if typed := typedEvent(event); typed != nil {
+				c.emit(typed)
+			}
+		case <-c.lost:
+			stop()
+			// emit leaves a place free, so this never blocks
+			c.events <- Disconnected{Time: time.Now()}
+			return
+		}
+	}
+}
+
+// emit queues event unless only the place kept for Disconnected is left.
+// forward is the only sender, so the channel cannot fill up in between.
+func (c *Client) emit(event Event) {
+	if len(c.events) < cap(c.events)-1 {
+		c.events <- event
+	}
+}
+
+func typedEvent(event connection.Event) Event {
+	switch event.Type {
+	case connection.TransferAddedEvent:
+		return TransferAdded{Time: event.Time, Transfer: newTransfer(*event.Transfer)}
+	case connection.TransferUpdatedEvent:
+		return TransferUpdated{Time: event.Time, Transfer: newTransfer(*event.Transfer)}
+	case connection.TransferFinishedEvent:
+		return TransferFinished{Time: event.Time, Transfer: newTransfer(*event.Transfer)}
+	case connection.MessageEvent:
+		return Message{Time: event.Time, Text: event.Text}
+	case connection.PresenceEvent:
+		return Presence{Time: event.Time, UserID: event.User, Online: event.State == "online"}
+	}
+	return nil
+}
@@ -0,0 +1,605 @@
+package connection
+
+import (
+	"crypto/sha256"
+	"drizlink/helper"
+	"drizlink/protocol"
+	"drizlink/utils"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// chunkedMinSize is the smallest file kept in the chunk store
+	chunkedMinSize = 1 << 20
+	// recipeEntriesPerFrame is how many chunk references go in one frame
+	recipeEntriesPerFrame = protocol.MaxChunkSize / helper.RecipeEntrySize
+	// maxReuseRun bounds the chunks one /REUSE refers to, so rebuilding them
+	// does not hold up the connection for long
+	maxReuseRun = 32
+)
+
+// chunkManifest lists the chunks a received file is made of. The chunks
+// are read from the file itself, and only while it keeps its size and
+// modification time.
+type chunkManifest struct {
+	Size    int64         `json:"size"`
+	ModTime time.Time     `json:"modTime"`
+	Chunks  []storedChunk `json:"chunks"`
+}
+
+// storedChunk is where a chunk lies in the file of its manifest
+type storedChunk struct {
+	Hash   string `json:"hash"`
+	Offset int64  `json:"offset"`
+	Size   int    `json:"size"`
+}
+
+// chunkLocation is a chunk found in a received file. The zero value means
+// no received file holds the chunk.
+type chunkLocation struct {
+	path   string
+	offset int64
+	size   int
+}
+
+// chunkedReceive is an incoming file for which we offered our chunk store:
+// the sender describes the file as a recipe of chunks and refers to the
+// chunks we hold with /REUSE instead of sending them
+type chunkedReceive struct {
+	dir       string
+	data      []byte // recipe frames received so far
+	recipe    []helper.ChunkRef
+	locations []chunkLocation // where each chunk of the recipe is held
+}
+
+var (
+	// chunkManifests maps absolute paths of received files to their
+	// chunks. It is loaded on first use.
+	chunkManifests map[string]chunkManifest
+	// chunkIndex maps the hash of every chunk in chunkManifests to one file
+	// that holds it
+	chunkIndex      map[[sha256.Size]byte]chunkLocation
+	chunkStoreMutex sync.Mutex
+)
+
+// chunkStoreDir returns the folder the manifests are kept in
+func chunkStoreDir() (string, error) {
+	dir, err := ConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "chunks"), nil
+}
+
+// loadChunkManifests reads the manifests unless they are already loaded.
+// Callers must hold chunkStoreMutex.
+func loadChunkManifests(dir string) {
+	if chunkManifests != nil {
+		return
+	}
+	chunkManifests = make(map[string]chunkManifest)
+	if data, err := os.ReadFile(filepath.Join(dir, "manifests.json")); err == nil {
+		if json.Unmarshal(data, &chunkManifests) != nil {
+			chunkManifests = make(map[string]chunkManifest)
+		}
+	}
+	indexChunks()
+}
+
+// indexChunks rebuilds chunkIndex from the manifests. Callers must hold
+// chunkStoreMutex.
+func indexChunks() {
+	chunkIndex = make(map[[sha256.Size]byte]chunkLocation)
+	for path, manifest := range chunkManifests {
+		indexManifest(path, manifest)
+	}
+}
+
+// indexManifest adds the chunks of the file at path to chunkIndex. Callers
+// must hold chunkStoreMutex.
+func indexManifest(path string, manifest chunkManifest) {
+	for _, chunk := range manifest.Chunks {
+		decoded, err := hex.DecodeString(chunk.Hash)
+		if err != nil || len(decoded) != sha256.Size {
+			continue
+		}
+		hash := [sha256.Size]byte(decoded)
+		if _, exists := chunkIndex[hash]; !exists {
+			chunkIndex[hash] = chunkLocation{path: path, offset: chunk.Offset, size: chunk.Size}
+		}
+	}
+}
+
+// saveChunkManifests writes the manifests. Callers must hold
+// chunkStoreMutex.
+func saveChunkManifests(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(chunkManifests)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, "manifests.json")
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// manifestCurrent reports whether the file at path is still the one
+// manifest describes
+func manifestCurrent(path string, manifest chunkManifest) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.Size() == manifest.Size && info.ModTime().Equal(manifest.ModTime)
+}
+
+// forgetChunkFiles drops the manifests of paths and saves the rest.
+// Callers must hold chunkStoreMutex.
+func forgetChunkFiles(dir string, paths []string) error {
+	for _, path := range paths {
+		delete(chunkManifests, path)
+	}
+	indexChunks()
+	return saveChunkManifests(dir)
+}
+
+// chunkStoreInUse reports whether the chunk store holds any file, so
+// offering it to a sender can save anything
+func chunkStoreInUse(dir string) bool {
+	chunkStoreMutex.Lock()
+	defer chunkStoreMutex.Unlock()
+	loadChunkManifests(dir)
+	return len(chunkManifests) > 0
+}
+
+// lookupChunks returns where each chunk of recipe is held. Files that
+// changed since they were received are forgotten on the way, so a chunk
+// they held is looked up in the other files.
+func lookupChunks(dir string, recipe []helper.ChunkRef) []chunkLocation {
+	chunkStoreMutex.Lock()
+	defer chunkStoreMutex.Unlock()
+	loadChunkManifests(dir)
+
+	checked := make(map[string]bool)
+	for {
+		var changed []string
+		for _, ref := range recipe {
+			location, exists := chunkIndex[ref.Hash]
+			if !exists || checked[location.path] {
+				continue
+			}
+			checked[location.path] = true
+			if !manifestCurrent(location.path, chunkManifests[location.path]) {
+				changed = append(changed, location.path)
+			}
+		}
+		if len(changed) == 0 {
+			break
+		}
+		if err := forgetChunkFiles(dir, changed); err != nil {
+			fmt.Fprintln(utils.Output, utils.WarningColor("⚠ Could not update the chunk store:"), err)
+		}
+	}
+
+	locations := make([]chunkLocation, len(recipe))
+	for i, ref := range recipe {
+		if location := chunkIndex[ref.Hash]; location.size == int(ref.Size) {
+			locations[i] = location
+		}
+	}
+	return locations
+}
+
+// readChunk returns the data of ref from the received file at location,
+// checked against its hash. A file that no longer holds the chunk is
+// forgotten.
+func readChunk(dir string, location chunkLocation, ref helper.ChunkRef) ([]byte, error) {
+	data := make([]byte, ref.Size)
+	file, err := os.Open(location.path)
+	if err == nil {
+		_, err = file.ReadAt(data, location.offset)
+		file.Close()
+	}
+	if err == nil && sha256.Sum256(data) == ref.Hash {
+		return data, nil
+	}
+
+	chunkStoreMutex.Lock()
+	forgetChunkFiles(dir, []string{location.path})
+	chunkStoreMutex.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("error reading chunk from %s: %v", location.path, err)
+	}
+	return nil, fmt.Errorf("chunk %x no longer matches %s", ref.Hash[:6], location.path)
+}
+
+// storeChunks records the chunks of the file at path in its manifest, so
+// they can be read back from the file later
+func storeChunks(path string) error {
+	dir, err := chunkStoreDir()
+	if err != nil {
+		return err
+	}
+	path, err = filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	manifest := chunkManifest{Size: info.Size(), ModTime: info.ModTime()}
+	var offset int64
+	err = helper.SplitChunks(file, func(chunk []byte) error {
+		hash := sha256.Sum256(chunk)
+		manifest.Chunks = append(manifest.Chunks, storedChunk{
+			Hash:   hex.EncodeToString(hash[:]),
+			Offset: offset,
+			Size:   len(chunk),
+		})
+		offset += int64(len(chunk))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	chunkStoreMutex.Lock()
+	defer chunkStoreMutex.Unlock()
+	loadChunkManifests(dir)
+	delete(chunkManifests, path)
+	indexChunks()
+	chunkManifests[path] = manifest
+	indexManifest(path, manifest)
+	return saveChunkManifests(dir)
+}
+
+// storeReceivedChunks adds a received file to the chunk store, in the
+// background since the file is read once more
+func storeReceivedChunks(path string, size int64) {
+	if !GetSettings().ChunkStore || size < chunkedMinSize {
+		return
+	}
+	go func() {
+		if err := storeChunks(path); err != nil {
+			fmt.Fprintln(utils.Output, utils.WarningColor("⚠ Could not add file to the chunk store:"), err)
+		}
+	}()
+}
+
+// collectChunkGarbage forgets the manifests of files that were removed or
+// changed. It returns how many files were forgotten.
+func collectChunkGarbage() (int, error) {
+	dir, err := chunkStoreDir()
+	if err != nil {
+		return 0, err
+	}
+
+	chunkStoreMutex.Lock()
+	defer chunkStoreMutex.Unlock()
+	loadChunkManifests(dir)
+
+	var changed []string
+	for path, manifest := range chunkManifests {
+		if !manifestCurrent(path, manifest) {
+			changed = append(changed, path)
+		}
+	}
+	if len(changed) == 0 {
+		return 0, nil
+	}
+	return len(changed), forgetChunkFiles(dir, changed)
+}
+
+// chunkStoreUsage returns the number and total size of distinct chunks in
+// the chunk store and how many files hold them
+func chunkStoreUsage() (int, int64, int, error) {
+	dir, err := chunkStoreDir()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	chunkStoreMutex.Lock()
+	defer chunkStoreMutex.Unlock()
+	loadChunkManifests(dir)
+
+	var size int64
+	for _, location := range chunkIndex {
+		size += int64(location.size)
+	}
+	return len(chunkIndex), size, len(chunkManifests), nil
+}
+
+// CleanChunkStore forgets received files that changed or were removed,
+// reporting only when there were any. It runs when the client starts.
+func CleanChunkStore() {
+	forgotten, err := collectChunkGarbage()
+	if err != nil {
+		fmt.Fprintln(utils.Output, utils.WarningColor("⚠ Could not clean the chunk store:"), err)
+		return
+	}
+	if forgotten > 0 {
+		fmt.Fprintf(utils.Output, "%s Removed %d changed or deleted files from the chunk store\n",
+			utils.InfoColor("🧹"),
+			forgotten)
+	}
+}
+
+// HandleChunks handles /chunks [gc]
+func HandleChunks(args []string) {
+	if len(args) == 1 && args[0] == "gc" {
+		forgotten, err := collectChunkGarbage()
+		if err != nil {
+			fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Error cleaning the chunk store:"), err)
+			return
+		}
+		fmt.Fprintf(utils.Output, "%s Removed %d changed or deleted files\n", utils.SuccessColor("🧹"), forgotten)
+		return
+	}
+	if len(args) != 0 {
+		fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Invalid arguments. Use: /chunks [gc]"))
+		return
+	}
+
+	chunks, size, files, err := chunkStoreUsage()
+	if err != nil {
+		fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Error reading the chunk store:"), err)
+		return
+	}
+	state := "on"
+	if !GetSettings().ChunkStore {
+		state = "off"
+	}
+	fmt.Fprintf(utils.Output, "%s Chunk store (%s): %d chunks, %s, in %d received files\n",
+		utils.InfoColor("🧩"),
+		state,
+		chunks,
+		formatSize(size),
+		files)
+}
+
+// openChunkedReceive returns the state for offering our chunk store for an
+// incoming file of size bytes, or nil when it cannot help
+func openChunkedReceive(size, offset int64) *chunkedReceive {
+	if !GetSettings().ChunkStore || size < chunkedMinSize || offset > 0 {
+		return nil
+	}
+	dir, err := chunkStoreDir()
+	if err != nil || !chunkStoreInUse(dir) {
+		return nil
+	}
+	return &chunkedReceive{dir: dir}
+}
+
+// acceptChunked accepts a transfer like acceptTransfer and asks the sender
+// for the recipe of the file, so chunks we hold need not be sent
+func acceptChunked(conn *protocol.Conn, senderId, remoteID, savePath string, streams int) error {
+	return conn.WriteLine(protocol.Format("/TRANSFER_ACCEPT",
+		senderId, remoteID, savePath, "0", strconv.Itoa(streams), "0", "0", "chunks"))
+}
+
+// attachChunkedReceive lets the incoming transfer from senderId use chunks
+// from the chunk store
+func attachChunkedReceive(senderId string, transfer *Transfer, chunks *chunkedReceive) {
+	incomingMutex.Lock()
+	defer incomingMutex.Unlock()
+	if incoming, exists := incomingTransfers[incomingKey(senderId, transfer.RemoteID)]; exists {
+		incoming.chunks = chunks
+	}
+}
+
+// HandleRecipe collects the recipe of an incoming file. Once it is complete
+// the sender is told which of the chunks we hold, as a bitmap in /HELD
+// frames.
+func HandleRecipe(senderId, remoteId string, total int, payload []byte) {
+	key := incomingKey(senderId, remoteId)
+
+	incomingMutex.Lock()
+	incoming, exists := incomingTransfers[key]
+	incomingMutex.Unlock()
+	if !exists || incoming.chunks == nil {
+		return
+	}
+	incoming.run(func() { incoming.collectRecipe(key, senderId, remoteId, total, payload) })
+}
+
+// collectRecipe adds payload to the recipe collected so far and answers it
+// once all total entries arrived
+func (incoming *incomingTransfer) collectRecipe(key, senderId, remoteId string, total int, payload []byte) {
+	chunks := incoming.chunks
+	chunks.data = append(chunks.data, payload...)
+	if total < 0 || len(chunks.data) < total*helper.RecipeEntrySize {
+		return
+	}
+	recipe, err := helper.DecodeRecipe(chunks.data[:total*helper.RecipeEntrySize])
+	chunks.data = nil
+	if err != nil {
+		incoming.abort(key, corruptData("received an invalid recipe: %v", err))
+		return
+	}
+	var size int64
+	for _, ref := range recipe {
+		size += int64(ref.Size)
+	}
+	if size != incoming.transfer.Size {
+		incoming.abort(key, corruptData("recipe describes %d bytes, expected %d bytes", size, incoming.transfer.Size))
+		return
+	}
+	chunks.recipe = recipe
+	chunks.locations = lookupChunks(chunks.dir, recipe)
+
+	var heldSize int64
+	held := make([]byte, (len(recipe)+7)/8)
+	for i, location := range chunks.locations {
+		if location.path != "" {
+			held[i/8] |= 1 << (i % 8)
+			heldSize += int64(location.size)
+		}
+	}
+
+	if heldSize > 0 {
+		fmt.Fprintf(utils.Output, "%s Chunk store already holds %s of this file\n", utils.InfoColor("🧩"), formatSize(heldSize))
+	}
+	conn := incoming.transfer.Connection
+	for len(held) > 0 {
+		n := min(len(held), protocol.MaxChunkSize)
+		header := protocol.Format("/HELD", senderId, remoteId, strconv.Itoa(n))
+		if err := conn.WriteFrame(header, held[:n]); err != nil {
+			fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Error answering recipe:"), err)
+			return
+		}
+		held = held[n:]
+	}
+}
+
+// HandleHeld stores a frame of the bitmap of chunks a recipient holds. It
+// takes the place of block signatures and is collected the same way.
+func HandleHeld(recipientId, transferID string, payload []byte) {
+	HandleSignatures(recipientId, transferID, payload)
+}
+
+// HandleReuse writes count chunks of the recipe, starting at index, from
+// the chunk store as the next data of an incoming transfer
+func HandleReuse(senderId, remoteId string, index, count int) {
+	key := incomingKey(senderId, remoteId)
+
+	incomingMutex.Lock()
+	incoming, exists := incomingTransfers[key]
+	incomingMutex.Unlock()
+	if !exists {
+		return
+	}
+	incoming.run(func() { incoming.reuseChunks(key, index, count) })
+}
+
+// reuseChunks writes count chunks of the recipe, starting at index, to the
+// incoming transfer
+func (incoming *incomingTransfer) reuseChunks(key string, index, count int) {
+	chunks := incoming.chunks
+	if chunks == nil || index < 0 || count < 1 || index+count > len(chunks.recipe) {
+		incoming.abort(key, corruptData("received an invalid reuse instruction (chunks %d+%d)", index, count))
+		return
+	}
+	for i := index; i < index+count; i++ {
+		if chunks.locations[i].path == "" {
+			incoming.abort(key, corruptData("received a reuse instruction for chunk %d we do not hold", i))
+			return
+		}
+		data, err := readChunk(chunks.dir, chunks.locations[i], chunks.recipe[i])
+		if err != nil {
+			incoming.abort(key, err)
+			return
+		}
+		if !incoming.write(key, data) {
+			return
+		}
+	}
+}
+
+// sendChunked sends file as a recipe of content defined chunks: chunks the
+// recipient holds are referred to with /REUSE and the others go out as
+// /CHUNK frames. The whole file is sent when the recipient does not answer
+// the recipe.
+func sendChunked(conn *protocol.Conn, transfer *Transfer, file *os.File, streams int, held *signatureCollector) (int64, error) {
+	recipe, err := helper.ChunkRecipe(file)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	data := helper.EncodeRecipe(recipe)
+	total := strconv.Itoa(len(recipe))
+	for len(data) > 0 {
+		n := min(len(data), recipeEntriesPerFrame*helper.RecipeEntrySize)
+		header := protocol.Format("/RECIPE", transfer.Recipient, transfer.ID, total, strconv.Itoa(n))
+		if err := conn.WriteFrame(header, data[:n]); err != nil {
+			return 0, err
+		}
+		data = data[n:]
+	}
+	bitmap, err := held.awaitBytes((len(recipe) + 7) / 8)
+	if err != nil {
+		fmt.Fprintln(utils.Output, utils.WarningColor("⚠ Sending the whole file:"), err)
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return 0, err
+		}
+		return sendData(conn, transfer, file, streams)
+	}
+
+	var literal, reused int64
+	run, runStart := 0, 0
+	flush := func() error {
+		if run == 0 {
+			return nil
+		}
+		err := conn.WriteLine(protocol.Format("/REUSE",
+			transfer.Recipient, transfer.ID, strconv.Itoa(runStart), strconv.Itoa(run)))
+		run = 0
+		return err
+	}
+
+	buffer := make([]byte, helper.MaxChunk)
+	for i, ref := range recipe {
+		if err := waitWhilePaused(transfer); err != nil {
+			return transfer.BytesComplete.Load(), err
+		}
+
+		chunk := buffer[:ref.Size]
+		if _, err := io.ReadFull(file, chunk); err != nil {
+			return transfer.BytesComplete.Load(), err
+		}
+		if bitmap[i/8]&(1<<(i%8)) != 0 {
+			if run == 0 || run == maxReuseRun {
+				if err := flush(); err != nil {
+					return transfer.BytesComplete.Load(), err
+				}
+				runStart = i
+			}
+			run++
+			reused += int64(ref.Size)
+			transfer.BytesComplete.Add(int64(ref.Size))
+			continue
+		}
+
+		if err := flush(); err != nil {
+			return transfer.BytesComplete.Load(), err
+		}
+		for len(chunk) > 0 {
+			n := min(len(chunk), chunkSize)
+			header := protocol.Format("/CHUNK", transfer.Recipient, transfer.ID, strconv.Itoa(n))
+			if err := conn.WriteFrame(header, chunk[:n]); err != nil {
+				return transfer.BytesComplete.Load(), err
+			}
+			chunk = chunk[n:]
+		}
+		literal += int64(ref.Size)
+		transfer.BytesComplete.Add(int64(ref.Size))
+	}
+	if err := flush(); err != nil {
+		return transfer.BytesComplete.Load(), err
+	}
+
+	fmt.Fprintf(utils.Output, "%s Sent %s of new chunks, the recipient reused %s from its chunk store\n",
+		utils.InfoColor("🧩"),
+		formatSize(literal),
+		formatSize(reused))
+	return transfer.BytesComplete.Load(), nil
+}
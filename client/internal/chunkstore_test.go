@@ -0,0 +1,130 @@
+package connection
+
+import (
+	"bytes"
+	"drizlink/helper"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// useTempChunkStore points the chunk store at an empty config directory
+// for the rest of the test
+func useTempChunkStore(t *testing.T) string {
+	t.Helper()
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	chunkStoreMutex.Lock()
+	chunkManifests = nil
+	chunkStoreMutex.Unlock()
+	dir, err := chunkStoreDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// writeRandomFile writes size bytes of random data to name in a temporary
+// folder and returns its path and data
+func writeRandomFile(t *testing.T, seed int64, name string, size int) (string, []byte) {
+	t.Helper()
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path, data
+}
+
+func TestChunkStoreReadsReceivedFiles(t *testing.T) {
+	dir := useTempChunkStore(t)
+	path, data := writeRandomFile(t, 1, "received.bin", 2<<20)
+	if err := storeChunks(path); err != nil {
+		t.Fatal(err)
+	}
+	// The store keeps where chunks lie, not copies of them
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 || entries[0].Name() != "manifests.json" {
+		t.Errorf("the chunk store holds %d entries, want only manifests.json", len(entries))
+	}
+
+	recipe, err := helper.ChunkRecipe(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	locations := lookupChunks(dir, recipe)
+	var rebuilt []byte
+	for i, location := range locations {
+		if location.path == "" {
+			t.Fatalf("chunk %d of the received file is not held", i)
+		}
+		chunk, err := readChunk(dir, location, recipe[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		rebuilt = append(rebuilt, chunk...)
+	}
+	if !bytes.Equal(rebuilt, data) {
+		t.Error("the chunks read back differ from the file")
+	}
+
+	_, other := writeRandomFile(t, 2, "other.bin", 1<<20)
+	recipe, err = helper.ChunkRecipe(bytes.NewReader(other))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, location := range lookupChunks(dir, recipe) {
+		if location.path != "" {
+			t.Errorf("chunk %d of unrelated data is held in %s", i, location.path)
+		}
+	}
+}
+
+func TestChunkStoreForgetsChangedFiles(t *testing.T) {
+	dir := useTempChunkStore(t)
+	path, data := writeRandomFile(t, 3, "received.bin", 2<<20)
+	if err := storeChunks(path); err != nil {
+		t.Fatal(err)
+	}
+	recipe, err := helper.ChunkRecipe(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	locations := lookupChunks(dir, recipe)
+
+	// Damage the file but keep its size and modification time, so only
+	// reading the chunk can tell
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteAt([]byte("damaged"), locations[0].offset)
+	file.Close()
+	os.Chtimes(path, info.ModTime(), info.ModTime())
+
+	if _, err := readChunk(dir, locations[0], recipe[0]); err == nil {
+		t.Fatal("a damaged chunk was read back without an error")
+	}
+	if chunkStoreInUse(dir) {
+		t.Error("the damaged file is still in the chunk store")
+	}
+
+	if err := storeChunks(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data[:1<<20], 0644); err != nil {
+		t.Fatal(err)
+	}
+	for i, location := range lookupChunks(dir, recipe) {
+		if location.path != "" {
+			t.Fatalf("chunk %d is still held after the file changed", i)
+		}
+	}
+	if forgotten, err := collectChunkGarbage(); err != nil || forgotten != 0 {
+		t.Errorf("collectChunkGarbage forgot %d files (%v), want 0 since the lookup already did", forgotten, err)
+	}
+}
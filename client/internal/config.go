@@ -0,0 +1,298 @@
+package connection
+
+import (
+	"drizlink/utils"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// Config holds user tunable client settings, persisted as JSON in the
+// client's config directory
+type Config struct {
+	MaxConcurrentTransfers int             `json:"maxConcurrentTransfers"`
+	ConflictPolicy         ConflictPolicy  `json:"conflictPolicy"`
+	RetryAttempts          int             `json:"retryAttempts"`
+	OfflineDelivery        DeliveryConsent `json:"offlineDelivery"`
+	Streams                int             `json:"streams"`
+	Delta                  bool            `json:"delta"`
+	ChunkStore             bool            `json:"chunkStore"`
+	DuplicatePolicy        DuplicatePolicy `json:"duplicatePolicy"`
+	SyncRequests           DeliveryConsent `json:"syncRequests"`
+}
+
+// DefaultConfig returns the settings used when no config file exists
+func DefaultConfig() Config {
+	return Config{
+		MaxConcurrentTransfers: 2,
+		ConflictPolicy:         RenameOnConflict,
+		RetryAttempts:          3,
+		OfflineDelivery:        AcceptOfflineDelivery,
+		Streams:                4,
+		Delta:                  true,
+		ChunkStore:             true,
+		DuplicatePolicy:        CopyDuplicate,
+		SyncRequests:           AskOfflineDelivery,
+	}
+}
+
+var (
+	Settings      = DefaultConfig()
+	SettingsMutex sync.RWMutex
+)
+
+// settingSpec describes one key accepted by the /set command
+type settingSpec struct {
+	description string
+	get         func(c *Config) string
+	set         func(c *Config, value string) error
+}
+
+var settingSpecs = map[string]settingSpec{
+	"max-transfers": {
+		description: "Number of outgoing transfers that may run at once",
+		get:         func(c *Config) string { return strconv.Itoa(c.MaxConcurrentTransfers) },
+		set: func(c *Config, value string) error {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return fmt.Errorf("max-transfers must be a positive number")
+			}
+			c.MaxConcurrentTransfers = n
+			return nil
+		},
+	},
+	"retry-attempts": {
+		description: "How often a file that fails checksum verification is requested again",
+		get:         func(c *Config) string { return strconv.Itoa(c.RetryAttempts) },
+		set: func(c *Config, value string) error {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return fmt.Errorf("retry-attempts must be zero or a positive number")
+			}
+			c.RetryAttempts = n
+			return nil
+		},
+	},
+	"streams": {
+		description: "Parallel data streams used for files of 64 MB or more (1 sends everything over the main connection)",
+		get:         func(c *Config) string { return strconv.Itoa(c.Streams) },
+		set: func(c *Config, value string) error {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 || n > maxStreams {
+				return fmt.Errorf("streams must be between 1 and %d", maxStreams)
+			}
+			c.Streams = n
+			return nil
+		},
+	},
+	"delta": {
+		description: "Send only the changed blocks of files the recipient has an older copy of: on or off",
+		get: func(c *Config) string {
+			if c.Delta {
+				return "on"
+			}
+			return "off"
+		},
+		set: func(c *Config, value string) error {
+			switch value {
+			case "on":
+				c.Delta = true
+			case "off":
+				c.Delta = false
+			default:
+				return fmt.Errorf("delta must be on or off")
+			}
+			return nil
+		},
+	},
+	"chunk-store": {
+		description: "Keep received files as chunks and send only chunks the recipient does not hold yet: on or off",
+		get: func(c *Config) string {
+			if c.ChunkStore {
+				return "on"
+			}
+			return "off"
+		},
+		set: func(c *Config, value string) error {
+			switch value {
+			case "on":
+				c.ChunkStore = true
+			case "off":
+				c.ChunkStore = false
+			default:
+				return fmt.Errorf("chunk-store must be on or off")
+			}
+			return nil
+		},
+	},
+	"offline-delivery": {
+		description: "What to do with transfers the server held while you were offline: accept, ask or reject",
+		get:         func(c *Config) string { return string(c.OfflineDelivery) },
+		set: func(c *Config, value string) error {
+			consent, err := ParseDeliveryConsent(value)
+			if err != nil {
+				return err
+			}
+			c.OfflineDelivery = consent
+			return nil
+		},
+	},
+	"sync-requests": {
+		description: "What to do when a user asks to sync or mirror a folder of yours: accept, ask or reject",
+		get:         func(c *Config) string { return string(c.SyncRequests) },
+		set: func(c *Config, value string) error {
+			consent, err := ParseDeliveryConsent(value)
+			if err != nil {
+				return err
+			}
+			c.SyncRequests = consent
+			return nil
+		},
+	},
+	"on-duplicate": {
+		description: "What to do when you already have a file with the same content: copy, link, keep or off",
+		get:         func(c *Config) string { return string(c.DuplicatePolicy) },
+		set: func(c *Config, value string) error {
+			policy, err := ParseDuplicatePolicy(value)
+			if err != nil {
+				return err
+			}
+			c.DuplicatePolicy = policy
+			return nil
+		},
+	},
+	"on-conflict": {
+		description: "What to do when a received name already exists: rename, overwrite, skip or version",
+		get:         func(c *Config) string { return string(c.ConflictPolicy) },
+		set: func(c *Config, value string) error {
+			policy, err := ParseConflictPolicy(value)
+			if err != nil {
+				return err
+			}
+			c.ConflictPolicy = policy
+			return nil
+		},
+	},
+}
+
+// ConfigDir returns the directory holding the client's persistent state
+func ConfigDir() (string, error) {
+	base, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(base, "drizlink")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+func configFilePath() (string, error) {
+	dir, err := ConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "config.json"), nil
+}
+
+// LoadConfig reads the persisted settings, keeping defaults for missing keys
+func LoadConfig() error {
+	path, err := configFilePath()
+	if err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	config := DefaultConfig()
+	if err := json.Unmarshal(data, &config); err != nil {
+		return fmt.Errorf("invalid config file %s: %v", path, err)
+	}
+
+	SettingsMutex.Lock()
+	Settings = config
+	SettingsMutex.Unlock()
+	return nil
+}
+
+// SaveConfig writes the current settings to the config directory
+func SaveConfig() error {
+	path, err := configFilePath()
+	if err != nil {
+		return err
+	}
+
+	SettingsMutex.RLock()
+	data, err := json.MarshalIndent(Settings, "", "  ")
+	SettingsMutex.RUnlock()
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// GetSettings returns a snapshot of the current settings
+func GetSettings() Config {
+	SettingsMutex.RLock()
+	defer SettingsMutex.RUnlock()
+	return Settings
+}
+
+// HandleSetSetting handles the /set command
+func HandleSetSetting(key, value string) {
+	spec, exists := settingSpecs[key]
+	if !exists {
+		fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Unknown setting:"), utils.CommandColor(key))
+		HandleShowSettings()
+		return
+	}
+
+	SettingsMutex.Lock()
+	err := spec.set(&Settings, value)
+	SettingsMutex.Unlock()
+	if err != nil {
+		fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Invalid value:"), err)
+		return
+	}
+
+	if err := SaveConfig(); err != nil {
+		fmt.Fprintln(utils.Output, utils.WarningColor("⚠ Setting applied but could not be saved:"), err)
+	}
+
+	fmt.Fprintf(utils.Output, "%s %s = %s\n", utils.SuccessColor("✅"), utils.CommandColor(key), utils.InfoColor(value))
+
+	// Some settings take effect immediately
+	TransferQueue.Dispatch()
+}
+
+// HandleShowSettings handles the /settings command
+func HandleShowSettings() {
+	keys := make([]string, 0, len(settingSpecs))
+	for key := range settingSpecs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	SettingsMutex.RLock()
+	defer SettingsMutex.RUnlock()
+
+	fmt.Fprintln(utils.Output, utils.HeaderColor("⚙ Settings:"))
+	fmt.Fprintln(utils.Output, utils.InfoColor("-----------------------------------"))
+	for _, key := range keys {
+		spec := settingSpecs[key]
+		fmt.Fprintf(utils.Output, "  %s = %s\n", utils.CommandColor(key), utils.InfoColor(spec.get(&Settings)))
+		fmt.Fprintf(utils.Output, "    %s\n", spec.description)
+	}
+	fmt.Fprintln(utils.Output, utils.InfoColor("-----------------------------------"))
+}
@@ -0,0 +1,103 @@
+package connection
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ConflictPolicy decides what happens when a received file or folder has
+// the same name as an existing entry in the store path
+type ConflictPolicy string
+
+const (
+	// RenameOnConflict saves the new copy as "name (1).ext", "name (2).ext", ...
+	RenameOnConflict ConflictPolicy = "rename"
+	// OverwriteOnConflict replaces the existing entry
+	OverwriteOnConflict ConflictPolicy = "overwrite"
+	// SkipOnConflict declines the transfer and keeps the existing entry
+	SkipOnConflict ConflictPolicy = "skip"
+	// VersionOnConflict keeps the existing entry as "name.v1.ext", "name.v2.ext", ...
+	// and saves the new copy under the original name
+	VersionOnConflict ConflictPolicy = "version"
+)
+
+// ParseConflictPolicy converts a user supplied policy name
+func ParseConflictPolicy(value string) (ConflictPolicy, error) {
+	switch policy := ConflictPolicy(strings.ToLower(strings.TrimSpace(value))); policy {
+	case RenameOnConflict, OverwriteOnConflict, SkipOnConflict, VersionOnConflict:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown policy %q (use rename, overwrite, skip or version)", value)
+	}
+}
+
+// errSkipExisting is returned when the skip policy declines a transfer
+var errSkipExisting = fmt.Errorf("a file with that name already exists")
+
+// resolveSavePath applies policy to name inside dir and returns the path the
+// received entry should be written to. For the version policy the existing
+// entry stays in place until keepExistingVersion moves it aside, once the
+// new copy has been verified. Folder names keep any dots intact when
+// numbered.
+func resolveSavePath(dir, name string, policy ConflictPolicy, isFolder bool) (string, error) {
+	path := filepath.Join(dir, name)
+	if _, err := os.Lstat(path); os.IsNotExist(err) {
+		return path, nil
+	}
+
+	switch policy {
+	case OverwriteOnConflict:
+		return path, nil
+	case SkipOnConflict:
+		return "", errSkipExisting
+	case VersionOnConflict:
+		return path, nil
+	default:
+		return nextFreeName(dir, name, !isFolder, func(base, ext string, n int) string {
+			return fmt.Sprintf("%s (%d)%s", base, n, ext)
+		}), nil
+	}
+}
+
+// keepExistingVersion moves the entry at path aside as "name.v1.ext",
+// "name.v2.ext", ... when the version policy is in effect, so a verified copy
+// can take its place. Under the other policies the entry is replaced.
+func keepExistingVersion(path string, isFolder bool) error {
+	if GetSettings().ConflictPolicy != VersionOnConflict {
+		return nil
+	}
+	if _, err := os.Lstat(path); os.IsNotExist(err) {
+		return nil
+	}
+
+	versioned := nextFreeName(filepath.Dir(path), filepath.Base(path), !isFolder, func(base, ext string, n int) string {
+		return fmt.Sprintf("%s.v%d%s", base, n, ext)
+	})
+	if err := os.Rename(path, versioned); err != nil {
+		return fmt.Errorf("could not keep existing version: %v", err)
+	}
+	return nil
+}
+
+// nextFreeName returns the first path in dir produced by format that does
+// not exist yet. With splitExt the number goes before the file extension.
+func nextFreeName(dir, name string, splitExt bool, format func(base, ext string, n int) string) string {
+	base, ext := name, ""
+	if splitExt {
+		ext = filepath.Ext(name)
+		base = strings.TrimSuffix(name, ext)
+		if base == "" {
+			// Dot files such as ".env" have no extension to preserve
+			base, ext = name, ""
+		}
+	}
+
+	for n := 1; ; n++ {
+		candidate := filepath.Join(dir, format(base, ext, n))
+		if _, err := os.Lstat(candidate); os.IsNotExist(err) {
+			return candidate
+		}
+	}
+}
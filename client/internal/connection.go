@@ -2,353 +2,746 @@ package connection
 
 import (
 	"bufio"
+	"drizlink/protocol"
 	"drizlink/utils"
 	"errors"
 	"fmt"
 	"net"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
-	"time"
 )
 
-func Connect(address string) (net.Conn, error) {
+// ErrConnectionLost fails whatever still waits for the server once the
+// connection to it is gone
+var ErrConnectionLost = errors.New("connection to the server lost")
+
+// Connect opens a connection to the server at address. Rejoin or
+// Authenticate logs in over it.
+func Connect(address string) (*protocol.Conn, error) {
 	conn, err := net.Dial("tcp", address)
 	if err != nil {
 		return nil, err
 	}
-	return conn, nil
+	return protocol.NewConn(conn), nil
 }
 
-func Close(conn net.Conn) {
-	conn.Close()
+// Rejoin asks the server to continue the session last held from this
+// machine's address, as the interactive client does, and returns its
+// username. When there is none to continue it reports false, and the server
+// waits for the username and store path instead.
+func Rejoin(conn *protocol.Conn) (string, bool, error) {
+	if err := conn.WriteLine(protocol.Format("/LOGIN", "resume")); err != nil {
+		return "", false, err
+	}
+	return readLoginReply(conn)
 }
 
-func UserInput(attribute string, conn net.Conn) error {
-	// First check if we get a reconnection signal
-	buffer := make([]byte, 1024)
-	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
-	n, err := conn.Read(buffer)
-	conn.SetReadDeadline(time.Time{}) // Reset read deadline
-
-	if err == nil && n > 0 {
-		message := string(buffer[:n])
-		if strings.HasPrefix(message, "/RECONNECT") {
-			parts := strings.SplitN(message, " ", 4)
-			if len(parts) == 3 {
-				fmt.Printf("Welcome back %s!\n", parts[1])
-				return errors.New("reconnect")
-			}
-		}
+// readLoginReply reads whether the server continued a session, and as whom
+func readLoginReply(conn *protocol.Conn) (string, bool, error) {
+	reply, err := conn.ReadLine()
+	if err != nil {
+		return "", false, err
 	}
+	if reply == "/LOGIN_NEEDED" {
+		return "", false, nil
+	}
+	parts, err := protocol.SplitArgs(reply)
+	if err != nil || len(parts) != 3 || parts[0] != "/RECONNECT" {
+		return "", false, fmt.Errorf("unexpected reply from the server: %s", reply)
+	}
+	return parts[1], true, nil
+}
 
-	// If no reconnection signal, proceed with normal user input
-	reader := bufio.NewReader(os.Stdin)
-
-	fmt.Println("Enter your " + attribute + ": ")
-	input, _ := reader.ReadString('\n')
-	input = strings.TrimSpace(input)
-
-	// If it's a store file path, validate it
-	if attribute == "Store File Path" {
-		for {
-			// Check if path exists
-			if _, err := os.Stat(input); os.IsNotExist(err) {
-				fmt.Println(utils.ErrorColor("❌ Error: Directory does not exist"))
-				fmt.Println("Enter a valid " + attribute + ": ")
-				input, _ = reader.ReadString('\n')
-				input = strings.TrimSpace(input)
-				continue
-			}
+// Login connects to address and logs in as username with storePath, without
+// prompting. It always starts a session of its own.
+func Login(address, username, storePath string) (*protocol.Conn, error) {
+	conn, err := Connect(address)
+	if err != nil {
+		return nil, err
+	}
+	if err := Authenticate(conn, username, storePath); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
 
-			// Check if it's a directory
-			fileInfo, err := os.Stat(input)
-			if err != nil || !fileInfo.IsDir() {
-				fmt.Println(utils.ErrorColor("❌ Error: Path is not a directory"))
-				fmt.Println("Enter a valid " + attribute + ": ")
-				input, _ = reader.ReadString('\n')
-				input = strings.TrimSpace(input)
-				continue
-			}
+// Relogin connects to address and continues the session this client last
+// held, using the token the server gave it. When the server no longer has
+// that session it logs in as username with storePath like Login.
+func Relogin(address, username, storePath string) (*protocol.Conn, error) {
+	token := currentSessionToken()
+	if token == "" {
+		return Login(address, username, storePath)
+	}
+	conn, err := Connect(address)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.WriteLine(protocol.Format("/LOGIN", "continue", token)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	_, continued, err := readLoginReply(conn)
+	if err == nil && !continued {
+		err = SendCredentials(conn, username, storePath)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
 
-			break
-		}
+// Authenticate logs in over conn as username sharing storePath. The session
+// is new, and is never one an interactive client on the same machine rejoins.
+func Authenticate(conn *protocol.Conn, username, storePath string) error {
+	storePath, err := resolveStorePath(storePath)
+	if err != nil {
+		return err
+	}
+	if err := conn.WriteLine(protocol.Format("/LOGIN", "new")); err != nil {
+		return err
 	}
+	if err := conn.WriteLine(username); err != nil {
+		return err
+	}
+	return conn.WriteLine(storePath)
+}
 
-	_, err = conn.Write([]byte(input))
+// SendCredentials sends the username and store path of a new session after
+// a Rejoin that found no session to continue
+func SendCredentials(conn *protocol.Conn, username, storePath string) error {
+	storePath, err := resolveStorePath(storePath)
 	if err != nil {
-		fmt.Println("error in write " + attribute)
-		panic(err)
+		return err
+	}
+	if err := conn.WriteLine(username); err != nil {
+		return err
 	}
+	return conn.WriteLine(storePath)
+}
 
-	return nil
+// resolveStorePath checks that storePath is a directory and makes it absolute
+func resolveStorePath(storePath string) (string, error) {
+	info, err := os.Stat(storePath)
+	if err != nil {
+		return "", err
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("%s is not a directory", storePath)
+	}
+	return filepath.Abs(storePath)
 }
 
-func ReadLoop(conn net.Conn) {
+func ReadLoop(conn *protocol.Conn) {
+	// Everything still depending on the connection ends with it
+	defer connectionLost(ErrConnectionLost)
 	for {
-		buffer := make([]byte, 1024)
-		n, err := conn.Read(buffer)
+		message, err := conn.ReadLine()
 		if err != nil {
-			fmt.Println(utils.ErrorColor("❌ Connection lost:"), err)
+			fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Connection lost:"), err)
 			return
 		}
-		message := string(buffer[:n])
 		switch {
+		case strings.HasPrefix(message, "/CHUNK"):
+			args, err := protocol.SplitArgs(message)
+			if err != nil || len(args) != 4 {
+				fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Invalid chunk header:"), message)
+				// Without a valid length the stream can no longer be framed
+				return
+			}
+			size, err := protocol.ParseSize(args[3])
+			if err != nil {
+				fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Invalid chunk header:"), err)
+				return
+			}
+			payload, err := conn.ReadPayload(size)
+			if err != nil {
+				fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Connection lost:"), err)
+				return
+			}
+			HandleChunk(args[1], args[2], payload)
+			continue
+		case strings.HasPrefix(message, "/RANGE"):
+			// Parallel data normally uses the data streams, but the server
+			// falls back to this connection when we have none
+			args, err := protocol.SplitArgs(message)
+			if err != nil || len(args) != 5 {
+				fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Invalid range header:"), message)
+				return
+			}
+			if !readRange(conn, args) {
+				fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Connection lost while reading transfer data"))
+				return
+			}
+			continue
+		case strings.HasPrefix(message, "/SESSION"):
+			args, err := protocol.SplitArgs(message)
+			if err != nil || len(args) != 2 {
+				fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Invalid session message:"), message)
+				continue
+			}
+			setSessionToken(args[1])
+			continue
+		case strings.HasPrefix(message, "/SIGNATURES"):
+			args, err := protocol.SplitArgs(message)
+			if err != nil || len(args) != 4 {
+				fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Invalid signatures header:"), message)
+				return
+			}
+			size, err := protocol.ParseSize(args[3])
+			if err != nil {
+				fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Invalid signatures header:"), err)
+				return
+			}
+			payload, err := conn.ReadPayload(size)
+			if err != nil {
+				fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Connection lost:"), err)
+				return
+			}
+			HandleSignatures(args[1], args[2], payload)
+			continue
+		case strings.HasPrefix(message, "/DELTA_COPY"):
+			args, err := protocol.SplitArgs(message)
+			if err != nil || len(args) != 5 {
+				fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Invalid copy instruction:"), message)
+				continue
+			}
+			block, err1 := strconv.Atoi(args[3])
+			count, err2 := strconv.Atoi(args[4])
+			if err1 != nil || err2 != nil {
+				fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Invalid copy instruction:"), message)
+				continue
+			}
+			HandleDeltaCopy(args[1], args[2], block, count)
+			continue
+		case strings.HasPrefix(message, "/RECIPE"), strings.HasPrefix(message, "/HELD"):
+			args, err := protocol.SplitArgs(message)
+			if err != nil || len(args) < 4 {
+				fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Invalid chunk list header:"), message)
+				return
+			}
+			size, err := protocol.ParseSize(args[len(args)-1])
+			if err != nil {
+				fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Invalid chunk list header:"), err)
+				return
+			}
+			payload, err := conn.ReadPayload(size)
+			if err != nil {
+				fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Connection lost:"), err)
+				return
+			}
+			if args[0] == "/HELD" {
+				HandleHeld(args[1], args[2], payload)
+			} else if total, err := strconv.Atoi(args[3]); err == nil && len(args) == 5 {
+				HandleRecipe(args[1], args[2], total, payload)
+			}
+			continue
+		case strings.HasPrefix(message, "/REUSE"):
+			args, err := protocol.SplitArgs(message)
+			if err != nil || len(args) != 5 {
+				fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Invalid reuse instruction:"), message)
+				continue
+			}
+			index, err1 := strconv.Atoi(args[3])
+			count, err2 := strconv.Atoi(args[4])
+			if err1 != nil || err2 != nil {
+				fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Invalid reuse instruction:"), message)
+				continue
+			}
+			HandleReuse(args[1], args[2], index, count)
+			continue
+		case strings.HasPrefix(message, "/SWARM_"):
+			args, err := protocol.SplitArgs(message)
+			if err != nil || len(args) < 2 {
+				fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Invalid swarm message:"), message)
+				continue
+			}
+			var payload []byte
+			if args[0] == "/SWARM_PIECE" || args[0] == "/SWARM_PIECES" {
+				size, err := protocol.ParseSize(args[len(args)-1])
+				if err != nil {
+					fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Invalid piece header:"), err)
+					return
+				}
+				payload, err = conn.ReadPayload(size)
+				if err != nil {
+					fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Connection lost:"), err)
+					return
+				}
+			}
+			HandleSwarmMessage(conn, args, payload)
+			continue
+		case strings.HasPrefix(message, "/SYNC_"):
+			args, err := protocol.SplitArgs(message)
+			if err != nil || len(args) < 3 {
+				fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Invalid sync message:"), message)
+				continue
+			}
+			HandleSyncMessage(conn, args)
+			continue
 		case strings.HasPrefix(message, "/FILE_RESPONSE"):
-			fmt.Println(utils.InfoColor("📥 File transfer starting..."))
-			args := strings.SplitN(message, " ", 5)
-			if len(args) != 5 {
-				fmt.Println(utils.ErrorColor("❌ Invalid arguments. Use: /FILE_RESPONSE <userId> <filename> <fileSize> <storeFilePath>"))
+			fmt.Fprintln(utils.Output, utils.InfoColor("📥 File transfer starting..."))
+			args, err := protocol.SplitArgs(message)
+			if err != nil || len(args) != 7 {
+				fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Invalid arguments. Use: /FILE_RESPONSE <userId> <filename> <fileSize> <checksum> <transferId> <storeFilePath>"))
 				continue
 			}
-			recipientId := args[1]
+			senderId := args[1]
 			fileName := args[2]
-			fileSizeStr := strings.TrimSpace(args[3])
-			fileSize, err := strconv.ParseInt(fileSizeStr, 10, 64)
-			storeFilePath := args[4]
+			fileSize, err := strconv.ParseInt(args[3], 10, 64)
 			if err != nil {
-				fmt.Println(utils.ErrorColor("❌ Invalid fileSize. Use: /FILE_RESPONSE <userId> <filename> <fileSize> <storeFilePath>"))
+				fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Invalid fileSize. Use: /FILE_RESPONSE <userId> <filename> <fileSize> <checksum> <transferId> <storeFilePath>"))
 				continue
 			}
+			checksum := args[4]
+			remoteID := args[5]
+			storeFilePath := args[6]
 
-			HandleFileTransfer(conn, recipientId, fileName, int64(fileSize), storeFilePath)
+			HandleFileTransfer(conn, senderId, fileName, fileSize, checksum, remoteID, storeFilePath)
 			continue
 		case strings.HasPrefix(message, "/FOLDER_RESPONSE"):
-			fmt.Println(utils.InfoColor("📥 Folder transfer starting..."))
-			args := strings.SplitN(message, " ", 5)
-			if len(args) != 5 {
-				fmt.Println(utils.ErrorColor("❌ Invalid arguments. Use: /FOLDER_RESPONSE <userId> <folderName> <folderSize> <storeFilePath>"))
+			fmt.Fprintln(utils.Output, utils.InfoColor("📥 Folder transfer starting..."))
+			args, err := protocol.SplitArgs(message)
+			if err != nil || len(args) != 7 {
+				fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Invalid arguments. Use: /FOLDER_RESPONSE <userId> <folderName> <folderSize> <checksum> <transferId> <storeFilePath>"))
 				continue
 			}
-			recipientId := args[1]
+			senderId := args[1]
 			folderName := args[2]
-			folderSizeStr := strings.TrimSpace(args[3])
-			folderSize, err := strconv.ParseInt(folderSizeStr, 10, 64)
-			storeFilePath := args[4]
+			folderSize, err := strconv.ParseInt(args[3], 10, 64)
 			if err != nil {
-				fmt.Println(utils.ErrorColor("❌ Invalid folderSize. Use: /FOLDER_RESPONSE <userId> <folderName> <folderSize> <storeFilePath>"))
+				fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Invalid folderSize. Use: /FOLDER_RESPONSE <userId> <folderName> <folderSize> <checksum> <transferId> <storeFilePath>"))
 				continue
 			}
-			HandleFolderTransfer(conn, recipientId, folderName, folderSize, storeFilePath)
+			checksum := args[4]
+			remoteID := args[5]
+			storeFilePath := args[6]
+
+			HandleFolderTransfer(conn, senderId, folderName, folderSize, checksum, remoteID, storeFilePath)
 			continue
-		case strings.HasPrefix(message, "PING"):
-			_, err = conn.Write([]byte("PONG\n"))
+		case strings.HasPrefix(message, "/PIPE_OFFER"):
+			args, err := protocol.SplitArgs(message)
+			if err != nil || len(args) != 6 {
+				fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Invalid arguments. Use: /PIPE_OFFER <userId> <username> <name> <transferId> <storeFilePath>"))
+				continue
+			}
+			HandlePipeOffer(conn, args[1], args[2], args[3], args[4], args[5])
+			continue
+		case strings.HasPrefix(message, "/PIPE_END"):
+			args, err := protocol.SplitArgs(message)
+			if err != nil || len(args) != 5 {
+				fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Invalid end of stream:"), message)
+				continue
+			}
+			size, err := strconv.ParseInt(args[3], 10, 64)
 			if err != nil {
-				fmt.Println(utils.ErrorColor("❌ Error responding to heartbeat:"), err)
+				fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Invalid end of stream:"), message)
 				continue
 			}
-		case message == "USERS:":
-			// Improved approach to accumulate the complete user list
-			fmt.Println(utils.HeaderColor("\n👥 Online Users:"))
-			fmt.Println(utils.InfoColor("-------------------"))
-
-			// Read the complete user list with timeout
-			userList := ""
-			tempBuf := make([]byte, 1024)
-			conn.SetReadDeadline(time.Now().Add(2 * time.Second))
-
-			for {
-				m, err := conn.Read(tempBuf)
-				if err != nil {
-					break // Break on error (likely timeout)
+			HandlePipeEnd(args[1], args[2], size, args[4])
+			continue
+		case strings.HasPrefix(message, "/TRANSFER_ACCEPT"), strings.HasPrefix(message, "/TRANSFER_DECLINE"):
+			args, err := protocol.SplitArgs(message)
+			if err != nil || len(args) < 4 {
+				fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Invalid transfer reply:"), message)
+				continue
+			}
+			reply := transferReply{Accepted: args[0] == "/TRANSFER_ACCEPT"}
+			if reply.Accepted {
+				reply.Path = args[3]
+				if len(args) > 4 {
+					reply.Offset, _ = strconv.ParseInt(args[4], 10, 64)
+				}
+				if len(args) > 5 {
+					reply.Streams, _ = strconv.Atoi(args[5])
 				}
-				userList += string(tempBuf[:m])
-				if m < 1024 {
-					break // All data received
+				if len(args) > 7 {
+					reply.BlockSize, _ = strconv.Atoi(args[6])
+					reply.Blocks, _ = strconv.Atoi(args[7])
 				}
+				if len(args) > 8 {
+					reply.Chunked = args[8] == "chunks"
+				}
+			} else {
+				reply.Reason = args[3]
+			}
+			HandleTransferReply(args[1], args[2], reply)
+			continue
+		case strings.HasPrefix(message, "/TRANSFER_PAUSE"), strings.HasPrefix(message, "/TRANSFER_RESUME"):
+			args, err := protocol.SplitArgs(message)
+			if err != nil || len(args) != 3 {
+				fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Invalid transfer pause:"), message)
+				continue
+			}
+			HandlePeerPause(args[1], args[2], args[0] == "/TRANSFER_PAUSE")
+			continue
+		case strings.HasPrefix(message, "/TRANSFER_ABORT"):
+			args, err := protocol.SplitArgs(message)
+			if err != nil || len(args) != 4 {
+				fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Invalid transfer abort:"), message)
+				continue
+			}
+			HandleTransferAbort(args[1], args[2], args[3])
+			continue
+		case strings.HasPrefix(message, "/TRANSFER_FAILED"):
+			args, err := protocol.SplitArgs(message)
+			if err != nil || len(args) != 5 {
+				fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Invalid transfer failure report:"), message)
+				continue
+			}
+			retry, _ := strconv.ParseBool(args[4])
+			HandleTransferFailed(args[1], args[2], args[3], retry)
+			continue
+		case strings.HasPrefix(message, "/PROGRESS"):
+			args, err := protocol.SplitArgs(message)
+			if err != nil || len(args) != 4 {
+				continue
+			}
+			bytes, err := strconv.ParseInt(args[3], 10, 64)
+			if err != nil {
+				continue
+			}
+			HandleProgressAck(args[1], args[2], bytes)
+			continue
+		case strings.HasPrefix(message, "/SPOOL_OFFER"):
+			args, err := protocol.SplitArgs(message)
+			if err != nil || len(args) != 6 {
+				fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Invalid held transfer offer:"), message)
+				continue
+			}
+			size, _ := strconv.ParseInt(args[5], 10, 64)
+			HandleSpoolOffer(conn, spoolOffer{ID: args[1], Sender: args[2], Kind: args[3], Name: args[4], Size: size})
+			continue
+		case strings.HasPrefix(message, "/PRESENCE"):
+			args, err := protocol.SplitArgs(message)
+			if err != nil || len(args) != 3 {
+				continue
+			}
+			HandlePresence(args[1], args[2])
+			continue
+		case strings.HasPrefix(message, "/FANOUT_STATUS"):
+			args, err := protocol.SplitArgs(message)
+			if err != nil || len(args) != 5 {
+				continue
+			}
+			HandleFanOutStatus(args[1], args[2], args[3], args[4])
+			continue
+		case strings.HasPrefix(message, "/SPOOL_STATUS"):
+			args, err := protocol.SplitArgs(message)
+			if err != nil || len(args) != 5 {
+				continue
+			}
+			HandleSpoolStatus(args[1], args[2], args[3], args[4])
+			continue
+		case strings.HasPrefix(message, "/RECEIPT"):
+			args, err := protocol.SplitArgs(message)
+			if err != nil || len(args) != 5 {
+				fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Invalid delivery receipt:"), message)
+				continue
+			}
+			HandleTransferReply(args[1], args[2], transferReply{Accepted: true, Path: args[3], Checksum: args[4]})
+			continue
+		case strings.HasPrefix(message, "PING"):
+			err = conn.WriteLine("PONG")
+			if err != nil {
+				fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Error responding to heartbeat:"), err)
+				continue
+			}
+		case strings.HasPrefix(message, "/USERS"):
+			args, err := protocol.SplitArgs(message)
+			if err != nil {
+				fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Invalid user list:"), err)
+				continue
 			}
 
-			// Reset the deadline
-			conn.SetReadDeadline(time.Time{})
+			// Users arrive as username and user ID pairs
+			users := args[1:]
+			if deliverUsers(users) {
+				continue
+			}
 
-			// Process users
-			userCount := 0
-			for _, line := range strings.Split(userList, "\n") {
-				if strings.TrimSpace(line) != "" {
-					userCount++
-					// Enhanced formatting for username and ID
-					if strings.Contains(line, "[ID:") {
-						parts := strings.SplitN(line, "[ID:", 2)
-						if len(parts) == 2 {
-							username := strings.TrimSpace(parts[0])
-							idPart := strings.SplitN(parts[1], "]", 2)
-							if len(idPart) == 2 {
-								userId := strings.TrimSpace(idPart[0])
-								status := strings.TrimSpace(idPart[1])
-								fmt.Printf("%s %s %s %s %s\n",
-									utils.SuccessColor(" •"),
-									utils.UserColor(username),
-									utils.InfoColor("(ID:"),
-									utils.CommandColor(userId),
-									utils.InfoColor(")"+status))
-								continue
-							}
-						}
-					}
-					// Fallback to original formatting if parsing fails
-					fmt.Println(utils.SuccessColor(" • "), utils.UserColor(line))
-				}
+			fmt.Fprintln(utils.Output, utils.HeaderColor("\n👥 Online Users:"))
+			fmt.Fprintln(utils.Output, utils.InfoColor("-------------------"))
+
+			for i := 0; i+1 < len(users); i += 2 {
+				fmt.Fprintf(utils.Output, "%s %s %s %s %s\n",
+					utils.SuccessColor(" •"),
+					utils.UserColor(users[i]),
+					utils.InfoColor("(ID:"),
+					utils.CommandColor(users[i+1]),
+					utils.InfoColor(") is online"))
 			}
 
-			if userCount == 0 {
-				fmt.Println(utils.InfoColor(" No users currently online"))
+			if len(users) < 2 {
+				fmt.Fprintln(utils.Output, utils.InfoColor(" No users currently online"))
 			}
 
-			fmt.Println(utils.InfoColor("-------------------"))
+			fmt.Fprintln(utils.Output, utils.InfoColor("-------------------"))
 			continue
 		case strings.HasPrefix(message, "/LOOK_REQUEST"):
-			args := strings.SplitN(message, " ", 3)
-			if len(args) != 3 {
-				fmt.Println(utils.ErrorColor("❌ Invalid arguments. Use: /LOOK_REQUEST <storageFilePath> <userId>"))
+			args, err := protocol.SplitArgs(message)
+			if err != nil || len(args) != 3 {
+				fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Invalid arguments. Use: /LOOK_REQUEST <userId> <storageFilePath>"))
 				continue
 			}
 			storageFilePath := args[2]
 			userId := args[1]
-			fmt.Println(utils.InfoColor("🔍 Processing directory lookup request from"), utils.UserColor(userId))
+			fmt.Fprintln(utils.Output, utils.InfoColor("🔍 Processing directory lookup request from"), utils.UserColor(userId))
 			HandleLookupResponse(conn, storageFilePath, userId)
 			continue
 		case strings.HasPrefix(message, "/LOOK_RESPONSE"):
-			args := strings.SplitN(message, " ", 3)
-			if len(args) != 3 {
-				fmt.Println(utils.ErrorColor("❌ Invalid arguments. Use: /LOOK_RESPONSE <userId> <files>"))
+			args, err := protocol.SplitArgs(message)
+			if err != nil || len(args) < 2 {
+				fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Invalid arguments. Use: /LOOK_RESPONSE <userId> <entry>..."))
 				continue
 			}
 			userId := args[1]
-			files := strings.Split(args[2], " ")
-
-			fmt.Println(utils.HeaderColor("\n📂 Directory Listing for User:"), utils.UserColor(userId))
-			fmt.Println(utils.InfoColor("-------------------------------------------"))
-
-			for _, file := range files {
-				if strings.HasPrefix(file, "[FOLDER]") {
-					fmt.Println(utils.WarningColor("📁"), utils.InfoColor(file))
-				} else if strings.HasPrefix(file, "[FILE]") {
-					fmt.Println(utils.SuccessColor("📄"), utils.InfoColor(file))
-				} else if strings.HasPrefix(file, "===") {
-					fmt.Println(utils.HeaderColor(file))
-				} else {
-					fmt.Println(utils.InfoColor(file))
-				}
+			entries := parseListingEntries(args[2:])
+			if deliverListing(userId, entries) {
+				continue
 			}
 
-			fmt.Println(utils.InfoColor("-------------------------------------------\n"))
+			fmt.Fprintln(utils.Output, utils.HeaderColor("\n📂 Directory Listing for User:"), utils.UserColor(userId))
+			fmt.Fprintln(utils.Output, utils.InfoColor("-------------------------------------------"))
+			printListing(entries)
+			fmt.Fprintln(utils.Output, utils.InfoColor("-------------------------------------------\n"))
 			continue
 		case strings.HasPrefix(message, "/DOWNLOAD_REQUEST"):
-			args := strings.SplitN(message, " ", 3)
-			if len(args) != 3 {
-				fmt.Println(utils.ErrorColor("❌ Invalid arguments. Use: /DOWNLOAD_REQUEST <userId> <filename>"))
+			args, err := protocol.SplitArgs(message)
+			if err != nil || len(args) != 3 {
+				fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Invalid arguments. Use: /DOWNLOAD_REQUEST <userId> <filename>"))
 				continue
 			}
 			userId := args[1]
 			filePath := args[2]
-			fmt.Println(utils.InfoColor("📤 Download request from"), utils.UserColor(userId), utils.InfoColor("for"), utils.InfoColor(filePath))
+			fmt.Fprintln(utils.Output, utils.InfoColor("📤 Download request from"), utils.UserColor(userId), utils.InfoColor("for"), utils.InfoColor(filePath))
 			HandleDownloadResponse(conn, userId, filePath)
 			continue
+		case strings.HasPrefix(message, "/DOWNLOAD_FAILED"):
+			args, err := protocol.SplitArgs(message)
+			if err != nil || len(args) != 4 {
+				fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Invalid arguments. Use: /DOWNLOAD_FAILED <userId> <filename> <reason>"))
+				continue
+			}
+			fmt.Fprintf(utils.Output, "%s User %s cannot send %s: %s\n",
+				utils.ErrorColor("❌"),
+				utils.UserColor(args[1]),
+				utils.InfoColor(args[2]),
+				args[3])
+			downloadFailed(args[1], args[3])
+			continue
 		default:
+			publish(Event{Type: MessageEvent, Text: message})
 			if strings.Contains(message, "has joined the chat") {
-				fmt.Println(utils.WarningColor("👋 " + message))
+				fmt.Fprintln(utils.Output, utils.WarningColor("👋 "+message))
 			} else if strings.Contains(message, "has rejoined the chat") {
-				fmt.Println(utils.WarningColor("🔄 " + message))
+				fmt.Fprintln(utils.Output, utils.WarningColor("🔄 "+message))
 			} else if strings.Contains(message, "is now offline") {
-				fmt.Println(utils.WarningColor("👋 " + message))
+				fmt.Fprintln(utils.Output, utils.WarningColor("👋 "+message))
 			} else {
-				fmt.Println(message)
+				fmt.Fprintln(utils.Output, message)
 			}
 		}
 	}
 }
 
-func WriteLoop(conn net.Conn) {
+func WriteLoop(conn *protocol.Conn) {
 	reader := bufio.NewReader(os.Stdin)
 	for {
-		fmt.Print(utils.CommandColor(">>> "))
+		fmt.Fprint(utils.Output, utils.CommandColor(">>> "))
 		message, _ := reader.ReadString('\n')
 		message = strings.TrimSpace(message)
+
+		// Commands take shell style arguments so paths with spaces can be quoted
+		var args []string
+		if strings.HasPrefix(message, "/") {
+			var err error
+			args, err = protocol.SplitArgs(message)
+			if err != nil {
+				fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Invalid command:"), err)
+				continue
+			}
+		}
+
 		switch {
 		case message == "exit":
-			fmt.Println(utils.InfoColor("👋 Goodbye!"))
+			fmt.Fprintln(utils.Output, utils.InfoColor("👋 Goodbye!"))
 			conn.Close()
 			return
 		case message == "/help":
 			utils.PrintHelp()
 			continue
 		case strings.HasPrefix(message, "/sendfile"):
-			args := strings.SplitN(message, " ", 3)
-			if len(args) != 3 {
-				fmt.Println(utils.ErrorColor("❌ Invalid arguments. Use: /sendfile <userId> <filename>"))
+			if len(args) < 3 {
+				fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Invalid arguments. Use: /sendfile <userId>[,<userId>...]|@all <filename|pattern>..."))
 				continue
 			}
 			recipientId := args[1]
-			filePath := args[2]
-			fmt.Println(utils.InfoColor("📤 Sending file to"), utils.UserColor(recipientId))
-			HandleSendFile(conn, recipientId, filePath)
+			fmt.Fprintln(utils.Output, utils.InfoColor("📤 Sending file to"), utils.UserColor(recipientId))
+			HandleSendFiles(conn, recipientId, args[2:])
 			continue
 		case strings.HasPrefix(message, "/sendfolder"):
-			args := strings.SplitN(message, " ", 3)
 			if len(args) != 3 {
-				fmt.Println(utils.ErrorColor("❌ Invalid arguments. Use: /sendfolder <userId> <folderPath>"))
+				fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Invalid arguments. Use: /sendfolder <userId> <folderPath>"))
 				continue
 			}
 			recipientId := args[1]
 			folderPath := args[2]
-			fmt.Println(utils.InfoColor("📤 Sending folder to"), utils.UserColor(recipientId))
+			fmt.Fprintln(utils.Output, utils.InfoColor("📤 Sending folder to"), utils.UserColor(recipientId))
 			HandleSendFolder(conn, recipientId, folderPath)
 			continue
+		case message == "/sync" || strings.HasPrefix(message, "/sync "):
+			if len(args) == 1 || args[1] == "accept" || args[1] == "reject" {
+				HandleSyncRequests(args[1:])
+				continue
+			}
+			if len(args) != 4 {
+				fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Invalid arguments. Use: /sync <userId> <localFolder> <remoteFolder>"))
+				continue
+			}
+			HandleSync(conn, args[1], args[2], args[3])
+			continue
+		case message == "/mirror" || strings.HasPrefix(message, "/mirror "):
+			HandleMirror(conn, args[1:])
+			continue
+		case message == "/unmirror" || strings.HasPrefix(message, "/unmirror "):
+			if len(args) != 2 {
+				fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Invalid arguments. Use: /unmirror <mirrorId>|all"))
+				continue
+			}
+			HandleUnmirror(args[1])
+			continue
+		case message == "/watch" || strings.HasPrefix(message, "/watch "):
+			if len(args) != 3 {
+				fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Invalid arguments. Use: /watch <userId> <folder>"))
+				continue
+			}
+			HandleWatch(conn, args[1], args[2])
+			continue
+		case message == "/watches":
+			HandleListWatches()
+			continue
+		case message == "/unwatch" || strings.HasPrefix(message, "/unwatch "):
+			if len(args) != 2 {
+				fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Invalid arguments. Use: /unwatch <watchId>|all"))
+				continue
+			}
+			HandleUnwatch(args[1])
+			continue
 		case strings.HasPrefix(message, "/lookup"):
-			args := strings.SplitN(message, " ", 2)
 			if len(args) != 2 {
-				fmt.Println(utils.ErrorColor("❌ Invalid arguments. Use: /lookup <userId>"))
+				fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Invalid arguments. Use: /lookup <userId>"))
 				continue
 			}
 			recipientId := args[1]
-			fmt.Println(utils.InfoColor("🔍 Looking up files for user"), utils.UserColor(recipientId))
+			fmt.Fprintln(utils.Output, utils.InfoColor("🔍 Looking up files for user"), utils.UserColor(recipientId))
 			HandleLookupRequest(conn, recipientId)
 			continue
 		case strings.HasPrefix(message, "/status"):
-			fmt.Println(utils.InfoColor("👥 Fetching online users..."))
-			_, err := conn.Write([]byte(message))
+			fmt.Fprintln(utils.Output, utils.InfoColor("👥 Fetching online users..."))
+			err := conn.WriteLine("/status")
 			if err != nil {
-				fmt.Println(utils.ErrorColor("❌ Error checking status:"), err)
+				fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Error checking status:"), err)
 				continue
 			}
 			continue
 		case strings.HasPrefix(message, "/download"):
-			args := strings.SplitN(message, " ", 3)
 			if len(args) != 3 {
-				fmt.Println(utils.ErrorColor("❌ Invalid arguments. Use: /download <userId> <filename>"))
+				fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Invalid arguments. Use: /download <userId> <filename>"))
 				continue
 			}
 			recipientId := args[1]
 			filePath := args[2]
-			fmt.Println(utils.InfoColor("📥 Requesting download from"), utils.UserColor(recipientId))
+			fmt.Fprintln(utils.Output, utils.InfoColor("📥 Requesting download from"), utils.UserColor(recipientId))
 			HandleDownloadRequest(conn, recipientId, filePath)
 			continue
+		case message == "/get" || strings.HasPrefix(message, "/get "):
+			if len(args) != 2 && len(args) != 3 {
+				fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Invalid arguments. Use: /get <checksum> [fileName]"))
+				continue
+			}
+			name := ""
+			if len(args) == 3 {
+				name = args[2]
+			}
+			HandleGet(conn, args[1], name)
+			continue
 		case strings.HasPrefix(message, "/transfers"):
 			HandleListTransfers()
 			continue
+		case message == "/history" || strings.HasPrefix(message, "/history "):
+			HandleHistory(args[1:])
+			continue
 		case strings.HasPrefix(message, "/pause"):
-			args := strings.SplitN(message, " ", 2)
 			if len(args) != 2 {
-				fmt.Println(utils.ErrorColor("❌ Invalid arguments. Use: /pause <transferId>"))
+				fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Invalid arguments. Use: /pause <transferId>"))
 				continue
 			}
 			transferID := args[1]
 			HandlePauseTransfer(transferID)
 			continue
 		case strings.HasPrefix(message, "/resume"):
-			args := strings.SplitN(message, " ", 2)
 			if len(args) != 2 {
-				fmt.Println(utils.ErrorColor("❌ Invalid arguments. Use: /resume <transferId>"))
+				fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Invalid arguments. Use: /resume <transferId>"))
 				continue
 			}
 			transferID := args[1]
 			HandleResumeTransfer(transferID)
 			continue
+		case strings.HasPrefix(message, "/cancel"):
+			if len(args) != 2 {
+				fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Invalid arguments. Use: /cancel <transferId>"))
+				continue
+			}
+			HandleCancelTransfer(args[1])
+			continue
+		case strings.HasPrefix(message, "/priority"):
+			if len(args) != 3 {
+				fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Invalid arguments. Use: /priority <transferId> high|normal|low"))
+				continue
+			}
+			HandleSetPriority(args[1], args[2])
+			continue
+		case strings.HasPrefix(message, "/move"):
+			if len(args) != 3 {
+				fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Invalid arguments. Use: /move <transferId> <position>"))
+				continue
+			}
+			position, err := strconv.Atoi(args[2])
+			if err != nil {
+				fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Invalid position. Use: /move <transferId> <position>"))
+				continue
+			}
+			HandleMoveTransfer(args[1], position)
+			continue
+		case message == "/settings":
+			HandleShowSettings()
+			continue
+		case message == "/journal" || strings.HasPrefix(message, "/journal "):
+			HandleJournal(conn, args[1:])
+			continue
+		case message == "/spool" || strings.HasPrefix(message, "/spool "):
+			HandleSpool(conn, args[1:])
+			continue
+		case message == "/chunks" || strings.HasPrefix(message, "/chunks "):
+			HandleChunks(args[1:])
+			continue
+		case strings.HasPrefix(message, "/set "):
+			if len(args) != 3 {
+				fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Invalid arguments. Use: /set <key> <value>"))
+				continue
+			}
+			HandleSetSetting(args[1], args[2])
+			continue
 		default:
 			if message != "" {
-				_, err := conn.Write([]byte(message))
+				err := conn.WriteLine(message)
 				if err != nil {
-					fmt.Println(utils.ErrorColor("❌ Error sending message:"), err)
+					fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Error sending message:"), err)
 					return
 				}
 			}
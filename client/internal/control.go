@@ -0,0 +1,304 @@
+package connection
+
+import (
+	"bufio"
+	"drizlink/protocol"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// The control socket carries one JSON object per line. A client sends a
+// ControlRequest and reads one ControlResponse before sending the next
+// request; tools wanting several operations at once open several
+// connections. After a successful "subscribe" the connection carries one
+// Event per line until either side closes it.
+
+// ControlRequest is one request on the control socket
+type ControlRequest struct {
+	Op       string   `json:"op"`
+	User     string   `json:"user,omitempty"`     // username or user ID; for send also a comma separated list or @all
+	Paths    []string `json:"paths,omitempty"`    // send: files, folders or glob patterns
+	Path     string   `json:"path,omitempty"`     // download: the path on the other user's machine
+	Transfer string   `json:"transfer,omitempty"` // pause, resume and cancel: the transfer ID
+	Text     string   `json:"text,omitempty"`     // chat: the message
+}
+
+// ControlResponse answers a ControlRequest
+type ControlResponse struct {
+	OK     bool            `json:"ok"`
+	Error  string          `json:"error,omitempty"`
+	Result json.RawMessage `json:"result,omitempty"`
+}
+
+// DefaultControlSocket is where drizlinkd listens unless told otherwise
+func DefaultControlSocket() (string, error) {
+	dir, err := ConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "drizlinkd.sock"), nil
+}
+
+// ListenControl listens on the Unix socket at path, which only the current
+// user may connect to. A socket left behind by a daemon that is gone is
+// replaced, but one that still answers is an error.
+func ListenControl(path string) (net.Listener, error) {
+	if probe, err := net.Dial("unix", path); err == nil {
+		probe.Close()
+		return nil, fmt.Errorf("a daemon is already listening on %s", path)
+	}
+	os.Remove(path)
+
+	// The socket is created inside a directory only we can enter and moved
+	// into place once its own permissions are tight, so nobody else can
+	// connect in between
+	private, err := os.MkdirTemp(filepath.Dir(path), ".drizlinkd-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(private)
+	staged := filepath.Join(private, "control.sock")
+
+	listener, err := net.Listen("unix", staged)
+	if err != nil {
+		return nil, err
+	}
+	// The socket is removed from its final path, by whoever closes it
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	if err := os.Chmod(staged, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	if err := os.Rename(staged, path); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// ControlServer answers control socket requests over the current server
+// connection
+type ControlServer struct {
+	mutex sync.Mutex
+	conn  *protocol.Conn
+}
+
+// SetConnection switches to conn, or to no connection when it is nil
+func (c *ControlServer) SetConnection(conn *protocol.Conn) {
+	c.mutex.Lock()
+	c.conn = conn
+	c.mutex.Unlock()
+}
+
+func (c *ControlServer) connection() (*protocol.Conn, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.conn == nil {
+		return nil, errors.New("not connected to the server")
+	}
+	return c.conn, nil
+}
+
+// Serve answers the clients of listener until it is closed
+func (c *ControlServer) Serve(listener net.Listener) error {
+	for {
+		client, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go c.serveClient(client)
+	}
+}
+
+func (c *ControlServer) serveClient(client net.Conn) {
+	defer client.Close()
+	reader := bufio.NewReader(client)
+	encoder := json.NewEncoder(client)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+		var request ControlRequest
+		if err := json.Unmarshal(line, &request); err != nil {
+			encoder.Encode(ControlResponse{Error: "invalid request: " + err.Error()})
+			continue
+		}
+
+		if request.Op == "subscribe" {
+			c.streamEvents(reader, encoder)
+			return
+		}
+
+		response := ControlResponse{OK: true}
+		result, err := c.handle(request)
+		if err == nil && result != nil {
+			response.Result, err = json.Marshal(result)
+		}
+		if err != nil {
+			response = ControlResponse{Error: err.Error()}
+		}
+		if encoder.Encode(response) != nil {
+			return
+		}
+	}
+}
+
+// streamEvents sends every event to client until it disconnects
+func (c *ControlServer) streamEvents(reader *bufio.Reader, encoder *json.Encoder) {
+	events, stop := Subscribe()
+	defer stop()
+	if encoder.Encode(ControlResponse{OK: true}) != nil {
+		return
+	}
+
+	// Nothing more is read from a subscriber, so a read only ends when it leaves
+	go func() {
+		reader.WriteTo(io.Discard)
+		stop()
+	}()
+	for event := range events {
+		if encoder.Encode(event) != nil {
+			return
+		}
+	}
+}
+
+// handle performs one request and returns its result
+func (c *ControlServer) handle(request ControlRequest) (interface{}, error) {
+	switch request.Op {
+	case "transfers":
+		infos := []TransferInfo{}
+		for _, transfer := range ListTransfers() {
+			infos = append(infos, transfer.Info())
+		}
+		return infos, nil
+	case "pause":
+		return nil, PauseTransfer(request.Transfer)
+	case "resume":
+		return nil, ResumeTransfer(request.Transfer)
+	case "cancel":
+		return nil, CancelTransfer(request.Transfer)
+	}
+
+	conn, err := c.connection()
+	if err != nil {
+		return nil, err
+	}
+	switch request.Op {
+	case "users":
+		return RequestUsers(conn)
+	case "ls":
+		userId, err := ResolveUser(conn, request.User)
+		if err != nil {
+			return nil, err
+		}
+		return Lookup(conn, userId)
+	case "send":
+		if len(request.Paths) == 0 {
+			return nil, errors.New("send needs paths")
+		}
+		recipientId, err := ResolveUsers(conn, request.User)
+		if err != nil {
+			return nil, err
+		}
+		return nil, SendPaths(conn, recipientId, request.Paths)
+	case "download":
+		userId, err := ResolveUser(conn, request.User)
+		if err != nil {
+			return nil, err
+		}
+		path, err := Download(conn, userId, request.Path)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]string{"path": path}, nil
+	case "chat":
+		text := strings.TrimSpace(request.Text)
+		if text == "" || strings.HasPrefix(text, "/") || strings.ContainsAny(text, "\r\n") {
+			return nil, errors.New("a chat message must be one line and cannot start with /")
+		}
+		return nil, conn.WriteLine(text)
+	default:
+		return nil, fmt.Errorf("unknown op %q", request.Op)
+	}
+}
+
+// ControlClient drives a daemon through its control socket. It performs
+// one request at a time.
+type ControlClient struct {
+	mutex   sync.Mutex
+	conn    net.Conn
+	reader  *bufio.Reader
+	encoder *json.Encoder
+}
+
+// DialControl connects to the daemon listening at path
+func DialControl(path string) (*ControlClient, error) {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	return &ControlClient{conn: conn, reader: bufio.NewReader(conn), encoder: json.NewEncoder(conn)}, nil
+}
+
+// Close disconnects from the daemon
+func (c *ControlClient) Close() error {
+	return c.conn.Close()
+}
+
+// Call sends request and decodes the result into result, which may be nil
+func (c *ControlClient) Call(request ControlRequest, result interface{}) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if err := c.encoder.Encode(request); err != nil {
+		return err
+	}
+	line, err := c.reader.ReadBytes('\n')
+	if err != nil {
+		return fmt.Errorf("daemon closed the connection: %v", err)
+	}
+	var response ControlResponse
+	if err := json.Unmarshal(line, &response); err != nil {
+		return fmt.Errorf("invalid response from daemon: %v", err)
+	}
+	if !response.OK {
+		return errors.New(response.Error)
+	}
+	if result != nil && response.Result != nil {
+		return json.Unmarshal(response.Result, result)
+	}
+	return nil
+}
+
+// Subscribe turns the connection into a stream of events. The channel is
+// closed when the daemon goes away or the client is closed; no further
+// requests can be made.
+func (c *ControlClient) Subscribe() (<-chan Event, error) {
+	if err := c.Call(ControlRequest{Op: "subscribe"}, nil); err != nil {
+		return nil, err
+	}
+	events := make(chan Event)
+	go func() {
+		defer close(events)
+		decoder := json.NewDecoder(c.reader)
+		for {
+			var event Event
+			if decoder.Decode(&event) != nil {
+				return
+			}
+			events <- event
+		}
+	}()
+	return events, nil
+}
@@ -0,0 +1,262 @@
+package connection
+
+import (
+	"drizlink/helper"
+	"drizlink/protocol"
+	"drizlink/utils"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// deltaMinSize is the smallest file worth comparing against an older copy
+	deltaMinSize = 1 << 20
+	// maxCopyRun bounds the data one /DELTA_COPY refers to, so rebuilding it
+	// does not hold up the connection for long
+	maxCopyRun = 8 << 20
+	// signaturesPerFrame is how many block signatures go in one frame
+	signaturesPerFrame = 32768
+)
+
+// deltaBase is an older copy of an incoming file that the sender may refer
+// to instead of sending unchanged blocks again
+type deltaBase struct {
+	file       *os.File
+	blockSize  int
+	signatures []helper.BlockSignature
+}
+
+// signatureCollector gathers the block signatures a recipient sends after
+// offering a delta transfer, or the chunks it holds after offering its chunk
+// store
+type signatureCollector struct {
+	mutex   sync.Mutex
+	data    []byte
+	arrived chan struct{}
+}
+
+var (
+	pendingSignatures      = make(map[string]*signatureCollector)
+	pendingSignaturesMutex sync.Mutex
+)
+
+// openDeltaBase opens the file at path as the base for receiving a new
+// version of size bytes. It returns nil when there is no usable older copy.
+func openDeltaBase(path string, size int64) *deltaBase {
+	if !GetSettings().Delta || size < deltaMinSize {
+		return nil
+	}
+	info, err := os.Stat(path)
+	if err != nil || !info.Mode().IsRegular() || info.Size() < deltaMinSize {
+		return nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+
+	blockSize := helper.DeltaBlockSize(info.Size())
+	signatures, err := helper.BlockSignatures(file, blockSize)
+	if err != nil || len(signatures) == 0 {
+		file.Close()
+		return nil
+	}
+	fmt.Fprintf(utils.Output, "%s Found an older copy (%s), asking the sender for changed blocks only\n",
+		utils.InfoColor("🔁"),
+		formatSize(info.Size()))
+	return &deltaBase{file: file, blockSize: blockSize, signatures: signatures}
+}
+
+func (base *deltaBase) close() {
+	if base != nil {
+		base.file.Close()
+	}
+}
+
+// acceptDelta accepts a transfer like acceptTransfer and offers the sender
+// the signatures of base, which follow the answer as /SIGNATURES frames
+func acceptDelta(conn *protocol.Conn, senderId, remoteID, savePath string, streams int, base *deltaBase) error {
+	err := conn.WriteLine(protocol.Format("/TRANSFER_ACCEPT",
+		senderId, remoteID, savePath, "0", strconv.Itoa(streams),
+		strconv.Itoa(base.blockSize), strconv.Itoa(len(base.signatures))))
+	if err != nil {
+		return err
+	}
+
+	data := helper.EncodeSignatures(base.signatures)
+	for len(data) > 0 {
+		n := min(len(data), signaturesPerFrame*helper.SignatureSize)
+		header := protocol.Format("/SIGNATURES", senderId, remoteID, strconv.Itoa(n))
+		if err := conn.WriteFrame(header, data[:n]); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+// attachDeltaBase lets the incoming transfer from senderId copy blocks from base
+func attachDeltaBase(senderId string, transfer *Transfer, base *deltaBase) {
+	incomingMutex.Lock()
+	defer incomingMutex.Unlock()
+	if incoming, exists := incomingTransfers[incomingKey(senderId, transfer.RemoteID)]; exists {
+		incoming.base = base
+	}
+}
+
+// HandleDeltaCopy writes count blocks of the older copy, starting at block,
+// as the next data of an incoming transfer
+func HandleDeltaCopy(senderId, remoteId string, block, count int) {
+	key := incomingKey(senderId, remoteId)
+
+	incomingMutex.Lock()
+	incoming, exists := incomingTransfers[key]
+	incomingMutex.Unlock()
+	if !exists {
+		return
+	}
+	incoming.run(func() { incoming.copyBlocks(key, block, count) })
+}
+
+// copyBlocks writes count blocks of the older copy, starting at block, to
+// the incoming transfer
+func (incoming *incomingTransfer) copyBlocks(key string, block, count int) {
+	base := incoming.base
+	if base == nil || block < 0 || count < 1 || block+count > len(base.signatures) {
+		incoming.abort(key, corruptData("received an invalid copy instruction (blocks %d+%d)", block, count))
+		return
+	}
+
+	buffer := make([]byte, chunkSize)
+	offset := int64(block) * int64(base.blockSize)
+	end := offset + int64(count)*int64(base.blockSize)
+	for offset < end {
+		n := min(int64(chunkSize), end-offset)
+		if _, err := base.file.ReadAt(buffer[:n], offset); err != nil {
+			incoming.abort(key, fmt.Errorf("error reading older copy: %v", err))
+			return
+		}
+		if !incoming.write(key, buffer[:n]) {
+			return
+		}
+		offset += n
+	}
+}
+
+// expectSignatures prepares to receive the block signatures a recipient may
+// send with its answer. Like expectReply it must be called before the request.
+func expectSignatures(recipientId, transferID string) *signatureCollector {
+	collector := &signatureCollector{arrived: make(chan struct{}, 1)}
+	pendingSignaturesMutex.Lock()
+	pendingSignatures[incomingKey(recipientId, transferID)] = collector
+	pendingSignaturesMutex.Unlock()
+	return collector
+}
+
+// cancelSignatures stops collecting signatures for a transfer
+func cancelSignatures(recipientId, transferID string) {
+	pendingSignaturesMutex.Lock()
+	delete(pendingSignatures, incomingKey(recipientId, transferID))
+	pendingSignaturesMutex.Unlock()
+}
+
+// HandleSignatures stores one frame of block signatures from a recipient
+func HandleSignatures(recipientId, transferID string, payload []byte) {
+	pendingSignaturesMutex.Lock()
+	collector, exists := pendingSignatures[incomingKey(recipientId, transferID)]
+	pendingSignaturesMutex.Unlock()
+	if !exists {
+		return
+	}
+
+	collector.mutex.Lock()
+	collector.data = append(collector.data, payload...)
+	collector.mutex.Unlock()
+	select {
+	case collector.arrived <- struct{}{}:
+	default:
+	}
+}
+
+// await waits until the signatures of blocks blocks have arrived
+func (collector *signatureCollector) await(blocks int) ([]helper.BlockSignature, error) {
+	data, err := collector.awaitBytes(blocks * helper.SignatureSize)
+	if err != nil {
+		return nil, err
+	}
+	return helper.DecodeSignatures(data)
+}
+
+// awaitBytes waits until at least want bytes have arrived and returns the
+// first want of them
+func (collector *signatureCollector) awaitBytes(want int) ([]byte, error) {
+	timeout := time.After(replyTimeout)
+	for {
+		collector.mutex.Lock()
+		if len(collector.data) >= want {
+			data := collector.data[:want]
+			collector.mutex.Unlock()
+			return data, nil
+		}
+		collector.mutex.Unlock()
+
+		select {
+		case <-collector.arrived:
+		case <-timeout:
+			return nil, fmt.Errorf("recipient did not answer the offer within %s", replyTimeout)
+		}
+	}
+}
+
+// sendDelta sends file as instructions for rebuilding it from the
+// recipient's older copy: blocks the recipient already has are referred to
+// with /DELTA_COPY and everything else goes out as /CHUNK frames. The
+// returned count is the size of the rebuilt file.
+func sendDelta(conn *protocol.Conn, transfer *Transfer, file io.Reader, blockSize int, signatures []helper.BlockSignature) (int64, error) {
+	runBlocks := max(1, maxCopyRun/blockSize)
+	var literal, copied int64
+
+	err := helper.ComputeDelta(file, blockSize, signatures, chunkSize, func(op helper.DeltaOp) error {
+		if err := waitWhilePaused(transfer); err != nil {
+			return err
+		}
+
+		if op.Literal != nil {
+			header := protocol.Format("/CHUNK", transfer.Recipient, transfer.ID, strconv.Itoa(len(op.Literal)))
+			if err := conn.WriteFrame(header, op.Literal); err != nil {
+				return err
+			}
+			literal += int64(len(op.Literal))
+			transfer.BytesComplete.Add(int64(len(op.Literal)))
+			return nil
+		}
+
+		for block, count := op.Block, op.Count; count > 0; {
+			run := min(count, runBlocks)
+			err := conn.WriteLine(protocol.Format("/DELTA_COPY",
+				transfer.Recipient, transfer.ID, strconv.Itoa(block), strconv.Itoa(run)))
+			if err != nil {
+				return err
+			}
+			block += run
+			count -= run
+		}
+		size := int64(op.Count) * int64(blockSize)
+		copied += size
+		transfer.BytesComplete.Add(size)
+		return nil
+	})
+	if err != nil {
+		return transfer.BytesComplete.Load(), err
+	}
+
+	fmt.Fprintf(utils.Output, "%s Sent %s of changed data, the recipient reused %s of its older copy\n",
+		utils.InfoColor("🔁"),
+		formatSize(literal),
+		formatSize(copied))
+	return transfer.BytesComplete.Load(), nil
+}
@@ -0,0 +1,113 @@
+package connection
+
+import (
+	"drizlink/protocol"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// downloadStartTimeout bounds how long Download waits for the owner to start
+// sending, in case the request never reached them
+const downloadStartTimeout = 30 * time.Second
+
+// downloadWaiter follows the receive a user starts in answer to a download
+// request
+type downloadWaiter struct {
+	started chan struct{}
+	done    chan downloadResult
+	once    sync.Once
+}
+
+type downloadResult struct {
+	path string
+	err  error
+}
+
+var (
+	// downloadWaiters holds the pending Download of each user ID
+	downloadWaiters      = make(map[string]*downloadWaiter)
+	downloadWaitersMutex sync.Mutex
+)
+
+// Download asks userId for the file or folder at path and waits until it has
+// been received, returning where it was saved. ReadLoop must be running to
+// deliver it.
+func Download(conn *protocol.Conn, userId, path string) (string, error) {
+	waiter := &downloadWaiter{started: make(chan struct{}), done: make(chan downloadResult, 1)}
+	downloadWaitersMutex.Lock()
+	if _, exists := downloadWaiters[userId]; exists {
+		downloadWaitersMutex.Unlock()
+		return "", fmt.Errorf("a download from %s is already pending", userId)
+	}
+	downloadWaiters[userId] = waiter
+	downloadWaitersMutex.Unlock()
+	defer func() {
+		downloadWaitersMutex.Lock()
+		delete(downloadWaiters, userId)
+		downloadWaitersMutex.Unlock()
+	}()
+
+	if err := conn.WriteLine(protocol.Format("/DOWNLOAD_REQUEST", userId, path)); err != nil {
+		return "", err
+	}
+
+	select {
+	case <-waiter.started:
+	case result := <-waiter.done:
+		return result.path, result.err
+	case <-time.After(downloadStartTimeout):
+		return "", fmt.Errorf("user %s did not start sending %s", userId, path)
+	}
+	result := <-waiter.done
+	return result.path, result.err
+}
+
+// pendingDownload returns the Download waiting on peerId, if any
+func pendingDownload(peerId string) *downloadWaiter {
+	downloadWaitersMutex.Lock()
+	defer downloadWaitersMutex.Unlock()
+	return downloadWaiters[peerId]
+}
+
+// downloadStarted tells a pending Download that its owner began sending
+func downloadStarted(transfer *Transfer) {
+	if waiter := pendingDownload(transfer.Recipient); waiter != nil {
+		waiter.once.Do(func() { close(waiter.started) })
+	}
+}
+
+// downloadFinished reports the outcome of a receive to the pending Download
+// of its sender
+func downloadFinished(transfer *Transfer) {
+	waiter := pendingDownload(transfer.Recipient)
+	if waiter == nil {
+		return
+	}
+
+	transfer.PauseLock.Lock()
+	result := downloadResult{path: transfer.Path}
+	if transfer.Type == FolderTransfer && transfer.SavePath != "" {
+		result.path = transfer.SavePath
+	}
+	if transfer.Status != Completed {
+		result.err = fmt.Errorf("receiving %s failed", transfer.Name)
+	}
+	transfer.PauseLock.Unlock()
+
+	select {
+	case waiter.done <- result:
+	default:
+	}
+}
+
+// downloadFailed fails the pending Download of peerId, if any
+func downloadFailed(peerId, reason string) {
+	if waiter := pendingDownload(peerId); waiter != nil {
+		select {
+		case waiter.done <- downloadResult{err: errors.New(reason)}:
+		default:
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package connection
+
+import (
+	"sync"
+	"time"
+)
+
+// Event types delivered to subscribers
+const (
+	TransferAddedEvent    = "transfer_added"
+	TransferUpdatedEvent  = "transfer_updated"
+	TransferFinishedEvent = "transfer_finished"
+	MessageEvent          = "message"
+	PresenceEvent         = "presence"
+)
+
+// Event is something that happened in this client, for tools following it
+// through Subscribe
+type Event struct {
+	Type     string        `json:"type"`
+	Time     time.Time     `json:"time"`
+	Transfer *TransferInfo `json:"transfer,omitempty"`
+	User     string        `json:"user,omitempty"`  // presence: the user ID
+	State    string        `json:"state,omitempty"` // presence: "online" or "offline"
+	Text     string        `json:"text,omitempty"`  // message: the line as the server sent it
+}
+
+// TransferInfo is a snapshot of a transfer
+type TransferInfo struct {
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	Name      string    `json:"name"`
+	Direction string    `json:"direction"`
+	Peer      string    `json:"peer"`
+	Status    string    `json:"status"`
+	Size      int64     `json:"size"`
+	Delivered int64     `json:"delivered"`
+	Path      string    `json:"path"`
+	SavePath  string    `json:"savePath,omitempty"`
+	Checksum  string    `json:"checksum,omitempty"`
+	Started   time.Time `json:"started"`
+}
+
+// Info returns a snapshot of the transfer
+func (t *Transfer) Info() TransferInfo {
+	t.PauseLock.Lock()
+	defer t.PauseLock.Unlock()
+	kind := formatTransferType(t.Type)
+	if t.Stream {
+		kind = "Stream"
+	}
+	return TransferInfo{
+		ID:        t.ID,
+		Type:      kind,
+		Name:      t.Name,
+		Direction: t.Direction,
+		Peer:      t.Recipient,
+		Status:    t.Status.String(),
+		Size:      t.Size,
+		Delivered: t.Delivered(),
+		Path:      t.Path,
+		SavePath:  t.SavePath,
+		Checksum:  t.Checksum,
+		Started:   t.StartTime,
+	}
+}
+
+// subscriberBuffer is how many events a subscriber may fall behind before
+// further events are dropped for it
+const subscriberBuffer = 256
+
+var (
+	subscribers      = make(map[chan Event]bool)
+	subscribersMutex sync.Mutex
+)
+
+// Subscribe returns a channel receiving every event from now on, and a
+// function that stops the subscription and closes the channel. Events are
+// dropped for a subscriber that does not keep up.
+func Subscribe() (<-chan Event, func()) {
+	events := make(chan Event, subscriberBuffer)
+	subscribersMutex.Lock()
+	subscribers[events] = true
+	subscribersMutex.Unlock()
+
+	var once sync.Once
+	return events, func() {
+		once.Do(func() {
+			subscribersMutex.Lock()
+			delete(subscribers, events)
+			subscribersMutex.Unlock()
+			close(events)
+		})
+	}
+}
+
+// publish hands event to every subscriber
+func publish(event Event) {
+	event.Time = time.Now()
+	subscribersMutex.Lock()
+	defer subscribersMutex.Unlock()
+	for events := range subscribers {
+		select {
+		case events <- event:
+		default:
+		}
+	}
+}
+
+// publishTransfer reports a change to transfer
+func publishTransfer(eventType string, transfer *Transfer) {
+	subscribersMutex.Lock()
+	idle := len(subscribers) == 0
+	subscribersMutex.Unlock()
+	if idle {
+		return
+	}
+	info := transfer.Info()
+	publish(Event{Type: eventType, Transfer: &info})
+}
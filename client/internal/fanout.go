@@ -0,0 +1,174 @@
+package connection
+
+import (
+	"drizlink/utils"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// AllUsers as recipient sends a file to every other online user
+const AllUsers = "@all"
+
+// fanOutRecipient is how delivery of a fan-out to one user is going
+type fanOutRecipient struct {
+	Status string // "offered", "accepted", "delivered", "declined" or "failed"
+	Bytes  int64
+	Detail string
+}
+
+// FanOut follows a file uploaded once and delivered by the server to
+// several users, each of whom accepts and confirms it separately
+type FanOut struct {
+	ID         string
+	Name       string
+	Size       int64
+	Recipients map[string]*fanOutRecipient
+	mutex      sync.Mutex
+}
+
+var (
+	activeFanOuts = make(map[string]*FanOut)
+	fanOutsMutex  sync.Mutex
+)
+
+// isFanOutTarget reports whether recipient names several users, as a comma
+// separated list or @all
+func isFanOutTarget(recipient string) bool {
+	return recipient == AllUsers || strings.Contains(recipient, ",")
+}
+
+// trackFanOut starts following the deliveries of transfer, which is about to
+// be sent to several users
+func trackFanOut(transfer *Transfer) {
+	fanOutsMutex.Lock()
+	activeFanOuts[transfer.ID] = &FanOut{
+		ID:         transfer.ID,
+		Name:       transfer.Name,
+		Size:       transfer.Size,
+		Recipients: make(map[string]*fanOutRecipient),
+	}
+	fanOutsMutex.Unlock()
+}
+
+// forgetFanOut stops following a fan-out the server did not take on
+func forgetFanOut(transferID string) {
+	fanOutsMutex.Lock()
+	delete(activeFanOuts, transferID)
+	fanOutsMutex.Unlock()
+}
+
+// HandleFanOutStatus records what the server reports about delivering a
+// fan-out to one recipient, and sums up once every recipient is done
+func HandleFanOutStatus(transferID, recipientId, status, detail string) {
+	fanOutsMutex.Lock()
+	fan, exists := activeFanOuts[transferID]
+	fanOutsMutex.Unlock()
+	if !exists {
+		return
+	}
+
+	fan.mutex.Lock()
+	recipient, exists := fan.Recipients[recipientId]
+	if !exists {
+		recipient = &fanOutRecipient{}
+		fan.Recipients[recipientId] = recipient
+	}
+	if status == "progress" {
+		recipient.Bytes, _ = strconv.ParseInt(detail, 10, 64)
+		fan.mutex.Unlock()
+		return
+	}
+	recipient.Status, recipient.Detail = status, detail
+	if status == "delivered" {
+		recipient.Bytes = fan.Size
+	}
+	delivered, finished := 0, true
+	for _, other := range fan.Recipients {
+		switch other.Status {
+		case "delivered":
+			delivered++
+		case "offered", "accepted":
+			finished = false
+		}
+	}
+	total := len(fan.Recipients)
+	fan.mutex.Unlock()
+
+	switch status {
+	case "delivered":
+		fmt.Fprintf(utils.Output, "%s '%s' delivered to user %s\n",
+			utils.SuccessColor("✅"),
+			utils.InfoColor(fan.Name),
+			utils.UserColor(recipientId))
+		fmt.Fprintln(utils.Output, utils.InfoColor("  Saved by recipient to:"), utils.InfoColor(detail))
+	case "declined":
+		fmt.Fprintf(utils.Output, "%s User %s declined '%s': %s\n",
+			utils.WarningColor("⏭"),
+			utils.UserColor(recipientId),
+			utils.InfoColor(fan.Name),
+			utils.WarningColor(detail))
+	case "failed":
+		fmt.Fprintf(utils.Output, "%s Could not deliver '%s' to user %s: %s\n",
+			utils.ErrorColor("❌"),
+			utils.InfoColor(fan.Name),
+			utils.UserColor(recipientId),
+			utils.ErrorColor(detail))
+	}
+
+	if !finished {
+		return
+	}
+	forgetFanOut(transferID)
+	fmt.Fprintf(utils.Output, "%s '%s' reached %d of %d users\n",
+		utils.InfoColor("📨"),
+		utils.InfoColor(fan.Name),
+		delivered,
+		total)
+}
+
+// ListFanOuts returns the fan-outs with deliveries still going on
+func ListFanOuts() []*FanOut {
+	fanOutsMutex.Lock()
+	fans := make([]*FanOut, 0, len(activeFanOuts))
+	for _, fan := range activeFanOuts {
+		fans = append(fans, fan)
+	}
+	fanOutsMutex.Unlock()
+
+	sort.Slice(fans, func(i, j int) bool {
+		a, _ := strconv.Atoi(fans[i].ID)
+		b, _ := strconv.Atoi(fans[j].ID)
+		return a < b
+	})
+	return fans
+}
+
+// describe lists each recipient of the fan-out with its progress, for
+// /transfers
+func (fan *FanOut) describe() []string {
+	fan.mutex.Lock()
+	defer fan.mutex.Unlock()
+
+	ids := make([]string, 0, len(fan.Recipients))
+	for id := range fan.Recipients {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	lines := make([]string, 0, len(ids))
+	for _, id := range ids {
+		recipient := fan.Recipients[id]
+		line := fmt.Sprintf("%s: %s", utils.UserColor(id), recipient.Status)
+		switch {
+		case recipient.Status == "accepted" && fan.Size > 0:
+			line += fmt.Sprintf(" (%.1f%%)", float64(recipient.Bytes)/float64(fan.Size)*100)
+		case recipient.Detail != "" && recipient.Status != "delivered":
+			line += " (" + recipient.Detail + ")"
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
@@ -2,29 +2,246 @@ package connection
 
 import (
 	"drizlink/helper"
+	"drizlink/protocol"
 	"drizlink/utils"
 	"fmt"
 	"io"
-	"net"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
-
 )
 
-func HandleSendFile(conn net.Conn, recipientId, filePath string) {
-	file, err := os.Open(filePath)
+func HandleSendFile(conn *protocol.Conn, recipientId, filePath string) {
+	transfer, err := newFileTransfer(conn, recipientId, filePath)
 	if err != nil {
-		fmt.Println(utils.ErrorColor("❌ Error opening file:"), err)
+		fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Error opening file:"), err)
+		return
+	}
+
+	position := TransferQueue.Enqueue(transfer, func(transfer *Transfer) {
+		sendFile(conn, transfer)
+	})
+	if position > 0 {
+		fmt.Fprintf(utils.Output, "%s File '%s' queued for user %s (Transfer ID: %s, position %d)\n",
+			utils.InfoColor("⏳"),
+			utils.InfoColor(transfer.Name),
+			utils.UserColor(recipientId),
+			utils.CommandColor(transfer.ID),
+			position)
+	}
+}
+
+// HandleSendFiles handles /sendfile with several paths or glob patterns.
+// The matched files are sent as one transfer group with a combined progress
+// bar and a per-file report once every file has finished.
+func HandleSendFiles(conn *protocol.Conn, recipientId string, patterns []string) {
+	var paths []string
+	group := NewTransferGroup(recipientId)
+
+	for _, pattern := range patterns {
+		matches, err := helper.ExpandGlob(pattern)
+		if err != nil {
+			group.AddFailure(pattern, err)
+			continue
+		}
+		if len(matches) == 0 {
+			group.AddFailure(pattern, fmt.Errorf("no files match"))
+			continue
+		}
+		paths = append(paths, matches...)
+	}
+
+	// A single file needs no group
+	if len(paths) == 1 && len(patterns) == 1 {
+		HandleSendFile(conn, recipientId, paths[0])
+		return
+	}
+
+	seen := make(map[string]bool)
+	var transfers []*Transfer
+	for _, path := range paths {
+		if seen[path] {
+			continue
+		}
+		seen[path] = true
+
+		transfer, err := newFileTransfer(conn, recipientId, path)
+		if err != nil {
+			group.AddFailure(path, err)
+			continue
+		}
+		group.Add(transfer)
+		transfers = append(transfers, transfer)
+	}
+
+	if len(transfers) == 0 {
+		group.finish()
 		return
 	}
+
+	group.Start()
+	for _, transfer := range transfers {
+		TransferQueue.Enqueue(transfer, func(transfer *Transfer) {
+			err := sendFile(conn, transfer)
+			transfer.Group.Done(transfer, err)
+		})
+	}
+
+	fmt.Fprintf(utils.Output, "%s Queued %d files for user %s as group %s (%s)\n",
+		utils.InfoColor("⏳"),
+		len(transfers),
+		utils.UserColor(recipientId),
+		utils.CommandColor(group.ID),
+		formatSize(group.Size))
+}
+
+// SendPaths sends the files and folders matching patterns to recipientId
+// through the send queue and waits until every one of them has finished.
+// Folders can only go to a single user.
+func SendPaths(conn *protocol.Conn, recipientId string, patterns []string) error {
+	var transfers []*Transfer
+	var lastErr error
+	failed := 0
+	seen := make(map[string]bool)
+	for _, pattern := range patterns {
+		matches, err := helper.ExpandGlob(pattern)
+		if err == nil && len(matches) == 0 {
+			err = fmt.Errorf("no files match")
+		}
+		if err != nil {
+			fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Error sending "+pattern+":"), err)
+			lastErr = err
+			failed++
+			continue
+		}
+
+		for _, path := range matches {
+			if seen[path] {
+				continue
+			}
+			seen[path] = true
+
+			var transfer *Transfer
+			info, err := os.Stat(path)
+			if err == nil && info.IsDir() {
+				transfer, err = newFolderTransfer(conn, recipientId, path)
+			} else if err == nil {
+				transfer, err = newFileTransfer(conn, recipientId, path)
+			}
+			if err != nil {
+				fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Error sending "+path+":"), err)
+				lastErr = err
+				failed++
+				continue
+			}
+			transfers = append(transfers, transfer)
+		}
+	}
+
+	total := failed + len(transfers)
+	var wg sync.WaitGroup
+	var failedMutex sync.Mutex
+	for _, transfer := range transfers {
+		wg.Add(1)
+		TransferQueue.Enqueue(transfer, func(transfer *Transfer) {
+			defer wg.Done()
+			if err := runSend(conn, transfer); err != nil {
+				failedMutex.Lock()
+				lastErr = err
+				failed++
+				failedMutex.Unlock()
+			}
+		})
+	}
+	wg.Wait()
+
+	if total == 1 {
+		return lastErr
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d paths could not be sent", failed, total)
+	}
+	return nil
+}
+
+// SendFile sends the file at filePath to recipientId and waits until it has
+// been delivered
+func SendFile(conn *protocol.Conn, recipientId, filePath string) error {
+	transfer, err := newFileTransfer(conn, recipientId, filePath)
+	if err != nil {
+		return err
+	}
+	return sendQueued(conn, transfer)
+}
+
+// sendQueued queues transfer and waits for its outcome
+func sendQueued(conn *protocol.Conn, transfer *Transfer) error {
+	done := make(chan error, 1)
+	TransferQueue.Enqueue(transfer, func(transfer *Transfer) {
+		done <- runSend(conn, transfer)
+	})
+	return <-done
+}
+
+// runSend sends transfer, whether it holds a file or a folder
+func runSend(conn *protocol.Conn, transfer *Transfer) error {
+	if transfer.Type == FolderTransfer {
+		return sendFolder(conn, transfer)
+	}
+	return sendFile(conn, transfer)
+}
+
+// newFileTransfer validates filePath and builds the transfer that will send it
+func newFileTransfer(conn *protocol.Conn, recipientId, filePath string) (*Transfer, error) {
+	fileInfo, err := os.Stat(filePath)
+	if err != nil {
+		return nil, err
+	}
+	if fileInfo.IsDir() {
+		return nil, fmt.Errorf("%s is a folder, use /sendfolder", filePath)
+	}
+
+	return &Transfer{
+		ID:         GenerateTransferID(),
+		Type:       FileTransfer,
+		Name:       fileInfo.Name(),
+		Size:       fileInfo.Size(),
+		Direction:  "send",
+		Recipient:  recipientId,
+		Path:       filePath,
+		StartTime:  time.Now(),
+		Connection: conn,
+		Priority:   NormalPriority,
+	}, nil
+}
+
+// sendFile performs a queued file transfer once the scheduler starts it
+func sendFile(conn *protocol.Conn, transfer *Transfer) error {
+	transferID := transfer.ID
+	filePath := transfer.Path
+
+	if transferCancelled(transfer) {
+		UpdateTransferStatus(transferID, Failed)
+		RemoveTransfer(transferID)
+		return errCancelled
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Error opening file:"), err)
+		RemoveTransfer(transferID)
+		return err
+	}
 	defer file.Close()
 
 	fileInfo, err := file.Stat()
 	if err != nil {
-		fmt.Println(utils.ErrorColor("❌ Error getting file info:"), err)
-		return
+		fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Error getting file info:"), err)
+		RemoveTransfer(transferID)
+		return err
 	}
 
 	fileSize := fileInfo.Size()
@@ -33,205 +250,400 @@ func HandleSendFile(conn net.Conn, recipientId, filePath string) {
 	// Calculate checksum of file
 	checksum, err := helper.CalculateFileChecksum(filePath)
 	if err != nil {
-		fmt.Println(utils.ErrorColor("❌ Error calculating checksum:"), err)
-		return
+		fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Error calculating checksum:"), err)
+		RemoveTransfer(transferID)
+		return err
 	}
 
-	transferID := GenerateTransferID()
-	fmt.Printf("%s Sending file '%s' to user %s (Transfer ID: %s)...\n",
+	fmt.Fprintf(utils.Output, "%s Sending file '%s' to user %s (Transfer ID: %s)...\n",
 		utils.InfoColor("📤"),
 		utils.InfoColor(fileName),
-		utils.UserColor(recipientId),
+		utils.UserColor(transfer.Recipient),
 		utils.CommandColor(transferID))
 
 	// Send file request with file size, checksum, and transfer ID
-	_, err = conn.Write([]byte(fmt.Sprintf("/FILE_REQUEST %s %s %d %s %s\n",
-		recipientId, fileName, fileSize, checksum, transferID)))
+	replies := expectReply(transfer.Recipient, transferID)
+	defer cancelReply(transfer.Recipient, transferID)
+	signatures := expectSignatures(transfer.Recipient, transferID)
+	defer cancelSignatures(transfer.Recipient, transferID)
+	request := protocol.Format("/FILE_REQUEST",
+		transfer.Recipient, fileName, strconv.FormatInt(fileSize, 10), checksum, transferID)
+	if ref := transfer.Sync; ref != nil {
+		request = protocol.Format("/SYNC_FILE", transfer.Recipient, ref.ID, ref.Path,
+			strconv.FormatInt(fileSize, 10), checksum, transferID, syncMode(ref.Conflict))
+	}
+	fanOut := isFanOutTarget(transfer.Recipient)
+	if fanOut {
+		// The server takes the upload and delivers it to every recipient
+		request = protocol.Format("/FANOUT_REQUEST",
+			transfer.Recipient, fileName, strconv.FormatInt(fileSize, 10), checksum, transferID)
+		transfer.Size = fileSize
+		trackFanOut(transfer)
+	}
+	err = conn.WriteLine(request)
 	if err != nil {
-		fmt.Println(utils.ErrorColor("❌ Error sending file request:"), err)
-		return
+		fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Error sending file request:"), err)
+		RemoveTransfer(transferID)
+		return err
 	}
 
-	// Create progress bar with transfer ID
-	bar := utils.CreateProgressBar(fileSize, "📤 Sending file")
-	bar.SetTransferId(transferID)
-
-	transfer := &Transfer{
-		ID:            transferID,
-		Type:          FileTransfer,
-		Name:          fileName,
-		Size:          fileSize,
-		BytesComplete: 0,
-		Status:        Active,
-		Direction:     "send",
-		Recipient:     recipientId,
-		Path:          filePath,
-		Checksum:      checksum,
-		StartTime:     time.Now(),
-		File:          file,
-		Connection:    conn,
-		ProgressBar:   bar,
+	// Wait for the recipient to decide where the file goes, or to decline it
+	reply, err := awaitReply(transfer.Recipient, transferID, replies)
+	if err != nil {
+		UpdateTransferStatus(transferID, Failed)
+		fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Error sending file:"), err)
+		RemoveTransfer(transferID)
+		return err
+	}
+	if !reply.Accepted {
+		forgetFanOut(transferID)
+		markDeclined(transfer)
+		UpdateTransferStatus(transferID, Failed)
+		fmt.Fprintf(utils.Output, "%s User %s declined '%s': %s\n",
+			utils.WarningColor("⏭"),
+			utils.UserColor(transfer.Recipient),
+			utils.InfoColor(fileName),
+			utils.WarningColor(reply.Reason))
+		RemoveTransfer(transferID)
+		return fmt.Errorf("declined by recipient: %s", reply.Reason)
 	}
+	transfer.SavePath = reply.Path
 
-	RegisterTransfer(transfer)
+	// Grouped transfers report to the group's combined bar instead
+	var bar *utils.ProgressBar
+	if transfer.Group == nil {
+		bar = utils.CreateProgressBar(fileSize, "📤 Sending file")
+		bar.SetTransferId(transferID)
+	}
 
-	reader := NewCheckpointedReader(file, transfer, 32768) // 32KB chunks
+	transfer.PauseLock.Lock()
+	transfer.Size = fileSize
+	transfer.Checksum = checksum
+	transfer.StartTime = time.Now()
+	transfer.File = file
+	transfer.ProgressBar = bar
+	transfer.PauseLock.Unlock()
+
+	// The recipient may already hold part of the file from an interrupted attempt
+	if err := resumeSend(transfer, file, reply.Offset); err != nil {
+		abortSend(conn, transfer, err)
+		UpdateTransferStatus(transferID, Failed)
+		fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Error resuming file:"), err)
+		RemoveTransfer(transferID)
+		return err
+	}
 
-	n, err := io.CopyN(conn, io.TeeReader(reader, bar), fileSize)
+	n, err := sendFileData(conn, transfer, file, reply, signatures)
 
 	if err != nil {
+		abortSend(conn, transfer, err)
 		UpdateTransferStatus(transferID, Failed)
-		fmt.Println(utils.ErrorColor("\n❌ Error sending file:"), err)
+		fmt.Fprintln(utils.Output, utils.ErrorColor("\n❌ Error sending file:"), err)
 		RemoveTransfer(transferID)
-		return
+		return err
 	}
 
 	if n != fileSize {
+		err = fmt.Errorf("sent %d bytes, expected %d bytes", n, fileSize)
+		abortSend(conn, transfer, err)
 		UpdateTransferStatus(transferID, Failed)
-		fmt.Println(utils.ErrorColor("\n❌ Error: sent"), utils.ErrorColor(n),
+		fmt.Fprintln(utils.Output, utils.ErrorColor("\n❌ Error: sent"), utils.ErrorColor(n),
 			utils.ErrorColor("bytes, expected"), utils.ErrorColor(fileSize), utils.ErrorColor("bytes"))
 		RemoveTransfer(transferID)
-		return
+		return err
+	}
+
+	if err := awaitReceipt(transfer, replies); err != nil {
+		if _, again := err.(errSendAgain); again {
+			restartSend(transfer)
+			return sendFile(conn, transfer)
+		}
+		UpdateTransferStatus(transferID, Failed)
+		fmt.Fprintf(utils.Output, "%s Delivery of '%s' failed: %v\n", utils.ErrorColor("❌"), utils.InfoColor(fileName), err)
+		RemoveTransfer(transferID)
+		return err
 	}
 
 	// Mark transfer as completed
 	UpdateTransferStatus(transferID, Completed)
 
-	fmt.Printf("%s File '%s' sent successfully!\n",
-		utils.SuccessColor("\n✅"),
+	if fanOut {
+		// Each recipient's delivery is reported by HandleFanOutStatus
+		fmt.Fprintf(utils.Output, "%s File '%s' uploaded, the server delivers it to each user\n",
+			utils.SuccessColor("✅"),
+			utils.SuccessColor(fileName))
+		fmt.Fprintln(utils.Output, utils.InfoColor("  MD5 Checksum:"), utils.InfoColor(checksum))
+		RemoveTransfer(transferID)
+		return nil
+	}
+
+	fmt.Fprintf(utils.Output, "%s File '%s' delivered successfully!\n",
+		utils.SuccessColor("✅"),
 		utils.SuccessColor(fileName))
-	fmt.Println(utils.InfoColor("  MD5 Checksum:"), utils.InfoColor(checksum))
+	fmt.Fprintln(utils.Output, utils.InfoColor("  MD5 Checksum:"), utils.InfoColor(checksum))
+	fmt.Fprintln(utils.Output, utils.InfoColor("  Saved by recipient to:"), utils.InfoColor(transfer.SavePath))
 
 	// Clean up the transfer
 	RemoveTransfer(transferID)
+	return nil
 }
 
-func HandleFileTransfer(conn net.Conn, recipientId, fileName string, fileSize int64, storeFilePath string) {
-	// Get checksum and transfer ID from the split content
-	parts := strings.SplitN(fileName, "|", 3)
-	checksum := ""
-	transferID := ""
-
-	if len(parts) >= 2 {
-		fileName = parts[0]
-		checksum = parts[1]
-		fmt.Println(utils.InfoColor("📋 Original checksum:"), utils.InfoColor(checksum))
+func HandleFileTransfer(conn *protocol.Conn, senderId, fileName string, fileSize int64, checksum, remoteID, storeFilePath string) {
+	fileName, err := helper.SanitizeFileName(fileName)
+	if err != nil {
+		fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Rejected incoming file:"), err)
+		return
+	}
+	if checksum != "" {
+		fmt.Fprintln(utils.Output, utils.InfoColor("📋 Original checksum:"), utils.InfoColor(checksum))
+	}
+	offerQueue.run(func() {
+		prepareFile(conn, senderId, fileName, fileSize, checksum, remoteID, storeFilePath)
+	})
+}
 
-		if len(parts) >= 3 {
-			transferID = parts[2]
-		} else {
-			transferID = GenerateTransferID()
-		}
-	} else {
-		transferID = GenerateTransferID()
+// prepareFile looks for what we already have of an offered file, a copy
+// with the same content or an older version to send a delta against, and
+// accepts it. It runs on offerQueue, so the block signatures of an older
+// version are computed before the answer without holding up the connection.
+func prepareFile(conn *protocol.Conn, senderId, fileName string, fileSize int64, checksum, remoteID, storeFilePath string) {
+	// A file with the same content in the store path makes the data unnecessary
+	if acceptDuplicate(conn, senderId, fileName, fileSize, checksum, remoteID, storeFilePath) {
+		return
 	}
 
-	fmt.Printf("%s Receiving file: %s (Size: %s, Transfer ID: %s)\n",
+	transferID := GenerateTransferID()
+
+	fmt.Fprintf(utils.Output, "%s Receiving file: %s (Size: %s, Transfer ID: %s)\n",
 		utils.InfoColor("📥"),
 		utils.InfoColor(fileName),
 		utils.InfoColor(fmt.Sprintf("%d bytes", fileSize)),
 		utils.CommandColor(transferID))
 
-	filePath := filepath.Join(storeFilePath, fileName)
-	file, err := os.Create(filePath)
+	// An older copy lets the sender skip unchanged blocks
+	base := openDeltaBase(filepath.Join(storeFilePath, fileName), fileSize)
+
+	filePath, err := resolveSavePath(storeFilePath, fileName, GetSettings().ConflictPolicy, false)
 	if err != nil {
-		fmt.Println(utils.ErrorColor("❌ Error creating file:"), err)
+		base.close()
+		fmt.Fprintf(utils.Output, "%s Skipped incoming file '%s': %v\n", utils.WarningColor("⏭"), utils.InfoColor(fileName), err)
+		declineTransfer(conn, senderId, remoteID, err.Error())
+		return
+	}
+
+	receiveFile(conn, transferID, senderId, fileName, fileSize, checksum, remoteID, filePath, base, nil)
+}
+
+// receiveFile accepts an incoming file that will be saved to filePath,
+// replacing anything there once verified. base, when not nil, is offered to
+// the sender for a delta transfer. ref is set for files of a /sync, whose
+// done callback learns the outcome.
+func receiveFile(conn *protocol.Conn, transferID, senderId, fileName string, fileSize int64, checksum, remoteID, filePath string, base *deltaBase, ref *syncFileRef) {
+	var done func(err error)
+	if ref != nil {
+		done = ref.done
+	}
+
+	// Data goes to a hidden partial file that is renamed once verified
+	file, offset, err := openPartial(filePath, partialMeta{
+		Name:     fileName,
+		Size:     fileSize,
+		Checksum: checksum,
+		Sender:   senderId,
+		Started:  time.Now(),
+	})
+	if err != nil {
+		base.close()
+		fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Error creating file:"), err)
+		declineTransfer(conn, senderId, remoteID, err.Error())
+		if done != nil {
+			done(err)
+		}
 		return
 	}
-	defer file.Close()
 
 	// Create progress bar with transfer ID
 	bar := utils.CreateProgressBar(fileSize, "📥 Receiving file")
 	bar.SetTransferId(transferID)
 
 	transfer := &Transfer{
-		ID:            transferID,
-		Type:          FileTransfer,
-		Name:          fileName,
-		Size:          fileSize,
-		BytesComplete: 0,
-		Status:        Active,
-		Direction:     "receive",
-		Recipient:     recipientId,
-		Path:          filePath,
-		Checksum:      checksum,
-		StartTime:     time.Now(),
-		File:          file,
-		Connection:    conn,
-		ProgressBar:   bar,
+		ID:          transferID,
+		Type:        FileTransfer,
+		Name:        fileName,
+		Size:        fileSize,
+		Status:      Active,
+		Direction:   "receive",
+		Recipient:   senderId,
+		RemoteID:    remoteID,
+		Path:        filePath,
+		Checksum:    checksum,
+		StartTime:   time.Now(),
+		File:        file,
+		Connection:  conn,
+		ProgressBar: bar,
+		Sync:        ref,
 	}
 
-	RegisterTransfer(transfer)
-
-	writer := NewCheckpointedWriter(file, transfer, 32768) // 32KB chunks
+	if offset > 0 {
+		fmt.Fprintln(utils.Output, utils.InfoColor("⏩ Resuming from"), utils.InfoColor(formatSize(offset)))
+		transfer.resumeFrom(offset)
+		// The partial data is newer than the older copy
+		base.close()
+		base = nil
+	}
 
-	// Write to file and update progress bar simultaneously
-	n, err := io.CopyN(writer, io.TeeReader(conn, bar), fileSize)
+	RegisterTransfer(transfer)
 
+	// The data arrives as /CHUNK or /RANGE frames; finish runs once it is complete
+	receiveTransfer(senderId, transfer, file, func(err error) {
+		base.close()
+		err = finishFileTransfer(transfer, err)
+		if done != nil {
+			done(err)
+		}
+	})
+
+	streams := offerStreams(conn, fileSize-offset)
+	if base != nil {
+		attachDeltaBase(senderId, transfer, base)
+		err = acceptDelta(conn, senderId, remoteID, filePath, streams, base)
+	} else if chunks := openChunkedReceive(fileSize, offset); chunks != nil {
+		attachChunkedReceive(senderId, transfer, chunks)
+		err = acceptChunked(conn, senderId, remoteID, filePath, streams)
+	} else {
+		err = acceptTransfer(conn, senderId, remoteID, filePath, offset, streams)
+	}
 	if err != nil {
-		UpdateTransferStatus(transferID, Failed)
-		fmt.Println(utils.ErrorColor("\n❌ Error receiving file:"), err)
-		RemoveTransfer(transferID)
-		return
+		fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Error accepting file:"), err)
 	}
+}
 
-	if n != fileSize {
-		UpdateTransferStatus(transferID, Failed)
-		fmt.Println(utils.ErrorColor("\n❌ Error: received"), utils.ErrorColor(n),
-			utils.ErrorColor("bytes, expected"), utils.ErrorColor(fileSize), utils.ErrorColor("bytes"))
-		RemoveTransfer(transferID)
-		return
+// sendFileData sends the rest of a file, as changes against the recipient's
+// older copy or as chunks missing from its chunk store when it offered one,
+// and as plain data otherwise
+func sendFileData(conn *protocol.Conn, transfer *Transfer, file *os.File, reply transferReply, signatures *signatureCollector) (int64, error) {
+	if reply.Chunked && reply.Offset == 0 && GetSettings().ChunkStore {
+		return sendChunked(conn, transfer, file, reply.Streams, signatures)
 	}
-
-	// Verify checksum if provided
-	if checksum != "" {
-		file.Close() // Close file before calculating checksum
-		receivedChecksum, err := helper.CalculateFileChecksum(filePath)
-		if err != nil {
-			fmt.Println(utils.ErrorColor("\n❌ Error calculating checksum:"), err)
-		} else {
-			fmt.Println(utils.InfoColor("\n📋 Calculated checksum:"), utils.InfoColor(receivedChecksum))
-
-			if helper.VerifyChecksum(checksum, receivedChecksum) {
-				fmt.Println(utils.SuccessColor("✅ Checksum verification successful! File integrity confirmed."))
-			} else {
-				fmt.Println(utils.ErrorColor("❌ Checksum verification failed! File may be corrupted."))
-			}
+	if reply.Blocks > 0 && reply.BlockSize > 0 && reply.Offset == 0 && GetSettings().Delta {
+		blocks, err := signatures.await(reply.Blocks)
+		if err == nil {
+			return sendDelta(conn, transfer, file, reply.BlockSize, blocks)
 		}
+		fmt.Fprintln(utils.Output, utils.WarningColor("⚠ Sending the whole file:"), err)
+	}
+	return sendData(conn, transfer, file, reply.Streams)
+}
+
+// finishFileTransfer verifies and reports a received file once its data has
+// fully arrived or the transfer was aborted. It returns why the file could
+// not be saved, if it could not.
+func finishFileTransfer(transfer *Transfer, err error) error {
+	transferID := transfer.ID
+	filePath := transfer.Path
+
+	var receivedChecksum string
+	if err == nil {
+		receivedChecksum, err = verifyReceived(transfer, partialPath(filePath))
+	}
+	if err == nil {
+		err = commitPartial(transfer.File, filePath)
+	}
+	if err != nil {
+		UpdateTransferStatus(transferID, Failed)
+		fmt.Fprintln(utils.Output, utils.ErrorColor("\n❌ Error receiving file:"), err)
+		handleReceiveError(transfer, filePath, err)
+		RemoveTransfer(transferID)
+		return err
 	}
+	clearReceiveAttempts(transfer)
+	indexReceived(filePath, receivedChecksum)
+	storeReceivedChunks(filePath, transfer.Size)
+	sendReceipt(transfer, filePath, receivedChecksum)
 
 	// Mark transfer as completed
 	UpdateTransferStatus(transferID, Completed)
 
-	fmt.Printf("%s File '%s' received successfully!\n",
+	fmt.Fprintf(utils.Output, "%s File '%s' received successfully!\n",
 		utils.SuccessColor("✅"),
-		utils.SuccessColor(fileName))
-	fmt.Println(utils.InfoColor("📂 Saved to:"), utils.InfoColor(filePath))
+		utils.SuccessColor(transfer.Name))
+	fmt.Fprintln(utils.Output, utils.InfoColor("📂 Saved to:"), utils.InfoColor(filePath))
 
 	// Clean up the transfer
 	RemoveTransfer(transferID)
+	return nil
+}
+
+// verifyReceived checks the size and, when provided, the checksum of the
+// data received for transfer at path. It returns the checksum of the data.
+func verifyReceived(transfer *Transfer, path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if info.Size() != transfer.Size {
+		return "", corruptData("received %d bytes, expected %d bytes", info.Size(), transfer.Size)
+	}
+
+	receivedChecksum, err := helper.CalculateFileChecksum(path)
+	if err != nil {
+		return "", fmt.Errorf("error calculating checksum: %v", err)
+	}
+	fmt.Fprintln(utils.Output, utils.InfoColor("\n📋 Calculated checksum:"), utils.InfoColor(receivedChecksum))
+
+	if transfer.Checksum == "" {
+		return receivedChecksum, nil
+	}
+	if !helper.VerifyChecksum(transfer.Checksum, receivedChecksum) {
+		fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Checksum verification failed! Data is corrupted."))
+		return "", errChecksumMismatch
+	}
+	fmt.Fprintln(utils.Output, utils.SuccessColor("✅ Checksum verification successful! Integrity confirmed."))
+	return receivedChecksum, nil
 }
 
-func HandleDownloadRequest(conn net.Conn, recipientId, filePath string) {
-	_, err := conn.Write([]byte(fmt.Sprintf("/DOWNLOAD_REQUEST %s %s\n", recipientId, filePath)))
+// resumeSend skips the offset bytes the recipient already has
+func resumeSend(transfer *Transfer, file *os.File, offset int64) error {
+	if offset == 0 {
+		return nil
+	}
+	if offset > transfer.Size {
+		return fmt.Errorf("recipient has %d bytes of a %d byte transfer", offset, transfer.Size)
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	if offset == transfer.Size {
+		fmt.Fprintln(utils.Output, utils.SuccessColor("♻ Recipient already has this file, nothing to send"))
+	} else {
+		fmt.Fprintln(utils.Output, utils.InfoColor("⏩ Recipient already has"), utils.InfoColor(formatSize(offset)), utils.InfoColor("- resuming"))
+	}
+	transfer.resumeFrom(offset)
+	return nil
+}
+
+func HandleDownloadRequest(conn *protocol.Conn, recipientId, filePath string) {
+	err := conn.WriteLine(protocol.Format("/DOWNLOAD_REQUEST", recipientId, filePath))
 	if err != nil {
-		fmt.Println("Error sending file request:", err)
+		fmt.Fprintln(utils.Output, "Error sending file request:", err)
 		return
 	}
-	fmt.Println("File download request sent successfully")
+	fmt.Fprintln(utils.Output, "File download request sent successfully")
 }
 
-func HandleDownloadResponse(conn net.Conn, userId, filePath string) {
+func HandleDownloadResponse(conn *protocol.Conn, userId, filePath string) {
 	cleanPath := filepath.Clean(strings.TrimSpace(filePath))
 	absPath, err := filepath.Abs(cleanPath)
 	if err != nil {
-		fmt.Printf("Error resolving absolute path: %v\n", err)
+		fmt.Fprintf(utils.Output, "Error resolving absolute path: %v\n", err)
+		refuseDownload(conn, userId, filePath, err)
 		return
 	}
 
 	fileInfo, err := os.Stat(absPath)
 	if err != nil {
-		fmt.Println("error in stat file", err)
+		fmt.Fprintln(utils.Output, "error in stat file", err)
+		refuseDownload(conn, userId, filePath, err)
 		return
 	}
 	if !fileInfo.IsDir() {
@@ -240,3 +652,10 @@ func HandleDownloadResponse(conn net.Conn, userId, filePath string) {
 		HandleSendFolder(conn, userId, absPath)
 	}
 }
+
+// refuseDownload tells the requester why filePath cannot be sent
+func refuseDownload(conn *protocol.Conn, requesterId, filePath string, err error) {
+	if writeErr := conn.WriteLine(protocol.Format("/DOWNLOAD_FAILED", requesterId, filePath, err.Error())); writeErr != nil {
+		fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Error refusing download:"), writeErr)
+	}
+}
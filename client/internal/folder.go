@@ -2,41 +2,120 @@ package connection
 
 import (
 	"drizlink/helper"
+	"drizlink/protocol"
 	"drizlink/utils"
 	"fmt"
-	"io"
-	"net"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
-func HandleSendFolder(conn net.Conn, recipientId, folderPath string) {
-	fmt.Println(utils.InfoColor("📦 Preparing folder for transfer..."))
+func HandleSendFolder(conn *protocol.Conn, recipientId, folderPath string) {
+	transfer, err := newFolderTransfer(conn, recipientId, folderPath)
+	if err != nil {
+		fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Error sending folder:"), err)
+		return
+	}
+
+	position := TransferQueue.Enqueue(transfer, func(transfer *Transfer) {
+		sendFolder(conn, transfer)
+	})
+	if position > 0 {
+		fmt.Fprintf(utils.Output, "%s Folder '%s' queued for user %s (Transfer ID: %s, position %d)\n",
+			utils.InfoColor("⏳"),
+			utils.InfoColor(transfer.Name),
+			utils.UserColor(recipientId),
+			utils.CommandColor(transfer.ID),
+			position)
+	}
+}
+
+// SendFolder sends the folder at folderPath to recipientId and waits until
+// it has been delivered
+func SendFolder(conn *protocol.Conn, recipientId, folderPath string) error {
+	transfer, err := newFolderTransfer(conn, recipientId, folderPath)
+	if err != nil {
+		return err
+	}
+	return sendQueued(conn, transfer)
+}
+
+// newFolderTransfer validates folderPath and builds the transfer that will
+// send it
+func newFolderTransfer(conn *protocol.Conn, recipientId, folderPath string) (*Transfer, error) {
+	if isFanOutTarget(recipientId) {
+		return nil, fmt.Errorf("folders can only be sent to one user at a time")
+	}
+	folderInfo, err := os.Stat(folderPath)
+	if err != nil {
+		return nil, err
+	}
+	if !folderInfo.IsDir() {
+		return nil, fmt.Errorf("%s is not a folder, use /sendfile", folderPath)
+	}
+
+	// The zip size is only known once the transfer starts; show the raw size meanwhile
+	folderSize, err := helper.GetFolderSize(folderPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Transfer{
+		ID:         GenerateTransferID(),
+		Type:       FolderTransfer,
+		Name:       filepath.Base(folderPath),
+		Size:       folderSize,
+		Direction:  "send",
+		Recipient:  recipientId,
+		Path:       folderPath,
+		StartTime:  time.Now(),
+		Connection: conn,
+		Priority:   NormalPriority,
+	}, nil
+}
+
+// sendFolder performs a queued folder transfer once the scheduler starts it
+func sendFolder(conn *protocol.Conn, transfer *Transfer) error {
+	transferID := transfer.ID
+	folderPath := transfer.Path
+	recipientId := transfer.Recipient
+
+	if transferCancelled(transfer) {
+		UpdateTransferStatus(transferID, Failed)
+		RemoveTransfer(transferID)
+		return errCancelled
+	}
+
+	fmt.Fprintln(utils.Output, utils.InfoColor("📦 Preparing folder for transfer..."))
 
 	//Create a temporary zip file
 	tempZipPath := folderPath + ".zip"
 	err := helper.CreateZipFromFolder(folderPath, tempZipPath)
 	if err != nil {
-		fmt.Println(utils.ErrorColor("❌ Error creating zip file:"), err)
-		return
+		fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Error creating zip file:"), err)
+		RemoveTransfer(transferID)
+		return err
 	}
 	defer os.Remove(tempZipPath) //clean up temporary zip file
 
 	//open zip file
 	zipFile, err := os.Open(tempZipPath)
 	if err != nil {
-		fmt.Println(utils.ErrorColor("❌ Error opening temp zip file:"), err)
-		return
+		fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Error opening temp zip file:"), err)
+		RemoveTransfer(transferID)
+		return err
 	}
 	defer zipFile.Close()
 
 	//Get zip file info
 	zipInfo, err := zipFile.Stat()
 	if err != nil {
-		fmt.Println(utils.ErrorColor("❌ Error getting zip file info:"), err)
-		return
+		fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Error getting zip file info:"), err)
+		RemoveTransfer(transferID)
+		return err
 	}
 
 	zipSize := zipInfo.Size()
@@ -45,109 +124,149 @@ func HandleSendFolder(conn net.Conn, recipientId, folderPath string) {
 	// Calculate checksum of the zip file
 	checksum, err := helper.CalculateFileChecksum(tempZipPath)
 	if err != nil {
-		fmt.Println(utils.ErrorColor("❌ Error calculating checksum:"), err)
-		return
+		fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Error calculating checksum:"), err)
+		RemoveTransfer(transferID)
+		return err
 	}
 
-	transferID := GenerateTransferID()
-
-	fmt.Printf("%s Sending folder '%s' to user %s (Transfer ID: %s)...\n",
+	fmt.Fprintf(utils.Output, "%s Sending folder '%s' to user %s (Transfer ID: %s)...\n",
 		utils.InfoColor("📤"),
 		utils.InfoColor(folderName),
 		utils.UserColor(recipientId),
 		utils.CommandColor(transferID))
 
 	// Send folder request with zip size, checksum and transfer ID
-	_, err = conn.Write([]byte(fmt.Sprintf("/FOLDER_REQUEST %s %s %d %s %s\n",
-		recipientId, folderName, zipSize, checksum, transferID)))
+	replies := expectReply(recipientId, transferID)
+	defer cancelReply(recipientId, transferID)
+	err = conn.WriteLine(protocol.Format("/FOLDER_REQUEST",
+		recipientId, folderName, strconv.FormatInt(zipSize, 10), checksum, transferID))
 	if err != nil {
-		fmt.Println(utils.ErrorColor("❌ Error sending folder request:"), err)
-		return
+		fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Error sending folder request:"), err)
+		RemoveTransfer(transferID)
+		return err
 	}
 
+	// Wait for the recipient to decide where the folder goes, or to decline it
+	reply, err := awaitReply(recipientId, transferID, replies)
+	if err != nil {
+		UpdateTransferStatus(transferID, Failed)
+		fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Error sending folder:"), err)
+		RemoveTransfer(transferID)
+		return err
+	}
+	if !reply.Accepted {
+		markDeclined(transfer)
+		UpdateTransferStatus(transferID, Failed)
+		fmt.Fprintf(utils.Output, "%s User %s declined folder '%s': %s\n",
+			utils.WarningColor("⏭"),
+			utils.UserColor(recipientId),
+			utils.InfoColor(folderName),
+			utils.WarningColor(reply.Reason))
+		RemoveTransfer(transferID)
+		return err
+	}
+	transfer.SavePath = reply.Path
+
 	// Create progress bar with transfer ID
 	bar := utils.CreateProgressBar(zipSize, "📤 Sending folder")
 	bar.SetTransferId(transferID)
 
-	// Create transfer record
-	transfer := &Transfer{
-		ID:            transferID,
-		Type:          FolderTransfer,
-		Name:          folderName,
-		Size:          zipSize,
-		BytesComplete: 0,
-		Status:        Active,
-		Direction:     "send",
-		Recipient:     recipientId,
-		Path:          folderPath,
-		Checksum:      checksum,
-		StartTime:     time.Now(),
-		File:          zipFile,
-		Connection:    conn,
-		ProgressBar:   bar,
-	}
-
-	// Register the transfer
-	RegisterTransfer(transfer)
-
-	checkpointedReader := NewCheckpointedReader(zipFile, transfer, 32768) // 32KB chunks
+	transfer.PauseLock.Lock()
+	transfer.Size = zipSize
+	transfer.Checksum = checksum
+	transfer.StartTime = time.Now()
+	transfer.File = zipFile
+	transfer.ProgressBar = bar
+	transfer.PauseLock.Unlock()
+
+	// The recipient may already hold part of the zip from an interrupted attempt
+	if err := resumeSend(transfer, zipFile, reply.Offset); err != nil {
+		abortSend(conn, transfer, err)
+		UpdateTransferStatus(transferID, Failed)
+		fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Error resuming folder:"), err)
+		RemoveTransfer(transferID)
+		return err
+	}
 
-	// Stream zip file data using the checkpointed reader with progress bar
-	reader := io.TeeReader(checkpointedReader, bar)
-	n, err := io.CopyN(conn, reader, zipSize)
+	// Stream zip file data with progress bar
+	n, err := sendData(conn, transfer, zipFile, reply.Streams)
 
 	if err != nil {
+		abortSend(conn, transfer, err)
 		UpdateTransferStatus(transferID, Failed)
-		fmt.Println(utils.ErrorColor("\n❌ Error sending folder:"), err)
+		fmt.Fprintln(utils.Output, utils.ErrorColor("\n❌ Error sending folder:"), err)
 		RemoveTransfer(transferID)
-		return
+		return err
 	}
 	if n != zipSize {
+		err = fmt.Errorf("sent %d bytes, expected %d bytes", n, zipSize)
+		abortSend(conn, transfer, err)
 		UpdateTransferStatus(transferID, Failed)
-		fmt.Println(utils.ErrorColor("\n❌ Error: sent"), utils.ErrorColor(n), utils.ErrorColor("bytes, expected"), utils.ErrorColor(zipSize), utils.ErrorColor("bytes"))
+		fmt.Fprintln(utils.Output, utils.ErrorColor("\n❌ Error: sent"), utils.ErrorColor(n), utils.ErrorColor("bytes, expected"), utils.ErrorColor(zipSize), utils.ErrorColor("bytes"))
 		RemoveTransfer(transferID)
-		return
+		return err
+	}
+
+	if err := awaitReceipt(transfer, replies); err != nil {
+		if _, again := err.(errSendAgain); again {
+			zipFile.Close()
+			os.Remove(tempZipPath)
+			restartSend(transfer)
+			return sendFolder(conn, transfer)
+		}
+		UpdateTransferStatus(transferID, Failed)
+		fmt.Fprintf(utils.Output, "%s Delivery of folder '%s' failed: %v\n", utils.ErrorColor("❌"), utils.InfoColor(folderName), err)
+		RemoveTransfer(transferID)
+		return err
 	}
 
 	UpdateTransferStatus(transferID, Completed)
 
-	fmt.Println(utils.SuccessColor("\n✅ Folder"), utils.SuccessColor(folderName), utils.SuccessColor("sent successfully!"))
-	fmt.Println(utils.InfoColor("  MD5 Checksum:"), utils.InfoColor(checksum))
+	fmt.Fprintln(utils.Output, utils.SuccessColor("✅ Folder"), utils.SuccessColor(folderName), utils.SuccessColor("delivered successfully!"))
+	fmt.Fprintln(utils.Output, utils.InfoColor("  MD5 Checksum:"), utils.InfoColor(checksum))
+	fmt.Fprintln(utils.Output, utils.InfoColor("  Saved by recipient to:"), utils.InfoColor(transfer.SavePath))
 
 	RemoveTransfer(transferID)
+	return nil
 }
 
-func HandleFolderTransfer(conn net.Conn, recipientId, folderName string, folderSize int64, storeFilePath string) {
-	// Extract checksum and transfer ID if present
-	checksum := ""
-	transferID := ""
-
-	parts := strings.SplitN(folderName, "|", 3)
-	if len(parts) >= 2 {
-		folderName = parts[0]
-		checksum = parts[1]
-		fmt.Println(utils.InfoColor("📋 Original checksum:"), utils.InfoColor(checksum))
-
-		if len(parts) >= 3 {
-			transferID = parts[2]
-		} else {
-			transferID = GenerateTransferID()
-		}
-	} else {
-		transferID = GenerateTransferID()
+func HandleFolderTransfer(conn *protocol.Conn, senderId, folderName string, folderSize int64, checksum, remoteID, storeFilePath string) {
+	folderName, err := helper.SanitizeFileName(folderName)
+	if err != nil {
+		fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Rejected incoming folder:"), err)
+		return
+	}
+	if checksum != "" {
+		fmt.Fprintln(utils.Output, utils.InfoColor("📋 Original checksum:"), utils.InfoColor(checksum))
 	}
 
-	fmt.Printf("%s Receiving folder: %s (Size: %s, Transfer ID: %s)\n",
+	transferID := GenerateTransferID()
+
+	fmt.Fprintf(utils.Output, "%s Receiving folder: %s (Size: %s, Transfer ID: %s)\n",
 		utils.InfoColor("📥"),
 		utils.InfoColor(folderName),
 		utils.InfoColor(fmt.Sprintf("%d bytes", folderSize)),
 		utils.CommandColor(transferID))
 
-	// Create temporary zip file to store received data
-	tempZipPath := filepath.Join(storeFilePath, folderName+".zip")
-	zipFile, err := os.Create(tempZipPath)
+	destPath, err := resolveSavePath(storeFilePath, folderName, GetSettings().ConflictPolicy, true)
 	if err != nil {
-		fmt.Println(utils.ErrorColor("❌ Error creating temporary zip file:"), err)
+		fmt.Fprintf(utils.Output, "%s Skipped incoming folder '%s': %v\n", utils.WarningColor("⏭"), utils.InfoColor(folderName), err)
+		declineTransfer(conn, senderId, remoteID, err.Error())
+		return
+	}
+
+	// The zip is received into a hidden partial file and only extracted once verified
+	zipPath := destPath + ".zip"
+	zipFile, offset, err := openPartial(zipPath, partialMeta{
+		Name:     folderName,
+		Size:     folderSize,
+		Checksum: checksum,
+		Sender:   senderId,
+		Started:  time.Now(),
+	})
+	if err != nil {
+		fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Error creating temporary zip file:"), err)
+		declineTransfer(conn, senderId, remoteID, err.Error())
 		return
 	}
 
@@ -157,98 +276,181 @@ func HandleFolderTransfer(conn net.Conn, recipientId, folderName string, folderS
 
 	// Create transfer record
 	transfer := &Transfer{
-		ID:            transferID,
-		Type:          FolderTransfer,
-		Name:          folderName,
-		Size:          folderSize,
-		BytesComplete: 0,
-		Status:        Active,
-		Direction:     "receive",
-		Recipient:     recipientId,
-		Path:          tempZipPath,
-		Checksum:      checksum,
-		StartTime:     time.Now(),
-		File:          zipFile,
-		Connection:    conn,
-		ProgressBar:   bar,
+		ID:          transferID,
+		Type:        FolderTransfer,
+		Name:        folderName,
+		Size:        folderSize,
+		Status:      Active,
+		Direction:   "receive",
+		Recipient:   senderId,
+		RemoteID:    remoteID,
+		Path:        zipPath,
+		SavePath:    destPath,
+		Checksum:    checksum,
+		StartTime:   time.Now(),
+		File:        zipFile,
+		Connection:  conn,
+		ProgressBar: bar,
+	}
+
+	if offset > 0 {
+		fmt.Fprintln(utils.Output, utils.InfoColor("⏩ Resuming from"), utils.InfoColor(formatSize(offset)))
+		transfer.resumeFrom(offset)
 	}
 
 	RegisterTransfer(transfer)
 
-	writer := NewCheckpointedWriter(zipFile, transfer, 32768) // 32KB chunks
+	// The zip data arrives as /CHUNK or /RANGE frames; extraction runs once it is complete
+	receiveTransfer(senderId, transfer, zipFile, func(err error) {
+		finishFolderTransfer(transfer, err)
+	})
 
-	// Receive the zip file data with progress
-	n, err := io.CopyN(writer, io.TeeReader(conn, bar), folderSize)
-	zipFile.Close()
+	streams := offerStreams(conn, folderSize-offset)
+	if err := acceptTransfer(conn, senderId, remoteID, destPath, offset, streams); err != nil {
+		fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Error accepting folder:"), err)
+	}
+}
 
+// finishFolderTransfer verifies and extracts a received folder once its data
+// has fully arrived or the transfer was aborted
+func finishFolderTransfer(transfer *Transfer, err error) {
+	transferID := transfer.ID
+	zipPath := transfer.Path
+	tempZipPath := partialPath(zipPath)
+	folderName := transfer.Name
+	destPath := transfer.SavePath
+
+	var receivedChecksum string
+	if err == nil {
+		receivedChecksum, err = verifyReceived(transfer, tempZipPath)
+	}
 	if err != nil {
 		UpdateTransferStatus(transferID, Failed)
-		os.Remove(tempZipPath)
-		fmt.Println(utils.ErrorColor("\n❌ Error receiving folder data:"), err)
+		fmt.Fprintln(utils.Output, utils.ErrorColor("\n❌ Error receiving folder data:"), err)
+		handleReceiveError(transfer, zipPath, err)
 		RemoveTransfer(transferID)
 		return
 	}
+	transfer.File.Close()
+	clearReceiveAttempts(transfer)
 
-	if n != folderSize {
+	fmt.Fprintln(utils.Output, utils.InfoColor("\n📦 Extracting folder..."))
+	// Extract next to the destination and move the folder into place in one step
+	err = extractFolder(tempZipPath, destPath)
+	discardPartial(nil, zipPath)
+	if err != nil {
 		UpdateTransferStatus(transferID, Failed)
-		os.Remove(tempZipPath)
-		fmt.Println(utils.ErrorColor("\n❌ Error: received"), utils.ErrorColor(n), utils.ErrorColor("bytes, expected"), utils.ErrorColor(folderSize), utils.ErrorColor("bytes"))
+		fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Error extracting folder:"), err)
+		reportReceiveFailure(transfer, err, false)
 		RemoveTransfer(transferID)
 		return
 	}
 
-	// Verify checksum if provided
-	if checksum != "" {
-		receivedChecksum, err := helper.CalculateFileChecksum(tempZipPath)
-		if err != nil {
-			fmt.Println(utils.ErrorColor("\n❌ Error calculating checksum:"), err)
-		} else {
-			fmt.Println(utils.InfoColor("\n📋 Calculated checksum:"), utils.InfoColor(receivedChecksum))
+	UpdateTransferStatus(transferID, Completed)
 
-			if helper.VerifyChecksum(checksum, receivedChecksum) {
-				fmt.Println(utils.SuccessColor("✅ Checksum verification successful! Folder integrity confirmed."))
-			} else {
-				fmt.Println(utils.ErrorColor("❌ Checksum verification failed! Folder may be corrupted."))
-			}
+	fmt.Fprintln(utils.Output, utils.SuccessColor("✅ Folder"), utils.SuccessColor(folderName), utils.SuccessColor("received and extracted successfully!"))
+	fmt.Fprintln(utils.Output, utils.InfoColor("📂 Saved to:"), utils.InfoColor(destPath))
+	sendReceipt(transfer, destPath, receivedChecksum)
+
+	RemoveTransfer(transferID)
+}
+
+// extractFolder unpacks zipPath into a hidden folder beside destPath, then
+// swaps it in for destPath. The save path was resolved on arrival, so
+// anything still at destPath is kept as an older version or overwritten, and
+// only once the extraction succeeded.
+func extractFolder(zipPath, destPath string) error {
+	extractPath := partialPath(destPath)
+	os.RemoveAll(extractPath)
+	if err := helper.ExtractZip(zipPath, extractPath); err != nil {
+		os.RemoveAll(extractPath)
+		return err
+	}
+	if err := keepExistingVersion(destPath, true); err != nil {
+		os.RemoveAll(extractPath)
+		return err
+	}
+
+	// The existing folder is renamed out of the way rather than removed
+	// first, so it is restored should the new one fail to move in
+	replacedPath := partialPath(destPath + ".old")
+	os.RemoveAll(replacedPath)
+	replaced := os.Rename(destPath, replacedPath) == nil
+	if err := os.Rename(extractPath, destPath); err != nil {
+		if replaced {
+			os.Rename(replacedPath, destPath)
 		}
+		os.RemoveAll(extractPath)
+		return err
 	}
+	if replaced {
+		os.RemoveAll(replacedPath)
+	}
+	syncDir(filepath.Dir(destPath))
+	return nil
+}
 
-	fmt.Println(utils.InfoColor("\n📦 Extracting folder..."))
-	//Extract the zip file
-	destPath := filepath.Join(storeFilePath, folderName)
-	err = helper.ExtractZip(tempZipPath, destPath)
+func HandleLookupRequest(conn *protocol.Conn, userId string) {
+	err := conn.WriteLine(protocol.Format("/LOOK", userId))
 	if err != nil {
-		UpdateTransferStatus(transferID, Failed)
-		os.Remove(tempZipPath)
-		fmt.Println(utils.ErrorColor("❌ Error extracting folder:"), err)
-		RemoveTransfer(transferID)
+		fmt.Fprintf(utils.Output, "Error sending look request: %v\n", err)
 		return
 	}
+}
 
-	UpdateTransferStatus(transferID, Completed)
+var (
+	// listingWaiters receive the next listing of a user ID instead of it
+	// being printed
+	listingWaiters      = make(map[string][]chan []ListingEntry)
+	listingWaitersMutex sync.Mutex
+)
 
-	// Clean up the temporary zip file
-	os.Remove(tempZipPath)
-	fmt.Println(utils.SuccessColor("✅ Folder"), utils.SuccessColor(folderName), utils.SuccessColor("received and extracted successfully!"))
-	fmt.Println(utils.InfoColor("📂 Saved to:"), utils.InfoColor(destPath))
+// Lookup asks userId for the contents of their store path and waits for the
+// answer. ReadLoop must be running to deliver it.
+func Lookup(conn *protocol.Conn, userId string) ([]ListingEntry, error) {
+	waiter := make(chan []ListingEntry, 1)
+	listingWaitersMutex.Lock()
+	listingWaiters[userId] = append(listingWaiters[userId], waiter)
+	listingWaitersMutex.Unlock()
 
-	RemoveTransfer(transferID)
+	if err := conn.WriteLine(protocol.Format("/LOOK", userId)); err != nil {
+		return nil, err
+	}
+	select {
+	case entries := <-waiter:
+		return entries, nil
+	case <-time.After(10 * time.Second):
+		return nil, fmt.Errorf("user %s did not send a listing", userId)
+	}
 }
 
-func HandleLookupRequest(conn net.Conn, userId string) {
-	_, err := conn.Write([]byte(fmt.Sprintf("/LOOK %s\n", userId)))
-	if err != nil {
-		fmt.Printf("Error sending look request: %v\n", err)
-		return
+// deliverListing hands the listing of userId to the oldest Lookup waiting
+// for it. It reports false when nobody is waiting.
+func deliverListing(userId string, entries []ListingEntry) bool {
+	listingWaitersMutex.Lock()
+	waiters := listingWaiters[userId]
+	if len(waiters) == 0 {
+		listingWaitersMutex.Unlock()
+		return false
 	}
+	waiter := waiters[0]
+	if len(waiters) == 1 {
+		delete(listingWaiters, userId)
+	} else {
+		listingWaiters[userId] = waiters[1:]
+	}
+	listingWaitersMutex.Unlock()
+
+	waiter <- entries
+	return true
 }
 
-func HandleLookupResponse(conn net.Conn, storeFilePath string, userId string) {
+func HandleLookupResponse(conn *protocol.Conn, storeFilePath string, requesterId string) {
 	// Clean and normalize the path
 	cleanPath := filepath.Clean(strings.TrimSpace(storeFilePath))
 	absPath, err := filepath.Abs(cleanPath)
 	if err != nil {
-		fmt.Printf("Error resolving absolute path: %v\n", err)
+		fmt.Fprintf(utils.Output, "Error resolving absolute path: %v\n", err)
 		return
 	}
 
@@ -256,70 +458,115 @@ func HandleLookupResponse(conn net.Conn, storeFilePath string, userId string) {
 	info, err := os.Stat(absPath)
 	if err != nil {
 		if os.IsNotExist(err) {
-			fmt.Printf("Store directory does not exist: %s\n", absPath)
+			fmt.Fprintf(utils.Output, "Store directory does not exist: %s\n", absPath)
 		} else {
-			fmt.Printf("Error accessing directory: %v\n", err)
+			fmt.Fprintf(utils.Output, "Error accessing directory: %v\n", err)
 		}
 		return
 	}
 
 	if !info.IsDir() {
-		fmt.Printf("Path is not a directory: %s\n", absPath)
+		fmt.Fprintf(utils.Output, "Path is not a directory: %s\n", absPath)
 		return
 	}
 
-	var folders []string
-	var files []string
+	var entries []ListingEntry
 
 	err = filepath.Walk(absPath, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
-			fmt.Printf("Error accessing path %s: %v\n", path, err)
+			fmt.Fprintf(utils.Output, "Error accessing path %s: %v\n", path, err)
 			return nil
 		}
 		if path == absPath {
 			return nil
 		}
+		// Unfinished receives are not offered to other users
+		if isPartialName(info.Name()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
 
-		// Get clean relative path
-		absolutePath := filepath.ToSlash(path)
-
+		entry := ListingEntry{Kind: "FILE", Path: filepath.ToSlash(path), Size: info.Size()}
 		if info.IsDir() {
-			folders = append(folders, fmt.Sprintf("[FOLDER] %s (Size: %d bytes)", absolutePath, info.Size()))
-		} else {
-			files = append(files, fmt.Sprintf("[FILE] %s (Size: %d bytes)", absolutePath, info.Size()))
+			entry.Kind = "FOLDER"
 		}
+		entries = append(entries, entry)
 		return nil
 	})
 
 	if err != nil {
-		fmt.Printf("Error walking directory: %v\n", err)
+		fmt.Fprintf(utils.Output, "Error walking directory: %v\n", err)
 		return
 	}
 
-	var allEntries []string
-	if len(folders) > 0 {
-		allEntries = append(allEntries, "=== FOLDERS ===")
-		allEntries = append(allEntries, folders...)
+	// Each entry travels as one quoted field holding its own fields
+	fields := []string{requesterId}
+	for _, entry := range entries {
+		fields = append(fields, entry.encode())
 	}
-	if len(files) > 0 {
-		if len(allEntries) > 0 {
-			allEntries = append(allEntries, "") // Add spacing between folders and files
-		}
-		allEntries = append(allEntries, "=== FILES ===")
-		allEntries = append(allEntries, files...)
+	err = conn.WriteLine(protocol.Format("/DIR_LISTING", fields...))
+	if err != nil {
+		fmt.Fprintf(utils.Output, "Error sending lookup response: %v\n", err)
 	}
 
-	if len(allEntries) == 0 {
-		allEntries = append(allEntries, "Directory is empty")
+	printListing(entries)
+}
+
+// ListingEntry is one file or folder in a directory listing
+type ListingEntry struct {
+	Kind string `json:"kind"` // "FILE" or "FOLDER"
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+func (e ListingEntry) encode() string {
+	return protocol.Join(e.Kind, e.Path, strconv.FormatInt(e.Size, 10))
+}
+
+// parseListingEntries decodes the entry fields of a /LOOK_RESPONSE,
+// skipping any that are malformed
+func parseListingEntries(fields []string) []ListingEntry {
+	var entries []ListingEntry
+	for _, field := range fields {
+		parts, err := protocol.SplitArgs(field)
+		if err != nil || len(parts) < 3 {
+			continue
+		}
+		size, _ := strconv.ParseInt(parts[2], 10, 64)
+		entries = append(entries, ListingEntry{Kind: parts[0], Path: parts[1], Size: size})
 	}
+	return entries
+}
 
-	response := fmt.Sprintf("LOOK_RESPONSE %s %s\n", userId, strings.Join(allEntries, "\n"))
-	_, err = conn.Write([]byte(response))
-	if err != nil {
-		fmt.Printf("Error sending lookup response: %v\n", err)
+// printListing shows folders first, then files
+func printListing(entries []ListingEntry) {
+	var folders, files []ListingEntry
+	for _, entry := range entries {
+		if entry.Kind == "FOLDER" {
+			folders = append(folders, entry)
+		} else {
+			files = append(files, entry)
+		}
 	}
 
-	for _, entry := range allEntries {
-		fmt.Println(entry)
+	if len(folders) > 0 {
+		fmt.Fprintln(utils.Output, utils.HeaderColor("=== FOLDERS ==="))
+		for _, entry := range folders {
+			fmt.Fprintln(utils.Output, utils.WarningColor("📁"), utils.InfoColor(fmt.Sprintf("[FOLDER] %s (Size: %d bytes)", entry.Path, entry.Size)))
+		}
+	}
+	if len(files) > 0 {
+		if len(folders) > 0 {
+			fmt.Fprintln(utils.Output)
+		}
+		fmt.Fprintln(utils.Output, utils.HeaderColor("=== FILES ==="))
+		for _, entry := range files {
+			fmt.Fprintln(utils.Output, utils.SuccessColor("📄"), utils.InfoColor(fmt.Sprintf("[FILE] %s (Size: %d bytes)", entry.Path, entry.Size)))
+		}
+	}
+	if len(entries) == 0 {
+		fmt.Fprintln(utils.Output, utils.InfoColor("Directory is empty"))
 	}
 }
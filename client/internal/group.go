@@ -0,0 +1,155 @@
+package connection
+
+import (
+	"drizlink/utils"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// groupResult records the outcome of one file in a transfer group
+type groupResult struct {
+	Name string
+	Err  error
+}
+
+// TransferGroup bundles the transfers started by one multi-file command so
+// they share a combined progress bar and a final per-file report
+type TransferGroup struct {
+	ID          string
+	Recipient   string
+	Size        int64
+	ProgressBar *utils.ProgressBar
+	Members     []*Transfer
+	results     []groupResult
+	pending     int
+	mutex       sync.Mutex
+}
+
+var (
+	activeGroups   = make(map[string]*TransferGroup)
+	groupsMutex    sync.Mutex
+	groupIDCounter = 1
+)
+
+// NewTransferGroup creates an empty group of transfers to recipientId
+func NewTransferGroup(recipientId string) *TransferGroup {
+	groupsMutex.Lock()
+	defer groupsMutex.Unlock()
+
+	group := &TransferGroup{
+		ID:        "g" + strconv.Itoa(groupIDCounter),
+		Recipient: recipientId,
+	}
+	groupIDCounter++
+	return group
+}
+
+// Add makes transfer a member of the group. All members must be added
+// before Start so the group cannot finish early.
+func (g *TransferGroup) Add(transfer *Transfer) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	transfer.Group = g
+	g.Members = append(g.Members, transfer)
+	g.Size += transfer.Size
+	g.pending++
+}
+
+// AddFailure records a file that could not be queued at all
+func (g *TransferGroup) AddFailure(name string, err error) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.results = append(g.results, groupResult{Name: name, Err: err})
+}
+
+// Start creates the combined progress bar and registers the group for
+// /transfers. The caller queues the members afterwards.
+func (g *TransferGroup) Start() {
+	g.mutex.Lock()
+	g.ProgressBar = utils.CreateProgressBar(g.Size, fmt.Sprintf("📤 Sending %d files", len(g.Members)))
+	g.ProgressBar.SetTransferId(g.ID)
+	g.mutex.Unlock()
+
+	groupsMutex.Lock()
+	activeGroups[g.ID] = g
+	groupsMutex.Unlock()
+}
+
+// Done records the outcome of a member and prints the group report once the
+// last member has finished
+func (g *TransferGroup) Done(transfer *Transfer, err error) {
+	g.mutex.Lock()
+	g.results = append(g.results, groupResult{Name: transfer.Name, Err: err})
+	g.pending--
+	finished := g.pending == 0
+	g.mutex.Unlock()
+
+	if finished {
+		g.finish()
+	}
+}
+
+// Progress returns the number of finished members and the bytes delivered so far
+func (g *TransferGroup) Progress() (int, int64) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	var bytes int64
+	for _, member := range g.Members {
+		bytes += member.Delivered()
+	}
+	return len(g.Members) - g.pending, bytes
+}
+
+// finish prints the per-file report and forgets the group
+func (g *TransferGroup) finish() {
+	groupsMutex.Lock()
+	delete(activeGroups, g.ID)
+	groupsMutex.Unlock()
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	sent, failed := 0, 0
+	for _, result := range g.results {
+		if result.Err == nil {
+			sent++
+		} else {
+			failed++
+		}
+	}
+
+	fmt.Fprintf(utils.Output, "\n%s Transfer group %s to user %s finished: %s sent, %s failed\n",
+		utils.HeaderColor("📦"),
+		utils.CommandColor(g.ID),
+		utils.UserColor(g.Recipient),
+		utils.SuccessColor(strconv.Itoa(sent)),
+		utils.ErrorColor(strconv.Itoa(failed)))
+	for _, result := range g.results {
+		if result.Err == nil {
+			fmt.Fprintln(utils.Output, utils.SuccessColor("  ✅"), utils.InfoColor(result.Name))
+		} else {
+			fmt.Fprintln(utils.Output, utils.ErrorColor("  ❌"), utils.InfoColor(result.Name+":"), utils.ErrorColor(result.Err))
+		}
+	}
+}
+
+// ListGroups returns the groups that still have unfinished members
+func ListGroups() []*TransferGroup {
+	groupsMutex.Lock()
+	defer groupsMutex.Unlock()
+
+	groups := make([]*TransferGroup, 0, len(activeGroups))
+	for _, group := range activeGroups {
+		groups = append(groups, group)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		a, _ := strconv.Atoi(groups[i].ID[1:])
+		b, _ := strconv.Atoi(groups[j].ID[1:])
+		return a < b
+	})
+	return groups
+}
@@ -0,0 +1,285 @@
+package connection
+
+import (
+	"drizlink/helper"
+	"drizlink/protocol"
+	"drizlink/utils"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DuplicatePolicy decides what happens when an incoming file has the same
+// content as a file already in the store path
+type DuplicatePolicy string
+
+const (
+	// CopyDuplicate copies the existing file to the new name
+	CopyDuplicate DuplicatePolicy = "copy"
+	// LinkDuplicate hard links the existing file to the new name, copying
+	// when a link is not possible
+	LinkDuplicate DuplicatePolicy = "link"
+	// KeepDuplicate creates nothing and reports the existing file
+	KeepDuplicate DuplicatePolicy = "keep"
+	// TransferDuplicate ignores existing copies and receives the data again
+	TransferDuplicate DuplicatePolicy = "off"
+)
+
+// ParseDuplicatePolicy converts a user supplied policy name
+func ParseDuplicatePolicy(value string) (DuplicatePolicy, error) {
+	switch policy := DuplicatePolicy(strings.ToLower(strings.TrimSpace(value))); policy {
+	case CopyDuplicate, LinkDuplicate, KeepDuplicate, TransferDuplicate:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown policy %q (use copy, link, keep or off)", value)
+	}
+}
+
+// indexEntry is the checksum of a file in the store path, valid while the
+// file keeps its size and modification time
+type indexEntry struct {
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"modTime"`
+	Checksum string    `json:"checksum"`
+}
+
+var (
+	// contentIndex maps absolute paths to their checksums. It is loaded on
+	// first use.
+	contentIndex      map[string]indexEntry
+	contentIndexMutex sync.Mutex
+)
+
+func contentIndexPath() (string, error) {
+	dir, err := ConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "content-index.json"), nil
+}
+
+// loadContentIndex reads the index unless it is already loaded. A missing
+// or damaged index starts out empty, it only saves hashing time. Callers
+// must hold contentIndexMutex.
+func loadContentIndex() {
+	if contentIndex != nil {
+		return
+	}
+	contentIndex = make(map[string]indexEntry)
+	path, err := contentIndexPath()
+	if err != nil {
+		return
+	}
+	if data, err := os.ReadFile(path); err == nil {
+		json.Unmarshal(data, &contentIndex)
+	}
+}
+
+// saveContentIndex writes the index, leaving out files that no longer
+// exist. Callers must hold contentIndexMutex.
+func saveContentIndex() {
+	for path := range contentIndex {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			delete(contentIndex, path)
+		}
+	}
+
+	path, err := contentIndexPath()
+	if err != nil {
+		return
+	}
+	data, err := json.Marshal(contentIndex)
+	if err != nil {
+		return
+	}
+	temp := path + ".tmp"
+	if err := os.WriteFile(temp, data, 0644); err != nil {
+		fmt.Fprintln(utils.Output, utils.WarningColor("⚠ Could not write content index:"), err)
+		return
+	}
+	if err := os.Rename(temp, path); err != nil {
+		fmt.Fprintln(utils.Output, utils.WarningColor("⚠ Could not write content index:"), err)
+	}
+}
+
+// indexedChecksum returns the checksum of the file at path, hashing it only
+// when the index has no current entry. It reports whether the index changed.
+// Callers must hold contentIndexMutex.
+func indexedChecksum(path string, info fs.FileInfo) (string, bool, error) {
+	entry, exists := contentIndex[path]
+	if exists && entry.Size == info.Size() && entry.ModTime.Equal(info.ModTime()) {
+		return entry.Checksum, false, nil
+	}
+	checksum, err := helper.CalculateFileChecksum(path)
+	if err != nil {
+		return "", false, err
+	}
+	contentIndex[path] = indexEntry{Size: info.Size(), ModTime: info.ModTime(), Checksum: checksum}
+	return checksum, true, nil
+}
+
+// findDuplicate returns a file below dir with size bytes and checksum, or ""
+// when there is none. Only files of the right size are hashed.
+func findDuplicate(dir string, size int64, checksum string) string {
+	root, err := filepath.Abs(dir)
+	if err != nil {
+		return ""
+	}
+
+	contentIndexMutex.Lock()
+	defer contentIndexMutex.Unlock()
+	loadContentIndex()
+
+	found, changed := "", false
+	filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.Type().IsRegular() || isPartialName(entry.Name()) {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil || info.Size() != size {
+			return nil
+		}
+		sum, updated, err := indexedChecksum(path, info)
+		changed = changed || updated
+		if err == nil && helper.VerifyChecksum(checksum, sum) {
+			found = path
+			return fs.SkipAll
+		}
+		return nil
+	})
+
+	if changed {
+		saveContentIndex()
+	}
+	return found
+}
+
+// indexReceived records the checksum of a file that was just received and
+// verified, so it never needs to be hashed for the index
+func indexReceived(path, checksum string) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+
+	contentIndexMutex.Lock()
+	defer contentIndexMutex.Unlock()
+	loadContentIndex()
+	contentIndex[path] = indexEntry{Size: info.Size(), ModTime: info.ModTime(), Checksum: checksum}
+	saveContentIndex()
+}
+
+// acceptDuplicate completes an incoming file at once when a file with the
+// same content is already in the store path. The sender is told the whole
+// file is present and gets a receipt without sending any data. It reports
+// whether the file was handled.
+func acceptDuplicate(conn *protocol.Conn, senderId, fileName string, fileSize int64, checksum, remoteID, storeFilePath string) bool {
+	settings := GetSettings()
+	if settings.DuplicatePolicy == TransferDuplicate || checksum == "" {
+		return false
+	}
+	source := findDuplicate(storeFilePath, fileSize, checksum)
+	if source == "" {
+		return false
+	}
+
+	savePath := source
+	samePlace, _ := filepath.Abs(filepath.Join(storeFilePath, fileName))
+	if settings.DuplicatePolicy != KeepDuplicate && source != samePlace {
+		dest, err := resolveSavePath(storeFilePath, fileName, settings.ConflictPolicy, false)
+		if err != nil {
+			// The regular path declines the transfer with the same reason
+			return false
+		}
+		if err := placeDuplicate(source, dest, settings.DuplicatePolicy); err != nil {
+			fmt.Fprintln(utils.Output, utils.WarningColor("⚠ Could not reuse the existing copy, receiving it instead:"), err)
+			return false
+		}
+		savePath = dest
+		indexReceived(dest, checksum)
+	}
+
+	transfer := &Transfer{
+		ID:         GenerateTransferID(),
+		Type:       FileTransfer,
+		Name:       fileName,
+		Size:       fileSize,
+		Status:     Active,
+		Direction:  "receive",
+		Recipient:  senderId,
+		RemoteID:   remoteID,
+		Path:       savePath,
+		Checksum:   checksum,
+		StartTime:  time.Now(),
+		Connection: conn,
+	}
+	transfer.BytesComplete.Store(fileSize)
+	RegisterTransfer(transfer)
+
+	if err := acceptTransfer(conn, senderId, remoteID, savePath, fileSize, 1); err != nil {
+		fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Error accepting file:"), err)
+		UpdateTransferStatus(transfer.ID, Failed)
+		RemoveTransfer(transfer.ID)
+		return true
+	}
+	sendReceipt(transfer, savePath, checksum)
+	UpdateTransferStatus(transfer.ID, Completed)
+
+	fmt.Fprintf(utils.Output, "%s Already have '%s' (same content as %s), nothing to transfer\n",
+		utils.SuccessColor("♻"),
+		utils.InfoColor(fileName),
+		utils.InfoColor(source))
+	fmt.Fprintln(utils.Output, utils.InfoColor("📂 Saved to:"), utils.InfoColor(savePath))
+
+	RemoveTransfer(transfer.ID)
+	return true
+}
+
+// placeDuplicate makes dest a copy of source, or a hard link to it with the
+// link policy. Like received data it appears under its final name complete.
+func placeDuplicate(source, dest string, policy DuplicatePolicy) error {
+	partial := partialPath(dest)
+	os.Remove(partial)
+	os.Remove(partialMetaPath(partial))
+
+	if policy == LinkDuplicate {
+		// Links only work within one file system, otherwise copy
+		if err := os.Link(source, partial); err == nil {
+			err = keepExistingVersion(dest, false)
+			if err == nil {
+				err = os.Rename(partial, dest)
+			}
+			if err != nil {
+				os.Remove(partial)
+				return err
+			}
+			syncDir(filepath.Dir(dest))
+			return nil
+		}
+	}
+
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(partial)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		discardPartial(out, dest)
+		return err
+	}
+	return commitPartial(out, dest)
+}
@@ -0,0 +1,334 @@
+package connection
+
+import (
+	"bufio"
+	"drizlink/utils"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// historyDisplayLimit is how many matching entries /history prints
+const historyDisplayLimit = 50
+
+// HistoryEntry records one finished transfer
+type HistoryEntry struct {
+	ID         string    `json:"id"`
+	Direction  string    `json:"direction"`
+	Type       string    `json:"type"`
+	Name       string    `json:"name"`
+	Peer       string    `json:"peer"`
+	Size       int64     `json:"size"`
+	Checksum   string    `json:"checksum,omitempty"`
+	Started    time.Time `json:"started"`
+	DurationMs int64     `json:"durationMs"`
+	Outcome    string    `json:"outcome"`
+	Path       string    `json:"path,omitempty"`
+}
+
+var historyMutex sync.Mutex
+
+func historyFilePath() (string, error) {
+	dir, err := ConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "history.jsonl"), nil
+}
+
+// recordHistory appends a finished transfer to the history file
+func recordHistory(transfer *Transfer) {
+	transfer.PauseLock.Lock()
+	entry := HistoryEntry{
+		ID:         transfer.ID,
+		Direction:  transfer.Direction,
+		Type:       strings.ToLower(formatTransferType(transfer.Type)),
+		Name:       transfer.Name,
+		Peer:       transfer.Recipient,
+		Size:       transfer.Size,
+		Checksum:   transfer.Checksum,
+		Started:    transfer.StartTime,
+		DurationMs: time.Since(transfer.StartTime).Milliseconds(),
+		Outcome:    "failed",
+		Path:       transfer.Path,
+	}
+	switch {
+	case transfer.Status == Completed:
+		entry.Outcome = "completed"
+	case transfer.IsDeclined:
+		entry.Outcome = "declined"
+	case transfer.IsCancelled, transfer.Status == Queued, transfer.Status == Paused:
+		entry.Outcome = "aborted"
+	}
+	transfer.PauseLock.Unlock()
+
+	// For sends the interesting location is where the recipient stored it
+	if entry.Direction == "send" {
+		entry.Path = transfer.SavePath
+	}
+
+	if err := appendHistory(entry); err != nil {
+		fmt.Fprintln(utils.Output, utils.WarningColor("⚠ Could not record transfer history:"), err)
+	}
+}
+
+func appendHistory(entry HistoryEntry) error {
+	path, err := historyFilePath()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	historyMutex.Lock()
+	defer historyMutex.Unlock()
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// LoadHistory reads every recorded transfer, oldest first. Lines that cannot
+// be parsed are skipped so a damaged line does not hide the rest.
+func LoadHistory() ([]HistoryEntry, error) {
+	path, err := historyFilePath()
+	if err != nil {
+		return nil, err
+	}
+
+	historyMutex.Lock()
+	defer historyMutex.Unlock()
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []HistoryEntry
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry HistoryEntry
+		if json.Unmarshal(scanner.Bytes(), &entry) == nil {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// matches reports whether entry satisfies every filter term. A term of the
+// form key:value compares one field (direction, type, name, peer, outcome,
+// path), any other term is searched for in all of them.
+func (entry HistoryEntry) matches(terms []string) bool {
+	fields := map[string]string{
+		"direction": entry.Direction,
+		"type":      entry.Type,
+		"name":      entry.Name,
+		"peer":      entry.Peer,
+		"outcome":   entry.Outcome,
+		"path":      entry.Path,
+	}
+
+	for _, term := range terms {
+		term = strings.ToLower(term)
+		if key, value, found := strings.Cut(term, ":"); found {
+			if field, known := fields[key]; known {
+				if !strings.Contains(strings.ToLower(field), value) {
+					return false
+				}
+				continue
+			}
+		}
+
+		matched := false
+		for _, field := range fields {
+			if strings.Contains(strings.ToLower(field), term) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+func filterHistory(entries []HistoryEntry, terms []string) []HistoryEntry {
+	var matched []HistoryEntry
+	for _, entry := range entries {
+		if entry.matches(terms) {
+			matched = append(matched, entry)
+		}
+	}
+	return matched
+}
+
+// HandleHistory handles the /history command: it lists finished transfers
+// matching the filter terms, or exports them with /history export <file>
+func HandleHistory(args []string) {
+	if len(args) > 0 && args[0] == "export" {
+		if len(args) < 2 {
+			fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Invalid arguments. Use: /history export <file.csv|file.json> [filter]"))
+			return
+		}
+		exportHistory(args[1], args[2:])
+		return
+	}
+
+	entries, err := LoadHistory()
+	if err != nil {
+		fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Error reading transfer history:"), err)
+		return
+	}
+	entries = filterHistory(entries, args)
+	if len(entries) == 0 {
+		fmt.Fprintln(utils.Output, utils.InfoColor("📜 No matching transfers in history"))
+		return
+	}
+
+	shown := entries
+	if len(shown) > historyDisplayLimit {
+		shown = shown[len(shown)-historyDisplayLimit:]
+	}
+
+	fmt.Fprintln(utils.Output, utils.HeaderColor("📜 Transfer History:"))
+	fmt.Fprintln(utils.Output, utils.InfoColor("-----------------------------------"))
+	for _, entry := range shown {
+		outcomeColor := utils.ErrorColor
+		outcomeIcon := "❌ "
+		switch entry.Outcome {
+		case "completed":
+			outcomeColor = utils.SuccessColor
+			outcomeIcon = "✅ "
+		case "aborted":
+			outcomeColor = utils.WarningColor
+			outcomeIcon = "⏹ "
+		case "declined":
+			outcomeColor = utils.WarningColor
+			outcomeIcon = "⏭ "
+		}
+
+		directionIcon, relationText := "📤 ", "To"
+		if entry.Direction == "receive" {
+			directionIcon, relationText = "📥 ", "From"
+		}
+
+		fmt.Fprintf(utils.Output, "%s %s%s %s (%s)\n",
+			outcomeColor(outcomeIcon),
+			directionIcon,
+			utils.InfoColor(entry.Started.Format("2006-01-02 15:04:05")),
+			utils.InfoColor(entry.Name),
+			outcomeColor(entry.Outcome))
+		fmt.Fprintf(utils.Output, "   Type: %s | Size: %s | Duration: %s | %s: %s\n",
+			entry.Type,
+			formatSize(entry.Size),
+			formatDuration(time.Duration(entry.DurationMs)*time.Millisecond),
+			relationText,
+			utils.UserColor(entry.Peer))
+		if entry.Path != "" {
+			fmt.Fprintf(utils.Output, "   Saved to: %s\n", utils.InfoColor(entry.Path))
+		}
+		if entry.Checksum != "" {
+			fmt.Fprintf(utils.Output, "   MD5: %s\n", entry.Checksum)
+		}
+	}
+	fmt.Fprintln(utils.Output, utils.InfoColor("-----------------------------------"))
+	if len(shown) < len(entries) {
+		fmt.Fprintf(utils.Output, "Showing the last %d of %d transfers, use a filter or %s to see more\n",
+			len(shown), len(entries), utils.CommandColor("/history export"))
+	}
+}
+
+// exportHistory writes the history entries matching terms to path as CSV or
+// JSON, depending on the file extension
+func exportHistory(path string, terms []string) {
+	entries, err := LoadHistory()
+	if err != nil {
+		fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Error reading transfer history:"), err)
+		return
+	}
+	entries = filterHistory(entries, terms)
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		err = writeHistoryCSV(path, entries)
+	case ".json":
+		err = writeHistoryJSON(path, entries)
+	default:
+		fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Export file must end in .csv or .json"))
+		return
+	}
+	if err != nil {
+		fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Error exporting transfer history:"), err)
+		return
+	}
+
+	fmt.Fprintf(utils.Output, "%s Exported %d transfers to %s\n",
+		utils.SuccessColor("✅"),
+		len(entries),
+		utils.InfoColor(path))
+}
+
+func writeHistoryJSON(path string, entries []HistoryEntry) error {
+	if entries == nil {
+		entries = []HistoryEntry{}
+	}
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+func writeHistoryCSV(path string, entries []HistoryEntry) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	// csv.Writer keeps the first write error; writer.Error() below reports it
+	writer := csv.NewWriter(file)
+	writer.Write([]string{"id", "direction", "type", "name", "peer", "size", "checksum",
+		"started", "duration_ms", "outcome", "path"})
+	for _, entry := range entries {
+		writer.Write([]string{
+			entry.ID,
+			entry.Direction,
+			entry.Type,
+			entry.Name,
+			entry.Peer,
+			strconv.FormatInt(entry.Size, 10),
+			entry.Checksum,
+			entry.Started.Format(time.RFC3339),
+			strconv.FormatInt(entry.DurationMs, 10),
+			entry.Outcome,
+			entry.Path,
+		})
+	}
+	writer.Flush()
+
+	if err := writer.Error(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,300 @@
+package connection
+
+import (
+	"drizlink/protocol"
+	"drizlink/utils"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// journalEntry is an outgoing transfer that had not finished when the
+// journal was last written
+type journalEntry struct {
+	ID       string    `json:"-"` // assigned when the journal is loaded
+	Type     string    `json:"type"`
+	Name     string    `json:"name"`
+	Path     string    `json:"path"`
+	Peer     string    `json:"peer"`
+	Size     int64     `json:"size"`
+	Offset   int64     `json:"offset"`             // bytes the recipient confirmed
+	Checksum string    `json:"checksum,omitempty"` // of the data being sent, once known
+	Status   string    `json:"status"`
+	Started  time.Time `json:"started"`
+}
+
+var (
+	// interruptedTransfers holds journal entries from an earlier session
+	// until they are resumed or dropped
+	interruptedTransfers = make(map[string]*journalEntry)
+	journalMutex         sync.Mutex
+	journalLoaded        bool
+	journalDirty         atomic.Bool
+)
+
+func journalFilePath() (string, error) {
+	dir, err := ConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "journal.json"), nil
+}
+
+// LoadJournal reads the transfers that were still running or queued when
+// the client last stopped. They are offered for resuming once their
+// recipient is online.
+func LoadJournal() error {
+	journalMutex.Lock()
+	defer journalMutex.Unlock()
+	journalLoaded = true
+
+	path, err := journalFilePath()
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var entries []*journalEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		// Keep the damaged journal for inspection instead of overwriting it
+		os.Rename(path, path+".corrupt")
+		return fmt.Errorf("invalid journal %s: %v", path, err)
+	}
+
+	for i, entry := range entries {
+		entry.ID = "j" + strconv.Itoa(i+1)
+		interruptedTransfers[entry.ID] = entry
+	}
+	if len(entries) > 0 {
+		fmt.Fprintf(utils.Output, "%s %d transfers were interrupted when DrizLink last stopped. They are offered for resuming once the recipient is online, see %s\n",
+			utils.WarningColor("⏯"),
+			len(entries),
+			utils.CommandColor("/journal"))
+	}
+	return nil
+}
+
+// StartJournal periodically writes the progress of running sends to the
+// journal
+func StartJournal(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	go func() {
+		for range ticker.C {
+			if journalDirty.Swap(false) {
+				saveJournal()
+			}
+		}
+	}()
+}
+
+// saveJournal writes every unfinished send and every interrupted transfer
+// not yet dealt with to the journal. The file is replaced atomically so a
+// crash leaves either the old or the new journal.
+func saveJournal() {
+	journalMutex.Lock()
+	defer journalMutex.Unlock()
+	if !journalLoaded {
+		return
+	}
+
+	entries := sortedInterrupted()
+	for _, transfer := range ListTransfers() {
+		// Streams cannot be read again, so they are not resumable
+		if transfer.Direction != "send" || transfer.Stream || transfer.Status == Completed || transfer.Status == Failed {
+			continue
+		}
+		path, err := filepath.Abs(transfer.Path)
+		if err != nil {
+			path = transfer.Path
+		}
+		entries = append(entries, &journalEntry{
+			Type:     formatTransferType(transfer.Type),
+			Name:     transfer.Name,
+			Path:     path,
+			Peer:     transfer.Recipient,
+			Size:     transfer.Size,
+			Offset:   transfer.BytesAcked.Load(),
+			Checksum: transfer.Checksum,
+			Status:   transfer.Status.String(),
+			Started:  transfer.StartTime,
+		})
+	}
+
+	if err := writeJournal(entries); err != nil {
+		fmt.Fprintln(utils.Output, utils.WarningColor("⚠ Could not write transfer journal:"), err)
+	}
+}
+
+func writeJournal(entries []*journalEntry) error {
+	path, err := journalFilePath()
+	if err != nil {
+		return err
+	}
+	if entries == nil {
+		entries = []*journalEntry{}
+	}
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	temp := path + ".tmp"
+	file, err := os.Create(temp)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(temp, path); err != nil {
+		return err
+	}
+	syncDir(filepath.Dir(path))
+	return nil
+}
+
+// sortedInterrupted returns the interrupted transfers in journal order.
+// Callers must hold journalMutex.
+func sortedInterrupted() []*journalEntry {
+	entries := make([]*journalEntry, 0, len(interruptedTransfers))
+	for _, entry := range interruptedTransfers {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		a, _ := strconv.Atoi(entries[i].ID[1:])
+		b, _ := strconv.Atoi(entries[j].ID[1:])
+		return a < b
+	})
+	return entries
+}
+
+// describe returns a one line summary of an interrupted transfer
+func (entry *journalEntry) describe() string {
+	progress := ""
+	if entry.Size > 0 && entry.Offset > 0 {
+		progress = fmt.Sprintf(", %.0f%% delivered", float64(entry.Offset)/float64(entry.Size)*100)
+	}
+	changed := ""
+	if info, err := os.Stat(entry.Path); err != nil {
+		changed = utils.ErrorColor(" (source is gone)")
+	} else if entry.Type == "File" && info.Size() != entry.Size {
+		changed = utils.WarningColor(" (source changed, it will be sent from the start)")
+	}
+	return fmt.Sprintf("%s %s '%s' (%s%s) to %s%s",
+		utils.CommandColor(entry.ID),
+		entry.Type,
+		utils.InfoColor(entry.Name),
+		formatSize(entry.Size),
+		progress,
+		utils.UserColor(entry.Peer),
+		changed)
+}
+
+// HandlePresence offers interrupted transfers for a peer that came online
+// and fails the streams of a peer that went offline
+func HandlePresence(userId, state string) {
+	publish(Event{Type: PresenceEvent, User: userId, State: state})
+	if state != "online" {
+		abortStreamsFrom(userId)
+		return
+	}
+
+	journalMutex.Lock()
+	var waiting []*journalEntry
+	for _, entry := range sortedInterrupted() {
+		if entry.Peer == userId {
+			waiting = append(waiting, entry)
+		}
+	}
+	journalMutex.Unlock()
+	if len(waiting) == 0 {
+		return
+	}
+
+	fmt.Fprintf(utils.Output, "\n%s User %s is online. Interrupted transfers to them can be resumed:\n",
+		utils.InfoColor("⏯"),
+		utils.UserColor(userId))
+	for _, entry := range waiting {
+		fmt.Fprintln(utils.Output, "  "+entry.describe())
+	}
+	fmt.Fprintf(utils.Output, "  Use %s or %s\n",
+		utils.CommandColor("/journal resume <id>|all"),
+		utils.CommandColor("/journal drop <id>|all"))
+}
+
+// HandleJournal handles the /journal command: without arguments it lists
+// transfers interrupted in an earlier session, otherwise it resumes or drops
+// one of them or all of them
+func HandleJournal(conn *protocol.Conn, args []string) {
+	journalMutex.Lock()
+
+	if len(args) == 0 {
+		entries := sortedInterrupted()
+		journalMutex.Unlock()
+		if len(entries) == 0 {
+			fmt.Fprintln(utils.Output, utils.InfoColor("⏯ No interrupted transfers"))
+			return
+		}
+		fmt.Fprintln(utils.Output, utils.HeaderColor("⏯ Interrupted Transfers:"))
+		for _, entry := range entries {
+			fmt.Fprintln(utils.Output, "  "+entry.describe())
+		}
+		return
+	}
+
+	if len(args) != 2 || (args[0] != "resume" && args[0] != "drop") {
+		journalMutex.Unlock()
+		fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Invalid arguments. Use: /journal [resume|drop <id>|all]"))
+		return
+	}
+
+	var selected []*journalEntry
+	if args[1] == "all" {
+		selected = sortedInterrupted()
+	} else if entry, exists := interruptedTransfers[args[1]]; exists {
+		selected = append(selected, entry)
+	} else {
+		journalMutex.Unlock()
+		fmt.Fprintln(utils.Output, utils.ErrorColor("❌ No interrupted transfer with ID"), utils.CommandColor(args[1]))
+		return
+	}
+	for _, entry := range selected {
+		delete(interruptedTransfers, entry.ID)
+	}
+	journalMutex.Unlock()
+
+	for _, entry := range selected {
+		if args[0] == "drop" {
+			fmt.Fprintln(utils.Output, utils.InfoColor("🗑 Dropped"), utils.InfoColor(entry.Name))
+			continue
+		}
+		// The recipient still holds the partial data, so sending the same
+		// content again continues where the interrupted transfer stopped
+		if entry.Type == "Folder" {
+			HandleSendFolder(conn, entry.Peer, entry.Path)
+		} else {
+			HandleSendFile(conn, entry.Peer, entry.Path)
+		}
+	}
+	saveJournal()
+}
@@ -0,0 +1,329 @@
+package connection
+
+import (
+	"drizlink/protocol"
+	"drizlink/utils"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultMirrorInterval is how often a mirror checks for changes
+	defaultMirrorInterval = time.Minute
+	// minMirrorInterval keeps mirrors from asking the peer all the time
+	minMirrorInterval = 5 * time.Second
+)
+
+// Mirror keeps Local a copy of Remote in the store path of Peer by fetching
+// the peer's listing every Interval and downloading what is new or changed
+type Mirror struct {
+	ID        string
+	Peer      string
+	Remote    string
+	Local     string
+	Delete    bool // remove local files that were removed from the peer
+	Interval  time.Duration
+	StartTime time.Time
+	LastRun   time.Time
+	LastError string
+	Running   bool
+	Received  int
+	Removed   int
+	conn      *protocol.Conn
+	stop      chan struct{}
+	mutex     sync.Mutex
+}
+
+var (
+	activeMirrors   = make(map[string]*Mirror)
+	mirrorsMutex    sync.Mutex
+	mirrorIDCounter = 1
+)
+
+// HandleMirror handles /mirror <userId> <remotePath> <localPath> [--delete]
+// [--every <duration>]
+func HandleMirror(conn *protocol.Conn, args []string) {
+	usage := "❌ Invalid arguments. Use: /mirror <userId> <remotePath> <localPath> [--delete] [--every <duration>]"
+	if len(args) < 3 {
+		fmt.Fprintln(utils.Output, utils.ErrorColor(usage))
+		return
+	}
+	mirror := &Mirror{
+		Peer:      args[0],
+		Remote:    args[1],
+		Interval:  defaultMirrorInterval,
+		StartTime: time.Now(),
+		conn:      conn,
+		stop:      make(chan struct{}),
+	}
+	for i := 3; i < len(args); i++ {
+		switch {
+		case args[i] == "--delete":
+			mirror.Delete = true
+		case args[i] == "--every" && i+1 < len(args):
+			interval, err := time.ParseDuration(args[i+1])
+			if err != nil || interval < minMirrorInterval {
+				fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Invalid interval, use a duration of at least"), minMirrorInterval)
+				return
+			}
+			mirror.Interval = interval
+			i++
+		default:
+			fmt.Fprintln(utils.Output, utils.ErrorColor(usage))
+			return
+		}
+	}
+
+	local, err := filepath.Abs(args[2])
+	if err == nil {
+		err = os.MkdirAll(local, 0755)
+	}
+	if err != nil {
+		fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Invalid folder:"), err)
+		return
+	}
+	mirror.Local = local
+
+	mirrorsMutex.Lock()
+	for _, other := range activeMirrors {
+		if other.Local == local {
+			mirrorsMutex.Unlock()
+			fmt.Fprintf(utils.Output, "%s %s is already a mirror (Mirror ID: %s)\n",
+				utils.WarningColor("⚠"),
+				local,
+				utils.CommandColor(other.ID))
+			return
+		}
+	}
+	mirror.ID = "m" + strconv.Itoa(mirrorIDCounter)
+	mirrorIDCounter++
+	activeMirrors[mirror.ID] = mirror
+	mirrorsMutex.Unlock()
+
+	fmt.Fprintf(utils.Output, "%s Mirroring %s of user %s to %s every %s (Mirror ID: %s)\n",
+		utils.InfoColor("🪞"),
+		utils.InfoColor(mirror.Remote),
+		utils.UserColor(mirror.Peer),
+		utils.InfoColor(local),
+		mirror.Interval,
+		utils.CommandColor(mirror.ID))
+	go mirror.run()
+}
+
+// HandleUnmirror stops the mirror with mirrorID, or every mirror for "all".
+// Files already fetched stay where they are.
+func HandleUnmirror(mirrorID string) {
+	mirrorsMutex.Lock()
+	var stopped []*Mirror
+	for id, mirror := range activeMirrors {
+		if mirrorID == "all" || id == mirrorID {
+			stopped = append(stopped, mirror)
+			delete(activeMirrors, id)
+		}
+	}
+	mirrorsMutex.Unlock()
+
+	if len(stopped) == 0 {
+		fmt.Fprintln(utils.Output, utils.ErrorColor("❌ No mirror with ID"), utils.CommandColor(mirrorID))
+		return
+	}
+	for _, mirror := range stopped {
+		close(mirror.stop)
+		fmt.Fprintf(utils.Output, "%s Stopped mirroring %s to %s\n",
+			utils.SuccessColor("✅"),
+			utils.InfoColor(mirror.Remote),
+			utils.InfoColor(mirror.Local))
+	}
+}
+
+// ListMirrors returns the running mirrors, oldest first
+func ListMirrors() []*Mirror {
+	mirrorsMutex.Lock()
+	mirrors := make([]*Mirror, 0, len(activeMirrors))
+	for _, mirror := range activeMirrors {
+		mirrors = append(mirrors, mirror)
+	}
+	mirrorsMutex.Unlock()
+
+	sort.Slice(mirrors, func(i, j int) bool {
+		return mirrors[i].StartTime.Before(mirrors[j].StartTime)
+	})
+	return mirrors
+}
+
+// describe summarizes the mirror's state for /transfers
+func (mirror *Mirror) describe() string {
+	mirror.mutex.Lock()
+	defer mirror.mutex.Unlock()
+
+	state := "waiting"
+	switch {
+	case mirror.Running:
+		state = "checking for changes"
+	case mirror.LastError != "":
+		state = "last check failed: " + mirror.LastError
+	case !mirror.LastRun.IsZero():
+		state = fmt.Sprintf("up to date as of %s", mirror.LastRun.Format("15:04:05"))
+	}
+	text := fmt.Sprintf("%d received", mirror.Received)
+	if mirror.Delete {
+		text += fmt.Sprintf(", %d removed", mirror.Removed)
+	}
+	return fmt.Sprintf("%s | every %s | %s", text, mirror.Interval, state)
+}
+
+// run checks the peer for changes until the mirror is stopped. A pass
+// finishes its downloads before the next one starts.
+func (mirror *Mirror) run() {
+	for {
+		mirror.pass()
+
+		timer := time.NewTimer(mirror.Interval)
+		select {
+		case <-mirror.stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// pass compares the mirror with the peer's folder once and fetches the
+// differences
+func (mirror *Mirror) pass() {
+	mirror.mutex.Lock()
+	mirror.Running = true
+	mirror.mutex.Unlock()
+
+	session, err := startSyncRun(mirror.conn, mirror.Peer, mirror.Local, mirror.Remote, mirror)
+	if err != nil {
+		mirror.failed(err)
+		return
+	}
+	go runSync(mirror.conn, session)
+
+	run := session.run
+	select {
+	case <-run.done:
+	case <-mirror.stop:
+		return
+	}
+	if run.err != nil {
+		mirror.failed(run.err)
+		return
+	}
+
+	run.mutex.Lock()
+	received, removed, failures := run.received, run.removed, run.failures
+	run.mutex.Unlock()
+
+	mirror.mutex.Lock()
+	failedBefore := mirror.LastError != ""
+	mirror.Running = false
+	mirror.LastRun = time.Now()
+	mirror.Received += received
+	mirror.Removed += removed
+	if failures == 0 {
+		mirror.LastError = ""
+	} else {
+		mirror.LastError = fmt.Sprintf("%d files could not be fetched", failures)
+	}
+	mirror.mutex.Unlock()
+
+	if received == 0 && removed == 0 && failures == 0 {
+		if failedBefore {
+			fmt.Fprintf(utils.Output, "%s Mirror %s is working again\n", utils.SuccessColor("🪞"), utils.CommandColor(mirror.ID))
+		}
+		return
+	}
+	fmt.Fprintf(utils.Output, "%s Mirror %s of %s updated: %d received, %d removed",
+		utils.SuccessColor("🪞"),
+		utils.CommandColor(mirror.ID),
+		utils.InfoColor(mirror.Remote),
+		received,
+		removed)
+	if failures > 0 {
+		fmt.Fprintf(utils.Output, ", %s", utils.ErrorColor(fmt.Sprintf("%d failed (retried on the next check)", failures)))
+	}
+	fmt.Fprintln(utils.Output)
+}
+
+// failed records a pass that could not compare the folders. The same error
+// is only reported once.
+func (mirror *Mirror) failed(err error) {
+	mirror.mutex.Lock()
+	repeated := mirror.LastError == err.Error()
+	mirror.Running = false
+	mirror.LastRun = time.Now()
+	mirror.LastError = err.Error()
+	mirror.mutex.Unlock()
+
+	if !repeated {
+		fmt.Fprintf(utils.Output, "%s Mirror %s could not check for changes: %v\n",
+			utils.WarningColor("⚠"),
+			utils.CommandColor(mirror.ID),
+			err)
+	}
+}
+
+// planMirror decides what a mirror pass does: every file that is missing
+// locally or differs from the remote version is fetched. With prune, files
+// an earlier pass knew from the peer and that are gone there are returned
+// for removal. Files that only ever existed locally are left alone.
+func planMirror(local, remote map[string]syncEntry, last map[string]syncBase, prune bool) ([]syncAction, []string) {
+	paths := make([]string, 0, len(remote))
+	for rel := range remote {
+		paths = append(paths, rel)
+	}
+	sort.Strings(paths)
+
+	actions := make([]syncAction, 0, len(paths))
+	for _, rel := range paths {
+		r := remote[rel]
+		action := syncAction{Path: rel, Agreed: syncBase{r.Checksum, r.Checksum}}
+		if l, exists := local[rel]; !exists || l.Checksum != r.Checksum {
+			action.Pull = true
+		}
+		actions = append(actions, action)
+	}
+
+	var removed []string
+	if prune {
+		for rel := range local {
+			if _, exists := remote[rel]; exists {
+				continue
+			}
+			if _, known := last[rel]; known {
+				removed = append(removed, rel)
+			}
+		}
+		sort.Strings(removed)
+	}
+	return actions, removed
+}
+
+// removeFiles deletes files of a mirror that were removed from the peer and
+// forgets them. It returns how many were removed. Callers must hold the
+// run's mutex.
+func (session *syncSession) removeFiles(paths []string) int {
+	removed := 0
+	for _, rel := range paths {
+		target, err := syncTarget(session.Folder, rel)
+		if err == nil {
+			err = os.Remove(target)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			fmt.Fprintf(utils.Output, "%s Could not remove '%s': %v\n", utils.WarningColor("⚠"), rel, err)
+			continue
+		}
+		delete(session.run.state.Files, rel)
+		removed++
+		fmt.Fprintf(utils.Output, "%s Removed '%s', it is gone from the mirrored folder\n", utils.InfoColor("🗑"), utils.InfoColor(rel))
+	}
+	return removed
+}
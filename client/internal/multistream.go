@@ -0,0 +1,386 @@
+package connection
+
+import (
+	"drizlink/protocol"
+	"drizlink/utils"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// maxStreams bounds the streams setting
+	maxStreams = 16
+	// multiStreamThreshold is the smallest remainder sent over parallel streams
+	multiStreamThreshold = 64 << 20
+	// rangeSize is how much of a file one stream sends before taking the next range
+	rangeSize = 8 << 20
+	// streamSetupTimeout bounds how long opening a data stream may take
+	streamSetupTimeout = 5 * time.Second
+)
+
+var (
+	// dataStreams are extra connections to the server that carry /RANGE
+	// frames for parallel transfers, in both directions
+	dataStreams      []*protocol.Conn
+	dataStreamsMutex sync.Mutex
+	// sessionToken is what the server gave this login to prove that a data
+	// stream, or a later login continuing the session, belongs to it.
+	// Guarded by dataStreamsMutex.
+	sessionToken string
+)
+
+// setSessionToken records the token of the current login
+func setSessionToken(token string) {
+	dataStreamsMutex.Lock()
+	sessionToken = token
+	dataStreamsMutex.Unlock()
+}
+
+// currentSessionToken returns the token of the latest login, or "" before
+// the first
+func currentSessionToken() string {
+	dataStreamsMutex.Lock()
+	defer dataStreamsMutex.Unlock()
+	return sessionToken
+}
+
+// ensureStreams opens data streams until count are available and returns
+// them. Fewer are returned when the server does not accept more.
+func ensureStreams(conn *protocol.Conn, count int) []*protocol.Conn {
+	dataStreamsMutex.Lock()
+	defer dataStreamsMutex.Unlock()
+
+	for len(dataStreams) < count {
+		stream, err := openStream(conn, sessionToken)
+		if err != nil {
+			fmt.Fprintln(utils.Output, utils.WarningColor("⚠ Could not open data stream:"), err)
+			break
+		}
+		dataStreams = append(dataStreams, stream)
+		go readStream(stream)
+	}
+
+	if len(dataStreams) < count {
+		count = len(dataStreams)
+	}
+	return append([]*protocol.Conn(nil), dataStreams[:count]...)
+}
+
+// openStream connects a data stream to the server conn is logged in to. The
+// session token tells the server which client it belongs to.
+func openStream(conn *protocol.Conn, token string) (*protocol.Conn, error) {
+	if token == "" {
+		return nil, errors.New("no session with the server yet")
+	}
+	netConn, err := net.DialTimeout("tcp", conn.RemoteAddr().String(), streamSetupTimeout)
+	if err != nil {
+		return nil, err
+	}
+	stream := protocol.NewConn(netConn)
+
+	if err := stream.WriteLine(protocol.Format("/STREAM", token)); err != nil {
+		stream.Close()
+		return nil, err
+	}
+	stream.SetReadDeadline(time.Now().Add(streamSetupTimeout))
+	reply, err := stream.ReadLine()
+	stream.SetReadDeadline(time.Time{})
+	if err != nil {
+		stream.Close()
+		return nil, err
+	}
+	if reply != "/STREAM_READY" {
+		stream.Close()
+		return nil, fmt.Errorf("server refused the stream: %s", reply)
+	}
+	return stream, nil
+}
+
+// readStream handles /RANGE frames arriving on a data stream until it closes
+func readStream(stream *protocol.Conn) {
+	defer closeStream(stream)
+	for {
+		header, err := stream.ReadLine()
+		if err != nil {
+			return
+		}
+		args, err := protocol.SplitArgs(header)
+		if err != nil || len(args) != 5 || args[0] != "/RANGE" {
+			fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Invalid data stream frame:"), header)
+			return
+		}
+		if !readRange(stream, args) {
+			return
+		}
+	}
+}
+
+// readRange reads the payload of a /RANGE frame and hands it to its
+// transfer. It reports false when the stream can no longer be framed.
+func readRange(conn *protocol.Conn, args []string) bool {
+	size, err := protocol.ParseSize(args[4])
+	if err != nil {
+		fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Invalid range header:"), err)
+		return false
+	}
+	payload, err := conn.ReadPayload(size)
+	if err != nil {
+		return false
+	}
+	offset, err := strconv.ParseInt(args[3], 10, 64)
+	if err != nil {
+		fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Invalid range offset:"), args[3])
+		return true
+	}
+	HandleRange(args[1], args[2], offset, payload)
+	return true
+}
+
+// closeStream closes a data stream and forgets it
+func closeStream(stream *protocol.Conn) {
+	stream.Close()
+	dataStreamsMutex.Lock()
+	defer dataStreamsMutex.Unlock()
+	for i, s := range dataStreams {
+		if s == stream {
+			dataStreams = append(dataStreams[:i], dataStreams[i+1:]...)
+			break
+		}
+	}
+}
+
+// offerStreams prepares to receive a transfer with remaining bytes still to
+// come and returns how many parallel streams the sender may use
+func offerStreams(conn *protocol.Conn, remaining int64) int {
+	count := GetSettings().Streams
+	if count < 2 || remaining < multiStreamThreshold {
+		return 1
+	}
+	if opened := len(ensureStreams(conn, count)); opened > 0 {
+		return opened
+	}
+	return 1
+}
+
+// sendData sends the rest of transfer from file. Large transfers go out over
+// parallel data streams when the recipient offered them, anything else as
+// /CHUNK frames on conn.
+func sendData(conn *protocol.Conn, transfer *Transfer, file *os.File, offered int) (int64, error) {
+	count := GetSettings().Streams
+	if offered < count {
+		count = offered
+	}
+	if count > 1 && transfer.Size-transfer.BytesComplete.Load() >= multiStreamThreshold {
+		if streams := ensureStreams(conn, count); len(streams) > 0 {
+			return streamRanges(streams, transfer, file)
+		}
+	}
+	return streamTransfer(conn, transfer, file)
+}
+
+// streamRanges sends the rest of transfer from file as /RANGE frames. The
+// remainder is cut into ranges that the streams take in turn, so a slow
+// stream holds back only its own range. The returned count includes bytes
+// sent before the call.
+func streamRanges(streams []*protocol.Conn, transfer *Transfer, file io.ReaderAt) (int64, error) {
+	var (
+		mutex    sync.Mutex
+		next     = transfer.BytesComplete.Load()
+		firstErr error
+		wg       sync.WaitGroup
+	)
+
+	// take hands out the next range, or reports false once everything is
+	// handed out or a stream failed
+	take := func() (int64, int64, bool) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if firstErr != nil || next >= transfer.Size {
+			return 0, 0, false
+		}
+		start := next
+		next += rangeSize
+		if next > transfer.Size {
+			next = transfer.Size
+		}
+		return start, next, true
+	}
+	fail := func(err error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	failed := func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return firstErr != nil
+	}
+
+	for _, stream := range streams {
+		wg.Add(1)
+		go func(stream *protocol.Conn) {
+			defer wg.Done()
+			buffer := make([]byte, chunkSize)
+			for {
+				start, end, ok := take()
+				if !ok {
+					return
+				}
+				for offset := start; offset < end; {
+					if transferPaused(transfer) {
+						time.Sleep(500 * time.Millisecond)
+						continue
+					}
+					if transferCancelled(transfer) {
+						fail(errCancelled)
+					}
+					if failed() {
+						return
+					}
+
+					n := int64(chunkSize)
+					if end-offset < n {
+						n = end - offset
+					}
+					read, err := file.ReadAt(buffer[:n], offset)
+					if int64(read) < n {
+						if err == nil || err == io.EOF {
+							err = io.ErrUnexpectedEOF
+						}
+						fail(err)
+						return
+					}
+
+					header := protocol.Format("/RANGE", transfer.Recipient, transfer.ID,
+						strconv.FormatInt(offset, 10), strconv.FormatInt(n, 10))
+					if err := stream.WriteFrame(header, buffer[:n]); err != nil {
+						fail(err)
+						return
+					}
+					offset += n
+					transfer.BytesComplete.Add(n)
+				}
+			}
+		}(stream)
+	}
+	wg.Wait()
+
+	return transfer.BytesComplete.Load(), firstErr
+}
+
+// transferPaused reports whether transfer is paused by the user, or for a
+// send by its recipient
+func transferPaused(transfer *Transfer) bool {
+	transfer.PauseLock.Lock()
+	defer transfer.PauseLock.Unlock()
+	return transfer.IsPaused || transfer.peerPaused
+}
+
+// waitWhilePaused blocks while transfer is paused and fails once it is
+// cancelled
+func waitWhilePaused(transfer *Transfer) error {
+	for transferPaused(transfer) {
+		time.Sleep(500 * time.Millisecond)
+	}
+	if transferCancelled(transfer) {
+		return errCancelled
+	}
+	return nil
+}
+
+// HandleRange writes one out of order frame of incoming transfer data
+func HandleRange(senderId, remoteId string, offset int64, payload []byte) {
+	key := incomingKey(senderId, remoteId)
+
+	incomingMutex.Lock()
+	incoming, exists := incomingTransfers[key]
+	incomingMutex.Unlock()
+	if !exists {
+		return
+	}
+	incoming.run(func() { incoming.handleRange(key, offset, payload) })
+}
+
+// handleRange writes a /RANGE frame on the transfer's goroutine
+func (incoming *incomingTransfer) handleRange(key string, offset int64, payload []byte) {
+	if !incoming.registered(key) {
+		return
+	}
+	if incoming.file == nil {
+		incoming.abort(key, fmt.Errorf("parallel data is not supported for this transfer"))
+		return
+	}
+
+	// A paused transfer holds its queued frames until it is resumed, or
+	// until it is aborted meanwhile
+	for transferPaused(incoming.transfer) && incoming.registered(key) {
+		time.Sleep(500 * time.Millisecond)
+	}
+	if !incoming.registered(key) {
+		return
+	}
+	if transferCancelled(incoming.transfer) {
+		incoming.abort(key, errCancelled)
+		return
+	}
+
+	done, err := incoming.writeRange(offset, payload)
+	if err != nil {
+		incoming.abort(key, err)
+		return
+	}
+	incoming.transfer.trackProgress(payload)
+	incoming.reportProgress()
+
+	if done {
+		incoming.complete(key)
+	}
+}
+
+// writeRange stores payload at offset and reports whether the transfer is
+// now complete. Ranges may arrive in any order but must not overlap.
+func (incoming *incomingTransfer) writeRange(offset int64, payload []byte) (bool, error) {
+	incoming.mutex.Lock()
+	defer incoming.mutex.Unlock()
+
+	transfer := incoming.transfer
+	end := offset + int64(len(payload))
+	if offset < incoming.contiguous || end > transfer.Size {
+		return false, corruptData("received data outside the expected range (%d-%d)", offset, end)
+	}
+	if incoming.segments == nil {
+		incoming.segments = make(map[int64]int64)
+	}
+	for start, stop := range incoming.segments {
+		if offset < stop && start < end {
+			return false, corruptData("received overlapping data at offset %d", offset)
+		}
+	}
+
+	if _, err := incoming.file.WriteAt(payload, offset); err != nil {
+		return false, err
+	}
+
+	// Track which bytes are in place so an interrupted transfer can resume
+	// after the leading complete part
+	incoming.segments[offset] = end
+	for {
+		stop, exists := incoming.segments[incoming.contiguous]
+		if !exists {
+			break
+		}
+		delete(incoming.segments, incoming.contiguous)
+		incoming.contiguous = stop
+	}
+	incoming.ranged = true
+
+	return transfer.BytesComplete.Add(int64(len(payload))) == transfer.Size, nil
+}
@@ -0,0 +1,194 @@
+package connection
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// partialSuffix marks data that is still being received. Partial files are
+// hidden and only renamed to their final name once verified.
+const partialSuffix = ".partial"
+
+// partialMeta is stored next to a partial file so a later transfer of the
+// same content can continue where an interrupted one stopped
+type partialMeta struct {
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	Checksum string    `json:"checksum"`
+	Sender   string    `json:"sender"`
+	Started  time.Time `json:"started"`
+	// Contiguous is set when data arrives out of order over parallel
+	// streams: only this many leading bytes are known to be complete
+	Contiguous *int64 `json:"contiguous,omitempty"`
+}
+
+// partialPath returns the hidden path data for dest is received into
+func partialPath(dest string) string {
+	dir, name := filepath.Split(dest)
+	return filepath.Join(dir, "."+name+partialSuffix)
+}
+
+func partialMetaPath(partial string) string {
+	return partial + ".json"
+}
+
+// isPartialName reports whether name belongs to an unfinished receive
+func isPartialName(name string) bool {
+	return strings.HasPrefix(name, ".") &&
+		(strings.HasSuffix(name, partialSuffix) || strings.HasSuffix(name, partialSuffix+".json"))
+}
+
+// openPartial opens the partial file for dest. When an earlier attempt left
+// a partial with matching metadata it is continued and the number of bytes
+// already received is returned; otherwise the partial starts out empty.
+func openPartial(dest string, meta partialMeta) (*os.File, int64, error) {
+	partial := partialPath(dest)
+
+	if offset, ok := resumableOffset(partial, meta); ok {
+		file, err := os.OpenFile(partial, os.O_WRONLY, 0644)
+		if err == nil {
+			if _, err = file.Seek(offset, io.SeekStart); err == nil {
+				return file, offset, nil
+			}
+			file.Close()
+		}
+	}
+
+	file, err := os.Create(partial)
+	if err != nil {
+		return nil, 0, err
+	}
+	data, err := json.Marshal(meta)
+	if err == nil {
+		err = os.WriteFile(partialMetaPath(partial), data, 0644)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(partial)
+		return nil, 0, err
+	}
+	return file, 0, nil
+}
+
+// resumableOffset returns how much of the content described by meta is
+// already in partial. Content is identified by name, size and checksum.
+func resumableOffset(partial string, meta partialMeta) (int64, bool) {
+	if meta.Checksum == "" {
+		return 0, false
+	}
+	data, err := os.ReadFile(partialMetaPath(partial))
+	if err != nil {
+		return 0, false
+	}
+	var saved partialMeta
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return 0, false
+	}
+	if saved.Name != meta.Name || saved.Size != meta.Size || saved.Checksum != meta.Checksum {
+		return 0, false
+	}
+	info, err := os.Stat(partial)
+	if err != nil || info.Size() > meta.Size {
+		return 0, false
+	}
+	if saved.Contiguous != nil && *saved.Contiguous < info.Size() {
+		return *saved.Contiguous, true
+	}
+	return info.Size(), true
+}
+
+// savePartialProgress records in the metadata of partial how many leading
+// bytes are complete, for data written out of order
+func savePartialProgress(partial string, contiguous int64) error {
+	path := partialMetaPath(partial)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var meta partialMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return err
+	}
+	meta.Contiguous = &contiguous
+	if data, err = json.Marshal(meta); err != nil {
+		return err
+	}
+	// A torn write only makes the partial unresumable, never wrong
+	return os.WriteFile(path, data, 0644)
+}
+
+// commitPartial flushes the partial file for dest to disk and moves it into
+// place, replacing anything already at dest or keeping it as an older
+// version when the conflict policy asks for that
+func commitPartial(file *os.File, dest string) error {
+	partial := partialPath(dest)
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := keepExistingVersion(dest, false); err != nil {
+		return err
+	}
+	if err := os.Rename(partial, dest); err != nil {
+		return err
+	}
+	os.Remove(partialMetaPath(partial))
+	syncDir(filepath.Dir(dest))
+	return nil
+}
+
+// keepPartial flushes what was received so far so a later attempt can resume
+func keepPartial(file *os.File) {
+	file.Sync()
+	file.Close()
+}
+
+// discardPartial removes the partial data for dest and its metadata
+func discardPartial(file *os.File, dest string) {
+	partial := partialPath(dest)
+	if file != nil {
+		file.Close()
+	}
+	os.Remove(partial)
+	os.Remove(partialMetaPath(partial))
+}
+
+// syncDir makes a rename inside dir durable. Not every platform supports
+// syncing a directory, so failures are ignored.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
+
+// errCorruptData marks receive failures where the data itself is wrong, so
+// the partial file must not be resumed
+type errCorruptData struct {
+	reason string
+}
+
+func (e errCorruptData) Error() string {
+	return e.reason
+}
+
+// corruptData builds an errCorruptData from a format string
+func corruptData(format string, args ...interface{}) error {
+	return errCorruptData{reason: fmt.Sprintf(format, args...)}
+}
+
+// isResumable reports whether a receive that failed with err left usable data
+func isResumable(err error) bool {
+	_, corrupt := err.(errCorruptData)
+	return !corrupt
+}
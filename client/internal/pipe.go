@@ -0,0 +1,327 @@
+package connection
+
+import (
+	"crypto/md5"
+	"drizlink/helper"
+	"drizlink/protocol"
+	"drizlink/utils"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// pipePath stands for standard input or output in place of a file path
+const pipePath = "-"
+
+// pipeSink takes the next stream from a user instead of the store path
+type pipeSink struct {
+	from   string // user ID or username the stream must come from, empty for anyone
+	writer io.Writer
+	done   chan error
+}
+
+var (
+	activeSink    *pipeSink
+	pipeSinkMutex sync.Mutex
+)
+
+// ReceivePipe writes the next stream offered by from, a user ID or
+// username, or by anyone when from is empty, to writer instead of the store
+// path. The returned channel receives the outcome once the stream ended.
+func ReceivePipe(from string, writer io.Writer) <-chan error {
+	sink := &pipeSink{from: from, writer: writer, done: make(chan error, 1)}
+	pipeSinkMutex.Lock()
+	activeSink = sink
+	pipeSinkMutex.Unlock()
+	return sink.done
+}
+
+// claimSink returns the sink waiting for a stream from the given user, if
+// any. Each sink takes one stream.
+func claimSink(senderId, senderName string) *pipeSink {
+	pipeSinkMutex.Lock()
+	defer pipeSinkMutex.Unlock()
+	sink := activeSink
+	if sink == nil || (sink.from != "" && sink.from != senderId && sink.from != senderName) {
+		return nil
+	}
+	activeSink = nil
+	return sink
+}
+
+// abortSink fails the sink still waiting for a stream, if any, with err
+func abortSink(err error) {
+	pipeSinkMutex.Lock()
+	sink := activeSink
+	activeSink = nil
+	pipeSinkMutex.Unlock()
+	if sink != nil {
+		sink.done <- err
+	}
+}
+
+// SendPipe sends everything read from reader to recipientId as a stream
+// called name. The length need not be known: the data goes out in /CHUNK
+// frames until reader is exhausted, and /PIPE_END then tells the recipient
+// the size and checksum to verify.
+func SendPipe(conn *protocol.Conn, recipientId, name string, reader io.Reader) error {
+	transfer := &Transfer{
+		ID:         GenerateTransferID(),
+		Type:       FileTransfer,
+		Name:       name,
+		Status:     Active,
+		Stream:     true,
+		Direction:  "send",
+		Recipient:  recipientId,
+		Path:       pipePath,
+		StartTime:  time.Now(),
+		Connection: conn,
+		Priority:   NormalPriority,
+	}
+	transferID := transfer.ID
+
+	replies := expectReply(recipientId, transferID)
+	defer cancelReply(recipientId, transferID)
+	if err := conn.WriteLine(protocol.Format("/PIPE_REQUEST", recipientId, name, transferID)); err != nil {
+		return err
+	}
+	reply, err := awaitReply(recipientId, transferID, replies)
+	if err != nil {
+		return err
+	}
+	if !reply.Accepted {
+		return fmt.Errorf("declined by recipient: %s", reply.Reason)
+	}
+
+	fmt.Fprintf(utils.Output, "%s Streaming '%s' to user %s (Transfer ID: %s)...\n",
+		utils.InfoColor("📤"),
+		utils.InfoColor(name),
+		utils.UserColor(recipientId),
+		utils.CommandColor(transferID))
+	transfer.ProgressBar = utils.CreateProgressBar(-1, "📤 Sending stream")
+	RegisterTransfer(transfer)
+
+	sum := md5.New()
+	buffer := make([]byte, chunkSize)
+	var sent int64
+	for {
+		if err := waitWhilePaused(transfer); err != nil {
+			abortSend(conn, transfer, err)
+			UpdateTransferStatus(transferID, Failed)
+			RemoveTransfer(transferID)
+			return err
+		}
+		n, readErr := reader.Read(buffer)
+		if n > 0 {
+			sum.Write(buffer[:n])
+			header := protocol.Format("/CHUNK", recipientId, transferID, strconv.Itoa(n))
+			if err := conn.WriteFrame(header, buffer[:n]); err != nil {
+				abortSend(conn, transfer, err)
+				UpdateTransferStatus(transferID, Failed)
+				RemoveTransfer(transferID)
+				return err
+			}
+			sent += int64(n)
+			transfer.BytesComplete.Store(sent)
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			// The recipient never accepts a stream without an end marker
+			err := fmt.Errorf("error reading input: %v", readErr)
+			abortSend(conn, transfer, err)
+			UpdateTransferStatus(transferID, Failed)
+			RemoveTransfer(transferID)
+			return err
+		}
+	}
+
+	checksum := hex.EncodeToString(sum.Sum(nil))
+	transfer.PauseLock.Lock()
+	transfer.Size = sent
+	transfer.Checksum = checksum
+	transfer.PauseLock.Unlock()
+	end := protocol.Format("/PIPE_END", recipientId, transferID, strconv.FormatInt(sent, 10), checksum)
+	if err := conn.WriteLine(end); err != nil {
+		UpdateTransferStatus(transferID, Failed)
+		RemoveTransfer(transferID)
+		return err
+	}
+
+	if err := awaitReceipt(transfer, replies); err != nil {
+		UpdateTransferStatus(transferID, Failed)
+		RemoveTransfer(transferID)
+		return err
+	}
+	UpdateTransferStatus(transferID, Completed)
+	fmt.Fprintf(utils.Output, "%s Stream '%s' delivered (%s)\n",
+		utils.SuccessColor("✅"),
+		utils.SuccessColor(name),
+		formatSize(sent))
+	fmt.Fprintln(utils.Output, utils.InfoColor("  MD5 Checksum:"), utils.InfoColor(checksum))
+	fmt.Fprintln(utils.Output, utils.InfoColor("  Saved by recipient to:"), utils.InfoColor(transfer.SavePath))
+	RemoveTransfer(transferID)
+	return nil
+}
+
+// HandlePipeOffer accepts a stream of unknown length. It goes to a waiting
+// ReceivePipe sink, or otherwise to a file called name in the store path.
+func HandlePipeOffer(conn *protocol.Conn, senderId, senderName, name, remoteID, storeFilePath string) {
+	sink := claimSink(senderId, senderName)
+
+	var writer io.Writer
+	var file *os.File
+	filePath := pipePath
+	if sink != nil {
+		writer = sink.writer
+	} else {
+		fileName, err := helper.SanitizeFileName(name)
+		if err != nil {
+			fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Rejected incoming stream:"), err)
+			declineTransfer(conn, senderId, remoteID, err.Error())
+			return
+		}
+		filePath, err = resolveSavePath(storeFilePath, fileName, GetSettings().ConflictPolicy, false)
+		if err == nil {
+			file, err = os.Create(partialPath(filePath))
+		}
+		if err != nil {
+			fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Error creating file:"), err)
+			declineTransfer(conn, senderId, remoteID, err.Error())
+			return
+		}
+		writer = file
+	}
+
+	transfer := &Transfer{
+		ID:          GenerateTransferID(),
+		Type:        FileTransfer,
+		Name:        name,
+		Status:      Active,
+		Stream:      true,
+		Direction:   "receive",
+		Recipient:   senderId,
+		RemoteID:    remoteID,
+		Path:        filePath,
+		StartTime:   time.Now(),
+		File:        file,
+		Connection:  conn,
+		ProgressBar: utils.CreateProgressBar(-1, "📥 Receiving stream"),
+	}
+	fmt.Fprintf(utils.Output, "%s Receiving stream '%s' from %s (Transfer ID: %s)\n",
+		utils.InfoColor("📥"),
+		utils.InfoColor(name),
+		utils.UserColor(senderName),
+		utils.CommandColor(transfer.ID))
+	RegisterTransfer(transfer)
+
+	// The data is hashed as it is written since standard output cannot be read back
+	sum := md5.New()
+	key := incomingKey(senderId, remoteID)
+	incoming := &incomingTransfer{
+		transfer:  transfer,
+		finish:    func(err error) { finishPipe(transfer, sink, sum, err) },
+		streaming: true,
+	}
+	incoming.writer = incoming.checkpoint(key, io.MultiWriter(writer, sum))
+	incomingMutex.Lock()
+	incomingTransfers[key] = incoming
+	incomingMutex.Unlock()
+
+	if err := acceptTransfer(conn, senderId, remoteID, filePath, 0, 1); err != nil {
+		fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Error accepting stream:"), err)
+	}
+}
+
+// HandlePipeEnd completes an incoming stream once its announced size
+// matches what arrived
+func HandlePipeEnd(senderId, remoteId string, size int64, checksum string) {
+	key := incomingKey(senderId, remoteId)
+
+	incomingMutex.Lock()
+	incoming, exists := incomingTransfers[key]
+	incomingMutex.Unlock()
+	if !exists || !incoming.streaming {
+		return
+	}
+
+	// The end is checked once the data queued before it was written
+	incoming.run(func() {
+		transfer := incoming.transfer
+		transfer.PauseLock.Lock()
+		transfer.Size = size
+		transfer.Checksum = checksum
+		transfer.PauseLock.Unlock()
+		if transfer.BytesComplete.Load() != size {
+			incoming.abort(key, corruptData("stream ended after %d bytes, sender sent %d bytes", transfer.BytesComplete.Load(), size))
+			return
+		}
+		incoming.complete(key)
+	})
+}
+
+// abortStreamsFrom fails the incoming streams of a user who went offline.
+// Unlike files, streams cannot be resumed.
+func abortStreamsFrom(senderId string) {
+	aborted := make(map[string]*incomingTransfer)
+	incomingMutex.Lock()
+	for key, incoming := range incomingTransfers {
+		if incoming.streaming && incoming.transfer.Recipient == senderId {
+			aborted[key] = incoming
+		}
+	}
+	incomingMutex.Unlock()
+
+	for key, incoming := range aborted {
+		incoming.abort(key, fmt.Errorf("user %s went offline before the stream ended", senderId))
+	}
+}
+
+// finishPipe verifies a stream against the checksum the sender announced
+// and reports the outcome to the sender and to the sink that took it
+func finishPipe(transfer *Transfer, sink *pipeSink, sum hash.Hash, err error) {
+	checksum := hex.EncodeToString(sum.Sum(nil))
+	if err == nil && checksum != transfer.Checksum {
+		err = errChecksumMismatch
+	}
+	if transfer.File != nil {
+		if err == nil {
+			err = commitPartial(transfer.File, transfer.Path)
+		} else {
+			discardPartial(transfer.File, transfer.Path)
+		}
+	}
+
+	if err != nil {
+		UpdateTransferStatus(transfer.ID, Failed)
+		fmt.Fprintln(utils.Output, utils.ErrorColor("\n❌ Error receiving stream:"), err)
+		reportReceiveFailure(transfer, err, false)
+	} else {
+		savePath := transfer.Path
+		if sink != nil {
+			savePath = "stdout"
+		} else {
+			indexReceived(transfer.Path, checksum)
+		}
+		sendReceipt(transfer, savePath, checksum)
+		UpdateTransferStatus(transfer.ID, Completed)
+		fmt.Fprintf(utils.Output, "%s Stream '%s' received (%s)\n",
+			utils.SuccessColor("✅"),
+			utils.SuccessColor(transfer.Name),
+			formatSize(transfer.Size))
+		if sink == nil {
+			fmt.Fprintln(utils.Output, utils.InfoColor("📂 Saved to:"), utils.InfoColor(transfer.Path))
+		}
+	}
+	RemoveTransfer(transfer.ID)
+
+	if sink != nil {
+		sink.done <- err
+	}
+}
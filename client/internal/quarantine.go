@@ -0,0 +1,136 @@
+package connection
+
+import (
+	"drizlink/protocol"
+	"drizlink/utils"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// errChecksumMismatch is returned when received data does not match the
+// checksum announced by the sender
+var errChecksumMismatch = corruptData("checksum verification failed")
+
+var (
+	// receiveAttempts counts failed verifications per sender and content
+	receiveAttempts      = make(map[string]int)
+	receiveAttemptsMutex sync.Mutex
+)
+
+// quarantine moves corrupt received data out of the store path into the
+// quarantine folder in the config directory and returns its new location
+func quarantine(path, name string) (string, error) {
+	dir, err := ConfigDir()
+	if err != nil {
+		return "", err
+	}
+	dir = filepath.Join(dir, "quarantine")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+
+	dest := filepath.Join(dir, time.Now().Format("20060102-150405")+"-"+name)
+	if err := os.Rename(path, dest); err != nil {
+		return "", err
+	}
+	return dest, nil
+}
+
+// handleCorruptReceive quarantines data that failed checksum verification
+// and reports the failure to the sender, asking for the transfer again
+// while attempts remain
+func handleCorruptReceive(transfer *Transfer, path string) {
+	if dest, err := quarantine(path, transfer.Name); err != nil {
+		os.Remove(path)
+		fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Could not quarantine corrupt data, deleted it:"), err)
+	} else {
+		fmt.Fprintln(utils.Output, utils.WarningColor("☣ Corrupt data moved to quarantine:"), utils.InfoColor(dest))
+	}
+
+	key := transfer.Recipient + "/" + transfer.Name + "/" + transfer.Checksum
+	receiveAttemptsMutex.Lock()
+	receiveAttempts[key]++
+	attempt := receiveAttempts[key]
+	receiveAttemptsMutex.Unlock()
+
+	// A file of a sync is fetched again by running the sync again
+	maxRetries := GetSettings().RetryAttempts
+	if transfer.Sync != nil {
+		maxRetries = 0
+	}
+	retry := attempt <= maxRetries
+	if retry {
+		fmt.Fprintf(utils.Output, "%s Requesting '%s' again (retry %d of %d)\n",
+			utils.InfoColor("🔁"),
+			utils.InfoColor(transfer.Name),
+			attempt,
+			maxRetries)
+	} else {
+		receiveAttemptsMutex.Lock()
+		delete(receiveAttempts, key)
+		receiveAttemptsMutex.Unlock()
+		if maxRetries > 0 {
+			fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Giving up after"), utils.ErrorColor(maxRetries), utils.ErrorColor("retries"))
+		}
+	}
+
+	reportReceiveFailure(transfer, errChecksumMismatch, retry)
+}
+
+// handleReceiveError disposes of the partial data received for dest after a
+// failed receive and tells the sender what happened
+func handleReceiveError(transfer *Transfer, dest string, err error) {
+	partial := partialPath(dest)
+	switch {
+	case err == errChecksumMismatch:
+		transfer.File.Close()
+		os.Remove(partialMetaPath(partial))
+		handleCorruptReceive(transfer, partial)
+	case isResumable(err):
+		keepPartial(transfer.File)
+		fmt.Fprintln(utils.Output, utils.WarningColor("⚠ Partial data kept; sending it again resumes the transfer"))
+		reportReceiveFailure(transfer, err, false)
+	default:
+		discardPartial(transfer.File, dest)
+		reportReceiveFailure(transfer, err, false)
+	}
+}
+
+// clearReceiveAttempts forgets earlier failures once content arrives intact
+func clearReceiveAttempts(transfer *Transfer) {
+	receiveAttemptsMutex.Lock()
+	delete(receiveAttempts, transfer.Recipient+"/"+transfer.Name+"/"+transfer.Checksum)
+	receiveAttemptsMutex.Unlock()
+}
+
+// reportReceiveFailure tells the sender a received transfer failed and
+// whether it should be sent again
+func reportReceiveFailure(transfer *Transfer, err error, retry bool) {
+	if _, aborted := err.(errSenderAborted); aborted || transfer.Connection == nil {
+		return
+	}
+	err = transfer.Connection.WriteLine(protocol.Format("/TRANSFER_FAILED",
+		transfer.Recipient, transfer.RemoteID, err.Error(), strconv.FormatBool(retry)))
+	if err != nil {
+		fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Error reporting failed transfer:"), err)
+	}
+}
+
+// HandleTransferFailed passes a recipient's report that a transfer we sent
+// could not be stored to the sender waiting for its receipt
+func HandleTransferFailed(recipientId, transferID, reason string, retry bool) {
+	reply := transferReply{Reason: reason, Retry: retry}
+	if HandleTransferReply(recipientId, transferID, reply) {
+		return
+	}
+
+	fmt.Fprintf(utils.Output, "\n%s User %s could not store transfer %s: %s\n",
+		utils.ErrorColor("❌"),
+		utils.UserColor(recipientId),
+		utils.CommandColor(transferID),
+		utils.ErrorColor(reason))
+}
@@ -0,0 +1,114 @@
+package connection
+
+import (
+	"drizlink/protocol"
+	"drizlink/utils"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// sendReceipt confirms to the sender that a received transfer was stored at
+// path and verified against checksum
+func sendReceipt(transfer *Transfer, path, checksum string) {
+	if transfer.Connection == nil {
+		return
+	}
+	err := transfer.Connection.WriteLine(protocol.Format("/RECEIPT",
+		transfer.Recipient, transfer.RemoteID, path, checksum))
+	if err != nil {
+		fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Error sending delivery receipt:"), err)
+	}
+}
+
+// keepReceiptAlive repeats the final progress report of a received
+// transfer every receiptKeepAlive until the returned function is called, so
+// the sender keeps waiting while a large file is verified or a folder is
+// unpacked
+func keepReceiptAlive(transfer *Transfer) (stop func()) {
+	if transfer.Connection == nil {
+		return func() {}
+	}
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(receiptKeepAlive)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				transfer.Connection.WriteLine(protocol.Format("/PROGRESS",
+					transfer.Recipient, transfer.RemoteID, strconv.FormatInt(transfer.BytesComplete.Load(), 10)))
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// errSendAgain is returned by awaitReceipt when the recipient could not
+// store a transfer and asked for it again
+type errSendAgain struct {
+	reason string
+}
+
+func (e errSendAgain) Error() string {
+	return e.reason + " (sending again)"
+}
+
+// awaitReceipt waits until the recipient confirms that transfer was stored
+// intact. replies is the channel registered with expectReply for the
+// transfer's request. It gives up only once the recipient has reported no
+// progress for replyTimeout, and not while it holds the transfer paused. When the recipient reports a failure and asks for a
+// retry it returns errSendAgain, and the caller offers the same transfer
+// again. Streams cannot be read twice, so they fail instead.
+func awaitReceipt(transfer *Transfer, replies chan transferReply) error {
+	UpdateTransferStatus(transfer.ID, AwaitingReceipt)
+	if transfer.Group == nil {
+		fmt.Fprintf(utils.Output, "%s Waiting for user %s to confirm receipt...\n",
+			utils.InfoColor("\n🕓"),
+			utils.UserColor(transfer.Recipient))
+	}
+
+	var reply transferReply
+	transfer.lastHeard.Store(time.Now().UnixNano())
+	for waiting := true; waiting; {
+		silent := time.Since(time.Unix(0, transfer.lastHeard.Load()))
+		select {
+		case reply = <-replies:
+			if reply.err != nil {
+				return reply.err
+			}
+			waiting = false
+		case <-time.After(replyTimeout - silent):
+			if transferPaused(transfer) {
+				transfer.lastHeard.Store(time.Now().UnixNano())
+			} else if time.Since(time.Unix(0, transfer.lastHeard.Load())) >= replyTimeout {
+				return fmt.Errorf("recipient reported no progress for %s", replyTimeout)
+			}
+		}
+	}
+
+	if reply.Accepted {
+		if transfer.Checksum != "" && reply.Checksum != transfer.Checksum {
+			return fmt.Errorf("recipient verified checksum %s, expected %s", reply.Checksum, transfer.Checksum)
+		}
+		transfer.SavePath = reply.Path
+		return nil
+	}
+
+	if !reply.Retry || transfer.Stream {
+		return errors.New(reply.Reason)
+	}
+	fmt.Fprintln(utils.Output, utils.InfoColor("🔁 Recipient asked for"), utils.InfoColor(transfer.Name), utils.InfoColor("again"))
+	return errSendAgain{reason: reply.Reason}
+}
+
+// restartSend prepares a transfer the recipient asked for again to be sent
+// from the start. It keeps its ID, so its group, priority and recipients
+// stay as they were.
+func restartSend(transfer *Transfer) {
+	transfer.resumeFrom(0)
+	UpdateTransferStatus(transfer.ID, Active)
+}
@@ -0,0 +1,235 @@
+package connection
+
+import (
+	"drizlink/utils"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// TransferPriority decides where a new transfer is placed in the send queue
+type TransferPriority int
+
+const (
+	LowPriority TransferPriority = iota
+	NormalPriority
+	HighPriority
+)
+
+// String representation of TransferPriority
+func (p TransferPriority) String() string {
+	switch p {
+	case LowPriority:
+		return "low"
+	case NormalPriority:
+		return "normal"
+	case HighPriority:
+		return "high"
+	default:
+		return "unknown"
+	}
+}
+
+// ParsePriority converts a user supplied priority name
+func ParsePriority(value string) (TransferPriority, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "low":
+		return LowPriority, nil
+	case "normal":
+		return NormalPriority, nil
+	case "high":
+		return HighPriority, nil
+	default:
+		return NormalPriority, fmt.Errorf("unknown priority %q (use high, normal or low)", value)
+	}
+}
+
+// queuedTransfer is an outgoing transfer waiting for a free slot
+type queuedTransfer struct {
+	transfer *Transfer
+	run      func(*Transfer)
+}
+
+// Scheduler runs queued outgoing transfers, at most
+// Settings.MaxConcurrentTransfers at a time. The queue is served strictly
+// front to back: priority only decides where a transfer is inserted, and
+// /move can override the order by hand.
+type Scheduler struct {
+	mutex   sync.Mutex
+	queue   []*queuedTransfer
+	running int
+}
+
+// TransferQueue is the scheduler for all outgoing transfers of this client
+var TransferQueue = &Scheduler{}
+
+// Enqueue registers transfer as Queued and schedules run to perform it.
+// It returns the transfer's 1-based position in the queue.
+func (s *Scheduler) Enqueue(transfer *Transfer, run func(*Transfer)) int {
+	transfer.Status = Queued
+	RegisterTransfer(transfer)
+
+	s.mutex.Lock()
+	entry := &queuedTransfer{transfer: transfer, run: run}
+	index := s.insertionIndex(transfer.Priority)
+	s.queue = append(s.queue, nil)
+	copy(s.queue[index+1:], s.queue[index:])
+	s.queue[index] = entry
+	s.mutex.Unlock()
+
+	s.Dispatch()
+	return s.Position(transfer.ID)
+}
+
+// insertionIndex returns the slot after the last entry of equal or higher
+// priority. Callers must hold s.mutex.
+func (s *Scheduler) insertionIndex(priority TransferPriority) int {
+	index := len(s.queue)
+	for index > 0 && s.queue[index-1].transfer.Priority < priority {
+		index--
+	}
+	return index
+}
+
+// Dispatch starts queued transfers while free slots are available
+func (s *Scheduler) Dispatch() {
+	limit := GetSettings().MaxConcurrentTransfers
+	if limit < 1 {
+		limit = 1
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for s.running < limit && len(s.queue) > 0 {
+		entry := s.queue[0]
+		s.queue = s.queue[1:]
+		s.running++
+
+		UpdateTransferStatus(entry.transfer.ID, Active)
+		go func(entry *queuedTransfer) {
+			entry.run(entry.transfer)
+			s.finished()
+		}(entry)
+	}
+}
+
+// finished releases the slot of a transfer that is no longer running
+func (s *Scheduler) finished() {
+	s.mutex.Lock()
+	s.running--
+	s.mutex.Unlock()
+	s.Dispatch()
+}
+
+// Position returns the 1-based queue position of a transfer, or 0 if it is
+// not queued
+func (s *Scheduler) Position(id string) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.indexOf(id) + 1
+}
+
+// indexOf returns the queue index of a transfer or -1. Callers must hold s.mutex.
+func (s *Scheduler) indexOf(id string) int {
+	for i, entry := range s.queue {
+		if entry.transfer.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// Cancel takes a cancelled transfer out of the queue. It is run at once
+// without taking a slot, so whoever queued it learns it failed.
+func (s *Scheduler) Cancel(id string) {
+	s.mutex.Lock()
+	index := s.indexOf(id)
+	if index < 0 {
+		s.mutex.Unlock()
+		return
+	}
+	entry := s.queue[index]
+	s.queue = append(s.queue[:index], s.queue[index+1:]...)
+	s.mutex.Unlock()
+
+	UpdateTransferStatus(id, Active)
+	go entry.run(entry.transfer)
+}
+
+// SetPriority changes the priority of a queued transfer and moves it behind
+// the last transfer of the same or higher priority
+func (s *Scheduler) SetPriority(id string, priority TransferPriority) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	index := s.indexOf(id)
+	if index < 0 {
+		return fmt.Errorf("transfer %s is not queued", id)
+	}
+
+	entry := s.queue[index]
+	s.queue = append(s.queue[:index], s.queue[index+1:]...)
+	entry.transfer.Priority = priority
+
+	index = s.insertionIndex(priority)
+	s.queue = append(s.queue, nil)
+	copy(s.queue[index+1:], s.queue[index:])
+	s.queue[index] = entry
+	return nil
+}
+
+// Move places a queued transfer at the given 1-based position
+func (s *Scheduler) Move(id string, position int) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	index := s.indexOf(id)
+	if index < 0 {
+		return fmt.Errorf("transfer %s is not queued", id)
+	}
+	if position < 1 || position > len(s.queue) {
+		return fmt.Errorf("position must be between 1 and %d", len(s.queue))
+	}
+
+	entry := s.queue[index]
+	s.queue = append(s.queue[:index], s.queue[index+1:]...)
+	target := position - 1
+	s.queue = append(s.queue, nil)
+	copy(s.queue[target+1:], s.queue[target:])
+	s.queue[target] = entry
+	return nil
+}
+
+// HandleSetPriority handles the /priority command
+func HandleSetPriority(transferID, level string) {
+	priority, err := ParsePriority(level)
+	if err != nil {
+		fmt.Fprintln(utils.Output, utils.ErrorColor("❌"), err)
+		return
+	}
+
+	if err := TransferQueue.SetPriority(transferID, priority); err != nil {
+		fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Failed to change priority:"), err)
+		return
+	}
+
+	fmt.Fprintf(utils.Output, "%s Transfer %s priority set to %s (queue position %d)\n",
+		utils.SuccessColor("✅"),
+		utils.CommandColor(transferID),
+		utils.InfoColor(priority.String()),
+		TransferQueue.Position(transferID))
+}
+
+// HandleMoveTransfer handles the /move command
+func HandleMoveTransfer(transferID string, position int) {
+	if err := TransferQueue.Move(transferID, position); err != nil {
+		fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Failed to move transfer:"), err)
+		return
+	}
+
+	fmt.Fprintf(utils.Output, "%s Transfer %s moved to queue position %d\n",
+		utils.SuccessColor("✅"),
+		utils.CommandColor(transferID),
+		position)
+}
@@ -0,0 +1,160 @@
+package connection
+
+import (
+	"drizlink/protocol"
+	"drizlink/utils"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DeliveryConsent decides what happens to transfers the server held for us
+// while we were offline, and to requests to sync one of our folders
+type DeliveryConsent string
+
+const (
+	// AcceptOfflineDelivery downloads held transfers as soon as we reconnect
+	AcceptOfflineDelivery DeliveryConsent = "accept"
+	// AskOfflineDelivery lists held transfers and waits for /spool accept
+	AskOfflineDelivery DeliveryConsent = "ask"
+	// RejectOfflineDelivery refuses held transfers
+	RejectOfflineDelivery DeliveryConsent = "reject"
+)
+
+// ParseDeliveryConsent converts a user supplied consent setting
+func ParseDeliveryConsent(value string) (DeliveryConsent, error) {
+	switch consent := DeliveryConsent(strings.ToLower(strings.TrimSpace(value))); consent {
+	case AcceptOfflineDelivery, AskOfflineDelivery, RejectOfflineDelivery:
+		return consent, nil
+	default:
+		return "", fmt.Errorf("unknown value %q (use accept, ask or reject)", value)
+	}
+}
+
+// spoolOffer is a transfer the server is holding for us
+type spoolOffer struct {
+	ID     string
+	Sender string
+	Kind   string
+	Name   string
+	Size   int64
+}
+
+var (
+	spoolOffers      = make(map[string]spoolOffer)
+	spoolOffersMutex sync.Mutex
+)
+
+// HandleSpoolOffer handles a transfer the server held while we were offline
+func HandleSpoolOffer(conn *protocol.Conn, offer spoolOffer) {
+	fmt.Fprintf(utils.Output, "%s %s sent you %s '%s' (%s) while you were away\n",
+		utils.InfoColor("📬"),
+		utils.UserColor(offer.Sender),
+		offer.Kind,
+		utils.InfoColor(offer.Name),
+		formatSize(offer.Size))
+
+	switch GetSettings().OfflineDelivery {
+	case AcceptOfflineDelivery:
+		respondToSpoolOffer(conn, offer.ID, true)
+	case RejectOfflineDelivery:
+		fmt.Fprintln(utils.Output, utils.WarningColor("⏭ Refused (offline-delivery is set to reject)"))
+		respondToSpoolOffer(conn, offer.ID, false)
+	default:
+		spoolOffersMutex.Lock()
+		spoolOffers[offer.ID] = offer
+		spoolOffersMutex.Unlock()
+		fmt.Fprintf(utils.Output, "  Use %s or %s\n",
+			utils.CommandColor("/spool accept "+offer.ID),
+			utils.CommandColor("/spool reject "+offer.ID))
+	}
+}
+
+func respondToSpoolOffer(conn *protocol.Conn, id string, accept bool) {
+	command := "/SPOOL_REJECT"
+	if accept {
+		command = "/SPOOL_ACCEPT"
+	}
+	if err := conn.WriteLine(protocol.Format(command, id)); err != nil {
+		fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Error answering held transfer:"), err)
+	}
+}
+
+// HandleSpool handles the /spool command: without arguments it lists held
+// transfers, otherwise it accepts or rejects one of them or all of them
+func HandleSpool(conn *protocol.Conn, args []string) {
+	spoolOffersMutex.Lock()
+	defer spoolOffersMutex.Unlock()
+
+	if len(args) == 0 {
+		if len(spoolOffers) == 0 {
+			fmt.Fprintln(utils.Output, utils.InfoColor("📬 No transfers waiting on the server"))
+			return
+		}
+		ids := make([]string, 0, len(spoolOffers))
+		for id := range spoolOffers {
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(i, j int) bool {
+			a, _ := strconv.Atoi(ids[i][1:])
+			b, _ := strconv.Atoi(ids[j][1:])
+			return a < b
+		})
+		fmt.Fprintln(utils.Output, utils.HeaderColor("📬 Transfers waiting on the server:"))
+		for _, id := range ids {
+			offer := spoolOffers[id]
+			fmt.Fprintf(utils.Output, "  %s %s '%s' (%s) from %s\n",
+				utils.CommandColor(id),
+				offer.Kind,
+				utils.InfoColor(offer.Name),
+				formatSize(offer.Size),
+				utils.UserColor(offer.Sender))
+		}
+		return
+	}
+
+	if len(args) != 2 || (args[0] != "accept" && args[0] != "reject") {
+		fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Invalid arguments. Use: /spool [accept|reject <id>|all]"))
+		return
+	}
+	accept := args[0] == "accept"
+
+	var ids []string
+	if args[1] == "all" {
+		for id := range spoolOffers {
+			ids = append(ids, id)
+		}
+	} else if _, exists := spoolOffers[args[1]]; exists {
+		ids = append(ids, args[1])
+	} else {
+		fmt.Fprintln(utils.Output, utils.ErrorColor("❌ No held transfer with ID"), utils.CommandColor(args[1]))
+		return
+	}
+
+	for _, id := range ids {
+		respondToSpoolOffer(conn, id, accept)
+		delete(spoolOffers, id)
+	}
+}
+
+// HandleSpoolStatus reports what became of a transfer the server held for
+// an offline recipient
+func HandleSpoolStatus(recipientId, name, status, detail string) {
+	switch status {
+	case "delivered":
+		fmt.Fprintf(utils.Output, "%s '%s' was delivered to user %s (saved to %s)\n",
+			utils.SuccessColor("📬"),
+			utils.InfoColor(name),
+			utils.UserColor(recipientId),
+			utils.InfoColor(detail))
+	default:
+		fmt.Fprintf(utils.Output, "%s '%s' held for user %s was %s: %s\n",
+			utils.WarningColor("📭"),
+			utils.InfoColor(name),
+			utils.UserColor(recipientId),
+			status,
+			detail)
+	}
+}
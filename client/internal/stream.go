@@ -0,0 +1,501 @@
+package connection
+
+import (
+	"drizlink/protocol"
+	"drizlink/utils"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// chunkSize is the payload size of each /CHUNK frame
+const chunkSize = 32768
+
+// progressInterval is how often a receiver reports its progress to the sender
+const progressInterval = 500 * time.Millisecond
+
+// replyTimeout bounds how long a sender waits for the recipient to accept,
+// and how long a recipient may stay silent before confirming receipt
+const replyTimeout = 2 * time.Minute
+
+// receiptKeepAlive is how often a receiver that is still verifying or
+// saving a transfer tells the sender it is working on it
+const receiptKeepAlive = 30 * time.Second
+
+// transferReply is the recipient's answer to a file or folder request
+type transferReply struct {
+	Accepted bool
+	Path     string // where the recipient saves the data
+	Offset   int64  // bytes the recipient already has from an interrupted attempt
+	Checksum string // checksum the recipient verified, in delivery receipts
+	Reason   string // why the transfer was declined or failed
+	Retry    bool   // whether the recipient asks for a failed transfer again
+	Streams  int    // parallel data streams the recipient accepts
+	// BlockSize and Blocks describe the signatures of an older copy the
+	// recipient offers for a delta transfer
+	BlockSize int
+	Blocks    int
+	Chunked   bool  // the recipient offers its chunk store for a recipe
+	err       error // set instead of an answer when the connection was lost
+}
+
+// incomingTransfer is a receive in progress whose data arrives in /CHUNK
+// frames interleaved with other traffic on the connection, or in /RANGE
+// frames spread over parallel data streams. The frames are handled in order
+// on a goroutine of the transfer's own, so a paused or slow receive never
+// stops the connection from being read.
+type incomingTransfer struct {
+	transfer *Transfer
+	writer   io.Writer
+	file     *os.File // target of out of order /RANGE writes, if any
+	// finish is called once with nil when all bytes arrived, or with the
+	// error that aborted the transfer
+	finish     func(err error)
+	mutex      sync.Mutex
+	lastReport time.Time
+	contiguous int64           // leading bytes known to be written
+	segments   map[int64]int64 // ranges written beyond contiguous, start to end
+	ranged     bool            // data arrived out of order
+	base       *deltaBase      // older copy /DELTA_COPY refers to, if any
+	chunks     *chunkedReceive // chunk store /REUSE refers to, if any
+	streaming  bool            // length unknown until /PIPE_END
+
+	taskQueue // work waiting for the transfer's goroutine
+}
+
+// taskQueue runs work in the order it was queued on a goroutine of its own,
+// which exists only while there is work
+type taskQueue struct {
+	tasks      []func()
+	running    bool // whether the goroutine is working through tasks
+	tasksMutex sync.Mutex
+}
+
+var (
+	incomingTransfers = make(map[string]*incomingTransfer)
+	incomingMutex     sync.Mutex
+
+	pendingReplies      = make(map[string]chan transferReply)
+	pendingRepliesMutex sync.Mutex
+
+	// offerQueue prepares incoming offers in the order they arrived. Looking
+	// for a copy we already have can hash large files, which must not keep
+	// the connection from being read.
+	offerQueue taskQueue
+)
+
+// incomingKey identifies a transfer by the sender and the sender's transfer
+// ID, since transfer IDs are only unique per client
+func incomingKey(senderId, remoteId string) string {
+	return senderId + "/" + remoteId
+}
+
+// expectReply prepares to receive the recipient's answers for a transfer: its
+// decision and later its receipt. It must be called before the request is
+// sent so a fast reply is not lost, and released with cancelReply.
+func expectReply(recipientId, transferID string) chan transferReply {
+	replies := make(chan transferReply, 2)
+	pendingRepliesMutex.Lock()
+	pendingReplies[incomingKey(recipientId, transferID)] = replies
+	pendingRepliesMutex.Unlock()
+	return replies
+}
+
+// awaitReply waits for the next answer registered with expectReply
+func awaitReply(recipientId, transferID string, replies chan transferReply) (transferReply, error) {
+	select {
+	case reply := <-replies:
+		return reply, reply.err
+	case <-time.After(replyTimeout):
+		return transferReply{}, fmt.Errorf("recipient did not answer within %s", replyTimeout)
+	}
+}
+
+// cancelReply stops waiting for an answer that is no longer needed
+func cancelReply(recipientId, transferID string) {
+	pendingRepliesMutex.Lock()
+	delete(pendingReplies, incomingKey(recipientId, transferID))
+	pendingRepliesMutex.Unlock()
+}
+
+// HandleTransferReply delivers an answer from the recipient (accept,
+// decline, receipt or failure) to the waiting sender. It reports whether
+// anyone was waiting for it.
+func HandleTransferReply(recipientId, transferID string, reply transferReply) bool {
+	// Whatever the recipient answers, it no longer holds the transfer paused
+	setPeerPaused(recipientId, transferID, false)
+
+	pendingRepliesMutex.Lock()
+	replies, exists := pendingReplies[incomingKey(recipientId, transferID)]
+	pendingRepliesMutex.Unlock()
+	if !exists {
+		return false
+	}
+
+	select {
+	case replies <- reply:
+	default:
+	}
+	return true
+}
+
+// acceptTransfer tells the sender to start streaming from offset, where the
+// data goes and over how many parallel streams it may be sent
+func acceptTransfer(conn *protocol.Conn, senderId, remoteID, savePath string, offset int64, streams int) error {
+	return conn.WriteLine(protocol.Format("/TRANSFER_ACCEPT",
+		senderId, remoteID, savePath, strconv.FormatInt(offset, 10), strconv.Itoa(streams)))
+}
+
+// declineTransfer tells the sender the transfer will not be received
+func declineTransfer(conn *protocol.Conn, senderId, remoteID, reason string) error {
+	downloadFailed(senderId, "declined: "+reason)
+	return conn.WriteLine(protocol.Format("/TRANSFER_DECLINE", senderId, remoteID, reason))
+}
+
+// abortSend tells the recipient we stopped sending transfer because of err,
+// so it can keep what arrived for a later attempt. The connection may be
+// what failed, so a notice that cannot be sent is not reported.
+func abortSend(conn *protocol.Conn, transfer *Transfer, err error) {
+	conn.WriteLine(protocol.Format("/TRANSFER_ABORT", transfer.Recipient, transfer.ID, err.Error()))
+}
+
+// streamTransfer sends the rest of the transfer from reader to the
+// recipient as /CHUNK frames, honouring pause requests. Sending starts at
+// transfer.BytesComplete and the returned count includes those bytes.
+func streamTransfer(conn *protocol.Conn, transfer *Transfer, reader io.Reader) (int64, error) {
+	checkpointed := NewCheckpointedReader(reader, transfer, chunkSize)
+	buffer := make([]byte, chunkSize)
+
+	sent := transfer.BytesComplete.Load()
+	for sent < transfer.Size {
+		want := int64(chunkSize)
+		if remaining := transfer.Size - sent; remaining < want {
+			want = remaining
+		}
+
+		n, err := checkpointed.Read(buffer[:want])
+		if n > 0 {
+			header := protocol.Format("/CHUNK", transfer.Recipient, transfer.ID, strconv.Itoa(n))
+			if writeErr := conn.WriteFrame(header, buffer[:n]); writeErr != nil {
+				return sent, writeErr
+			}
+			sent += int64(n)
+		}
+		if err == io.EOF {
+			return sent, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return sent, err
+		}
+	}
+	return sent, nil
+}
+
+// receiveTransfer starts accepting /CHUNK frames for transfer from senderId.
+// finish runs once all transfer.Size bytes have been written to writer.
+func receiveTransfer(senderId string, transfer *Transfer, writer io.Writer, finish func(err error)) {
+	key := incomingKey(senderId, transfer.RemoteID)
+	incoming := &incomingTransfer{
+		transfer:   transfer,
+		finish:     finish,
+		contiguous: transfer.BytesComplete.Load(),
+	}
+	incoming.writer = incoming.checkpoint(key, writer)
+	if file, ok := writer.(*os.File); ok {
+		incoming.file = file
+	}
+
+	if transfer.BytesComplete.Load() >= transfer.Size {
+		incoming.run(func() { finish(nil) })
+		return
+	}
+
+	incomingMutex.Lock()
+	incomingTransfers[key] = incoming
+	incomingMutex.Unlock()
+}
+
+// checkpoint wraps writer so that writes wait while the transfer is paused,
+// and stop waiting once it was aborted
+func (incoming *incomingTransfer) checkpoint(key string, writer io.Writer) io.Writer {
+	checkpointed := NewCheckpointedWriter(writer, incoming.transfer, chunkSize)
+	paused := checkpointed.PauseCheck
+	checkpointed.PauseCheck = func() bool {
+		return paused() && incoming.registered(key)
+	}
+	return checkpointed
+}
+
+// HandleChunk writes one frame of incoming transfer data
+func HandleChunk(senderId, remoteId string, payload []byte) {
+	key := incomingKey(senderId, remoteId)
+
+	incomingMutex.Lock()
+	incoming, exists := incomingTransfers[key]
+	incomingMutex.Unlock()
+	if !exists {
+		return
+	}
+
+	incoming.run(func() { incoming.write(key, payload) })
+}
+
+// run queues task behind the earlier work and makes sure the queue's
+// goroutine is working through it
+func (queue *taskQueue) run(task func()) {
+	queue.tasksMutex.Lock()
+	defer queue.tasksMutex.Unlock()
+	queue.tasks = append(queue.tasks, task)
+	if !queue.running {
+		queue.running = true
+		go queue.drain()
+	}
+}
+
+// drain runs the queued work in order until none is left. Frames that
+// arrive while a transfer is paused wait in its queue.
+func (queue *taskQueue) drain() {
+	for {
+		queue.tasksMutex.Lock()
+		if len(queue.tasks) == 0 {
+			queue.running = false
+			queue.tasksMutex.Unlock()
+			return
+		}
+		task := queue.tasks[0]
+		queue.tasks[0] = nil
+		queue.tasks = queue.tasks[1:]
+		queue.tasksMutex.Unlock()
+
+		task()
+	}
+}
+
+// write appends payload to the incoming data. It reports false when the
+// transfer was aborted.
+func (incoming *incomingTransfer) write(key string, payload []byte) bool {
+	if !incoming.registered(key) {
+		return false
+	}
+	transfer := incoming.transfer
+	if !incoming.streaming && transfer.BytesComplete.Load()+int64(len(payload)) > transfer.Size {
+		incoming.abort(key, corruptData("received more data than announced (%d bytes)", transfer.Size))
+		return false
+	}
+
+	if _, err := incoming.writer.Write(payload); err != nil {
+		incoming.abort(key, err)
+		return false
+	}
+	transfer.trackProgress(payload)
+	incoming.reportProgress()
+
+	if !incoming.streaming && transfer.BytesComplete.Load() == transfer.Size {
+		incoming.complete(key)
+	}
+	return true
+}
+
+// reportProgress tells the sender how much has been written, at most once
+// per progressInterval and always for the final chunk
+func (incoming *incomingTransfer) reportProgress() {
+	transfer := incoming.transfer
+	incoming.mutex.Lock()
+	written := transfer.BytesComplete.Load()
+	if (written < transfer.Size || incoming.streaming) && time.Since(incoming.lastReport) < progressInterval {
+		incoming.mutex.Unlock()
+		return
+	}
+	incoming.lastReport = time.Now()
+	contiguous, ranged := incoming.contiguous, incoming.ranged
+	incoming.mutex.Unlock()
+
+	// Out of order data leaves holes, so record how far the partial file
+	// can be trusted should the transfer be interrupted
+	if ranged && written < transfer.Size {
+		savePartialProgress(incoming.file.Name(), contiguous)
+	}
+
+	if transfer.Connection == nil {
+		return
+	}
+	err := transfer.Connection.WriteLine(protocol.Format("/PROGRESS",
+		transfer.Recipient, transfer.RemoteID, strconv.FormatInt(written, 10)))
+	if err != nil {
+		fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Error reporting progress:"), err)
+	}
+}
+
+// notifySenderPause asks the sender of a receive to stop or start sending
+// again, so the data of a paused transfer does not pile up here
+func notifySenderPause(transfer *Transfer, paused bool) {
+	if transfer.Direction != "receive" || transfer.Connection == nil {
+		return
+	}
+	command := "/TRANSFER_RESUME"
+	if paused {
+		command = "/TRANSFER_PAUSE"
+	}
+	if err := transfer.Connection.WriteLine(protocol.Format(command, transfer.Recipient, transfer.RemoteID)); err != nil {
+		fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Error telling the sender:"), err)
+	}
+}
+
+// HandlePeerPause holds or continues a send whose recipient paused or
+// resumed receiving it
+func HandlePeerPause(recipientId, transferID string, paused bool) {
+	transfer, changed := setPeerPaused(recipientId, transferID, paused)
+	if !changed {
+		return
+	}
+	icon, action := utils.SuccessColor("▶"), "resumed"
+	if paused {
+		icon, action = utils.WarningColor("⏸"), "paused"
+	}
+	fmt.Fprintf(utils.Output, "%s User %s %s receiving '%s'\n",
+		icon,
+		utils.UserColor(recipientId),
+		action,
+		utils.InfoColor(transfer.Name))
+	publishTransfer(TransferUpdatedEvent, transfer)
+}
+
+// setPeerPaused records whether recipientId holds our send transferID
+// paused and reports whether that changed
+func setPeerPaused(recipientId, transferID string, paused bool) (*Transfer, bool) {
+	transfer, exists := GetTransfer(transferID)
+	if !exists || transfer.Direction != "send" || transfer.Recipient != recipientId {
+		return nil, false
+	}
+	transfer.PauseLock.Lock()
+	defer transfer.PauseLock.Unlock()
+	changed := transfer.peerPaused != paused
+	transfer.peerPaused = paused
+	return transfer, changed
+}
+
+// HandleProgressAck records how much of a transfer we are sending the
+// recipient has written
+func HandleProgressAck(recipientId, transferID string, bytes int64) {
+	transfer, exists := GetTransfer(transferID)
+	if !exists || transfer.Direction != "send" || transfer.Recipient != recipientId {
+		return
+	}
+	transfer.lastHeard.Store(time.Now().UnixNano())
+	transfer.trackDelivered(bytes)
+}
+
+// abort stops an incoming transfer and reports err to its owner once the
+// work queued before it is done
+func (incoming *incomingTransfer) abort(key string, err error) {
+	if !incoming.unregister(key) {
+		return
+	}
+	incoming.run(func() {
+		// Record how far out of order data got, so resuming keeps it all
+		incoming.mutex.Lock()
+		contiguous, ranged := incoming.contiguous, incoming.ranged
+		incoming.mutex.Unlock()
+		if ranged {
+			savePartialProgress(incoming.file.Name(), contiguous)
+		}
+		incoming.finish(err)
+	})
+}
+
+// complete reports a fully received transfer to its owner. Verifying and
+// saving it happen on the transfer's goroutine, not the connection's.
+func (incoming *incomingTransfer) complete(key string) {
+	if incoming.unregister(key) {
+		incoming.run(func() {
+			stop := keepReceiptAlive(incoming.transfer)
+			defer stop()
+			incoming.finish(nil)
+		})
+	}
+}
+
+// HandleTransferAbort fails an incoming transfer its sender stopped sending.
+// What arrived so far is kept so the transfer can resume.
+func HandleTransferAbort(senderId, remoteId, reason string) {
+	key := incomingKey(senderId, remoteId)
+
+	incomingMutex.Lock()
+	incoming, exists := incomingTransfers[key]
+	incomingMutex.Unlock()
+	if !exists {
+		return
+	}
+	incoming.abort(key, errSenderAborted{reason: reason})
+}
+
+// errSenderAborted fails a transfer its sender stopped. The sender already
+// knows, so the failure is not reported back.
+type errSenderAborted struct {
+	reason string
+}
+
+func (e errSenderAborted) Error() string {
+	return "sender stopped the transfer: " + e.reason
+}
+
+// abortIncoming fails every incoming transfer once the connection they
+// arrive on is lost. Their partial data is kept as for any interruption.
+func abortIncoming(err error) {
+	aborted := make(map[string]*incomingTransfer)
+	incomingMutex.Lock()
+	for key, incoming := range incomingTransfers {
+		aborted[key] = incoming
+	}
+	incomingMutex.Unlock()
+
+	for key, incoming := range aborted {
+		incoming.abort(key, err)
+	}
+}
+
+// connectionLost ends what waits for the server once the connection to it
+// is gone: transfers still arriving, sends waiting for an answer or held
+// paused by their recipient, and a stream receive. Otherwise they would
+// wait for their timeouts, or forever.
+func connectionLost(err error) {
+	abortIncoming(err)
+	abortSink(err)
+
+	for _, transfer := range ListTransfers() {
+		if transfer.Direction == "send" {
+			setPeerPaused(transfer.Recipient, transfer.ID, false)
+		}
+	}
+
+	pendingRepliesMutex.Lock()
+	defer pendingRepliesMutex.Unlock()
+	for _, replies := range pendingReplies {
+		select {
+		case replies <- transferReply{err: err}:
+		default:
+		}
+	}
+}
+
+// registered reports whether frames are still routed to incoming
+func (incoming *incomingTransfer) registered(key string) bool {
+	incomingMutex.Lock()
+	defer incomingMutex.Unlock()
+	return incomingTransfers[key] == incoming
+}
+
+// unregister stops routing frames to incoming. It reports false when another
+// stream already finished or aborted the transfer.
+func (incoming *incomingTransfer) unregister(key string) bool {
+	incomingMutex.Lock()
+	defer incomingMutex.Unlock()
+	if incomingTransfers[key] != incoming {
+		return false
+	}
+	delete(incomingTransfers, key)
+	return true
+}
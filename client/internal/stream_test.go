@@ -0,0 +1,47 @@
+package connection
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTaskQueueRunsInOrder(t *testing.T) {
+	var queue taskQueue
+	var mutex sync.Mutex
+	var order []int
+	active := 0
+	done := make(chan struct{})
+
+	const tasks = 100
+	for i := 0; i < tasks; i++ {
+		queue.run(func() {
+			mutex.Lock()
+			active++
+			if active > 1 {
+				t.Error("two tasks ran at once")
+			}
+			mutex.Unlock()
+			time.Sleep(10 * time.Microsecond)
+
+			mutex.Lock()
+			active--
+			order = append(order, i)
+			mutex.Unlock()
+			if i == tasks-1 {
+				close(done)
+			}
+		})
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the queued tasks did not finish")
+	}
+	for i, task := range order {
+		if task != i {
+			t.Fatalf("task %d ran in place %d", task, i)
+		}
+	}
+}
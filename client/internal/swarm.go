@@ -0,0 +1,712 @@
+package connection
+
+import (
+	"bytes"
+	"crypto/md5"
+	"drizlink/helper"
+	"drizlink/protocol"
+	"drizlink/utils"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// swarmPieceSize is the smallest piece a /get download is split into.
+	// Pieces grow for large files so their hashes fit in one frame.
+	swarmPieceSize = 256 << 10
+	// swarmPiecesPerPeer is how many pieces are requested from one peer at
+	// a time
+	swarmPiecesPerPeer = 4
+	// swarmTimeout is how long the server or a peer gets to answer
+	swarmTimeout = 30 * time.Second
+	// advertiseInterval is how often the store path is checked for files to
+	// advertise
+	advertiseInterval = time.Minute
+	// advertiseBatch is how many files one /SWARM_HAVE lists
+	advertiseBatch = 50
+)
+
+// sharedFile is a file in the store path other users can fetch by checksum
+type sharedFile struct {
+	Path string
+	Size int64
+}
+
+// pieceMap holds the MD5 of every piece of a shared file
+type pieceMap struct {
+	ModTime   time.Time
+	PieceSize int
+	Hashes    []byte
+}
+
+var (
+	sharedFiles      = make(map[string]sharedFile)
+	sharedStorePath  string
+	advertiseStarted bool
+	sharedMutex      sync.Mutex
+	// advertiseMutex keeps two scans of the store path from overlapping
+	advertiseMutex sync.Mutex
+
+	pieceMaps      = make(map[string]*pieceMap)
+	pieceMapsMutex sync.Mutex
+)
+
+// HandleSwarmMessage handles the messages of content addressed downloads:
+// the server asking for the files to advertise, the answer to a lookup, and
+// requests and pieces exchanged with other users
+func HandleSwarmMessage(conn *protocol.Conn, args []string, payload []byte) {
+	command := args[0]
+	switch {
+	case command == "/SWARM_ADVERTISE" && len(args) == 2:
+		startAdvertising(conn, args[1])
+	case command == "/SWARM_SOURCES":
+		var sources swarmSources
+		if len(args) >= 4 {
+			sources.Size, _ = strconv.ParseInt(args[2], 10, 64)
+			sources.Name = args[3]
+			sources.Peers = args[4:]
+		}
+		if download := lookupSwarmDownload(args[1]); download != nil {
+			select {
+			case download.sources <- sources:
+			default:
+			}
+		}
+	case command == "/SWARM_MAP" && len(args) == 3:
+		go servePieceMap(conn, args[1], args[2])
+	case command == "/SWARM_WANT" && len(args) == 4:
+		index, err := strconv.Atoi(args[3])
+		if err != nil {
+			return
+		}
+		go servePiece(conn, args[1], args[2], index)
+	case command == "/SWARM_PIECES" && len(args) == 5:
+		pieceSize, _ := strconv.Atoi(args[3])
+		deliverSwarmEvent(args[2], swarmEvent{Peer: args[1], Index: -1, PieceSize: pieceSize, Data: payload})
+	case command == "/SWARM_PIECE" && len(args) == 5:
+		index, err := strconv.Atoi(args[3])
+		if err != nil {
+			return
+		}
+		deliverSwarmEvent(args[2], swarmEvent{Peer: args[1], Index: index, Data: payload})
+	case command == "/SWARM_MISSING" && len(args) == 4:
+		deliverSwarmEvent(args[2], swarmEvent{Peer: args[1], Missing: args[3]})
+	}
+}
+
+// startAdvertising lists the files in storePath with the server and keeps
+// the list current. The server asks for it after every login.
+func startAdvertising(conn *protocol.Conn, storePath string) {
+	sharedMutex.Lock()
+	sharedStorePath = storePath
+	sharedFiles = make(map[string]sharedFile)
+	started := advertiseStarted
+	advertiseStarted = true
+	sharedMutex.Unlock()
+
+	if started {
+		go advertise(conn)
+		return
+	}
+	go func() {
+		for {
+			advertise(conn)
+			time.Sleep(advertiseInterval)
+		}
+	}()
+}
+
+// advertise scans the store path and tells the server which files appeared
+// or went away since the last scan
+func advertise(conn *protocol.Conn) {
+	advertiseMutex.Lock()
+	defer advertiseMutex.Unlock()
+
+	sharedMutex.Lock()
+	root := sharedStorePath
+	sharedMutex.Unlock()
+	found := scanShared(root)
+
+	sharedMutex.Lock()
+	var added, dropped []string
+	for checksum := range found {
+		if _, exists := sharedFiles[checksum]; !exists {
+			added = append(added, checksum)
+		}
+	}
+	for checksum := range sharedFiles {
+		if _, exists := found[checksum]; !exists {
+			dropped = append(dropped, checksum)
+		}
+	}
+	sharedFiles = found
+	sharedMutex.Unlock()
+	sort.Strings(added)
+	sort.Strings(dropped)
+
+	for start := 0; start < len(added); start += advertiseBatch {
+		end := start + advertiseBatch
+		if end > len(added) {
+			end = len(added)
+		}
+		fields := make([]string, 0, 3*(end-start))
+		for _, checksum := range added[start:end] {
+			file := found[checksum]
+			fields = append(fields, checksum, strconv.FormatInt(file.Size, 10), filepath.Base(file.Path))
+		}
+		if err := conn.WriteLine(protocol.Format("/SWARM_HAVE", fields...)); err != nil {
+			return
+		}
+	}
+	for start := 0; start < len(dropped); start += advertiseBatch {
+		end := start + advertiseBatch
+		if end > len(dropped) {
+			end = len(dropped)
+		}
+		if err := conn.WriteLine(protocol.Format("/SWARM_DROP", dropped[start:end]...)); err != nil {
+			return
+		}
+	}
+}
+
+// scanShared returns the files below root by checksum. Hidden files and
+// folders, partial receives and empty files are left out.
+func scanShared(root string) map[string]sharedFile {
+	found := make(map[string]sharedFile)
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return found
+	}
+
+	contentIndexMutex.Lock()
+	defer contentIndexMutex.Unlock()
+	loadContentIndex()
+
+	changed := false
+	filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if path != root && strings.HasPrefix(entry.Name(), ".") {
+			if entry.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil || info.Size() == 0 {
+			return nil
+		}
+		checksum, updated, err := indexedChecksum(path, info)
+		changed = changed || updated
+		if _, exists := found[checksum]; err == nil && !exists {
+			found[checksum] = sharedFile{Path: path, Size: info.Size()}
+		}
+		return nil
+	})
+
+	if changed {
+		saveContentIndex()
+	}
+	return found
+}
+
+// shareReceived advertises a file that was just fetched, so it is offered
+// to others without waiting for the next scan
+func shareReceived(conn *protocol.Conn, path, checksum string, size int64) {
+	sharedMutex.Lock()
+	_, exists := sharedFiles[checksum]
+	if !exists {
+		sharedFiles[checksum] = sharedFile{Path: path, Size: size}
+	}
+	sharedMutex.Unlock()
+	if !exists {
+		conn.WriteLine(protocol.Format("/SWARM_HAVE", checksum, strconv.FormatInt(size, 10), filepath.Base(path)))
+	}
+}
+
+// lookupShared returns the advertised file with checksum, provided it has
+// not changed size since the scan
+func lookupShared(checksum string) (sharedFile, os.FileInfo, error) {
+	sharedMutex.Lock()
+	file, exists := sharedFiles[checksum]
+	sharedMutex.Unlock()
+	if !exists {
+		return file, nil, fmt.Errorf("file not shared")
+	}
+	info, err := os.Stat(file.Path)
+	if err != nil || info.Size() != file.Size {
+		return file, nil, fmt.Errorf("file changed")
+	}
+	return file, info, nil
+}
+
+// swarmPieceSizeFor returns the piece size for a file of size bytes, and
+// false when the file has too many pieces for their hashes to fit in a frame
+func swarmPieceSizeFor(size int64) (int, bool) {
+	pieceSize := swarmPieceSize
+	pieces := func() int64 { return (size + int64(pieceSize) - 1) / int64(pieceSize) }
+	for pieces()*md5.Size > protocol.MaxChunkSize && pieceSize < protocol.MaxChunkSize {
+		pieceSize *= 2
+	}
+	return pieceSize, pieces()*md5.Size <= protocol.MaxChunkSize
+}
+
+// servePieceMap sends requester the piece hashes of the shared file with
+// checksum. The file is hashed once and checked against checksum, so a file
+// edited since the last scan is reported missing rather than served.
+func servePieceMap(conn *protocol.Conn, requester, checksum string) {
+	pieces, err := loadPieceMap(checksum)
+	if err != nil {
+		conn.WriteLine(protocol.Format("/SWARM_MISSING", requester, checksum, err.Error()))
+		return
+	}
+	header := protocol.Format("/SWARM_PIECES", requester, checksum,
+		strconv.Itoa(pieces.PieceSize), strconv.Itoa(len(pieces.Hashes)))
+	conn.WriteFrame(header, pieces.Hashes)
+}
+
+func loadPieceMap(checksum string) (*pieceMap, error) {
+	shared, info, err := lookupShared(checksum)
+	if err != nil {
+		return nil, err
+	}
+
+	pieceMapsMutex.Lock()
+	cached, exists := pieceMaps[checksum]
+	pieceMapsMutex.Unlock()
+	if exists && cached.ModTime.Equal(info.ModTime()) {
+		return cached, nil
+	}
+
+	pieceSize, ok := swarmPieceSizeFor(shared.Size)
+	if !ok {
+		return nil, fmt.Errorf("file too large to share in pieces")
+	}
+	file, err := os.Open(shared.Path)
+	if err != nil {
+		return nil, fmt.Errorf("file not readable")
+	}
+	defer file.Close()
+
+	whole := md5.New()
+	pieces := &pieceMap{ModTime: info.ModTime(), PieceSize: pieceSize}
+	buffer := make([]byte, pieceSize)
+	for {
+		n, err := io.ReadFull(file, buffer)
+		if n > 0 {
+			sum := md5.Sum(buffer[:n])
+			pieces.Hashes = append(pieces.Hashes, sum[:]...)
+			whole.Write(buffer[:n])
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("file not readable")
+		}
+	}
+	if !helper.VerifyChecksum(checksum, hex.EncodeToString(whole.Sum(nil))) {
+		return nil, fmt.Errorf("file changed")
+	}
+
+	pieceMapsMutex.Lock()
+	pieceMaps[checksum] = pieces
+	pieceMapsMutex.Unlock()
+	return pieces, nil
+}
+
+// servePiece sends requester piece index of the shared file with checksum.
+// The requester verifies it against the piece map.
+func servePiece(conn *protocol.Conn, requester, checksum string, index int) {
+	missing := func(reason string) {
+		conn.WriteLine(protocol.Format("/SWARM_MISSING", requester, checksum, reason))
+	}
+	shared, _, err := lookupShared(checksum)
+	if err != nil {
+		missing(err.Error())
+		return
+	}
+	pieceSize, ok := swarmPieceSizeFor(shared.Size)
+	offset := int64(index) * int64(pieceSize)
+	if !ok || index < 0 || offset >= shared.Size {
+		missing("no such piece")
+		return
+	}
+	length := int64(pieceSize)
+	if offset+length > shared.Size {
+		length = shared.Size - offset
+	}
+
+	file, err := os.Open(shared.Path)
+	if err != nil {
+		missing("file not readable")
+		return
+	}
+	defer file.Close()
+	data := make([]byte, length)
+	if _, err := file.ReadAt(data, offset); err != nil {
+		missing("file not readable")
+		return
+	}
+	header := protocol.Format("/SWARM_PIECE", requester, checksum, strconv.Itoa(index), strconv.Itoa(len(data)))
+	conn.WriteFrame(header, data)
+}
+
+// swarmSources is the server's answer to a lookup: the users holding some
+// content, its size and a name it is stored under
+type swarmSources struct {
+	Size  int64
+	Name  string
+	Peers []string
+}
+
+// swarmEvent is an answer from a peer: the piece map (Index -1), a piece,
+// or the reason it cannot serve the content
+type swarmEvent struct {
+	Peer      string
+	Index     int
+	PieceSize int
+	Data      []byte
+	Missing   string
+}
+
+// swarmDownload is a running /get. Answers are handed to its goroutine
+// through the channels until done is closed.
+type swarmDownload struct {
+	Checksum string
+	sources  chan swarmSources
+	events   chan swarmEvent
+	done     chan struct{}
+}
+
+var (
+	swarmDownloads      = make(map[string]*swarmDownload)
+	swarmDownloadsMutex sync.Mutex
+)
+
+func lookupSwarmDownload(checksum string) *swarmDownload {
+	swarmDownloadsMutex.Lock()
+	defer swarmDownloadsMutex.Unlock()
+	return swarmDownloads[checksum]
+}
+
+func deliverSwarmEvent(checksum string, event swarmEvent) {
+	download := lookupSwarmDownload(checksum)
+	if download == nil {
+		return
+	}
+	select {
+	case download.events <- event:
+	case <-download.done:
+	}
+}
+
+// HandleGet handles /get <checksum> [fileName]: the file with that MD5 is
+// fetched from every online user who has it, different pieces from each
+func HandleGet(conn *protocol.Conn, checksum, name string) {
+	checksum = strings.ToLower(checksum)
+	if decoded, err := hex.DecodeString(checksum); err != nil || len(decoded) != md5.Size {
+		fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Invalid checksum, use the MD5 checksum of the file"))
+		return
+	}
+	if name != "" {
+		var err error
+		if name, err = helper.SanitizeFileName(name); err != nil {
+			fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Invalid file name:"), err)
+			return
+		}
+	}
+	sharedMutex.Lock()
+	storePath := sharedStorePath
+	sharedMutex.Unlock()
+	if storePath == "" {
+		fmt.Fprintln(utils.Output, utils.ErrorColor("❌ The server has not confirmed the store path yet, try again in a moment"))
+		return
+	}
+
+	download := &swarmDownload{
+		Checksum: checksum,
+		sources:  make(chan swarmSources, 1),
+		events:   make(chan swarmEvent, 16),
+		done:     make(chan struct{}),
+	}
+	swarmDownloadsMutex.Lock()
+	if _, exists := swarmDownloads[checksum]; exists {
+		swarmDownloadsMutex.Unlock()
+		fmt.Fprintln(utils.Output, utils.WarningColor("⚠ That content is already being fetched"))
+		return
+	}
+	swarmDownloads[checksum] = download
+	swarmDownloadsMutex.Unlock()
+
+	go func() {
+		defer func() {
+			close(download.done)
+			swarmDownloadsMutex.Lock()
+			delete(swarmDownloads, checksum)
+			swarmDownloadsMutex.Unlock()
+		}()
+		if err := download.run(conn, storePath, name); err != nil {
+			fmt.Fprintf(utils.Output, "%s Could not get %s: %v\n", utils.ErrorColor("❌"), utils.InfoColor(checksum), err)
+		}
+	}()
+}
+
+// run finds the users holding the content, fetches the piece map from one
+// of them and then the pieces from all of them
+func (download *swarmDownload) run(conn *protocol.Conn, storePath, name string) error {
+	checksum := download.Checksum
+	if err := conn.WriteLine(protocol.Format("/SWARM_QUERY", checksum)); err != nil {
+		return err
+	}
+	var sources swarmSources
+	select {
+	case sources = <-download.sources:
+	case <-time.After(swarmTimeout):
+		return fmt.Errorf("the server did not answer")
+	}
+	if len(sources.Peers) == 0 {
+		return fmt.Errorf("no online user has it")
+	}
+	if name == "" {
+		var err error
+		if name, err = helper.SanitizeFileName(sources.Name); err != nil {
+			name = checksum
+		}
+	}
+
+	if existing := findDuplicate(storePath, sources.Size, checksum); existing != "" {
+		fmt.Fprintf(utils.Output, "%s Already have '%s' at %s, nothing to fetch\n",
+			utils.SuccessColor("♻"),
+			utils.InfoColor(name),
+			utils.InfoColor(existing))
+		return nil
+	}
+
+	pieces, peers, err := download.fetchPieceMap(conn, sources)
+	if err != nil {
+		return err
+	}
+
+	dest, err := resolveSavePath(storePath, name, GetSettings().ConflictPolicy, false)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(partialPath(dest), os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+	if err == nil {
+		err = file.Truncate(sources.Size)
+	}
+	if err != nil {
+		discardPartial(file, dest)
+		return err
+	}
+
+	transfer := &Transfer{
+		ID:         GenerateTransferID(),
+		Type:       FileTransfer,
+		Name:       name,
+		Size:       sources.Size,
+		Status:     Active,
+		Direction:  "receive",
+		Recipient:  strings.Join(peers, ","),
+		Path:       dest,
+		Checksum:   checksum,
+		StartTime:  time.Now(),
+		Connection: conn,
+	}
+	transfer.ProgressBar = utils.CreateProgressBar(sources.Size, "📥 Receiving file")
+	transfer.ProgressBar.SetTransferId(transfer.ID)
+	RegisterTransfer(transfer)
+	defer RemoveTransfer(transfer.ID)
+
+	fmt.Fprintf(utils.Output, "%s Fetching '%s' (%s) from %d users (Transfer ID: %s)\n",
+		utils.InfoColor("🐝"),
+		utils.InfoColor(name),
+		formatSize(sources.Size),
+		len(peers),
+		utils.CommandColor(transfer.ID))
+
+	counts, err := download.fetchPieces(conn, transfer, file, pieces, peers)
+	if err == nil {
+		// The pieces were checked one by one, this confirms the piece map
+		var sum string
+		if sum, err = helper.CalculateFileChecksum(partialPath(dest)); err == nil && !helper.VerifyChecksum(checksum, sum) {
+			err = fmt.Errorf("checksum verification failed")
+		}
+	}
+	if err == nil {
+		err = commitPartial(file, dest)
+	}
+	if err != nil {
+		UpdateTransferStatus(transfer.ID, Failed)
+		discardPartial(file, dest)
+		return err
+	}
+	UpdateTransferStatus(transfer.ID, Completed)
+	indexReceived(dest, checksum)
+	shareReceived(conn, dest, checksum, sources.Size)
+
+	fmt.Fprintf(utils.Output, "\n%s File '%s' received from %d users!\n",
+		utils.SuccessColor("✅"),
+		utils.SuccessColor(name),
+		len(counts))
+	for _, peer := range peers {
+		if counts[peer] > 0 {
+			fmt.Fprintf(utils.Output, "  %s %s\n", utils.UserColor(peer), utils.InfoColor(fmt.Sprintf("%d pieces", counts[peer])))
+		}
+	}
+	fmt.Fprintln(utils.Output, utils.InfoColor("📂 Saved to:"), utils.InfoColor(dest))
+	return nil
+}
+
+// fetchPieceMap asks the sources for the piece hashes one after another
+// until one answers with a map that fits the size. It returns the map and
+// the peers that were not found to be missing the content.
+func (download *swarmDownload) fetchPieceMap(conn *protocol.Conn, sources swarmSources) (*pieceMap, []string, error) {
+	peers := append([]string(nil), sources.Peers...)
+	for len(peers) > 0 {
+		peer := peers[0]
+		if err := conn.WriteLine(protocol.Format("/SWARM_MAP", peer, download.Checksum)); err != nil {
+			return nil, nil, err
+		}
+		timeout := time.After(swarmTimeout)
+		var answer *swarmEvent
+		for answer == nil {
+			select {
+			case event := <-download.events:
+				if event.Peer == peer && (event.Index == -1 || event.Missing != "") {
+					answer = &event
+				}
+			case <-timeout:
+				answer = &swarmEvent{Peer: peer, Missing: "no answer"}
+			}
+		}
+
+		if answer.Missing == "" {
+			// Every peer splits a file of this size the same way
+			pieceSize, _ := swarmPieceSizeFor(sources.Size)
+			count := (sources.Size + int64(pieceSize) - 1) / int64(pieceSize)
+			if answer.PieceSize == pieceSize && int64(len(answer.Data)) == count*md5.Size {
+				return &pieceMap{PieceSize: answer.PieceSize, Hashes: answer.Data}, peers, nil
+			}
+			answer.Missing = "invalid piece map"
+		}
+		fmt.Fprintf(utils.Output, "%s User %s cannot serve it: %s\n", utils.WarningColor("⚠"), utils.UserColor(peer), answer.Missing)
+		peers = peers[1:]
+	}
+	return nil, nil, fmt.Errorf("no user could serve it")
+}
+
+// fetchPieces requests pieces from every peer in parallel, keeping a few
+// requests open with each so faster peers serve more of the file. A piece
+// is written once it matches its hash; a peer that sends a wrong piece,
+// reports the content missing or stops answering is dropped and its
+// pieces go to the others. It returns how many pieces each peer served.
+func (download *swarmDownload) fetchPieces(conn *protocol.Conn, transfer *Transfer, file *os.File, pieces *pieceMap, peers []string) (map[string]int, error) {
+	count := len(pieces.Hashes) / md5.Size
+	pending := make([]int, count)
+	for i := range pending {
+		pending[i] = i
+	}
+	inflight := make(map[string]map[int]time.Time)
+	for _, peer := range peers {
+		inflight[peer] = make(map[int]time.Time)
+	}
+	received := make([]bool, count)
+	counts := make(map[string]int)
+	done := 0
+
+	drop := func(peer, reason string) {
+		for index := range inflight[peer] {
+			pending = append(pending, index)
+		}
+		delete(inflight, peer)
+		fmt.Fprintf(utils.Output, "\n%s Stopped fetching from user %s: %s\n", utils.WarningColor("⚠"), utils.UserColor(peer), reason)
+	}
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for done < count {
+		if len(inflight) == 0 {
+			return nil, fmt.Errorf("no user is left to fetch from")
+		}
+
+		transfer.PauseLock.Lock()
+		paused := transfer.IsPaused
+		transfer.PauseLock.Unlock()
+		for _, peer := range peers {
+			requested, active := inflight[peer]
+			for active && !paused && len(requested) < swarmPiecesPerPeer && len(pending) > 0 {
+				index := pending[0]
+				pending = pending[1:]
+				if received[index] {
+					continue
+				}
+				err := conn.WriteLine(protocol.Format("/SWARM_WANT", peer, download.Checksum, strconv.Itoa(index)))
+				if err != nil {
+					return nil, err
+				}
+				requested[index] = time.Now()
+			}
+		}
+
+		select {
+		case event := <-download.events:
+			requested, active := inflight[event.Peer]
+			if !active {
+				continue
+			}
+			if event.Missing != "" {
+				drop(event.Peer, event.Missing)
+				continue
+			}
+			if _, wanted := requested[event.Index]; !wanted || event.Index < 0 {
+				continue
+			}
+			delete(requested, event.Index)
+			if received[event.Index] {
+				continue
+			}
+
+			offset := int64(event.Index) * int64(pieces.PieceSize)
+			expected := min(int64(pieces.PieceSize), transfer.Size-offset)
+			sum := md5.Sum(event.Data)
+			if int64(len(event.Data)) != expected || !bytes.Equal(sum[:], pieces.Hashes[event.Index*md5.Size:(event.Index+1)*md5.Size]) {
+				pending = append(pending, event.Index)
+				drop(event.Peer, "sent a piece that does not match its hash")
+				continue
+			}
+			if _, err := file.WriteAt(event.Data, offset); err != nil {
+				return nil, err
+			}
+			received[event.Index] = true
+			done++
+			counts[event.Peer]++
+			transfer.BytesComplete.Add(int64(len(event.Data)))
+			transfer.trackProgress(event.Data)
+		case <-ticker.C:
+			for peer, requested := range inflight {
+				for _, since := range requested {
+					if time.Since(since) > swarmTimeout {
+						drop(peer, "no answer")
+						break
+					}
+				}
+			}
+		}
+	}
+	return counts, nil
+}
@@ -0,0 +1,897 @@
+package connection
+
+import (
+	"crypto/md5"
+	"drizlink/protocol"
+	"drizlink/utils"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// syncEntry describes one file of a synced folder
+type syncEntry struct {
+	Size     int64
+	Checksum string
+}
+
+// syncBase records the checksums both sides had when a file was last synced
+type syncBase struct {
+	Local  string `json:"local"`
+	Remote string `json:"remote"`
+}
+
+// syncState is what the previous runs of /sync for one pair of folders left
+// behind. It tells which side changed a file since.
+type syncState struct {
+	Peer   string              `json:"peer"`
+	Local  string              `json:"local"`
+	Remote string              `json:"remote"`
+	Files  map[string]syncBase `json:"files"`
+}
+
+// syncAction is what a run does for one path
+type syncAction struct {
+	Path     string
+	Push     bool
+	Pull     bool
+	Conflict bool     // both sides changed, each gets the other's version as a copy
+	Agreed   syncBase // recorded once the action succeeded
+}
+
+// syncFileRef marks a file exchanged by /sync
+type syncFileRef struct {
+	ID       string // sync session
+	Path     string // slash separated path inside the synced folder
+	Conflict bool   // saved as a conflict copy next to Path
+	done     func(err error)
+}
+
+// syncSession is a folder taking part in a sync with a peer. The side that
+// ran /sync also holds the run's progress.
+type syncSession struct {
+	ID       string
+	Peer     string
+	Folder   string
+	ReadOnly bool // the peer mirrors the folder and may not change it
+	run      *syncRun
+	mirror   *Mirror // set when the run is a pass of a /mirror
+
+	// pushes holds the paths the peer announced it will send, to whether
+	// they are conflict copies. Only those are received.
+	pushes      map[string]bool
+	pushesMutex sync.Mutex
+}
+
+// syncRequest is a peer's request to sync or mirror one of our folders that
+// waits for /sync accept
+type syncRequest struct {
+	ID       string
+	Peer     string
+	SyncID   string
+	Folder   string // as the peer named it, relative to the store path
+	Root     string
+	Mirror   bool
+	Received time.Time
+	conn     *protocol.Conn
+}
+
+// syncRun tracks a /sync started here until every file is exchanged
+type syncRun struct {
+	mutex     sync.Mutex
+	remote    map[string]syncEntry
+	manifest  chan error // receives nil once the peer's manifest is complete
+	state     *syncState
+	statePath string
+	pulls     map[string]bool // requested paths, to whether they are conflict copies
+	pending   map[string]int  // operations still running per path
+	failed    map[string]bool
+	agreed    map[string]syncBase
+	remaining int
+	sent      int
+	received  int
+	removed   int
+	failures  int
+	err       error         // why the folders could not be compared
+	done      chan struct{} // closed once the run has ended
+}
+
+var (
+	syncSessions      = make(map[string]*syncSession)
+	syncSessionsMutex sync.Mutex
+
+	syncRequests      = make(map[string]*syncRequest)
+	syncApproved      = make(map[string]bool) // requests accepted until the client exits
+	nextSyncRequest   int
+	syncRequestsMutex sync.Mutex
+)
+
+func syncStatePath(local, remote string) (string, error) {
+	dir, err := ConfigDir()
+	if err != nil {
+		return "", err
+	}
+	sum := md5.Sum([]byte(local + "\x00" + remote))
+	return filepath.Join(dir, "sync", hex.EncodeToString(sum[:])+".json"), nil
+}
+
+// loadSyncState reads the state of earlier runs for a folder pair. Without
+// one every difference is treated as a conflict.
+func loadSyncState(path, peer, local, remote string) *syncState {
+	state := &syncState{Files: make(map[string]syncBase)}
+	if data, err := os.ReadFile(path); err == nil {
+		json.Unmarshal(data, state)
+	}
+	if state.Files == nil {
+		state.Files = make(map[string]syncBase)
+	}
+	state.Peer, state.Local, state.Remote = peer, local, remote
+	return state
+}
+
+// saveSyncState writes state after every finished file, so an interrupted
+// run only repeats what did not finish
+func saveSyncState(path string, state *syncState) {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(path), 0755)
+	}
+	if err == nil {
+		err = os.WriteFile(path+".tmp", data, 0644)
+	}
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		fmt.Fprintln(utils.Output, utils.WarningColor("⚠ Could not save sync state:"), err)
+	}
+}
+
+// buildManifest lists every file below root with its checksum. Checksums
+// come from the content index, so unchanged files are not hashed again.
+func buildManifest(root string) (map[string]syncEntry, error) {
+	manifest := make(map[string]syncEntry)
+
+	contentIndexMutex.Lock()
+	defer contentIndexMutex.Unlock()
+	loadContentIndex()
+
+	changed := false
+	err := filepath.WalkDir(root, func(file string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.Type().IsRegular() || isPartialName(entry.Name()) {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		checksum, updated, err := indexedChecksum(file, info)
+		if err != nil {
+			return err
+		}
+		changed = changed || updated
+
+		rel, err := filepath.Rel(root, file)
+		if err != nil {
+			return err
+		}
+		manifest[filepath.ToSlash(rel)] = syncEntry{Size: info.Size(), Checksum: checksum}
+		return nil
+	})
+
+	if changed {
+		saveContentIndex()
+	}
+	return manifest, err
+}
+
+// planSync decides for every path in either manifest what to do, using the
+// checksums recorded by the last run to tell which side changed a file.
+// Files missing on one side are copied there; deletions are not synced.
+func planSync(local, remote map[string]syncEntry, last map[string]syncBase) []syncAction {
+	paths := make([]string, 0, len(local)+len(remote))
+	for rel := range local {
+		paths = append(paths, rel)
+	}
+	for rel := range remote {
+		if _, exists := local[rel]; !exists {
+			paths = append(paths, rel)
+		}
+	}
+	sort.Strings(paths)
+
+	actions := make([]syncAction, 0, len(paths))
+	for _, rel := range paths {
+		l, hasLocal := local[rel]
+		r, hasRemote := remote[rel]
+		b, hasBase := last[rel]
+		action := syncAction{Path: rel}
+
+		switch {
+		case hasLocal && hasRemote && l.Checksum == r.Checksum:
+			action.Agreed = syncBase{l.Checksum, l.Checksum}
+		case !hasRemote:
+			action.Push = true
+			action.Agreed = syncBase{l.Checksum, l.Checksum}
+		case !hasLocal:
+			action.Pull = true
+			action.Agreed = syncBase{r.Checksum, r.Checksum}
+		case hasBase && l.Checksum == b.Local && r.Checksum == b.Remote:
+			// A conflict from an earlier run that nobody resolved yet
+			action.Agreed = b
+		case hasBase && l.Checksum == b.Local:
+			action.Pull = true
+			action.Agreed = syncBase{r.Checksum, r.Checksum}
+		case hasBase && r.Checksum == b.Remote:
+			action.Push = true
+			action.Agreed = syncBase{l.Checksum, l.Checksum}
+		default:
+			action.Push, action.Pull, action.Conflict = true, true, true
+			action.Agreed = syncBase{l.Checksum, r.Checksum}
+		}
+		actions = append(actions, action)
+	}
+	return actions
+}
+
+// conflictPath names the copy of rel that holds the version from userId
+func conflictPath(rel, userId string) string {
+	ext := path.Ext(rel)
+	return fmt.Sprintf("%s (conflict from %s)%s", rel[:len(rel)-len(ext)], userId, ext)
+}
+
+// syncTarget returns where rel lives inside folder. Paths that would leave
+// the folder are refused.
+func syncTarget(folder, rel string) (string, error) {
+	local := filepath.FromSlash(rel)
+	if !filepath.IsLocal(local) || isPartialName(filepath.Base(local)) {
+		return "", fmt.Errorf("invalid path %q", rel)
+	}
+	return filepath.Join(folder, local), nil
+}
+
+func newSyncID() string {
+	return strconv.FormatInt(time.Now().UnixNano(), 36)
+}
+
+func registerSyncSession(session *syncSession) {
+	syncSessionsMutex.Lock()
+	syncSessions[incomingKey(session.Peer, session.ID)] = session
+	syncSessionsMutex.Unlock()
+}
+
+func lookupSyncSession(peer, id string) *syncSession {
+	syncSessionsMutex.Lock()
+	defer syncSessionsMutex.Unlock()
+	return syncSessions[incomingKey(peer, id)]
+}
+
+func endSyncSession(peer, id string) {
+	syncSessionsMutex.Lock()
+	delete(syncSessions, incomingKey(peer, id))
+	syncSessionsMutex.Unlock()
+}
+
+// HandleSync handles the /sync command: it compares localFolder with
+// remoteFolder in the store path of recipientId and exchanges new and
+// changed files in both directions
+func HandleSync(conn *protocol.Conn, recipientId, localFolder, remoteFolder string) {
+	info, err := os.Stat(localFolder)
+	if err != nil || !info.IsDir() {
+		fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Not a folder:"), localFolder)
+		return
+	}
+	local, err := filepath.Abs(localFolder)
+	if err != nil {
+		fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Invalid folder:"), err)
+		return
+	}
+
+	fmt.Fprintf(utils.Output, "%s Comparing %s with %s of user %s...\n",
+		utils.InfoColor("🔄"),
+		utils.InfoColor(local),
+		utils.InfoColor(remoteFolder),
+		utils.UserColor(recipientId))
+	session, err := startSyncRun(conn, recipientId, local, remoteFolder, nil)
+	if err != nil {
+		fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Error sending sync request:"), err)
+		return
+	}
+
+	// Comparing can take a while, keep the prompt usable
+	go runSync(conn, session)
+}
+
+// startSyncRun asks recipientId for the manifest of remoteFolder and returns
+// the session that collects it. mirror is set for a pass of a /mirror.
+func startSyncRun(conn *protocol.Conn, recipientId, local, remoteFolder string, mirror *Mirror) (*syncSession, error) {
+	statePath, err := syncStatePath(local, remoteFolder)
+	if err != nil {
+		return nil, err
+	}
+	session := &syncSession{
+		ID:     newSyncID(),
+		Peer:   recipientId,
+		Folder: local,
+		mirror: mirror,
+		run: &syncRun{
+			remote:    make(map[string]syncEntry),
+			manifest:  make(chan error, 1),
+			state:     loadSyncState(statePath, recipientId, local, remoteFolder),
+			statePath: statePath,
+			pulls:     make(map[string]bool),
+			pending:   make(map[string]int),
+			failed:    make(map[string]bool),
+			agreed:    make(map[string]syncBase),
+			done:      make(chan struct{}),
+		},
+	}
+	registerSyncSession(session)
+
+	fields := []string{recipientId, session.ID, remoteFolder}
+	if mirror != nil {
+		fields = append(fields, "mirror")
+	}
+	if err := conn.WriteLine(protocol.Format("/SYNC_REQUEST", fields...)); err != nil {
+		endSyncSession(recipientId, session.ID)
+		return nil, err
+	}
+	return session, nil
+}
+
+// runSync waits for the peer's manifest, then starts every transfer the
+// comparison calls for
+func runSync(conn *protocol.Conn, session *syncSession) {
+	run := session.run
+	local, err := buildManifest(session.Folder)
+	if err == nil {
+		select {
+		case err = <-run.manifest:
+		case <-time.After(replyTimeout):
+			err = fmt.Errorf("user %s did not answer within %s", session.Peer, replyTimeout)
+		}
+	}
+	if err != nil {
+		endSyncSession(session.Peer, session.ID)
+		run.err = err
+		close(run.done)
+		if session.mirror == nil {
+			fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Sync failed:"), err)
+		}
+		return
+	}
+
+	run.mutex.Lock()
+	var actions []syncAction
+	if session.mirror != nil {
+		var removed []string
+		actions, removed = planMirror(local, run.remote, run.state.Files, session.mirror.Delete)
+		run.removed = session.removeFiles(removed)
+	} else {
+		actions = planSync(local, run.remote, run.state.Files)
+	}
+	var pushes, pulls []syncAction
+	conflicts, unresolved := 0, 0
+	for _, action := range actions {
+		if !action.Push && !action.Pull {
+			run.state.Files[action.Path] = action.Agreed
+			if action.Agreed.Local != action.Agreed.Remote {
+				unresolved++
+			}
+			continue
+		}
+		run.agreed[action.Path] = action.Agreed
+		if action.Push {
+			pushes = append(pushes, action)
+			run.pending[action.Path]++
+		}
+		if action.Pull {
+			pulls = append(pulls, action)
+			run.pending[action.Path]++
+			run.pulls[action.Path] = action.Conflict
+		}
+		if action.Conflict {
+			conflicts++
+		}
+	}
+	run.remaining = len(pushes) + len(pulls)
+	saveSyncState(run.statePath, run.state)
+	run.mutex.Unlock()
+
+	if unresolved > 0 {
+		fmt.Fprintf(utils.Output, "%s %d files still have unresolved conflict copies\n", utils.WarningColor("⚠"), unresolved)
+	}
+	if run.remaining == 0 {
+		session.end(conn)
+		if session.mirror == nil {
+			fmt.Fprintln(utils.Output, utils.SuccessColor("✅ Folders are already in sync"))
+		}
+		return
+	}
+	if session.mirror == nil {
+		fmt.Fprintf(utils.Output, "%s Sending %d files, receiving %d files, %d conflicts\n",
+			utils.InfoColor("🔄"),
+			len(pushes),
+			len(pulls),
+			conflicts)
+	}
+
+	for _, action := range pushes {
+		action := action
+		ref := &syncFileRef{ID: session.ID, Path: action.Path, Conflict: action.Conflict, done: func(err error) {
+			session.finished(conn, action.Path, err, true)
+		}}
+		// The peer only receives files it was told about first
+		err := conn.WriteLine(protocol.Format("/SYNC_PUSH",
+			session.Peer, session.ID, action.Path, syncMode(action.Conflict)))
+		if err != nil {
+			ref.done(err)
+			continue
+		}
+		sendSyncFile(conn, session.Peer, filepath.Join(session.Folder, filepath.FromSlash(action.Path)), ref)
+	}
+	for _, action := range pulls {
+		err := conn.WriteLine(protocol.Format("/SYNC_PULL",
+			session.Peer, session.ID, action.Path, syncMode(action.Conflict)))
+		if err != nil {
+			session.pullFailed(conn, action.Path, err.Error())
+		}
+	}
+}
+
+// finished records the outcome of one file of a run and reports the run
+// once every file is done
+func (session *syncSession) finished(conn *protocol.Conn, rel string, err error, sent bool) {
+	run := session.run
+	run.mutex.Lock()
+	switch {
+	case err != nil:
+		run.failed[rel] = true
+		run.failures++
+	case sent:
+		run.sent++
+	default:
+		run.received++
+	}
+	run.pending[rel]--
+	if run.pending[rel] == 0 {
+		if !run.failed[rel] {
+			run.state.Files[rel] = run.agreed[rel]
+			saveSyncState(run.statePath, run.state)
+		}
+		delete(run.pending, rel)
+	}
+	run.remaining--
+	last := run.remaining == 0
+	run.mutex.Unlock()
+	if !last {
+		return
+	}
+
+	session.end(conn)
+	if session.mirror != nil {
+		return
+	}
+	fmt.Fprintf(utils.Output, "%s Sync with user %s finished: %d sent, %d received",
+		utils.SuccessColor("🔄"),
+		utils.UserColor(session.Peer),
+		run.sent,
+		run.received)
+	if run.failures > 0 {
+		fmt.Fprintf(utils.Output, ", %s", utils.ErrorColor(fmt.Sprintf("%d failed (run /sync again to retry them)", run.failures)))
+	}
+	fmt.Fprintln(utils.Output)
+}
+
+// manifestDone hands runSync the outcome of collecting the peer's manifest.
+// Only the first outcome counts; a repeated one must not block the reader.
+func (run *syncRun) manifestDone(err error) {
+	select {
+	case run.manifest <- err:
+	default:
+	}
+}
+
+// expectPush records a file the peer announced it will send
+func (session *syncSession) expectPush(rel string, conflict bool) {
+	session.pushesMutex.Lock()
+	defer session.pushesMutex.Unlock()
+	if session.pushes == nil {
+		session.pushes = make(map[string]bool)
+	}
+	session.pushes[rel] = conflict
+}
+
+// pushExpected reports whether the peer announced sending rel as it does.
+// An announcement stays valid for the session, so a file the peer is asked
+// to send again is still received.
+func (session *syncSession) pushExpected(rel string, conflict bool) bool {
+	session.pushesMutex.Lock()
+	defer session.pushesMutex.Unlock()
+	announced, exists := session.pushes[rel]
+	return exists && announced == conflict
+}
+
+// end tells the peer the run is over and wakes anyone waiting for it
+func (session *syncSession) end(conn *protocol.Conn) {
+	endSyncSession(session.Peer, session.ID)
+	conn.WriteLine(protocol.Format("/SYNC_END", session.Peer, session.ID))
+	close(session.run.done)
+}
+
+// pullFailed records a requested file the peer could not send
+func (session *syncSession) pullFailed(conn *protocol.Conn, rel, reason string) {
+	run := session.run
+	run.mutex.Lock()
+	_, requested := run.pulls[rel]
+	delete(run.pulls, rel)
+	run.mutex.Unlock()
+	if !requested {
+		return
+	}
+	fmt.Fprintf(utils.Output, "%s Could not fetch '%s': %s\n", utils.ErrorColor("❌"), utils.InfoColor(rel), reason)
+	session.finished(conn, rel, fmt.Errorf("%s", reason), false)
+}
+
+func syncMode(conflict bool) string {
+	if conflict {
+		return "conflict"
+	}
+	return "replace"
+}
+
+// sendSyncFile queues filePath to be sent to recipientId as part of a sync
+func sendSyncFile(conn *protocol.Conn, recipientId, filePath string, ref *syncFileRef) {
+	transfer, err := newFileTransfer(conn, recipientId, filePath)
+	if err != nil {
+		fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Error opening file:"), err)
+		if ref.done != nil {
+			ref.done(err)
+		}
+		return
+	}
+	transfer.Sync = ref
+
+	TransferQueue.Enqueue(transfer, func(transfer *Transfer) {
+		err := sendFile(conn, transfer)
+		if ref.done != nil {
+			ref.done(err)
+		}
+	})
+}
+
+// HandleSyncMessage handles the /SYNC_ messages a peer sends while a folder
+// is synchronized, whichever side started the sync
+func HandleSyncMessage(conn *protocol.Conn, args []string) {
+	command, peer, id := args[0], args[1], args[2]
+	if command == "/SYNC_REQUEST" {
+		switch {
+		case len(args) == 5:
+			handleSyncRequest(conn, peer, id, args[3], false, args[4])
+		case len(args) == 6 && args[4] == "mirror":
+			handleSyncRequest(conn, peer, id, args[3], true, args[5])
+		}
+		return
+	}
+
+	session := lookupSyncSession(peer, id)
+	if session == nil {
+		if command == "/SYNC_FILE" && len(args) == 8 {
+			declineTransfer(conn, peer, args[6], "no such sync")
+		}
+		return
+	}
+	run := session.run
+
+	switch {
+	case command == "/SYNC_FILE" && len(args) == 8:
+		size, err := strconv.ParseInt(args[4], 10, 64)
+		if err != nil {
+			declineTransfer(conn, peer, args[6], "invalid size")
+			return
+		}
+		handleSyncFile(conn, session, args[3], size, args[5], args[6], args[7] == "conflict")
+	case command == "/SYNC_PULL" && len(args) == 5 && run == nil:
+		handleSyncPull(conn, session, args[3], args[4] == "conflict")
+	case command == "/SYNC_PUSH" && len(args) == 5 && run == nil && !session.ReadOnly:
+		session.expectPush(args[3], args[4] == "conflict")
+	case command == "/SYNC_END" && run == nil:
+		endSyncSession(peer, id)
+		if session.ReadOnly {
+			return
+		}
+		fmt.Fprintf(utils.Output, "%s Sync of %s with user %s finished\n",
+			utils.SuccessColor("🔄"),
+			utils.InfoColor(session.Folder),
+			utils.UserColor(peer))
+	case run == nil:
+		return
+	case command == "/SYNC_ENTRY" && len(args) == 6:
+		size, _ := strconv.ParseInt(args[4], 10, 64)
+		run.mutex.Lock()
+		run.remote[args[3]] = syncEntry{Size: size, Checksum: args[5]}
+		run.mutex.Unlock()
+	case command == "/SYNC_MANIFEST" && len(args) == 4:
+		count, _ := strconv.Atoi(args[3])
+		run.mutex.Lock()
+		var err error
+		if count != len(run.remote) {
+			err = fmt.Errorf("received %d of %d manifest entries", len(run.remote), count)
+		}
+		run.mutex.Unlock()
+		run.manifestDone(err)
+	case command == "/SYNC_DECLINE" && len(args) == 4:
+		run.manifestDone(fmt.Errorf("user %s declined: %s", peer, args[3]))
+	case command == "/SYNC_PULL_FAILED" && len(args) == 5:
+		session.pullFailed(conn, args[3], args[4])
+	}
+}
+
+// handleSyncRequest handles a peer that wants to sync with folder inside
+// our store path, or mirror it. Like held transfers it needs our consent,
+// given by sync-requests or by /sync accept. Accepting holds for the same
+// peer, folder and mode until the client exits, so a mirror is not asked
+// about again on every check.
+func handleSyncRequest(conn *protocol.Conn, peer, id, folder string, mirror bool, storeFilePath string) {
+	root, err := syncTarget(storeFilePath, folder)
+	if err != nil {
+		declineSyncRequest(conn, peer, id, fmt.Errorf("folder must be inside the store path"))
+		return
+	}
+	request := &syncRequest{Peer: peer, SyncID: id, Folder: folder, Root: root, Mirror: mirror, Received: time.Now(), conn: conn}
+
+	consent := GetSettings().SyncRequests
+	if consent == RejectOfflineDelivery {
+		declineSyncRequest(conn, peer, id, errors.New("sync requests are refused"))
+		return
+	}
+	syncRequestsMutex.Lock()
+	approved := consent == AcceptOfflineDelivery || syncApproved[request.key()]
+	repeated := false
+	if !approved {
+		// A mirror asks again on every check; keep one request for it
+		for _, waiting := range syncRequests {
+			if waiting.key() == request.key() {
+				request.ID, repeated = waiting.ID, true
+			}
+		}
+		if !repeated {
+			nextSyncRequest++
+			request.ID = "r" + strconv.Itoa(nextSyncRequest)
+		}
+		syncRequests[request.ID] = request
+	}
+	syncRequestsMutex.Unlock()
+
+	if approved {
+		// Listing the folder hashes new files, keep reading the connection
+		go answerSyncRequest(request)
+		return
+	}
+	if repeated {
+		return
+	}
+	fmt.Fprintf(utils.Output, "%s User %s wants to %s %s\n",
+		utils.InfoColor("🔄"),
+		utils.UserColor(peer),
+		request.verb(),
+		utils.InfoColor(root))
+	fmt.Fprintf(utils.Output, "  Use %s or %s\n",
+		utils.CommandColor("/sync accept "+request.ID),
+		utils.CommandColor("/sync reject "+request.ID))
+}
+
+// key identifies what a request asks for, regardless of the run
+func (request *syncRequest) key() string {
+	return fmt.Sprintf("%s\x00%s\x00%t", request.Peer, request.Root, request.Mirror)
+}
+
+func (request *syncRequest) verb() string {
+	if request.Mirror {
+		return "mirror"
+	}
+	return "sync"
+}
+
+func declineSyncRequest(conn *protocol.Conn, peer, id string, err error) {
+	fmt.Fprintf(utils.Output, "%s Declined sync request from user %s: %v\n", utils.WarningColor("⏭"), utils.UserColor(peer), err)
+	conn.WriteLine(protocol.Format("/SYNC_DECLINE", peer, id, err.Error()))
+}
+
+// answerSyncRequest sends the peer the manifest of the folder it asked
+// for. A peer that mirrors the folder only reads it, which is not announced
+// every time it checks for changes.
+func answerSyncRequest(request *syncRequest) {
+	conn, peer, id := request.conn, request.Peer, request.SyncID
+	root := request.Root
+	if err := os.MkdirAll(root, 0755); err != nil {
+		declineSyncRequest(conn, peer, id, err)
+		return
+	}
+	root, err := filepath.Abs(root)
+	if err != nil {
+		declineSyncRequest(conn, peer, id, err)
+		return
+	}
+
+	manifest, err := buildManifest(root)
+	if err != nil {
+		declineSyncRequest(conn, peer, id, err)
+		return
+	}
+	registerSyncSession(&syncSession{ID: id, Peer: peer, Folder: root, ReadOnly: request.Mirror})
+	if !request.Mirror {
+		fmt.Fprintf(utils.Output, "%s User %s is syncing %s with you\n",
+			utils.InfoColor("🔄"),
+			utils.UserColor(peer),
+			utils.InfoColor(root))
+	}
+
+	paths := make([]string, 0, len(manifest))
+	for rel := range manifest {
+		paths = append(paths, rel)
+	}
+	sort.Strings(paths)
+	for _, rel := range paths {
+		entry := manifest[rel]
+		err := conn.WriteLine(protocol.Format("/SYNC_ENTRY",
+			peer, id, rel, strconv.FormatInt(entry.Size, 10), entry.Checksum))
+		if err != nil {
+			return
+		}
+	}
+	conn.WriteLine(protocol.Format("/SYNC_MANIFEST", peer, id, strconv.Itoa(len(paths))))
+}
+
+// HandleSyncRequests handles /sync without folders: it lists the sync
+// requests waiting for consent, or accepts or rejects one or all of them
+func HandleSyncRequests(args []string) {
+	syncRequestsMutex.Lock()
+	defer syncRequestsMutex.Unlock()
+
+	// The peer stops waiting after replyTimeout, answering later is no use
+	for id, request := range syncRequests {
+		if time.Since(request.Received) > replyTimeout {
+			delete(syncRequests, id)
+		}
+	}
+
+	if len(args) == 0 {
+		if len(syncRequests) == 0 {
+			fmt.Fprintln(utils.Output, utils.InfoColor("🔄 No sync requests waiting"))
+			return
+		}
+		ids := make([]string, 0, len(syncRequests))
+		for id := range syncRequests {
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(i, j int) bool {
+			a, _ := strconv.Atoi(ids[i][1:])
+			b, _ := strconv.Atoi(ids[j][1:])
+			return a < b
+		})
+		fmt.Fprintln(utils.Output, utils.HeaderColor("🔄 Sync requests waiting:"))
+		for _, id := range ids {
+			request := syncRequests[id]
+			fmt.Fprintf(utils.Output, "  %s %s %s from %s\n",
+				utils.CommandColor(id),
+				request.verb(),
+				utils.InfoColor(request.Root),
+				utils.UserColor(request.Peer))
+		}
+		return
+	}
+
+	if len(args) != 2 || (args[0] != "accept" && args[0] != "reject") {
+		fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Invalid arguments. Use: /sync [accept|reject <id>|all]"))
+		return
+	}
+	accept := args[0] == "accept"
+
+	var ids []string
+	if args[1] == "all" {
+		for id := range syncRequests {
+			ids = append(ids, id)
+		}
+	} else if _, exists := syncRequests[args[1]]; exists {
+		ids = append(ids, args[1])
+	} else {
+		fmt.Fprintln(utils.Output, utils.ErrorColor("❌ No sync request with ID"), utils.CommandColor(args[1]))
+		return
+	}
+
+	for _, id := range ids {
+		request := syncRequests[id]
+		delete(syncRequests, id)
+		if accept {
+			syncApproved[request.key()] = true
+			go answerSyncRequest(request)
+		} else {
+			go declineSyncRequest(request.conn, request.Peer, request.SyncID, errors.New("declined by user"))
+		}
+	}
+}
+
+// handleSyncPull sends a file the peer asked for during its sync
+func handleSyncPull(conn *protocol.Conn, session *syncSession, rel string, conflict bool) {
+	filePath, err := syncTarget(session.Folder, rel)
+	if err != nil {
+		conn.WriteLine(protocol.Format("/SYNC_PULL_FAILED", session.Peer, session.ID, rel, err.Error()))
+		return
+	}
+	sendSyncFile(conn, session.Peer, filePath, &syncFileRef{ID: session.ID, Path: rel, Conflict: conflict, done: func(err error) {
+		if err != nil {
+			conn.WriteLine(protocol.Format("/SYNC_PULL_FAILED", session.Peer, session.ID, rel, err.Error()))
+		}
+	}})
+}
+
+// handleSyncFile receives a file of a sync into the synced folder, replacing
+// the existing version or, for conflicts, next to it
+func handleSyncFile(conn *protocol.Conn, session *syncSession, rel string, size int64, checksum, remoteID string, conflict bool) {
+	if session.ReadOnly {
+		declineTransfer(conn, session.Peer, remoteID, "the folder is only mirrored")
+		return
+	}
+	ref := &syncFileRef{ID: session.ID, Path: rel, Conflict: conflict}
+	if run := session.run; run != nil {
+		// Only files this run asked for are accepted
+		run.mutex.Lock()
+		_, requested := run.pulls[rel]
+		delete(run.pulls, rel)
+		run.mutex.Unlock()
+		if !requested {
+			declineTransfer(conn, session.Peer, remoteID, "not requested")
+			return
+		}
+		ref.done = func(err error) {
+			session.finished(conn, rel, err, false)
+		}
+	} else if !session.pushExpected(rel, conflict) {
+		declineTransfer(conn, session.Peer, remoteID, "not announced")
+		return
+	}
+
+	target := rel
+	if conflict {
+		target = conflictPath(rel, session.Peer)
+	}
+	dest, err := syncTarget(session.Folder, target)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(dest), 0755)
+	}
+	if err != nil {
+		declineTransfer(conn, session.Peer, remoteID, err.Error())
+		if ref.done != nil {
+			ref.done(err)
+		}
+		return
+	}
+
+	transferID := GenerateTransferID()
+	fmt.Fprintf(utils.Output, "%s Receiving file: %s (Size: %s, Transfer ID: %s)\n",
+		utils.InfoColor("📥"),
+		utils.InfoColor(target),
+		utils.InfoColor(fmt.Sprintf("%d bytes", size)),
+		utils.CommandColor(transferID))
+
+	// Our own version is the best base for a delta, also for conflict copies.
+	// Its signatures take a while for large files, so the answer is sent
+	// once they are ready, from offerQueue.
+	offerQueue.run(func() {
+		base := openDeltaBase(filepath.Join(session.Folder, filepath.FromSlash(rel)), size)
+		receiveFile(conn, transferID, session.Peer, filepath.Base(dest), size, checksum, remoteID, dest, base, ref)
+	})
+}
@@ -1,13 +1,16 @@
 package connection
 
 import (
+	"drizlink/protocol"
 	"drizlink/utils"
+	"errors"
 	"fmt"
 	"io"
-	"net"
 	"os"
+	"sort"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -27,6 +30,8 @@ const (
 	Paused
 	Completed
 	Failed
+	Queued
+	AwaitingReceipt
 )
 
 // String representation of TransferStatus
@@ -40,6 +45,10 @@ func (s TransferStatus) String() string {
 		return "Completed"
 	case Failed:
 		return "Failed"
+	case Queued:
+		return "Queued"
+	case AwaitingReceipt:
+		return "Awaiting receipt"
 	default:
 		return "Unknown"
 	}
@@ -51,18 +60,90 @@ type Transfer struct {
 	Type          TransferType
 	Name          string
 	Size          int64
-	BytesComplete int64
+	BytesComplete atomic.Int64
+	BytesAcked    atomic.Int64 // bytes the recipient confirmed writing, for sends
 	Status        TransferStatus
 	Direction     string // "send" or "receive"
 	Recipient     string
+	RemoteID      string // the sender's transfer ID for received transfers
+	Priority      TransferPriority
+	Group         *TransferGroup // set when sent as part of a multi-file command
+	Sync          *syncFileRef   // set for files exchanged by /sync
+	Stream        bool           // piped data whose size is known only once it ends
 	Path          string
+	SavePath      string // final location on the recipient's side
 	Checksum      string
 	StartTime     time.Time
 	File          *os.File
-	Connection    net.Conn
+	Connection    *protocol.Conn
 	ProgressBar   *utils.ProgressBar
 	PauseLock     sync.Mutex
 	IsPaused      bool
+	IsCancelled   bool
+	IsDeclined    bool         // the recipient refused the transfer
+	peerPaused    bool         // the recipient paused receiving this send
+	lastHeard     atomic.Int64 // when the recipient last reported progress, in Unix nanoseconds
+	resumedFrom   int64
+}
+
+// trackProgress feeds transferred bytes to the transfer's progress bar, or to
+// its group's combined bar when it belongs to one
+func (t *Transfer) trackProgress(p []byte) {
+	if t.ProgressBar != nil {
+		t.ProgressBar.Write(p)
+	} else if t.Group != nil && t.Group.ProgressBar != nil {
+		t.Group.ProgressBar.Write(p)
+	}
+}
+
+// trackDelivered advances a send's progress to the bytes the recipient has
+// confirmed writing
+func (t *Transfer) trackDelivered(bytes int64) {
+	acked := t.BytesAcked.Load()
+	for bytes > acked && !t.BytesAcked.CompareAndSwap(acked, bytes) {
+		acked = t.BytesAcked.Load()
+	}
+	delta := bytes - acked
+	if delta <= 0 {
+		return
+	}
+	journalDirty.Store(true)
+	if t.ProgressBar != nil {
+		t.ProgressBar.Add64(delta)
+	} else if t.Group != nil && t.Group.ProgressBar != nil {
+		t.Group.ProgressBar.Add64(delta)
+	}
+}
+
+// Delivered returns the bytes that have reached the recipient: the
+// acknowledged bytes for sends and the written bytes for receives
+func (t *Transfer) Delivered() int64 {
+	if t.Direction == "send" {
+		return t.BytesAcked.Load()
+	}
+	return t.BytesComplete.Load()
+}
+
+// Throughput returns the transfer rate in bytes per second since it started,
+// not counting data carried over from an interrupted attempt
+func (t *Transfer) Throughput() float64 {
+	elapsed := time.Since(t.StartTime).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(t.Delivered()-t.resumedFrom) / elapsed
+}
+
+// resumeFrom records offset bytes as already transferred by an earlier attempt
+func (t *Transfer) resumeFrom(offset int64) {
+	t.BytesComplete.Store(offset)
+	t.BytesAcked.Store(offset)
+	t.resumedFrom = offset
+	if t.ProgressBar != nil {
+		t.ProgressBar.Add64(offset)
+	} else if t.Group != nil && t.Group.ProgressBar != nil {
+		t.Group.ProgressBar.Add64(offset)
+	}
 }
 
 // ActiveTransfers tracks all ongoing transfers
@@ -81,11 +162,19 @@ func GenerateTransferID() string {
 	return id
 }
 
-// RegisterTransfer adds a new transfer to the tracking system
+// RegisterTransfer adds a new transfer to the tracking system. Sends are
+// also written to the journal so they survive a restart.
 func RegisterTransfer(transfer *Transfer) {
 	TransfersMutex.Lock()
-	defer TransfersMutex.Unlock()
 	ActiveTransfers[transfer.ID] = transfer
+	TransfersMutex.Unlock()
+	publishTransfer(TransferAddedEvent, transfer)
+
+	if transfer.Direction == "send" {
+		saveJournal()
+	} else {
+		downloadStarted(transfer)
+	}
 }
 
 // GetTransfer retrieves a transfer by ID
@@ -96,11 +185,23 @@ func GetTransfer(id string) (*Transfer, bool) {
 	return transfer, exists
 }
 
-// RemoveTransfer removes a completed or failed transfer
+// RemoveTransfer removes a completed or failed transfer and records it in
+// the transfer history
 func RemoveTransfer(id string) {
 	TransfersMutex.Lock()
-	defer TransfersMutex.Unlock()
+	transfer, exists := ActiveTransfers[id]
 	delete(ActiveTransfers, id)
+	TransfersMutex.Unlock()
+
+	if exists {
+		publishTransfer(TransferFinishedEvent, transfer)
+		recordHistory(transfer)
+		if transfer.Direction == "send" {
+			saveJournal()
+		} else {
+			downloadFinished(transfer)
+		}
+	}
 }
 
 // ListTransfers returns all active transfers
@@ -112,6 +213,11 @@ func ListTransfers() []*Transfer {
 	for _, transfer := range ActiveTransfers {
 		transfers = append(transfers, transfer)
 	}
+	sort.Slice(transfers, func(i, j int) bool {
+		a, _ := strconv.Atoi(transfers[i].ID)
+		b, _ := strconv.Atoi(transfers[j].ID)
+		return a < b
+	})
 	return transfers
 }
 
@@ -123,9 +229,8 @@ func PauseTransfer(id string) error {
 	}
 	
 	transfer.PauseLock.Lock()
-	defer transfer.PauseLock.Unlock()
-	
 	if transfer.Status != Active {
+		defer transfer.PauseLock.Unlock()
 		return fmt.Errorf("cannot pause transfer with status: %s", transfer.Status)
 	}
 	
@@ -136,7 +241,10 @@ func PauseTransfer(id string) error {
 	if transfer.ProgressBar != nil {
 		transfer.ProgressBar.SetPaused(true)
 	}
-	
+	transfer.PauseLock.Unlock()
+
+	publishTransfer(TransferUpdatedEvent, transfer)
+	notifySenderPause(transfer, true)
 	return nil
 }
 
@@ -148,9 +256,8 @@ func ResumeTransfer(id string) error {
 	}
 	
 	transfer.PauseLock.Lock()
-	defer transfer.PauseLock.Unlock()
-	
 	if transfer.Status != Paused {
+		defer transfer.PauseLock.Unlock()
 		return fmt.Errorf("cannot resume transfer with status: %s", transfer.Status)
 	}
 	
@@ -161,10 +268,64 @@ func ResumeTransfer(id string) error {
 	if transfer.ProgressBar != nil {
 		transfer.ProgressBar.SetPaused(false)
 	}
-	
+	transfer.PauseLock.Unlock()
+
+	publishTransfer(TransferUpdatedEvent, transfer)
+	notifySenderPause(transfer, false)
 	return nil
 }
 
+// errCancelled ends a transfer the user cancelled
+var errCancelled = errors.New("transfer cancelled")
+
+// CancelTransfer stops a queued, active or paused transfer. A queued
+// transfer is taken out of the queue; a running one fails the next time it
+// sends or writes data.
+func CancelTransfer(id string) error {
+	transfer, exists := GetTransfer(id)
+	if !exists {
+		return fmt.Errorf("transfer with ID %s not found", id)
+	}
+
+	transfer.PauseLock.Lock()
+	switch transfer.Status {
+	case Queued, Active, Paused:
+	default:
+		status := transfer.Status
+		transfer.PauseLock.Unlock()
+		return fmt.Errorf("cannot cancel transfer with status: %s", status)
+	}
+	wasPaused := transfer.IsPaused
+	transfer.IsCancelled = true
+	transfer.IsPaused = false
+	if transfer.ProgressBar != nil {
+		transfer.ProgressBar.SetPaused(false)
+	}
+	transfer.PauseLock.Unlock()
+
+	// A paused receive only notices the cancel with the next frame
+	if wasPaused {
+		notifySenderPause(transfer, false)
+	}
+
+	TransferQueue.Cancel(id)
+	return nil
+}
+
+// transferCancelled reports whether the user cancelled transfer
+func transferCancelled(transfer *Transfer) bool {
+	transfer.PauseLock.Lock()
+	defer transfer.PauseLock.Unlock()
+	return transfer.IsCancelled
+}
+
+// markDeclined records that the recipient refused transfer
+func markDeclined(transfer *Transfer) {
+	transfer.PauseLock.Lock()
+	transfer.IsDeclined = true
+	transfer.PauseLock.Unlock()
+}
+
 // UpdateTransferStatus updates the status of a transfer
 func UpdateTransferStatus(id string, status TransferStatus) {
 	transfer, exists := GetTransfer(id)
@@ -173,9 +334,9 @@ func UpdateTransferStatus(id string, status TransferStatus) {
 	}
 	
 	transfer.PauseLock.Lock()
-	defer transfer.PauseLock.Unlock()
-	
 	transfer.Status = status
+	transfer.PauseLock.Unlock()
+	publishTransfer(TransferUpdatedEvent, transfer)
 }
 
 // CheckpointedReader is an io.Reader that supports pausing/resuming
@@ -192,19 +353,22 @@ type CheckpointedReader struct {
 func NewCheckpointedReader(reader io.Reader, transfer *Transfer, chunkSize int) *CheckpointedReader {
 	return &CheckpointedReader{
 		Reader:    reader,
+		BytesRead: transfer.BytesComplete.Load(),
 		Transfer:  transfer,
 		ChunkSize: chunkSize,
 		Buffer:    make([]byte, chunkSize),
 		PauseCheck: func() bool {
-			transfer.PauseLock.Lock()
-			defer transfer.PauseLock.Unlock()
-			return transfer.IsPaused
+			return transferPaused(transfer)
 		},
 	}
 }
 
 // Read implements io.Reader and supports pausing
 func (cr *CheckpointedReader) Read(p []byte) (n int, err error) {
+	if transferCancelled(cr.Transfer) {
+		return 0, errCancelled
+	}
+
 	// Check if transfer is paused
 	if cr.PauseCheck() {
 		// Sleep a bit and check again to avoid CPU spinning
@@ -217,7 +381,7 @@ func (cr *CheckpointedReader) Read(p []byte) (n int, err error) {
 	
 	if n > 0 {
 		cr.BytesRead += int64(n)
-		cr.Transfer.BytesComplete = cr.BytesRead
+		cr.Transfer.BytesComplete.Store(cr.BytesRead)
 	}
 	
 	return n, err
@@ -236,10 +400,11 @@ type CheckpointedWriter struct {
 // NewCheckpointedWriter creates a new CheckpointedWriter
 func NewCheckpointedWriter(writer io.Writer, transfer *Transfer, chunkSize int) *CheckpointedWriter {
 	return &CheckpointedWriter{
-		Writer:     writer,
-		Transfer:   transfer,
-		ChunkSize:  chunkSize,
-		Buffer:     make([]byte, chunkSize),
+		Writer:       writer,
+		BytesWritten: transfer.BytesComplete.Load(),
+		Transfer:     transfer,
+		ChunkSize:    chunkSize,
+		Buffer:       make([]byte, chunkSize),
 		PauseCheck: func() bool {
 			transfer.PauseLock.Lock()
 			defer transfer.PauseLock.Unlock()
@@ -248,18 +413,22 @@ func NewCheckpointedWriter(writer io.Writer, transfer *Transfer, chunkSize int)
 	}
 }
 
-// Write implements io.Writer and supports pausing
+// Write implements io.Writer and supports pausing. A paused write waits
+// until the transfer is resumed rather than dropping data; incoming
+// transfers write on a goroutine of their own, so only they wait.
 func (cw *CheckpointedWriter) Write(p []byte) (n int, err error) {
-	if cw.PauseCheck() {
+	for cw.PauseCheck() {
 		time.Sleep(500 * time.Millisecond)
-		return 0, nil
+	}
+	if transferCancelled(cw.Transfer) {
+		return 0, errCancelled
 	}
 	
 	n, err = cw.Writer.Write(p)
 	
 	if n > 0 {
 		cw.BytesWritten += int64(n)
-		cw.Transfer.BytesComplete = cw.BytesWritten
+		cw.Transfer.BytesComplete.Store(cw.BytesWritten)
 	}
 	
 	return n, err
@@ -269,12 +438,12 @@ func (cw *CheckpointedWriter) Write(p []byte) (n int, err error) {
 func HandlePauseTransfer(transferID string) {
 	transfer, exists := GetTransfer(transferID)
 	if !exists {
-		fmt.Println(utils.ErrorColor("❌ Transfer not found:"), utils.CommandColor(transferID))
+		fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Transfer not found:"), utils.CommandColor(transferID))
 		return
 	}
 	
 	if transfer.Status != Active {
-		fmt.Printf("%s Transfer %s is already %s\n", 
+		fmt.Fprintf(utils.Output, "%s Transfer %s is already %s\n", 
 			utils.WarningColor("⚠"),
 			utils.CommandColor(transferID),
 			utils.WarningColor(transfer.Status.String()))
@@ -283,36 +452,36 @@ func HandlePauseTransfer(transferID string) {
 	
 	err := PauseTransfer(transferID)
 	if err != nil {
-		fmt.Println(utils.ErrorColor("❌ Failed to pause transfer:"), err)
+		fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Failed to pause transfer:"), err)
 		return
 	}
 	
-	fmt.Printf("%s Transfer %s paused\n", 
+	fmt.Fprintf(utils.Output, "%s Transfer %s paused\n", 
 		utils.WarningColor("⏸"),
 		utils.CommandColor(transferID))
 	
-	fmt.Printf("  %s: %s (%s)\n", 
+	fmt.Fprintf(utils.Output, "  %s: %s (%s)\n", 
 		utils.InfoColor("Name"),
 		utils.InfoColor(transfer.Name),
 		utils.InfoColor(formatTransferType(transfer.Type)))
 		
-	fmt.Printf("  %s: %s / %s (%.1f%%)\n", 
+	fmt.Fprintf(utils.Output, "  %s: %s / %s (%.1f%%)\n", 
 		utils.InfoColor("Progress"),
-		utils.InfoColor(formatSize(transfer.BytesComplete)),
+		utils.InfoColor(formatSize(transfer.BytesComplete.Load())),
 		utils.InfoColor(formatSize(transfer.Size)),
-		float64(transfer.BytesComplete) / float64(transfer.Size) * 100)
+		float64(transfer.BytesComplete.Load()) / float64(transfer.Size) * 100)
 }
 
 // HandleResumeTransfer handles the /resume command
 func HandleResumeTransfer(transferID string) {
 	transfer, exists := GetTransfer(transferID)
 	if !exists {
-		fmt.Println(utils.ErrorColor("❌ Transfer not found:"), utils.CommandColor(transferID))
+		fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Transfer not found:"), utils.CommandColor(transferID))
 		return
 	}
 	
 	if transfer.Status != Paused {
-		fmt.Printf("%s Transfer %s is not paused (current status: %s)\n", 
+		fmt.Fprintf(utils.Output, "%s Transfer %s is not paused (current status: %s)\n", 
 			utils.WarningColor("⚠"),
 			utils.CommandColor(transferID),
 			utils.WarningColor(transfer.Status.String()))
@@ -321,40 +490,66 @@ func HandleResumeTransfer(transferID string) {
 	
 	err := ResumeTransfer(transferID)
 	if err != nil {
-		fmt.Println(utils.ErrorColor("❌ Failed to resume transfer:"), err)
+		fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Failed to resume transfer:"), err)
 		return
 	}
 	
-	fmt.Printf("%s Transfer %s resumed\n", 
+	fmt.Fprintf(utils.Output, "%s Transfer %s resumed\n", 
 		utils.SuccessColor("▶"),
 		utils.CommandColor(transferID))
 	
-	fmt.Printf("  %s: %s (%s)\n", 
+	fmt.Fprintf(utils.Output, "  %s: %s (%s)\n", 
 		utils.InfoColor("Name"),
 		utils.InfoColor(transfer.Name),
 		utils.InfoColor(formatTransferType(transfer.Type)))
 		
-	fmt.Printf("  %s: %s / %s (%.1f%%)\n", 
+	fmt.Fprintf(utils.Output, "  %s: %s / %s (%.1f%%)\n", 
 		utils.InfoColor("Progress"),
-		utils.InfoColor(formatSize(transfer.BytesComplete)),
+		utils.InfoColor(formatSize(transfer.BytesComplete.Load())),
 		utils.InfoColor(formatSize(transfer.Size)),
-		float64(transfer.BytesComplete) / float64(transfer.Size) * 100)
+		float64(transfer.BytesComplete.Load()) / float64(transfer.Size) * 100)
+}
+
+// HandleCancelTransfer handles the /cancel command
+func HandleCancelTransfer(transferID string) {
+	if err := CancelTransfer(transferID); err != nil {
+		fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Failed to cancel transfer:"), err)
+		return
+	}
+	fmt.Fprintf(utils.Output, "%s Transfer %s cancelled\n",
+		utils.WarningColor("⏹"),
+		utils.CommandColor(transferID))
 }
 
 // HandleListTransfers handles the /transfers command
 func HandleListTransfers() {
 	transfers := ListTransfers()
+	mirrors := ListMirrors()
+	fanOuts := ListFanOuts()
 	
-	if len(transfers) == 0 {
-		fmt.Println(utils.InfoColor("📡 No active transfers"))
+	if len(transfers) == 0 && len(mirrors) == 0 && len(fanOuts) == 0 {
+		fmt.Fprintln(utils.Output, utils.InfoColor("📡 No active transfers"))
 		return
 	}
 	
-	fmt.Println(utils.HeaderColor("📡 Active Transfers:"))
-	fmt.Println(utils.InfoColor("-----------------------------------"))
+	// Running transfers first, then the queue in the order it will be served
+	sort.SliceStable(transfers, func(i, j int) bool {
+		iQueued, jQueued := transfers[i].Status == Queued, transfers[j].Status == Queued
+		if iQueued != jQueued {
+			return !iQueued
+		}
+		if iQueued {
+			return TransferQueue.Position(transfers[i].ID) < TransferQueue.Position(transfers[j].ID)
+		}
+		return false
+	})
+
+	fmt.Fprintln(utils.Output, utils.HeaderColor("📡 Active Transfers:"))
+	fmt.Fprintln(utils.Output, utils.InfoColor("-----------------------------------"))
 	
 	for _, transfer := range transfers {
-		progress := float64(transfer.BytesComplete) / float64(transfer.Size) * 100
+		delivered := transfer.Delivered()
+		progress := float64(delivered) / float64(transfer.Size) * 100
 		
 		statusColor := utils.InfoColor
 		statusIcon := ""
@@ -371,6 +566,12 @@ func HandleListTransfers() {
 		case Failed:
 			statusColor = utils.ErrorColor
 			statusIcon = "❌ "
+		case Queued:
+			statusColor = utils.WarningColor
+			statusIcon = "⏳ "
+		case AwaitingReceipt:
+			statusColor = utils.InfoColor
+			statusIcon = "🕓 "
 		}
 		
 		directionIcon := "📤 "
@@ -378,36 +579,107 @@ func HandleListTransfers() {
 			directionIcon = "📥 "
 		}
 		
-		fmt.Printf("%s %s%s %s (%s)\n", 
+		fmt.Fprintf(utils.Output, "%s %s%s %s (%s)\n", 
 			statusColor(statusIcon),
 			directionIcon,
 			utils.CommandColor("ID: "+transfer.ID),
 			utils.InfoColor(transfer.Name),
 			statusColor(transfer.Status.String()))
 		
-		fmt.Printf("   Type: %s | Size: %s | Progress: %.1f%% (%s/%s)\n", 
-			formatTransferType(transfer.Type),
-			formatSize(transfer.Size),
-			progress,
-			formatSize(transfer.BytesComplete),
-			formatSize(transfer.Size))
+		if transfer.Stream && transfer.Status == Active {
+			fmt.Fprintf(utils.Output, "   Type: Stream | Progress: %s so far | Speed: %s/s\n",
+				formatSize(delivered),
+				formatSize(int64(transfer.Throughput())))
+		} else {
+			fmt.Fprintf(utils.Output, "   Type: %s | Size: %s | Progress: %.1f%% (%s/%s)\n", 
+				formatTransferType(transfer.Type),
+				formatSize(transfer.Size),
+				progress,
+				formatSize(delivered),
+				formatSize(transfer.Size))
+		}
+
+		if (transfer.Status == Active || transfer.Status == Paused) && !transfer.Stream {
+			eta := "unknown"
+			if rate := transfer.Throughput(); rate > 0 {
+				eta = formatDuration(time.Duration(float64(transfer.Size-delivered) / rate * float64(time.Second)))
+			}
+			fmt.Fprintf(utils.Output, "   Speed: %s/s | ETA: %s", formatSize(int64(transfer.Throughput())), eta)
+			if transfer.Direction == "send" {
+				fmt.Fprintf(utils.Output, " | Sent: %s", formatSize(transfer.BytesComplete.Load()))
+			}
+			fmt.Fprintln(utils.Output)
+		}
 		
 		relationText := "From"
 		if transfer.Direction == "send" {
 			relationText = "To"
 		}
-		fmt.Printf("   %s: %s | Started: %s ago\n", 
-			relationText,
-			utils.UserColor(transfer.Recipient),
-			formatDuration(time.Since(transfer.StartTime)))
+		if transfer.Status == Queued {
+			fmt.Fprintf(utils.Output, "   %s: %s | Queue position: %d | Priority: %s | Waiting: %s\n",
+				relationText,
+				utils.UserColor(transfer.Recipient),
+				TransferQueue.Position(transfer.ID),
+				transfer.Priority,
+				formatDuration(time.Since(transfer.StartTime)))
+		} else {
+			fmt.Fprintf(utils.Output, "   %s: %s | Started: %s ago\n",
+				relationText,
+				utils.UserColor(transfer.Recipient),
+				formatDuration(time.Since(transfer.StartTime)))
+		}
 		
-		fmt.Println(utils.InfoColor("   ---"))
+		fmt.Fprintln(utils.Output, utils.InfoColor("   ---"))
+	}
+
+	for _, group := range ListGroups() {
+		done, bytes := group.Progress()
+		fmt.Fprintf(utils.Output, "%s %s %s (%d/%d files, %s/%s)\n",
+			utils.HeaderColor("📦"),
+			utils.CommandColor("Group: "+group.ID),
+			utils.UserColor("to "+group.Recipient),
+			done,
+			len(group.Members),
+			formatSize(bytes),
+			formatSize(group.Size))
+	}
+	if len(ListGroups()) > 0 {
+		fmt.Fprintln(utils.Output, utils.InfoColor("   ---"))
+	}
+
+	for _, fan := range fanOuts {
+		fmt.Fprintf(utils.Output, "%s %s %s\n",
+			utils.HeaderColor("📨"),
+			utils.CommandColor("Fan-out: "+fan.ID),
+			utils.InfoColor(fan.Name))
+		for _, line := range fan.describe() {
+			fmt.Fprintln(utils.Output, "   " + line)
+		}
+	}
+	if len(fanOuts) > 0 {
+		fmt.Fprintln(utils.Output, utils.InfoColor("   ---"))
+	}
+
+	for _, mirror := range mirrors {
+		fmt.Fprintf(utils.Output, "%s %s %s %s → %s\n",
+			utils.HeaderColor("🪞"),
+			utils.CommandColor("Mirror: "+mirror.ID),
+			utils.UserColor("from "+mirror.Peer),
+			utils.InfoColor(mirror.Remote),
+			utils.InfoColor(mirror.Local))
+		fmt.Fprintf(utils.Output, "   %s\n", mirror.describe())
+	}
+	if len(mirrors) > 0 {
+		fmt.Fprintln(utils.Output, utils.InfoColor("   ---"))
 	}
 
-	fmt.Println(utils.InfoColor("Commands:"))
-	fmt.Printf("  %s - Pause a transfer\n", utils.CommandColor("/pause <transferId>"))
-	fmt.Printf("  %s - Resume a paused transfer\n", utils.CommandColor("/resume <transferId>"))
-	fmt.Println(utils.InfoColor("-----------------------------------"))
+	fmt.Fprintln(utils.Output, utils.InfoColor("Commands:"))
+	fmt.Fprintf(utils.Output, "  %s - Pause a transfer\n", utils.CommandColor("/pause <transferId>"))
+	fmt.Fprintf(utils.Output, "  %s - Resume a paused transfer\n", utils.CommandColor("/resume <transferId>"))
+	fmt.Fprintf(utils.Output, "  %s - Stop a queued or running transfer\n", utils.CommandColor("/cancel <transferId>"))
+	fmt.Fprintf(utils.Output, "  %s - Change a queued transfer's priority\n", utils.CommandColor("/priority <transferId> high|normal|low"))
+	fmt.Fprintf(utils.Output, "  %s - Move a queued transfer in the queue\n", utils.CommandColor("/move <transferId> <position>"))
+	fmt.Fprintln(utils.Output, utils.InfoColor("-----------------------------------"))
 }
 
 // Helper functions for formatting
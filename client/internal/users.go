@@ -0,0 +1,113 @@
+package connection
+
+import (
+	"drizlink/protocol"
+	"fmt"
+	"os/user"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OnlineUser is one entry of the server's list of online users
+type OnlineUser struct {
+	Name string `json:"name"`
+	ID   string `json:"id"`
+}
+
+var (
+	// userListWaiters receive the next user list instead of it being printed
+	userListWaiters      []chan []OnlineUser
+	userListWaitersMutex sync.Mutex
+)
+
+// RequestUsers asks the server which users are online and waits for the
+// answer. ReadLoop must be running to deliver it.
+func RequestUsers(conn *protocol.Conn) ([]OnlineUser, error) {
+	waiter := make(chan []OnlineUser, 1)
+	userListWaitersMutex.Lock()
+	userListWaiters = append(userListWaiters, waiter)
+	userListWaitersMutex.Unlock()
+
+	if err := conn.WriteLine("/status"); err != nil {
+		return nil, err
+	}
+	select {
+	case users := <-waiter:
+		return users, nil
+	case <-time.After(10 * time.Second):
+		return nil, fmt.Errorf("server did not send the user list")
+	}
+}
+
+// deliverUsers hands a user list of username and user ID pairs to the
+// oldest waiting RequestUsers. It reports false when nobody is waiting.
+func deliverUsers(pairs []string) bool {
+	userListWaitersMutex.Lock()
+	if len(userListWaiters) == 0 {
+		userListWaitersMutex.Unlock()
+		return false
+	}
+	waiter := userListWaiters[0]
+	userListWaiters = userListWaiters[1:]
+	userListWaitersMutex.Unlock()
+
+	var users []OnlineUser
+	for i := 0; i+1 < len(pairs); i += 2 {
+		users = append(users, OnlineUser{Name: pairs[i], ID: pairs[i+1]})
+	}
+	waiter <- users
+	return true
+}
+
+// ResolveUser returns the ID of the online user called user, or with user
+// as their ID
+func ResolveUser(conn *protocol.Conn, user string) (string, error) {
+	users, err := RequestUsers(conn)
+	if err != nil {
+		return "", err
+	}
+
+	var matches []string
+	for _, online := range users {
+		if online.ID == user {
+			return online.ID, nil
+		}
+		if online.Name == user {
+			matches = append(matches, online.ID)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf("no online user called %s", user)
+	case 1:
+		return matches[0], nil
+	default:
+		return "", fmt.Errorf("%d online users are called %s, use a user ID", len(matches), user)
+	}
+}
+
+// ResolveUsers resolves a comma separated list of usernames or user IDs
+// like ResolveUser, leaving AllUsers as it is
+func ResolveUsers(conn *protocol.Conn, users string) (string, error) {
+	if users == AllUsers {
+		return users, nil
+	}
+	var ids []string
+	for _, user := range strings.Split(users, ",") {
+		id, err := ResolveUser(conn, strings.TrimSpace(user))
+		if err != nil {
+			return "", err
+		}
+		ids = append(ids, id)
+	}
+	return strings.Join(ids, ","), nil
+}
+
+// DefaultUsername is the login name of the local user
+func DefaultUsername() string {
+	if current, err := user.Current(); err == nil && current.Username != "" {
+		return current.Username
+	}
+	return "drizlink"
+}
@@ -0,0 +1,309 @@
+package connection
+
+import (
+	"drizlink/protocol"
+	"drizlink/utils"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// watchSettleTime is how long a file must keep its size and modification
+	// time before it is considered finished and sent
+	watchSettleTime = 3 * time.Second
+	// watchPollInterval is how often a folder is scanned when the system
+	// cannot report changes
+	watchPollInterval = 2 * time.Second
+	// watchRescanInterval is how often a folder is scanned anyway while
+	// changes are reported, in case an event was missed
+	watchRescanInterval = time.Minute
+)
+
+// fileStamp identifies one version of a file
+type fileStamp struct {
+	Size    int64
+	ModTime time.Time
+}
+
+func (stamp fileStamp) equal(other fileStamp) bool {
+	return stamp.Size == other.Size && stamp.ModTime.Equal(other.ModTime)
+}
+
+// pendingFile is a new or changed file waiting to become stable
+type pendingFile struct {
+	stamp fileStamp
+	since time.Time
+}
+
+// changeNotifier reports that something in a watched folder may have changed
+type changeNotifier interface {
+	Changes() <-chan struct{}
+	Close()
+}
+
+// FolderWatch sends new and modified files in Folder to Recipient
+type FolderWatch struct {
+	ID        string
+	Recipient string
+	Folder    string
+	Mode      string
+	Sent      int
+	StartTime time.Time
+	conn      *protocol.Conn
+	known     map[string]fileStamp
+	pending   map[string]pendingFile
+	notifier  changeNotifier
+	stop      chan struct{}
+	mutex     sync.Mutex
+}
+
+var (
+	activeWatches  = make(map[string]*FolderWatch)
+	watchesMutex   sync.Mutex
+	watchIDCounter = 1
+)
+
+// HandleWatch starts watching folder and sending files that appear in it or
+// change to recipientId. Files already in the folder are not sent.
+func HandleWatch(conn *protocol.Conn, recipientId, folder string) {
+	folder, err := filepath.Abs(folder)
+	if err != nil {
+		fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Invalid folder:"), err)
+		return
+	}
+	info, err := os.Stat(folder)
+	if err != nil {
+		fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Error opening folder:"), err)
+		return
+	}
+	if !info.IsDir() {
+		fmt.Fprintln(utils.Output, utils.ErrorColor("❌ Not a folder:"), folder)
+		return
+	}
+
+	watchesMutex.Lock()
+	for _, watch := range activeWatches {
+		if watch.Folder == folder && watch.Recipient == recipientId {
+			watchesMutex.Unlock()
+			fmt.Fprintf(utils.Output, "%s %s is already watched for user %s (Watch ID: %s)\n",
+				utils.WarningColor("⚠"),
+				folder,
+				utils.UserColor(recipientId),
+				utils.CommandColor(watch.ID))
+			return
+		}
+	}
+	watch := &FolderWatch{
+		ID:        "w" + strconv.Itoa(watchIDCounter),
+		Recipient: recipientId,
+		Folder:    folder,
+		StartTime: time.Now(),
+		conn:      conn,
+		known:     make(map[string]fileStamp),
+		pending:   make(map[string]pendingFile),
+		stop:      make(chan struct{}),
+	}
+	watchIDCounter++
+	activeWatches[watch.ID] = watch
+	watchesMutex.Unlock()
+
+	watch.Mode = "polling"
+	if notifier, err := newChangeNotifier(folder); err == nil {
+		watch.notifier = notifier
+		watch.Mode = "notify"
+	}
+
+	// Whatever is there now is the starting point
+	for name, stamp := range watch.list() {
+		watch.known[name] = stamp
+	}
+
+	fmt.Fprintf(utils.Output, "%s Watching %s for user %s (Watch ID: %s, %d existing files ignored)\n",
+		utils.InfoColor("👀"),
+		utils.InfoColor(folder),
+		utils.UserColor(recipientId),
+		utils.CommandColor(watch.ID),
+		len(watch.known))
+
+	go watch.run()
+}
+
+// HandleListWatches prints the folders being watched
+func HandleListWatches() {
+	watchesMutex.Lock()
+	watches := make([]*FolderWatch, 0, len(activeWatches))
+	for _, watch := range activeWatches {
+		watches = append(watches, watch)
+	}
+	watchesMutex.Unlock()
+
+	if len(watches) == 0 {
+		fmt.Fprintln(utils.Output, utils.InfoColor("👀 No folders are watched"))
+		return
+	}
+	sort.Slice(watches, func(i, j int) bool {
+		return watches[i].StartTime.Before(watches[j].StartTime)
+	})
+
+	fmt.Fprintln(utils.Output, utils.HeaderColor("👀 Watched Folders:"))
+	fmt.Fprintln(utils.Output, utils.InfoColor("-----------------------------------"))
+	for _, watch := range watches {
+		watch.mutex.Lock()
+		sent, waiting, mode := watch.Sent, len(watch.pending), watch.Mode
+		watch.mutex.Unlock()
+
+		fmt.Fprintf(utils.Output, "%s %s → %s\n",
+			utils.CommandColor(watch.ID),
+			utils.InfoColor(watch.Folder),
+			utils.UserColor(watch.Recipient))
+		fmt.Fprintf(utils.Output, "   %d files sent, %d waiting to settle, %s, since %s\n",
+			sent, waiting, mode, watch.StartTime.Format("15:04:05"))
+	}
+}
+
+// HandleUnwatch stops the watch with watchID, or every watch for "all"
+func HandleUnwatch(watchID string) {
+	watchesMutex.Lock()
+	var stopped []*FolderWatch
+	for id, watch := range activeWatches {
+		if watchID == "all" || id == watchID {
+			stopped = append(stopped, watch)
+			delete(activeWatches, id)
+		}
+	}
+	watchesMutex.Unlock()
+
+	if len(stopped) == 0 {
+		fmt.Fprintln(utils.Output, utils.ErrorColor("❌ No watch with ID"), utils.CommandColor(watchID))
+		return
+	}
+	for _, watch := range stopped {
+		close(watch.stop)
+		watch.mutex.Lock()
+		sent := watch.Sent
+		watch.mutex.Unlock()
+		fmt.Fprintf(utils.Output, "%s Stopped watching %s (%d files sent)\n",
+			utils.SuccessColor("✅"),
+			utils.InfoColor(watch.Folder),
+			sent)
+	}
+}
+
+// run scans the folder whenever a change is reported or the scan interval
+// passes, until the watch is stopped
+func (watch *FolderWatch) run() {
+	var changes <-chan struct{}
+	if watch.notifier != nil {
+		changes = watch.notifier.Changes()
+	}
+	defer func() {
+		if watch.notifier != nil {
+			watch.notifier.Close()
+		}
+	}()
+
+	for {
+		interval := watchRescanInterval
+		if watch.notifier == nil {
+			interval = watchPollInterval
+		}
+		watch.mutex.Lock()
+		if len(watch.pending) > 0 {
+			// Check again once the waiting files may have settled
+			interval = min(interval, watchSettleTime/2)
+		}
+		watch.mutex.Unlock()
+
+		timer := time.NewTimer(interval)
+		select {
+		case <-watch.stop:
+			timer.Stop()
+			return
+		case _, ok := <-changes:
+			timer.Stop()
+			if !ok {
+				fmt.Fprintf(utils.Output, "%s Change notifications for %s stopped, polling instead\n",
+					utils.WarningColor("⚠"),
+					watch.Folder)
+				watch.notifier.Close()
+				watch.notifier, changes = nil, nil
+				watch.mutex.Lock()
+				watch.Mode = "polling"
+				watch.mutex.Unlock()
+			}
+		case <-timer.C:
+		}
+		watch.scan()
+	}
+}
+
+// list returns the stamps of the regular files directly in the folder.
+// Hidden files are left out, they are usually still being written.
+func (watch *FolderWatch) list() map[string]fileStamp {
+	files := make(map[string]fileStamp)
+	entries, err := os.ReadDir(watch.Folder)
+	if err != nil {
+		return files
+	}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		files[entry.Name()] = fileStamp{Size: info.Size(), ModTime: info.ModTime()}
+	}
+	return files
+}
+
+// scan notes new and changed files and sends those that have not changed
+// for watchSettleTime
+func (watch *FolderWatch) scan() {
+	files := watch.list()
+	now := time.Now()
+	var ready []string
+
+	watch.mutex.Lock()
+	for name, stamp := range files {
+		if known, exists := watch.known[name]; exists && known.equal(stamp) {
+			delete(watch.pending, name)
+			continue
+		}
+		pending, exists := watch.pending[name]
+		if !exists || !pending.stamp.equal(stamp) {
+			watch.pending[name] = pendingFile{stamp: stamp, since: now}
+			continue
+		}
+		if now.Sub(pending.since) >= watchSettleTime {
+			watch.known[name] = stamp
+			delete(watch.pending, name)
+			ready = append(ready, name)
+		}
+	}
+	for name := range watch.pending {
+		if _, exists := files[name]; !exists {
+			delete(watch.pending, name)
+		}
+	}
+	for name := range watch.known {
+		if _, exists := files[name]; !exists {
+			delete(watch.known, name)
+		}
+	}
+	watch.Sent += len(ready)
+	watch.mutex.Unlock()
+
+	sort.Strings(ready)
+	for _, name := range ready {
+		fmt.Fprintf(utils.Output, "%s New or changed file in watched folder: %s\n", utils.InfoColor("👀"), utils.InfoColor(name))
+		HandleSendFile(watch.conn, watch.Recipient, filepath.Join(watch.Folder, name))
+	}
+}
@@ -0,0 +1,57 @@
+package connection
+
+import (
+	"os"
+	"syscall"
+)
+
+// inotifyNotifier reports changes in a folder using inotify
+type inotifyNotifier struct {
+	file    *os.File
+	changes chan struct{}
+}
+
+// newChangeNotifier watches folder with inotify. Events are only used as a
+// hint to scan the folder, so their details are not decoded.
+func newChangeNotifier(folder string) (changeNotifier, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	mask := uint32(syscall.IN_CLOSE_WRITE | syscall.IN_CREATE | syscall.IN_MODIFY |
+		syscall.IN_MOVED_TO | syscall.IN_ATTRIB | syscall.IN_DELETE_SELF | syscall.IN_MOVE_SELF)
+	if _, err := syscall.InotifyAddWatch(fd, folder, mask); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	// A non-blocking descriptor lets Close interrupt a pending read
+	notifier := &inotifyNotifier{
+		file:    os.NewFile(uintptr(fd), "inotify"),
+		changes: make(chan struct{}, 1),
+	}
+	go notifier.read()
+	return notifier, nil
+}
+
+func (notifier *inotifyNotifier) read() {
+	defer close(notifier.changes)
+	buffer := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		if _, err := notifier.file.Read(buffer); err != nil {
+			return
+		}
+		select {
+		case notifier.changes <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (notifier *inotifyNotifier) Changes() <-chan struct{} {
+	return notifier.changes
+}
+
+func (notifier *inotifyNotifier) Close() {
+	notifier.file.Close()
+}
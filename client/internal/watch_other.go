@@ -0,0 +1,10 @@
+//go:build !linux
+
+package connection
+
+import "errors"
+
+// newChangeNotifier is only available on Linux, elsewhere folders are polled
+func newChangeNotifier(folder string) (changeNotifier, error) {
+	return nil, errors.New("change notifications are not supported on this system")
+}
@@ -0,0 +1,115 @@
+package helper
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	// MinChunk, AvgChunk and MaxChunk bound the size of content defined
+	// chunks. A boundary is found where the rolling hash has as many low zero
+	// bits as AvgChunk has, so chunks average about AvgChunk bytes.
+	MinChunk = 16 << 10
+	AvgChunk = 64 << 10
+	MaxChunk = 256 << 10
+
+	// RecipeEntrySize is the encoded size of one ChunkRef
+	RecipeEntrySize = sha256.Size + 4
+
+	chunkMask = AvgChunk - 1
+)
+
+// ChunkRef identifies one content defined chunk of a file by its SHA-256
+type ChunkRef struct {
+	Hash [sha256.Size]byte
+	Size uint32
+}
+
+// gearTable maps every byte to a random value for the rolling hash. It is
+// generated from a fixed seed since every client must cut files at the same
+// places.
+var gearTable = func() [256]uint64 {
+	var table [256]uint64
+	state := uint64(0x6472697a6c696e6b)
+	for i := range table {
+		// splitmix64
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+		z = (z ^ z>>27) * 0x94d049bb133111eb
+		table[i] = z ^ z>>31
+	}
+	return table
+}()
+
+// SplitChunks cuts the data of reader into content defined chunks and calls
+// emit with each of them in order. Inserting or removing bytes only changes
+// the chunks around the edit, so similar files share most of their chunks.
+// The slice passed to emit is reused once emit returns.
+func SplitChunks(reader io.Reader, emit func(chunk []byte) error) error {
+	buffered := bufio.NewReaderSize(reader, 1<<20)
+	chunk := make([]byte, 0, MaxChunk)
+	var hash uint64
+	for {
+		c, err := buffered.ReadByte()
+		if err == io.EOF {
+			if len(chunk) > 0 {
+				return emit(chunk)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		chunk = append(chunk, c)
+		hash = hash<<1 + gearTable[c]
+		if len(chunk) >= MaxChunk || (len(chunk) >= MinChunk && hash&chunkMask == 0) {
+			if err := emit(chunk); err != nil {
+				return err
+			}
+			chunk = chunk[:0]
+			hash = 0
+		}
+	}
+}
+
+// ChunkRecipe returns the chunks reader is made of
+func ChunkRecipe(reader io.Reader) ([]ChunkRef, error) {
+	var recipe []ChunkRef
+	err := SplitChunks(reader, func(chunk []byte) error {
+		recipe = append(recipe, ChunkRef{Hash: sha256.Sum256(chunk), Size: uint32(len(chunk))})
+		return nil
+	})
+	return recipe, err
+}
+
+// EncodeRecipe serializes chunk references for the wire
+func EncodeRecipe(recipe []ChunkRef) []byte {
+	data := make([]byte, 0, len(recipe)*RecipeEntrySize)
+	for _, ref := range recipe {
+		data = append(data, ref.Hash[:]...)
+		data = binary.BigEndian.AppendUint32(data, ref.Size)
+	}
+	return data
+}
+
+// DecodeRecipe parses chunk references produced by EncodeRecipe
+func DecodeRecipe(data []byte) ([]ChunkRef, error) {
+	if len(data)%RecipeEntrySize != 0 {
+		return nil, fmt.Errorf("invalid recipe length %d", len(data))
+	}
+	recipe := make([]ChunkRef, len(data)/RecipeEntrySize)
+	for i := range recipe {
+		entry := data[i*RecipeEntrySize:]
+		copy(recipe[i].Hash[:], entry[:sha256.Size])
+		recipe[i].Size = binary.BigEndian.Uint32(entry[sha256.Size:])
+		if recipe[i].Size == 0 || recipe[i].Size > MaxChunk {
+			return nil, fmt.Errorf("invalid chunk size %d", recipe[i].Size)
+		}
+	}
+	return recipe, nil
+}
@@ -0,0 +1,85 @@
+package helper
+
+import (
+	"bytes"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestSplitChunksInsertion(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	original := make([]byte, 4<<20)
+	random.Read(original)
+	inserted := make([]byte, 1000)
+	random.Read(inserted)
+	edited := bytes.Join([][]byte{original[:2<<20], inserted, original[2<<20:]}, nil)
+
+	before, err := ChunkRecipe(bytes.NewReader(original))
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, err := ChunkRecipe(bytes.NewReader(edited))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var total int
+	for _, ref := range before {
+		if ref.Size > MaxChunk {
+			t.Errorf("chunk of %d bytes exceeds MaxChunk", ref.Size)
+		}
+		total += int(ref.Size)
+	}
+	if total != len(original) {
+		t.Fatalf("chunks cover %d bytes, want %d", total, len(original))
+	}
+
+	known := make(map[ChunkRef]bool, len(before))
+	for _, ref := range before {
+		known[ref] = true
+	}
+	changed := 0
+	for _, ref := range after {
+		if !known[ref] {
+			changed++
+		}
+	}
+	// Only the chunks around the insertion may differ
+	if changed == 0 || changed > 2 {
+		t.Errorf("%d of %d chunks changed after a 1000 byte insertion, want 1 or 2", changed, len(after))
+	}
+	if len(before) < 20 {
+		t.Errorf("got %d chunks for 4 MB, want chunks near AvgChunk", len(before))
+	}
+}
+
+func TestSplitChunksContent(t *testing.T) {
+	random := rand.New(rand.NewSource(2))
+	data := make([]byte, 1<<20)
+	random.Read(data)
+
+	var joined []byte
+	err := SplitChunks(bytes.NewReader(data), func(chunk []byte) error {
+		joined = append(joined, chunk...)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(joined, data) {
+		t.Fatal("chunks do not add up to the input")
+	}
+
+	recipe, err := ChunkRecipe(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := DecodeRecipe(EncodeRecipe(recipe))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, recipe) {
+		t.Fatal("recipe changed in an encode and decode round trip")
+	}
+}
@@ -0,0 +1,242 @@
+package helper
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+const (
+	// SignatureSize is the encoded size of one BlockSignature
+	SignatureSize = 4 + md5.Size
+
+	minDeltaBlock = 2 << 10
+	maxDeltaBlock = 128 << 10
+)
+
+// BlockSignature identifies one block of a file by a cheap rolling checksum
+// and a strong hash that confirms a rolling checksum match
+type BlockSignature struct {
+	Weak   uint32
+	Strong [md5.Size]byte
+}
+
+// DeltaOp is one instruction for rebuilding a file from an older copy: either
+// Count blocks starting at Block are copied from the old copy, or Literal
+// bytes are written as they are
+type DeltaOp struct {
+	Block   int
+	Count   int
+	Literal []byte
+}
+
+// DeltaBlockSize picks the block size for signatures of a file of size bytes,
+// growing with the file so large files do not need huge signature lists
+func DeltaBlockSize(size int64) int {
+	block := int(math.Sqrt(float64(size))) &^ (1<<10 - 1)
+	if block < minDeltaBlock {
+		return minDeltaBlock
+	}
+	if block > maxDeltaBlock {
+		return maxDeltaBlock
+	}
+	return block
+}
+
+// rollingChecksum is the rsync weak checksum of a window of bytes, which can
+// be moved forward one byte at a time
+type rollingChecksum struct {
+	a, b   uint32
+	length uint32
+}
+
+func newRollingChecksum(window []byte) rollingChecksum {
+	r := rollingChecksum{length: uint32(len(window))}
+	for i, c := range window {
+		r.a += uint32(c)
+		r.b += uint32(len(window)-i) * uint32(c)
+	}
+	return r
+}
+
+func (r *rollingChecksum) roll(out, in byte) {
+	r.a += uint32(in) - uint32(out)
+	r.b += r.a - r.length*uint32(out)
+}
+
+func (r rollingChecksum) sum() uint32 {
+	return r.a&0xffff | r.b<<16
+}
+
+// BlockSignatures computes the signature of every complete block of reader.
+// A shorter final block is left out and is sent literally when needed.
+func BlockSignatures(reader io.Reader, blockSize int) ([]BlockSignature, error) {
+	var signatures []BlockSignature
+	block := make([]byte, blockSize)
+	for {
+		_, err := io.ReadFull(reader, block)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return signatures, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		signatures = append(signatures, BlockSignature{
+			Weak:   newRollingChecksum(block).sum(),
+			Strong: md5.Sum(block),
+		})
+	}
+}
+
+// EncodeSignatures converts signatures to their wire format
+func EncodeSignatures(signatures []BlockSignature) []byte {
+	data := make([]byte, 0, len(signatures)*SignatureSize)
+	for _, sig := range signatures {
+		data = binary.BigEndian.AppendUint32(data, sig.Weak)
+		data = append(data, sig.Strong[:]...)
+	}
+	return data
+}
+
+// DecodeSignatures parses signatures in wire format
+func DecodeSignatures(data []byte) ([]BlockSignature, error) {
+	if len(data)%SignatureSize != 0 {
+		return nil, fmt.Errorf("signature data has invalid length %d", len(data))
+	}
+	signatures := make([]BlockSignature, len(data)/SignatureSize)
+	for i := range signatures {
+		entry := data[i*SignatureSize:]
+		signatures[i].Weak = binary.BigEndian.Uint32(entry)
+		copy(signatures[i].Strong[:], entry[4:SignatureSize])
+	}
+	return signatures, nil
+}
+
+// ComputeDelta reads the new version of a file from reader and calls emit
+// with the instructions that rebuild it from the old copy described by
+// signatures. Literal data is emitted in pieces of at most maxLiteral bytes
+// and each op is emitted once the following data is known not to extend it.
+func ComputeDelta(reader io.Reader, blockSize int, signatures []BlockSignature, maxLiteral int, emit func(op DeltaOp) error) error {
+	index := make(map[uint32][]int, len(signatures))
+	for i, sig := range signatures {
+		index[sig.Weak] = append(index[sig.Weak], i)
+	}
+	// match returns the old block equal to window, or -1
+	match := func(weak uint32, window []byte) int {
+		candidates, exists := index[weak]
+		if !exists {
+			return -1
+		}
+		strong := md5.Sum(window)
+		for _, i := range candidates {
+			if signatures[i].Strong == strong {
+				return i
+			}
+		}
+		return -1
+	}
+
+	var pending *DeltaOp
+	flush := func() error {
+		if pending == nil {
+			return nil
+		}
+		op := *pending
+		pending = nil
+		return emit(op)
+	}
+	copyBlock := func(block int) error {
+		if pending != nil && pending.Literal == nil && pending.Block+pending.Count == block {
+			pending.Count++
+			return nil
+		}
+		if err := flush(); err != nil {
+			return err
+		}
+		pending = &DeltaOp{Block: block, Count: 1}
+		return nil
+	}
+	literal := func(data []byte) error {
+		if len(data) == 0 {
+			return nil
+		}
+		if err := flush(); err != nil {
+			return err
+		}
+		return emit(DeltaOp{Literal: bytes.Clone(data)})
+	}
+
+	input := bufio.NewReaderSize(reader, 256<<10)
+	// buffer holds literal bytes not yet emitted followed by the window
+	buffer := make([]byte, 0, maxLiteral+blockSize)
+	start := 0
+
+	fill := func() (bool, error) {
+		n, err := io.ReadFull(input, buffer[start:start+blockSize])
+		buffer = buffer[:start+n]
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return false, nil
+		}
+		return err == nil, err
+	}
+
+	full, err := fill()
+	if err != nil {
+		return err
+	}
+	var rolling rollingChecksum
+	if full {
+		rolling = newRollingChecksum(buffer[start:])
+	}
+	for full {
+		if block := match(rolling.sum(), buffer[start:]); block >= 0 {
+			if err := literal(buffer[:start]); err != nil {
+				return err
+			}
+			if err := copyBlock(block); err != nil {
+				return err
+			}
+			buffer, start = buffer[:0], 0
+			if full, err = fill(); err != nil {
+				return err
+			}
+			if full {
+				rolling = newRollingChecksum(buffer)
+			}
+			continue
+		}
+
+		c, err := input.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		rolling.roll(buffer[start], c)
+		buffer = append(buffer, c)
+		start++
+
+		if start >= maxLiteral {
+			if err := literal(buffer[:start]); err != nil {
+				return err
+			}
+			buffer = append(buffer[:0], buffer[start:]...)
+			start = 0
+		}
+	}
+
+	// Whatever did not match, including a short final window, goes literally
+	for len(buffer) > 0 {
+		n := min(len(buffer), maxLiteral)
+		if err := literal(buffer[:n]); err != nil {
+			return err
+		}
+		buffer = buffer[n:]
+	}
+	return flush()
+}
@@ -0,0 +1,104 @@
+package helper
+
+import (
+	"bytes"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+// applyDelta rebuilds a file from old and ops the way a receiver does
+func applyDelta(old []byte, blockSize int, ops []DeltaOp) []byte {
+	var result []byte
+	for _, op := range ops {
+		if op.Literal != nil {
+			result = append(result, op.Literal...)
+			continue
+		}
+		result = append(result, old[op.Block*blockSize:(op.Block+op.Count)*blockSize]...)
+	}
+	return result
+}
+
+func TestDeltaRoundTrip(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	old := make([]byte, 200<<10)
+	random.Read(old)
+	extra := make([]byte, 5000)
+	random.Read(extra)
+
+	join := func(parts ...[]byte) []byte {
+		return bytes.Join(parts, nil)
+	}
+	modified := bytes.Clone(old)
+	copy(modified[70000:], extra[:300])
+
+	tests := []struct {
+		name   string
+		target []byte
+	}{
+		{"identical", old},
+		{"insertion", join(old[:100000], extra, old[100000:])},
+		{"deletion", join(old[:50000], old[60000:])},
+		{"modification", modified},
+		{"prepended", join(extra, old)},
+		{"appended", join(old, extra[:123])},
+		{"unrelated", extra},
+		{"empty", nil},
+	}
+	blockSize := DeltaBlockSize(int64(len(old)))
+	signatures, err := BlockSignatures(bytes.NewReader(old), blockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := DecodeSignatures(EncodeSignatures(signatures))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, signatures) {
+		t.Fatal("signatures changed in an encode and decode round trip")
+	}
+
+	const maxLiteral = 4096
+	for _, test := range tests {
+		var ops []DeltaOp
+		literal := 0
+		err := ComputeDelta(bytes.NewReader(test.target), blockSize, decoded, maxLiteral, func(op DeltaOp) error {
+			if len(op.Literal) > maxLiteral {
+				t.Errorf("%s: literal of %d bytes exceeds %d", test.name, len(op.Literal), maxLiteral)
+			}
+			literal += len(op.Literal)
+			ops = append(ops, op)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if got := applyDelta(old, blockSize, ops); !bytes.Equal(got, test.target) {
+			t.Errorf("%s: rebuilt %d bytes that differ from the %d byte target", test.name, len(got), len(test.target))
+		}
+		if test.name == "identical" && literal != 0 {
+			t.Errorf("identical: sent %d literal bytes, want 0", literal)
+		}
+		if test.name == "insertion" && literal > len(extra)+2*blockSize {
+			t.Errorf("insertion: sent %d literal bytes for a %d byte insertion", literal, len(extra))
+		}
+	}
+}
+
+func TestDeltaBlockSize(t *testing.T) {
+	tests := []struct {
+		size int64
+		want int
+	}{
+		{0, minDeltaBlock},
+		{1 << 20, minDeltaBlock},
+		{64 << 20, 8 << 10},
+		{1 << 40, maxDeltaBlock},
+	}
+	for _, test := range tests {
+		if got := DeltaBlockSize(test.size); got != test.want {
+			t.Errorf("DeltaBlockSize(%d) = %d, want %d", test.size, got, test.want)
+		}
+	}
+}
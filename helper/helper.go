@@ -4,6 +4,7 @@ import (
 	"archive/zip"
 	"bytes"
 	"crypto/md5"
+	cryptorand "crypto/rand"
 	"encoding/hex"
 	"fmt"
 	"io"
@@ -40,10 +41,10 @@ func CalculateDataChecksum(reader io.Reader) (string, io.Reader, error) {
 	if err != nil {
 		return "", nil, err
 	}
-	
+
 	hash.Write(data)
 	checksum := hex.EncodeToString(hash.Sum(nil))
-	
+
 	// Return a new reader with the same data
 	return checksum, bytes.NewReader(data), nil
 }
@@ -57,6 +58,13 @@ func GenerateUserId() string {
 	return strconv.Itoa(rand.Intn(10000000))
 }
 
+// GenerateToken returns a random secret that is hard to guess
+func GenerateToken() string {
+	token := make([]byte, 16)
+	cryptorand.Read(token)
+	return hex.EncodeToString(token)
+}
+
 // CheckServerAvailability checks if a server is running at the given address
 // Returns a boolean and an error message if the server is not available
 func CheckServerAvailability(address string) (bool, string) {
@@ -81,7 +89,7 @@ func CheckServerAvailability(address string) (bool, string) {
 func IsPortInUse(port string) bool {
 	// Make sure we have just the port number
 	portNum := strings.TrimPrefix(port, ":")
-	
+
 	conn, err := net.DialTimeout("tcp", "localhost:"+portNum, time.Second)
 	if err != nil {
 		return false
@@ -208,4 +216,100 @@ func GetFolderSize(folderPath string) (int64, error) {
 		return nil
 	})
 	return size, err
-}
\ No newline at end of file
+}
+
+// HasGlobMeta reports whether pattern contains shell glob characters
+func HasGlobMeta(pattern string) bool {
+	return strings.ContainsAny(pattern, "*?[")
+}
+
+// ExpandGlob returns the regular files matching a shell style pattern.
+// Besides the usual filepath.Match syntax, a "**" path segment matches any
+// number of nested directories. Patterns without glob characters are
+// returned unchanged so callers can report missing files themselves.
+func ExpandGlob(pattern string) ([]string, error) {
+	if !HasGlobMeta(pattern) {
+		return []string{pattern}, nil
+	}
+
+	if !strings.Contains(pattern, "**") {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		var files []string
+		for _, match := range matches {
+			if info, err := os.Stat(match); err == nil && !info.IsDir() {
+				files = append(files, match)
+			}
+		}
+		return files, nil
+	}
+
+	// Walk from the longest directory prefix that contains no glob characters
+	segments := strings.Split(filepath.ToSlash(pattern), "/")
+	root := ""
+	for len(segments) > 0 && !HasGlobMeta(segments[0]) {
+		root = filepath.Join(root, segments[0])
+		if segments[0] == "" {
+			root = "/"
+		}
+		segments = segments[1:]
+	}
+	if root == "" {
+		root = "."
+	}
+	for _, segment := range segments {
+		if _, err := filepath.Match(segment, ""); err != nil {
+			return nil, err
+		}
+	}
+
+	var files []string
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		relPath, err := filepath.Rel(root, path)
+		if err != nil {
+			return nil
+		}
+		if matchSegments(segments, strings.Split(filepath.ToSlash(relPath), "/")) {
+			files = append(files, path)
+		}
+		return nil
+	})
+	return files, err
+}
+
+// matchSegments matches path segments against pattern segments where "**"
+// stands for zero or more whole segments
+func matchSegments(pattern, path []string) bool {
+	if len(pattern) == 0 {
+		return len(path) == 0
+	}
+	if pattern[0] == "**" {
+		if matchSegments(pattern[1:], path) {
+			return true
+		}
+		return len(path) > 0 && matchSegments(pattern, path[1:])
+	}
+	if len(path) == 0 {
+		return false
+	}
+	matched, err := filepath.Match(pattern[0], path[0])
+	return err == nil && matched && matchSegments(pattern[1:], path[1:])
+}
+
+// SanitizeFileName reduces a name received from a peer to a single path
+// element so it cannot escape the directory it is saved into
+func SanitizeFileName(name string) (string, error) {
+	cleaned := filepath.Base(filepath.Clean(strings.ReplaceAll(name, "\\", "/")))
+	if cleaned == "." || cleaned == ".." || cleaned == "/" || cleaned == "" {
+		return "", fmt.Errorf("invalid file name %q", name)
+	}
+	if strings.ContainsRune(cleaned, 0) {
+		return "", fmt.Errorf("invalid file name %q", name)
+	}
+	return cleaned, nil
+}
@@ -0,0 +1,110 @@
+package helper
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestMatchSegments(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		want    bool
+	}{
+		{"a.txt", "a.txt", true},
+		{"*.txt", "a.txt", true},
+		{"*.txt", "dir/a.txt", false},
+		{"dir/*.txt", "dir/a.txt", true},
+		{"**", "a.txt", true},
+		{"**", "x/y/z.go", true},
+		{"**/*.go", "main.go", true},
+		{"**/*.go", "x/y/z.go", true},
+		{"**/*.go", "x/y/z.txt", false},
+		{"x/**/z.go", "x/z.go", true},
+		{"x/**/z.go", "x/a/b/z.go", true},
+		{"x/**/z.go", "y/a/z.go", false},
+		{"x/**", "x/a/b", true},
+		{"x/**", "y/a", false},
+		{"**/b/**", "a/b/c/d", true},
+		{"**/b/**", "a/c/d", false},
+		{"?.go", "ab.go", false},
+		{"[ab].go", "b.go", true},
+	}
+	for _, test := range tests {
+		got := matchSegments(strings.Split(test.pattern, "/"), strings.Split(test.path, "/"))
+		if got != test.want {
+			t.Errorf("matchSegments(%q, %q) = %v, want %v", test.pattern, test.path, got, test.want)
+		}
+	}
+}
+
+func TestExpandGlob(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{
+		"a.txt",
+		"b.go",
+		"sub/c.txt",
+		"sub/deep/d.txt",
+		"sub/deep/e.go",
+		"other/f.txt",
+	} {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		pattern string
+		want    []string
+	}{
+		{"*.txt", []string{"a.txt"}},
+		{"*", []string{"a.txt", "b.go"}},
+		{"sub/*.txt", []string{"sub/c.txt"}},
+		{"**/*.txt", []string{"a.txt", "other/f.txt", "sub/c.txt", "sub/deep/d.txt"}},
+		{"**/*.go", []string{"b.go", "sub/deep/e.go"}},
+		{"sub/**/*.txt", []string{"sub/c.txt", "sub/deep/d.txt"}},
+		{"sub/**", []string{"sub/c.txt", "sub/deep/d.txt", "sub/deep/e.go"}},
+		{"*/deep/*", []string{"sub/deep/d.txt", "sub/deep/e.go"}},
+		{"**/missing", nil},
+	}
+	for _, test := range tests {
+		matches, err := ExpandGlob(filepath.Join(root, filepath.FromSlash(test.pattern)))
+		if err != nil {
+			t.Errorf("ExpandGlob(%q): %v", test.pattern, err)
+			continue
+		}
+		var got []string
+		for _, match := range matches {
+			relPath, err := filepath.Rel(root, match)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, filepath.ToSlash(relPath))
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ExpandGlob(%q) = %v, want %v", test.pattern, got, test.want)
+		}
+	}
+}
+
+func TestExpandGlobLiteral(t *testing.T) {
+	got, err := ExpandGlob("no/such/file.txt")
+	if err != nil || !reflect.DeepEqual(got, []string{"no/such/file.txt"}) {
+		t.Errorf("ExpandGlob of a plain path = %v, %v", got, err)
+	}
+}
+
+func TestExpandGlobBadPattern(t *testing.T) {
+	if _, err := ExpandGlob("dir/**/[a.txt"); err == nil {
+		t.Error("ExpandGlob accepted an unterminated character class")
+	}
+}
@@ -0,0 +1,163 @@
+package protocol
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Quote returns arg in a form SplitArgs reads back unchanged. Plain words are
+// left as they are; anything containing whitespace, quotes, backslashes or
+// control characters is wrapped in double quotes with backslash escapes.
+// Other UTF-8 text passes through untouched.
+func Quote(arg string) string {
+	if arg == "" {
+		return `""`
+	}
+	if !needsQuoting(arg) {
+		return arg
+	}
+
+	var builder strings.Builder
+	builder.WriteByte('"')
+	for _, r := range arg {
+		switch r {
+		case '"':
+			builder.WriteString(`\"`)
+		case '\\':
+			builder.WriteString(`\\`)
+		case '\n':
+			builder.WriteString(`\n`)
+		case '\r':
+			builder.WriteString(`\r`)
+		case '\t':
+			builder.WriteString(`\t`)
+		default:
+			builder.WriteRune(r)
+		}
+	}
+	builder.WriteByte('"')
+	return builder.String()
+}
+
+func needsQuoting(arg string) bool {
+	for _, r := range arg {
+		if unicode.IsSpace(r) || unicode.IsControl(r) || r == '"' || r == '\'' || r == '\\' {
+			return true
+		}
+	}
+	return false
+}
+
+// Join quotes each argument and joins them with single spaces
+func Join(args ...string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = Quote(arg)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// Format builds a control message from a command and its arguments
+func Format(command string, args ...string) string {
+	if len(args) == 0 {
+		return command
+	}
+	return command + " " + Join(args...)
+}
+
+// SplitArgs splits a line into arguments using shell style rules, both for
+// commands typed at the prompt and for messages on the wire:
+//
+//   - unquoted whitespace separates arguments
+//   - "double quotes" group text and understand \" \\ \n \r \t escapes
+//   - 'single quotes' group text literally
+//   - outside quotes a backslash escapes a following space, quote or
+//     backslash; any other backslash is kept so Windows paths still work
+func SplitArgs(line string) ([]string, error) {
+	var args []string
+	var current strings.Builder
+	inArg := false
+	runes := []rune(line)
+
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case r == '"':
+			inArg = true
+			closed := false
+			for i++; i < len(runes); i++ {
+				if runes[i] == '"' {
+					closed = true
+					break
+				}
+				if runes[i] == '\\' && i+1 < len(runes) {
+					switch runes[i+1] {
+					case '"', '\\':
+						current.WriteRune(runes[i+1])
+						i++
+						continue
+					case 'n':
+						current.WriteRune('\n')
+						i++
+						continue
+					case 'r':
+						current.WriteRune('\r')
+						i++
+						continue
+					case 't':
+						current.WriteRune('\t')
+						i++
+						continue
+					}
+				}
+				current.WriteRune(runes[i])
+			}
+			if !closed {
+				return nil, fmt.Errorf("unterminated double quote")
+			}
+		case r == '\'':
+			inArg = true
+			closed := false
+			for i++; i < len(runes); i++ {
+				if runes[i] == '\'' {
+					closed = true
+					break
+				}
+				current.WriteRune(runes[i])
+			}
+			if !closed {
+				return nil, fmt.Errorf("unterminated single quote")
+			}
+		case r == '\\' && i+1 < len(runes) && (unicode.IsSpace(runes[i+1]) || strings.ContainsRune(`"'\`, runes[i+1])):
+			inArg = true
+			current.WriteRune(runes[i+1])
+			i++
+		case unicode.IsSpace(r):
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			inArg = true
+			current.WriteRune(r)
+		}
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	return args, nil
+}
+
+// Parse splits a control message into its command and arguments
+func Parse(line string) (string, []string, error) {
+	args, err := SplitArgs(line)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(args) == 0 {
+		return "", nil, nil
+	}
+	return args[0], args[1:], nil
+}
@@ -0,0 +1,95 @@
+package protocol
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestQuoteRoundTrip(t *testing.T) {
+	args := []string{
+		"plain",
+		"",
+		"two words",
+		`say "hi"`,
+		`it's`,
+		`C:\Users\bob\file.txt`,
+		`trailing\`,
+		`\\server\share`,
+		"tab\there",
+		"line\nbreak\r\n",
+		"  padded  ",
+		"ünïcödé 文件.txt",
+		`mixed "quotes' and \ slashes`,
+	}
+	for _, arg := range args {
+		got, err := SplitArgs(Quote(arg))
+		if err != nil {
+			t.Errorf("SplitArgs(Quote(%q)): %v", arg, err)
+			continue
+		}
+		if len(got) != 1 || got[0] != arg {
+			t.Errorf("SplitArgs(Quote(%q)) = %q", arg, got)
+		}
+	}
+
+	line := Format("/SEND", args...)
+	command, got, err := Parse(line)
+	if err != nil {
+		t.Fatalf("Parse(%q): %v", line, err)
+	}
+	if command != "/SEND" || !reflect.DeepEqual(got, args) {
+		t.Errorf("Parse(Format(/SEND, ...)) = %q %q, want %q", command, got, args)
+	}
+}
+
+func TestQuoteLeavesPlainWords(t *testing.T) {
+	for _, arg := range []string{"report.pdf", "/tmp/dir/file", "12345", "ünïcödé"} {
+		if got := Quote(arg); got != arg {
+			t.Errorf("Quote(%q) = %q, want it unchanged", arg, got)
+		}
+	}
+	if got := Quote(""); got != `""` {
+		t.Errorf(`Quote("") = %q, want ""`, got)
+	}
+}
+
+func TestSplitArgs(t *testing.T) {
+	tests := []struct {
+		line string
+		want []string
+	}{
+		{"", nil},
+		{"   ", nil},
+		{"a b  c", []string{"a", "b", "c"}},
+		{`"two words" next`, []string{"two words", "next"}},
+		{`'single "quoted"' x`, []string{`single "quoted"`, "x"}},
+		{`'no \n escapes'`, []string{`no \n escapes`}},
+		{`"esc \" \\ \n \t"`, []string{"esc \" \\ \n \t"}},
+		{`"keeps \q"`, []string{`keeps \q`}},
+		{`a\ b`, []string{"a b"}},
+		{`\"quoted\"`, []string{`"quoted"`}},
+		{`C:\Users\bob`, []string{`C:\Users\bob`}},
+		{`trailing\`, []string{`trailing\`}},
+		{`"" ''`, []string{"", ""}},
+		{`a""b`, []string{"ab"}},
+		{`pre"fix"post`, []string{"prefixpost"}},
+	}
+	for _, test := range tests {
+		got, err := SplitArgs(test.line)
+		if err != nil {
+			t.Errorf("SplitArgs(%q): %v", test.line, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("SplitArgs(%q) = %q, want %q", test.line, got, test.want)
+		}
+	}
+}
+
+func TestSplitArgsUnterminated(t *testing.T) {
+	for _, line := range []string{`"open`, `a 'open`, `"escaped end\"`, `'`} {
+		if got, err := SplitArgs(line); err == nil {
+			t.Errorf("SplitArgs(%q) = %q, want an error", line, got)
+		}
+	}
+}
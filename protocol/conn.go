@@ -0,0 +1,108 @@
+package protocol
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// MaxChunkSize is the largest payload accepted in a single /CHUNK frame
+const MaxChunkSize = 1 << 20
+
+// Conn wraps a net.Conn with buffered, line oriented reads and serialized
+// writes so several goroutines (chat, heartbeats and concurrent transfers)
+// can share one connection without interleaving their messages.
+//
+// Every control message is a single line terminated by "\n". Raw transfer
+// data travels in chunk frames: a "/CHUNK ... <length>" header line followed
+// by exactly <length> payload bytes.
+type Conn struct {
+	net.Conn
+	reader  *bufio.Reader
+	writeMu sync.Mutex
+}
+
+// NewConn wraps conn for framed reads and writes
+func NewConn(conn net.Conn) *Conn {
+	return &Conn{
+		Conn:   conn,
+		reader: bufio.NewReaderSize(conn, 64*1024),
+	}
+}
+
+// Read reads from the buffered stream so that raw reads and line reads
+// never lose data to each other
+func (c *Conn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// Write writes p as one uninterrupted unit
+func (c *Conn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.Conn.Write(p)
+}
+
+// ReadLine reads the next control message without its line terminator
+func (c *Conn) ReadLine() (string, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// ReadLines reads count consecutive lines, used for list style responses
+func (c *Conn) ReadLines(count int) ([]string, error) {
+	lines := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		line, err := c.ReadLine()
+		if err != nil {
+			return lines, err
+		}
+		lines = append(lines, line)
+	}
+	return lines, nil
+}
+
+// WriteLine sends a single control message, appending the terminator
+func (c *Conn) WriteLine(line string) error {
+	_, err := c.Write([]byte(line + "\n"))
+	return err
+}
+
+// WriteFrame sends a header line immediately followed by payload as one write
+// so no other message can be interleaved between them
+func (c *Conn) WriteFrame(header string, payload []byte) error {
+	frame := make([]byte, 0, len(header)+1+len(payload))
+	frame = append(frame, header...)
+	frame = append(frame, '\n')
+	frame = append(frame, payload...)
+	_, err := c.Write(frame)
+	return err
+}
+
+// ReadPayload reads exactly size bytes of frame payload
+func (c *Conn) ReadPayload(size int) ([]byte, error) {
+	if size < 0 || size > MaxChunkSize {
+		return nil, fmt.Errorf("invalid chunk size %d", size)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// ParseSize parses the trailing payload length of a frame header
+func ParseSize(field string) (int, error) {
+	size, err := strconv.Atoi(strings.TrimSpace(field))
+	if err != nil {
+		return 0, fmt.Errorf("invalid chunk size %q", field)
+	}
+	return size, nil
+}
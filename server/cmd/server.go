@@ -1,43 +1,82 @@
 package main
 
 import (
+	"context"
 	helper "drizlink/helper"
-	"drizlink/server/interfaces"
-	connection "drizlink/server/internal"
+	"drizlink/server"
 	"drizlink/utils"
 	"flag"
 	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
 	"strings"
+	"syscall"
 	"time"
 )
 
 func main() {
 	port := flag.String("port", "8080", "Port to run the server on")
+	spoolDir := flag.String("spool-dir", filepath.Join(os.TempDir(), "drizlink-spool"), "Directory holding transfers for offline users")
+	spoolSize := flag.Int64("spool-size", 1024, "Maximum size of the offline spool in MB (0 disables it)")
+	spoolTTL := flag.Duration("spool-ttl", 72*time.Hour, "How long transfers for offline users are kept")
+	drainTimeout := flag.Duration("drain-timeout", 30*time.Second, "How long shutting down waits for running transfers")
 	flag.Parse()
-	
+
 	// Ensure port starts with a colon for address format
 	formattedPort := *port
 	if !strings.HasPrefix(formattedPort, ":") {
 		formattedPort = ":" + formattedPort
 	}
-	
+
 	// Check if port is already in use
 	if helper.IsPortInUse(*port) {
 		fmt.Println(utils.ErrorColor("❌ Error: Port " + *port + " is already in use"))
 		fmt.Println(utils.InfoColor("Please choose a different port or stop the other server."))
 		return
 	}
-	
+
 	utils.PrintBanner()
 	fmt.Println(utils.InfoColor("Starting server on port " + *port + "..."))
-	
-	server := interfaces.Server{
-		Address:     formattedPort,
-		Connections: make(map[string]*interfaces.User),
-		IpAddresses: make(map[string]*interfaces.User),
-		Messages:    make(chan interfaces.Message),
+
+	srv, err := server.New(server.Options{
+		SpoolDir:          *spoolDir,
+		SpoolSize:         *spoolSize * 1024 * 1024,
+		SpoolTTL:          *spoolTTL,
+		HeartbeatInterval: 100 * time.Second,
+		Log:               os.Stdout,
+	})
+	if err != nil {
+		fmt.Println(utils.ErrorColor("❌ Error preparing spool directory:"), err)
+		return
 	}
 
-	go connection.StartHeartBeat(100*time.Second, &server)
-	connection.Start(&server)
+	listener, err := net.Listen("tcp", formattedPort)
+	if err != nil {
+		fmt.Println(utils.ErrorColor("❌ Error listening on port "+*port+":"), err)
+		os.Exit(1)
+	}
+
+	// The first signal drains running transfers, a second one stops at once
+	signals, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		<-signals.Done()
+		stop()
+		fmt.Println(utils.InfoColor("👋 Shutting down"))
+		ctx, cancel := context.WithTimeout(context.Background(), *drainTimeout)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			fmt.Println(utils.WarningColor("⚠ Transfers still running were cut off:"), err)
+		}
+	}()
+
+	if err := srv.Serve(context.Background(), listener); err != server.ErrServerClosed {
+		fmt.Println(utils.ErrorColor("❌ Server stopped:"), err)
+		os.Exit(1)
+	}
+	<-stopped
 }
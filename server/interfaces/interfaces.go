@@ -1,8 +1,11 @@
 package interfaces
 
 import (
-	"net"
+	"drizlink/protocol"
+	"io"
+	"os"
 	"sync"
+	"time"
 )
 
 type Server struct {
@@ -11,6 +14,44 @@ type Server struct {
 	IpAddresses map[string]*User
 	Messages    chan Message
 	Mutex       sync.Mutex
+	Spool       *Spool             // nil when store-and-forward is disabled
+	FanOuts     map[string]*FanOut // uploads being delivered to several users, by sender and transfer ID
+	Relays      map[string]*Relay  // transfers between two online users, by sender and transfer ID
+	Draining    bool               // new transfers are refused while the server shuts down
+	Log         io.Writer          // receives the server's log messages
+	Events      func(Event)        // called for every Event when set
+}
+
+// Relay is a transfer the server passes from one online user to another
+type Relay struct {
+	SenderId    string
+	RecipientId string
+	TransferId  string
+	Kind        string // "file", "folder" or "stream"
+	Name        string
+	Size        int64 // unknown for streams
+	Started     time.Time
+}
+
+// Event types reported to Server.Events
+const (
+	UserJoinedEvent       = "user_joined"
+	UserRejoinedEvent     = "user_rejoined"
+	UserLeftEvent         = "user_left"
+	MessageEvent          = "message"
+	TransferStartedEvent  = "transfer_started"
+	TransferFinishedEvent = "transfer_finished"
+)
+
+// Event is something that happened on the server
+type Event struct {
+	Type     string
+	Time     time.Time
+	UserId   string // the user it concerns; for transfers the sender
+	Username string
+	Text     string // message: what was said
+	Transfer *Relay // transfer events
+	Status   string // transfer_finished: "delivered", "declined", "failed" or "dropped"
 }
 
 type Message struct {
@@ -24,7 +65,79 @@ type User struct {
 	UserId        string
 	Username      string
 	StoreFilePath string
-	Conn          net.Conn
+	Conn          *protocol.Conn
 	IsOnline      bool
 	IpAddress     string
+	Streams       []*protocol.Conn // extra data connections for parallel transfers
+	StreamToken   string           // proves a data stream belongs to this session
+	NextStream    int
+	Shared        map[string]SharedFile // content the user advertises for /get, by checksum
+}
+
+// SharedFile is a file a user holds and other users can fetch by checksum
+type SharedFile struct {
+	Size int64
+	Name string
+}
+
+// Spool holds transfers for offline users on disk until they reconnect
+type Spool struct {
+	Dir     string
+	Limit   int64         // maximum bytes held at once
+	TTL     time.Duration // how long an undelivered item is kept
+	Items   map[string]*SpoolItem
+	Uploads map[string]*SpoolItem // items still being received, by sender and transfer ID
+	Used    int64                 // bytes reserved by items and uploads
+	Streams int                   // items being sent to their recipients right now
+	NextId  int
+	Mutex   sync.Mutex
+}
+
+// SpoolItem is one file or folder held for an offline user
+type SpoolItem struct {
+	Id          string
+	RecipientId string
+	SenderId    string
+	SenderName  string
+	Kind        string // "file" or "folder"
+	Name        string
+	Size        int64
+	Checksum    string
+	TransferId  string // the sender's transfer ID while uploading
+	Received    int64
+	DataPath    string
+	File        *os.File
+	Created     time.Time
+	LastReport  time.Time
+	Paused      bool          // the recipient paused receiving it
+	Delivering  bool          // the recipient accepted it and delivery is under way
+	Delivery    int           // counts the streams started, so an older stream stops
+	Streamed    chan struct{} // closed when the latest stream ends
+}
+
+// FanOut is a file uploaded once and delivered to several recipients. The
+// upload is kept in DataPath, each recipient reads it at its own pace.
+type FanOut struct {
+	SenderId   string
+	Recipients string // the recipient list as the sender wrote it
+	Name       string
+	Size       int64
+	Checksum   string
+	TransferId string
+	DataPath   string
+	File       *os.File
+	Received   int64
+	Complete   bool // the upload arrived and was verified
+	Failed     bool // the upload will not complete
+	Deliveries map[string]*FanOutDelivery
+	LastReport time.Time
+	Mutex      sync.Mutex
+	Cond       *sync.Cond // signalled when data arrives or the upload fails
+}
+
+// FanOutDelivery is one recipient of a FanOut
+type FanOutDelivery struct {
+	RecipientId string
+	Status      string // "offered", "accepted", "delivered", "declined" or "failed"
+	Paused      bool   // the recipient paused receiving it
 }
@@ -1,7 +1,9 @@
 package connection
 
 import (
+	"context"
 	"drizlink/helper"
+	"drizlink/protocol"
 	"drizlink/server/interfaces"
 	"fmt"
 	"net"
@@ -10,83 +12,64 @@ import (
 	"time"
 )
 
-func Connect(address string) (net.Listener, error) {
-	listener, err := net.Listen("tcp", address)
-	if err != nil {
-		fmt.Println("Error connecting to server:", err)
-		return nil, err
-	}
-	return listener, nil
-}
-
-func Close(conn net.Conn) {
-	conn.Close()
-}
+func HandleConnection(netConn net.Conn, server *interfaces.Server) {
+	conn := protocol.NewConn(netConn)
+	ipAddr := conn.RemoteAddr().String()
+	ip := strings.Split(ipAddr, ":")[0]
+	fmt.Fprintln(server.Log, "New connection from", ip)
 
-func Start(server *interfaces.Server) {
-	listen, err := net.Listen("tcp", server.Address)
+	// Clients say what a connection is for before anything else
+	hello, err := conn.ReadLine()
 	if err != nil {
-		fmt.Println("error in listen")
-		panic(err)
+		fmt.Fprintln(server.Log, "error in read hello")
+		return
 	}
-
-	defer listen.Close()
-	fmt.Println("Server started on", server.Address)
-
-	for {
-		conn, err := listen.Accept()
-		if err != nil {
-			fmt.Println("error in accept")
-			continue
+	if strings.HasPrefix(hello, "/STREAM") {
+		args, err := protocol.SplitArgs(hello)
+		var owner *interfaces.User
+		if err == nil && len(args) == 2 {
+			owner = streamOwner(server, args[1])
 		}
-
-		go HandleConnection(conn, server)
+		if owner == nil {
+			conn.WriteLine(protocol.Format("/STREAM_REJECTED", "unknown session"))
+			conn.Close()
+			return
+		}
+		HandleDataStream(server, owner, conn)
+		return
+	}
+	args, err := protocol.SplitArgs(hello)
+	if err != nil || len(args) < 2 || args[0] != "/LOGIN" || !validLogin(args[1:]) {
+		fmt.Fprintln(server.Log, "Unexpected hello from", ip)
+		conn.Close()
+		return
 	}
-}
 
-func HandleConnection(conn net.Conn, server *interfaces.Server) {
-	ipAddr := conn.RemoteAddr().String()
-	ip := strings.Split(ipAddr, ":")[0]
-	fmt.Println("New connection from", ip)
-	if existingUser := server.IpAddresses[ip]; existingUser != nil {
-		fmt.Println("Connection already exists for IP:", ip)
-		// Send reconnection signal with existing user data
-		reconnectMsg := fmt.Sprintf("/RECONNECT %s %s", existingUser.Username, existingUser.StoreFilePath)
-		_, err := conn.Write([]byte(reconnectMsg))
-		if err != nil {
-			fmt.Println("Error sending reconnect signal:", err)
+	// Interactive clients continue the session last held from their address
+	// unless it is still connected, and a client that kept its session token
+	// continues that session. Anything else starts a new one.
+	mode := args[1]
+	if mode != "new" {
+		if existingUser := claimSession(server, conn, ip, args[1:]); existingUser != nil {
+			rejoinUser(server, existingUser, conn)
+			return
+		}
+		if err := conn.WriteLine("/LOGIN_NEEDED"); err != nil {
+			fmt.Fprintln(server.Log, "Error asking for login:", err)
 			return
 		}
-
-		// Update connection and online status
-		server.Mutex.Lock()
-		existingUser.Conn = conn
-		existingUser.IsOnline = true
-		server.Mutex.Unlock()
-
-		// Encrypt and broadcast welcome back message
-		welcomeMsg := fmt.Sprintf("User %s has rejoined the chat", existingUser.Username)
-		BroadcastMessage(welcomeMsg, server, existingUser)
-
-		// Start handling messages for the reconnected user
-		handleUserMessages(conn, existingUser, server)
-		return
 	}
 
-	buffer := make([]byte, 1024)
-	n, err := conn.Read(buffer)
+	username, err := conn.ReadLine()
 	if err != nil {
-		fmt.Println("error in read username")
+		fmt.Fprintln(server.Log, "error in read username")
 		return
 	}
-	username := string(buffer[:n])
-
-	n, err = conn.Read(buffer)
+	storeFilePath, err := conn.ReadLine()
 	if err != nil {
-		fmt.Println("error in read storeFilePath")
+		fmt.Fprintln(server.Log, "error in read storeFilePath")
 		return
 	}
-	storeFilePath := string(buffer[:n])
 
 	userId := helper.GenerateUserId()
 
@@ -101,145 +84,404 @@ func HandleConnection(conn net.Conn, server *interfaces.Server) {
 
 	server.Mutex.Lock()
 	server.Connections[user.UserId] = user
-	server.IpAddresses[ip] = user
+	if mode == "resume" {
+		server.IpAddresses[ip] = user
+	}
 	server.Mutex.Unlock()
+	if err := startSession(server, user); err != nil {
+		// The read loop below notices the broken connection and cleans up
+		fmt.Fprintln(server.Log, "Error starting session:", err)
+	}
 
 	welcomeMsg := fmt.Sprintf("User %s has joined the chat", username)
 	BroadcastMessage(welcomeMsg, server, user)
+	BroadcastPresence(server, user)
+	SendPresence(server, user)
 
-	fmt.Printf("New user connected: %s (ID: %s)\n", username, userId)
+	fmt.Fprintf(server.Log, "New user connected: %s (ID: %s)\n", username, userId)
+	emit(server, interfaces.Event{Type: interfaces.UserJoinedEvent, UserId: userId, Username: username})
+	RequestAdvertisement(server, user)
 
 	// Start handling messages for the new user
 	handleUserMessages(conn, user, server)
 }
 
-func handleUserMessages(conn net.Conn, user *interfaces.User, server *interfaces.Server) {
+// validLogin reports whether args are a login mode with its arguments:
+// "new", "resume" or "continue <token>"
+func validLogin(args []string) bool {
+	switch args[0] {
+	case "new", "resume":
+		return len(args) == 1
+	case "continue":
+		return len(args) == 2 && args[1] != ""
+	}
+	return false
+}
+
+// claimSession finds the session a login asks to continue and hands it to
+// conn. A connection it replaces is closed.
+func claimSession(server *interfaces.Server, conn *protocol.Conn, ip string, login []string) *interfaces.User {
+	server.Mutex.Lock()
+	var user *interfaces.User
+	if login[0] == "resume" {
+		if existing := server.IpAddresses[ip]; existing != nil && !existing.IsOnline {
+			user = existing
+		}
+	} else {
+		for _, existing := range server.Connections {
+			if existing.StreamToken == login[1] {
+				user = existing
+				break
+			}
+		}
+	}
+	var replaced *protocol.Conn
+	if user != nil {
+		if user.IsOnline {
+			replaced = user.Conn
+		}
+		user.Conn = conn
+		user.IsOnline = true
+	}
+	server.Mutex.Unlock()
+
+	if replaced != nil {
+		replaced.Close()
+	}
+	return user
+}
+
+// goOffline marks user offline when conn is still its connection, and
+// reports whether that changed anything. A session a newer connection took
+// over stays online.
+func goOffline(server *interfaces.Server, user *interfaces.User, conn *protocol.Conn) bool {
+	server.Mutex.Lock()
+	defer server.Mutex.Unlock()
+	if user.Conn != conn || !user.IsOnline {
+		return false
+	}
+	user.IsOnline = false
+	return true
+}
+
+// rejoinUser continues user's earlier session on conn
+func rejoinUser(server *interfaces.Server, user *interfaces.User, conn *protocol.Conn) {
+	fmt.Fprintln(server.Log, "Connection already exists for IP:", user.IpAddress)
+	// Send reconnection signal with existing user data
+	reconnectMsg := protocol.Format("/RECONNECT", user.Username, user.StoreFilePath)
+	if err := conn.WriteLine(reconnectMsg); err != nil {
+		fmt.Fprintln(server.Log, "Error sending reconnect signal:", err)
+		if goOffline(server, user, conn) {
+			userLeft(server, user)
+		}
+		return
+	}
+	if err := startSession(server, user); err != nil {
+		// The read loop below notices the broken connection and cleans up
+		fmt.Fprintln(server.Log, "Error starting session:", err)
+	}
+
+	welcomeMsg := fmt.Sprintf("User %s has rejoined the chat", user.Username)
+	BroadcastMessage(welcomeMsg, server, user)
+	BroadcastPresence(server, user)
+	SendPresence(server, user)
+	emit(server, interfaces.Event{Type: interfaces.UserRejoinedEvent, UserId: user.UserId, Username: user.Username})
+
+	// Offer anything that arrived while the user was away
+	OfferSpooledItems(server, user)
+	RequestAdvertisement(server, user)
+
+	// Start handling messages for the reconnected user
+	handleUserMessages(conn, user, server)
+}
+
+func handleUserMessages(conn *protocol.Conn, user *interfaces.User, server *interfaces.Server) {
 	for {
-		buffer := make([]byte, 1024)
-		n, err := conn.Read(buffer)
+		messageContent, err := conn.ReadLine()
 		if err != nil {
-			fmt.Printf("User disconnected: %s\n", user.Username)
-			server.Mutex.Lock()
-			user.IsOnline = false
-			server.Mutex.Unlock()
-			offlineMsg := fmt.Sprintf("User %s is now offline", user.Username)
-			BroadcastMessage(offlineMsg, server, user)
+			if goOffline(server, user, conn) {
+				fmt.Fprintf(server.Log, "User disconnected: %s\n", user.Username)
+				userLeft(server, user)
+			}
 			return
 		}
 
-		messageContent := string(buffer[:n])
-
 		switch {
 		case messageContent == "/exit":
-			server.Mutex.Lock()
-			user.IsOnline = false
-			server.Mutex.Unlock()
-			offlineMsg := fmt.Sprintf("User %s is now offline", user.Username)
-			BroadcastMessage(offlineMsg, server, user)
+			if goOffline(server, user, conn) {
+				userLeft(server, user)
+			}
 			return
+		case strings.HasPrefix(messageContent, "/CHUNK"):
+			args, err := protocol.SplitArgs(messageContent)
+			if err != nil || len(args) != 4 {
+				fmt.Fprintln(server.Log, "Invalid arguments. Use: /CHUNK <userId> <transferId> <length>")
+				// Without a valid length the stream can no longer be framed
+				return
+			}
+			size, err := protocol.ParseSize(args[3])
+			if err != nil {
+				fmt.Fprintln(server.Log, "Invalid chunk length:", err)
+				return
+			}
+			payload, err := conn.ReadPayload(size)
+			if err != nil {
+				fmt.Fprintf(server.Log, "Error reading chunk from %s: %v\n", user.Username, err)
+				continue
+			}
+			HandleChunk(server, user, args[1], args[2], payload)
+			continue
+		case strings.HasPrefix(messageContent, "/SIGNATURES"), strings.HasPrefix(messageContent, "/HELD"):
+			args, err := protocol.SplitArgs(messageContent)
+			if err != nil || len(args) != 4 {
+				fmt.Fprintln(server.Log, "Invalid arguments. Use: /SIGNATURES <userId> <transferId> <length> or /HELD <userId> <transferId> <length>")
+				return
+			}
+			size, err := protocol.ParseSize(args[3])
+			if err != nil {
+				fmt.Fprintln(server.Log, "Invalid signatures length:", err)
+				return
+			}
+			payload, err := conn.ReadPayload(size)
+			if err != nil {
+				fmt.Fprintf(server.Log, "Error reading signatures from %s: %v\n", user.Username, err)
+				continue
+			}
+			HandleSignatures(server, user, args[0], args[1], args[2], payload)
+			continue
+		case strings.HasPrefix(messageContent, "/RECIPE"):
+			args, err := protocol.SplitArgs(messageContent)
+			if err != nil || len(args) != 5 {
+				fmt.Fprintln(server.Log, "Invalid arguments. Use: /RECIPE <userId> <transferId> <chunks> <length>")
+				return
+			}
+			size, err := protocol.ParseSize(args[4])
+			if err != nil {
+				fmt.Fprintln(server.Log, "Invalid recipe length:", err)
+				return
+			}
+			payload, err := conn.ReadPayload(size)
+			if err != nil {
+				fmt.Fprintf(server.Log, "Error reading recipe from %s: %v\n", user.Username, err)
+				continue
+			}
+			HandleRecipe(server, user, args[1], args[2:], payload)
+			continue
+		case strings.HasPrefix(messageContent, "/DELTA_COPY"), strings.HasPrefix(messageContent, "/REUSE"):
+			args, err := protocol.SplitArgs(messageContent)
+			if err != nil || len(args) != 5 {
+				fmt.Fprintln(server.Log, "Invalid arguments. Use: /DELTA_COPY <userId> <transferId> <block> <count> or /REUSE <userId> <transferId> <chunk> <count>")
+				continue
+			}
+			HandleDeltaCopy(server, user, args[0], args[1], args[2:])
+			continue
 		case strings.HasPrefix(messageContent, "/FILE_REQUEST"):
-			args := strings.SplitN(messageContent, " ", 5) // Updated to include checksum
-			if len(args) < 4 {
-				fmt.Println("Invalid arguments. Use: /FILE_REQUEST <userId> <filename> <fileSize> [checksum]")
+			args, err := protocol.SplitArgs(messageContent)
+			if err != nil || len(args) != 6 {
+				fmt.Fprintln(server.Log, "Invalid arguments. Use: /FILE_REQUEST <userId> <filename> <fileSize> <checksum> <transferId>")
 				continue
 			}
 			recipientId := args[1]
 			fileName := args[2]
-			fileSizeStr := strings.TrimSpace(args[3])
-			fileSize, err := strconv.ParseInt(fileSizeStr, 10, 64)
-			
-			// Include checksum in filename if provided
-			if len(args) == 5 {
-				checksum := strings.TrimSpace(args[4])
-				fileName = fileName + "|" + checksum
-			}
-			
+			fileSize, err := strconv.ParseInt(args[3], 10, 64)
 			if err != nil {
-				fmt.Println("Invalid fileSize. Use: /FILE_REQUEST <userId> <filename> <fileSize> [checksum]")
+				fmt.Fprintln(server.Log, "Invalid fileSize. Use: /FILE_REQUEST <userId> <filename> <fileSize> <checksum> <transferId>")
 				continue
 			}
+			checksum := args[4]
+			transferId := args[5]
 
-			HandleFileTransfer(server, conn, recipientId, fileName, fileSize)
+			HandleFileTransfer(server, user, recipientId, fileName, fileSize, checksum, transferId)
+			continue
+		case strings.HasPrefix(messageContent, "/PIPE_REQUEST"):
+			args, err := protocol.SplitArgs(messageContent)
+			if err != nil || len(args) != 4 {
+				fmt.Fprintln(server.Log, "Invalid arguments. Use: /PIPE_REQUEST <userId> <name> <transferId>")
+				continue
+			}
+			HandlePipeRequest(server, user, args[1], args[2], args[3])
+			continue
+		case strings.HasPrefix(messageContent, "/PIPE_END"):
+			args, err := protocol.SplitArgs(messageContent)
+			if err != nil || len(args) != 5 {
+				fmt.Fprintln(server.Log, "Invalid arguments. Use: /PIPE_END <userId> <transferId> <size> <checksum>")
+				continue
+			}
+			HandlePipeEnd(server, user, args[1], args[2:])
+			continue
+		case strings.HasPrefix(messageContent, "/FANOUT_REQUEST"):
+			args, err := protocol.SplitArgs(messageContent)
+			if err != nil || len(args) != 6 {
+				fmt.Fprintln(server.Log, "Invalid arguments. Use: /FANOUT_REQUEST <userId>,...|@all <filename> <fileSize> <checksum> <transferId>")
+				continue
+			}
+			fileSize, err := strconv.ParseInt(args[3], 10, 64)
+			if err != nil {
+				fmt.Fprintln(server.Log, "Invalid fileSize. Use: /FANOUT_REQUEST <userId>,...|@all <filename> <fileSize> <checksum> <transferId>")
+				continue
+			}
+			HandleFanOutRequest(server, user, args[1], args[2], fileSize, args[4], args[5])
 			continue
 		case strings.HasPrefix(messageContent, "/FOLDER_REQUEST"):
-			args := strings.SplitN(messageContent, " ", 5) // Updated to include checksum
-			if len(args) < 4 {
-				fmt.Println("Invalid arguments. Use: /FOLDER_REQUEST <userId> <folderName> <folderSize> [checksum]")
+			args, err := protocol.SplitArgs(messageContent)
+			if err != nil || len(args) != 6 {
+				fmt.Fprintln(server.Log, "Invalid arguments. Use: /FOLDER_REQUEST <userId> <folderName> <folderSize> <checksum> <transferId>")
 				continue
 			}
 			recipientId := args[1]
 			folderName := args[2]
-			folderSizeStr := strings.TrimSpace(args[3])
-			folderSize, err := strconv.ParseInt(folderSizeStr, 10, 64)
-			
-			// Include checksum in foldername if provided
-			if len(args) == 5 {
-				checksum := strings.TrimSpace(args[4])
-				folderName = folderName + "|" + checksum
-			}
-			
+			folderSize, err := strconv.ParseInt(args[3], 10, 64)
 			if err != nil {
-				fmt.Println("Invalid folderSize. Use: /FOLDER_REQUEST <userId> <folderName> <folderSize> [checksum]")
+				fmt.Fprintln(server.Log, "Invalid folderSize. Use: /FOLDER_REQUEST <userId> <folderName> <folderSize> <checksum> <transferId>")
 				continue
 			}
+			checksum := args[4]
+			transferId := args[5]
 
-			HandleFolderTransfer(server, conn, recipientId, folderName, folderSize)
+			HandleFolderTransfer(server, user, recipientId, folderName, folderSize, checksum, transferId)
 			continue
-		case messageContent == "PONG\n":
+		case strings.HasPrefix(messageContent, "/TRANSFER_ACCEPT"), strings.HasPrefix(messageContent, "/TRANSFER_DECLINE"),
+			strings.HasPrefix(messageContent, "/TRANSFER_FAILED"), strings.HasPrefix(messageContent, "/RECEIPT"),
+			strings.HasPrefix(messageContent, "/PROGRESS"):
+			args, err := protocol.SplitArgs(messageContent)
+			if err != nil || len(args) < 4 {
+				fmt.Fprintln(server.Log, "Invalid arguments. Use: /TRANSFER_ACCEPT <userId> <transferId> <path> <offset>, /TRANSFER_DECLINE <userId> <transferId> <reason>, /TRANSFER_FAILED <userId> <transferId> <reason> <retry>, /RECEIPT <userId> <transferId> <path> <checksum> or /PROGRESS <userId> <transferId> <bytes>")
+				continue
+			}
+			HandleTransferReply(server, user, args[0], args[1:])
 			continue
-		case strings.HasPrefix(messageContent, "/status"):
-			_, err = conn.Write([]byte("USERS:"))
-			if err != nil {
-				fmt.Println("Error sending user list header:", err)
+		case strings.HasPrefix(messageContent, "/TRANSFER_PAUSE"), strings.HasPrefix(messageContent, "/TRANSFER_RESUME"):
+			args, err := protocol.SplitArgs(messageContent)
+			if err != nil || len(args) != 3 {
+				fmt.Fprintln(server.Log, "Invalid arguments. Use: /TRANSFER_PAUSE <userId> <transferId> or /TRANSFER_RESUME <userId> <transferId>")
+				continue
+			}
+			HandleTransferReply(server, user, args[0], args[1:])
+			continue
+		case strings.HasPrefix(messageContent, "/TRANSFER_ABORT"):
+			args, err := protocol.SplitArgs(messageContent)
+			if err != nil || len(args) != 4 {
+				fmt.Fprintln(server.Log, "Invalid arguments. Use: /TRANSFER_ABORT <userId> <transferId> <reason>")
+				continue
+			}
+			HandleTransferAbort(server, user, args[1], args[2], args[3])
+			continue
+		case strings.HasPrefix(messageContent, "/SYNC_"):
+			args, err := protocol.SplitArgs(messageContent)
+			if err != nil || len(args) < 3 {
+				fmt.Fprintln(server.Log, "Invalid arguments. Use: /SYNC_<command> <userId> <syncId> ...")
+				continue
+			}
+			HandleSyncMessage(server, user, args[0], args[1:])
+			continue
+		case strings.HasPrefix(messageContent, "/SWARM_"):
+			args, err := protocol.SplitArgs(messageContent)
+			if err != nil || len(args) < 2 {
+				fmt.Fprintln(server.Log, "Invalid arguments. Use: /SWARM_<command> <userId|checksum> ...")
+				continue
+			}
+			var payload []byte
+			if args[0] == "/SWARM_PIECE" || args[0] == "/SWARM_PIECES" {
+				size, err := protocol.ParseSize(args[len(args)-1])
+				if err != nil {
+					fmt.Fprintln(server.Log, "Invalid piece length:", err)
+					return
+				}
+				payload, err = conn.ReadPayload(size)
+				if err != nil {
+					fmt.Fprintf(server.Log, "Error reading piece from %s: %v\n", user.Username, err)
+					continue
+				}
+			}
+			HandleSwarmMessage(server, user, args[0], args[1:], payload)
+			continue
+		case strings.HasPrefix(messageContent, "/SPOOL_ACCEPT"), strings.HasPrefix(messageContent, "/SPOOL_REJECT"):
+			args, err := protocol.SplitArgs(messageContent)
+			if err != nil || len(args) != 2 {
+				fmt.Fprintln(server.Log, "Invalid arguments. Use: /SPOOL_ACCEPT <itemId> or /SPOOL_REJECT <itemId>")
 				continue
 			}
+			if args[0] == "/SPOOL_ACCEPT" {
+				HandleSpoolAccept(server, user, args[1])
+			} else {
+				HandleSpoolReject(server, user, args[1])
+			}
+			continue
+		case messageContent == "PONG":
+			continue
+		case strings.HasPrefix(messageContent, "/status"):
+			// Each online user is sent as a username and user ID pair
+			var online []string
+			server.Mutex.Lock()
 			for _, user := range server.Connections {
 				if user.IsOnline {
-					statusMsg := fmt.Sprintf("%s (%s) is online\n", user.Username, user.UserId)
-					_, err = conn.Write([]byte(statusMsg))
-					if err != nil {
-						fmt.Println("Error sending user list:", err)
-						continue
-					}
+					online = append(online, user.Username, user.UserId)
 				}
 			}
+			server.Mutex.Unlock()
+
+			err = conn.WriteLine(protocol.Format("/USERS", online...))
+			if err != nil {
+				fmt.Fprintln(server.Log, "Error sending user list:", err)
+			}
 			continue
 		case strings.HasPrefix(messageContent, "/LOOK"):
-			args := strings.SplitN(messageContent, " ", 2)
-			if len(args) != 2 {
-				fmt.Println("Invalid arguments. Use: /LOOK <userId>")
+			args, err := protocol.SplitArgs(messageContent)
+			if err != nil || len(args) != 2 {
+				fmt.Fprintln(server.Log, "Invalid arguments. Use: /LOOK <userId>")
 				continue
 			}
-			recipientId := strings.TrimSpace(args[1])
-			HandleLookupRequest(server, conn, recipientId)
+			recipientId := args[1]
+			HandleLookupRequest(server, conn, user.UserId, recipientId)
 			continue
 		case strings.HasPrefix(messageContent, "/DIR_LISTING"):
-			args := strings.SplitN(messageContent, " ", 3)
-			if len(args) != 3 {
-				fmt.Println("Invalid arguments. Use: /DIR_LISTING <userId> <files>")
+			args, err := protocol.SplitArgs(messageContent)
+			if err != nil || len(args) < 2 {
+				fmt.Fprintln(server.Log, "Invalid arguments. Use: /DIR_LISTING <userId> <entry>...")
 				continue
 			}
-			userId := strings.TrimSpace(args[1])
-			files := strings.TrimSpace(args[2])
-			HandleLookupResponse(server, conn, userId, strings.Split(files, " "))
+			requesterId := args[1]
+			HandleLookupResponse(server, user, requesterId, args[2:])
 			continue
 		case strings.HasPrefix(messageContent, "/DOWNLOAD_REQUEST"):
-			args := strings.SplitN(messageContent, " ", 3)
-			if len(args) != 3 {
-				fmt.Println("Invalid arguments. Use: /DOWNLOAD_REQUEST <userId> <filename>")
+			args, err := protocol.SplitArgs(messageContent)
+			if err != nil || len(args) != 3 {
+				fmt.Fprintln(server.Log, "Invalid arguments. Use: /DOWNLOAD_REQUEST <userId> <filename>")
 				continue
 			}
-			senderId := strings.TrimSpace(args[1])
+			senderId := args[1]
 			recipientId := user.UserId
-			filePath := strings.TrimSpace(args[2])
+			filePath := args[2]
 			HandleDownloadRequest(server, conn, senderId, recipientId, filePath)
 			continue
+		case strings.HasPrefix(messageContent, "/DOWNLOAD_FAILED"):
+			args, err := protocol.SplitArgs(messageContent)
+			if err != nil || len(args) != 4 {
+				fmt.Fprintln(server.Log, "Invalid arguments. Use: /DOWNLOAD_FAILED <userId> <filename> <reason>")
+				continue
+			}
+			HandleDownloadFailed(server, user, args[1], args[2], args[3])
+			continue
 		default:
 			BroadcastMessage(messageContent, server, user)
+			emit(server, interfaces.Event{Type: interfaces.MessageEvent, UserId: user.UserId, Username: user.Username, Text: messageContent})
 		}
 	}
 }
 
+// userLeft tells everyone that user went offline and ends the transfers it
+// took part in
+func userLeft(server *interfaces.Server, user *interfaces.User) {
+	offlineMsg := fmt.Sprintf("User %s is now offline", user.Username)
+	BroadcastMessage(offlineMsg, server, user)
+	BroadcastPresence(server, user)
+	DropFanOuts(server, user)
+	DropSpoolUploads(server, user)
+	EndSpoolDeliveries(server, user)
+	dropRelays(server, user)
+	emit(server, interfaces.Event{Type: interfaces.UserLeftEvent, UserId: user.UserId, Username: user.Username})
+}
+
 func BroadcastMessage(content string, server *interfaces.Server, sender *interfaces.User) {
 	server.Mutex.Lock()
 	defer server.Mutex.Unlock()
@@ -250,22 +492,63 @@ func BroadcastMessage(content string, server *interfaces.Server, sender *interfa
 	}
 }
 
-func StartHeartBeat(interval time.Duration, server *interfaces.Server) {
+// BroadcastPresence tells the other online users that user came online or
+// went offline, so clients can react to a peer by ID
+func BroadcastPresence(server *interfaces.Server, user *interfaces.User) {
+	server.Mutex.Lock()
+	defer server.Mutex.Unlock()
+	state := "offline"
+	if user.IsOnline {
+		state = "online"
+	}
+	for _, recipient := range server.Connections {
+		if recipient.IsOnline && recipient != user {
+			_ = recipient.Conn.WriteLine(protocol.Format("/PRESENCE", user.UserId, state))
+		}
+	}
+}
+
+// SendPresence tells user which other users are online right now
+func SendPresence(server *interfaces.Server, user *interfaces.User) {
+	server.Mutex.Lock()
+	defer server.Mutex.Unlock()
+	for _, other := range server.Connections {
+		if other.IsOnline && other != user {
+			_ = user.Conn.WriteLine(protocol.Format("/PRESENCE", other.UserId, "online"))
+		}
+	}
+}
+
+// StartHeartBeat pings every online user each interval until ctx is done,
+// and takes those that cannot be reached offline
+func StartHeartBeat(ctx context.Context, interval time.Duration, server *interfaces.Server) {
 	ticker := time.NewTicker(interval)
 	go func() {
-		for range ticker.C {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			var lost []*interfaces.User
 			server.Mutex.Lock()
 			for _, user := range server.Connections {
 				if user.IsOnline {
 					_, err := user.Conn.Write([]byte("PING\n"))
 					if err != nil {
-						fmt.Printf("User disconnected: %s\n", user.Username)
 						user.IsOnline = false
-						BroadcastMessage(fmt.Sprintf("User %s is now offline", user.Username), server, user)
+						lost = append(lost, user)
 					}
 				}
 			}
 			server.Mutex.Unlock()
+
+			for _, user := range lost {
+				fmt.Fprintf(server.Log, "User disconnected: %s\n", user.Username)
+				userLeft(server, user)
+			}
 		}
 	}()
 }
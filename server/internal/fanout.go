@@ -0,0 +1,426 @@
+package connection
+
+import (
+	"drizlink/helper"
+	"drizlink/protocol"
+	"drizlink/server/interfaces"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AllUsers addresses a fan-out to every other online user
+const AllUsers = "@all"
+
+func fanOutKey(senderId, transferId string) string {
+	return senderId + "/" + transferId
+}
+
+// HandleFanOutRequest accepts a file the sender uploads once for several
+// recipients. Every recipient is offered the file as if the sender had sent
+// it to them alone, and gets the data from the server once they accept.
+func HandleFanOutRequest(server *interfaces.Server, sender *interfaces.User, recipients, fileName string, fileSize int64, checksum, transferId string) {
+	if refuseWhileDraining(server, sender, recipients, transferId) {
+		return
+	}
+	var online []*interfaces.User
+	unavailable := make(map[string]string)
+	seen := make(map[string]bool)
+	server.Mutex.Lock()
+	if recipients == AllUsers {
+		for _, user := range server.Connections {
+			if user.IsOnline && user != sender {
+				online = append(online, user)
+			}
+		}
+	} else {
+		for _, id := range strings.Split(recipients, ",") {
+			id = strings.TrimSpace(id)
+			if id == "" || seen[id] {
+				continue
+			}
+			seen[id] = true
+			user, exists := server.Connections[id]
+			switch {
+			case !exists:
+				unavailable[id] = "user not found"
+			case !user.IsOnline:
+				unavailable[id] = "user is not online"
+			default:
+				online = append(online, user)
+			}
+		}
+	}
+	server.Mutex.Unlock()
+
+	if len(online) == 0 {
+		declineRequest(server, sender, recipients, transferId, "none of the recipients is online")
+		return
+	}
+
+	file, err := os.CreateTemp("", "drizlink-fanout-*")
+	if err != nil {
+		fmt.Fprintf(server.Log, "Error creating fan-out file: %v\n", err)
+		declineRequest(server, sender, recipients, transferId, "the server could not hold the transfer")
+		return
+	}
+	fan := &interfaces.FanOut{
+		SenderId:   sender.UserId,
+		Recipients: recipients,
+		Name:       fileName,
+		Size:       fileSize,
+		Checksum:   checksum,
+		TransferId: transferId,
+		DataPath:   file.Name(),
+		File:       file,
+		Deliveries: make(map[string]*interfaces.FanOutDelivery),
+	}
+	fan.Cond = sync.NewCond(&fan.Mutex)
+	for _, user := range online {
+		fan.Deliveries[user.UserId] = &interfaces.FanOutDelivery{RecipientId: user.UserId, Status: "offered"}
+	}
+
+	server.Mutex.Lock()
+	server.FanOuts[fanOutKey(sender.UserId, transferId)] = fan
+	server.Mutex.Unlock()
+
+	fmt.Fprintf(server.Log, "Fanning out %s from %s to %d users\n", fileName, sender.Username, len(online))
+	// The sender learns every recipient before the upload starts
+	for _, user := range online {
+		notifyFanOut(server, sender, transferId, user.UserId, "offered", "")
+	}
+	for id, reason := range unavailable {
+		notifyFanOut(server, sender, transferId, id, "failed", reason)
+	}
+	err = sender.Conn.WriteLine(protocol.Format("/TRANSFER_ACCEPT", recipients, transferId, "server", "0"))
+	if err != nil {
+		fmt.Fprintf(server.Log, "Error accepting fan-out from %s: %v\n", sender.UserId, err)
+	}
+	for _, user := range online {
+		offerFanOut(server, fan, user)
+	}
+
+	if fileSize == 0 {
+		finishFanOutUpload(server, sender, fan)
+	}
+}
+
+// offerFanOut announces the file to one recipient, which answers the sender
+// as usual. The server intercepts the answers in HandleFanOutReply.
+func offerFanOut(server *interfaces.Server, fan *interfaces.FanOut, recipient *interfaces.User) {
+	err := recipient.Conn.WriteLine(protocol.Format("/FILE_RESPONSE",
+		fan.SenderId, fan.Name, strconv.FormatInt(fan.Size, 10), fan.Checksum, fan.TransferId, recipient.StoreFilePath))
+	if err != nil {
+		fmt.Fprintf(server.Log, "Error offering fan-out to %s: %v\n", recipient.UserId, err)
+	}
+}
+
+// notifyFanOut tells the sender how delivery to one recipient is going
+func notifyFanOut(server *interfaces.Server, sender *interfaces.User, transferId, recipientId, status, detail string) {
+	err := sender.Conn.WriteLine(protocol.Format("/FANOUT_STATUS", transferId, recipientId, status, detail))
+	if err != nil {
+		fmt.Fprintf(server.Log, "Error sending fan-out status to %s: %v\n", sender.UserId, err)
+	}
+}
+
+func lookupFanOut(server *interfaces.Server, senderId, transferId string) (*interfaces.FanOut, bool) {
+	server.Mutex.Lock()
+	defer server.Mutex.Unlock()
+	fan, exists := server.FanOuts[fanOutKey(senderId, transferId)]
+	return fan, exists
+}
+
+// HandleFanOutChunk stores a frame of a fan-out upload and wakes the
+// recipients waiting for it. It reports whether the frame belonged to one.
+func HandleFanOutChunk(server *interfaces.Server, sender *interfaces.User, transferId string, payload []byte) bool {
+	fan, exists := lookupFanOut(server, sender.UserId, transferId)
+	if !exists {
+		return false
+	}
+
+	fan.Mutex.Lock()
+	if fan.Complete || fan.Failed {
+		fan.Mutex.Unlock()
+		return true
+	}
+	if fan.Received+int64(len(payload)) > fan.Size {
+		fan.Mutex.Unlock()
+		failFanOutUpload(server, sender, fan, "received more data than announced", false)
+		return true
+	}
+	if _, err := fan.File.Write(payload); err != nil {
+		fan.Mutex.Unlock()
+		fmt.Fprintf(server.Log, "Error writing fan-out file: %v\n", err)
+		failFanOutUpload(server, sender, fan, "server could not store the data", false)
+		return true
+	}
+	fan.Received += int64(len(payload))
+	received := fan.Received
+	report := received == fan.Size || time.Since(fan.LastReport) >= spoolProgressInterval
+	if report {
+		fan.LastReport = time.Now()
+	}
+	fan.Cond.Broadcast()
+	fan.Mutex.Unlock()
+
+	if report {
+		sender.Conn.WriteLine(protocol.Format("/PROGRESS", fan.Recipients, transferId, strconv.FormatInt(received, 10)))
+	}
+	if received == fan.Size {
+		finishFanOutUpload(server, sender, fan)
+	}
+	return true
+}
+
+// finishFanOutUpload verifies a completed upload and confirms it to the
+// sender. Deliveries continue on their own.
+func finishFanOutUpload(server *interfaces.Server, sender *interfaces.User, fan *interfaces.FanOut) {
+	fan.File.Close()
+	checksum, err := helper.CalculateFileChecksum(fan.DataPath)
+	if err != nil || !helper.VerifyChecksum(fan.Checksum, checksum) {
+		failFanOutUpload(server, sender, fan, "checksum verification failed", true)
+		return
+	}
+
+	fan.Mutex.Lock()
+	fan.Complete = true
+	fan.Mutex.Unlock()
+
+	err = sender.Conn.WriteLine(protocol.Format("/RECEIPT", fan.Recipients, fan.TransferId, "server", checksum))
+	if err != nil {
+		fmt.Fprintf(server.Log, "Error sending fan-out receipt to %s: %v\n", sender.UserId, err)
+	}
+	releaseFanOut(server, fan)
+}
+
+// failFanOutUpload gives up on an upload like stopFanOutUpload and tells
+// the sender it failed
+func failFanOutUpload(server *interfaces.Server, sender *interfaces.User, fan *interfaces.FanOut, reason string, retry bool) {
+	if !stopFanOutUpload(server, sender, fan, reason) {
+		return
+	}
+	err := sender.Conn.WriteLine(protocol.Format("/TRANSFER_FAILED",
+		fan.Recipients, fan.TransferId, reason, strconv.FormatBool(retry)))
+	if err != nil {
+		fmt.Fprintf(server.Log, "Error reporting fan-out failure to %s: %v\n", sender.UserId, err)
+	}
+}
+
+// stopFanOutUpload gives up on an upload. Recipients still waiting for data
+// are told the transfer failed. It reports whether the sender is still
+// online.
+func stopFanOutUpload(server *interfaces.Server, sender *interfaces.User, fan *interfaces.FanOut, reason string) bool {
+	fan.Mutex.Lock()
+	fan.Failed = true
+	fan.File.Close()
+	var waiting []string
+	for id, delivery := range fan.Deliveries {
+		if delivery.Status == "offered" || delivery.Status == "accepted" {
+			delivery.Status = "failed"
+			waiting = append(waiting, id)
+		}
+	}
+	fan.Cond.Broadcast()
+	fan.Mutex.Unlock()
+
+	fmt.Fprintf(server.Log, "Fan-out of %s from %s failed: %s\n", fan.Name, fan.SenderId, reason)
+	server.Mutex.Lock()
+	online := sender.IsOnline
+	server.Mutex.Unlock()
+	if online {
+		for _, id := range waiting {
+			notifyFanOut(server, sender, fan.TransferId, id, "failed", reason)
+		}
+	}
+	releaseFanOut(server, fan)
+	return online
+}
+
+// HandleFanOutReply handles a recipient's answer to a fan-out offer, which
+// is addressed to the original sender. It reports whether the reply belonged
+// to a fan-out.
+func HandleFanOutReply(server *interfaces.Server, recipient *interfaces.User, command string, args []string) bool {
+	fan, exists := lookupFanOut(server, args[0], args[1])
+	if !exists {
+		return false
+	}
+	fan.Mutex.Lock()
+	delivery, exists := fan.Deliveries[recipient.UserId]
+	fan.Mutex.Unlock()
+	if !exists {
+		return false
+	}
+
+	server.Mutex.Lock()
+	sender := server.Connections[fan.SenderId]
+	online := sender != nil && sender.IsOnline
+	server.Mutex.Unlock()
+
+	status, detail := "", ""
+	switch command {
+	case "/TRANSFER_ACCEPT":
+		var offset int64
+		if len(args) > 3 {
+			offset, _ = strconv.ParseInt(args[3], 10, 64)
+		}
+		status = "accepted"
+		fan.Mutex.Lock()
+		delivery.Paused = false
+		fan.Mutex.Unlock()
+		go streamFanOut(server, fan, delivery, recipient, offset)
+	case "/TRANSFER_PAUSE", "/TRANSFER_RESUME":
+		fan.Mutex.Lock()
+		delivery.Paused = command == "/TRANSFER_PAUSE"
+		fan.Mutex.Unlock()
+		return true
+	case "/PROGRESS":
+		// Progress is passed on without changing the delivery's state
+		if online {
+			notifyFanOut(server, sender, fan.TransferId, recipient.UserId, "progress", args[2])
+		}
+		return true
+	case "/RECEIPT":
+		status, detail = "delivered", args[2]
+	case "/TRANSFER_DECLINE":
+		status, detail = "declined", args[2]
+	case "/TRANSFER_FAILED":
+		fan.Mutex.Lock()
+		retry := len(args) > 3 && args[3] == "true" && !fan.Failed
+		fan.Mutex.Unlock()
+		if retry {
+			offerFanOut(server, fan, recipient)
+			return true
+		}
+		status, detail = "failed", args[2]
+	default:
+		return true
+	}
+
+	fan.Mutex.Lock()
+	delivery.Status = status
+	fan.Mutex.Unlock()
+	if online {
+		notifyFanOut(server, sender, fan.TransferId, recipient.UserId, status, detail)
+	}
+	releaseFanOut(server, fan)
+	return true
+}
+
+// streamFanOut sends the upload to one recipient from offset, waiting for
+// data that has not arrived yet
+func streamFanOut(server *interfaces.Server, fan *interfaces.FanOut, delivery *interfaces.FanOutDelivery, recipient *interfaces.User, offset int64) {
+	file, err := os.Open(fan.DataPath)
+	if err != nil {
+		fmt.Fprintf(server.Log, "Error opening fan-out file: %v\n", err)
+		return
+	}
+	defer file.Close()
+
+	server.Mutex.Lock()
+	conn := recipient.Conn
+	server.Mutex.Unlock()
+	paused := func() bool {
+		fan.Mutex.Lock()
+		defer fan.Mutex.Unlock()
+		return delivery.Paused
+	}
+
+	buffer := make([]byte, spoolChunkSize)
+	for position := offset; position < fan.Size; {
+		if !waitWhilePaused(server, recipient, conn, paused) {
+			return
+		}
+		fan.Mutex.Lock()
+		for fan.Received <= position && !fan.Failed {
+			fan.Cond.Wait()
+		}
+		failed, available := fan.Failed, fan.Received
+		fan.Mutex.Unlock()
+		if failed {
+			abortDelivery(server, fan.SenderId, recipient.UserId, fan.TransferId, "the upload to the server failed")
+			return
+		}
+
+		n := int(min(int64(len(buffer)), available-position))
+		if _, err := file.ReadAt(buffer[:n], position); err != nil {
+			fmt.Fprintf(server.Log, "Error reading fan-out file: %v\n", err)
+			return
+		}
+		header := protocol.Format("/CHUNK", fan.SenderId, fan.TransferId, strconv.Itoa(n))
+		if err := conn.WriteFrame(header, buffer[:n]); err != nil {
+			fmt.Fprintf(server.Log, "Error delivering fan-out to %s: %v\n", recipient.UserId, err)
+			return
+		}
+		position += int64(n)
+	}
+}
+
+// isFanOut reports whether senderId's transfer is a fan-out, whose
+// recipients get whole files from the server
+func isFanOut(server *interfaces.Server, senderId, transferId string) bool {
+	_, exists := lookupFanOut(server, senderId, transferId)
+	return exists
+}
+
+// releaseFanOut forgets a fan-out and removes its data once the upload is
+// over and no recipient still needs it
+func releaseFanOut(server *interfaces.Server, fan *interfaces.FanOut) {
+	fan.Mutex.Lock()
+	done := fan.Complete || fan.Failed
+	for _, delivery := range fan.Deliveries {
+		if delivery.Status == "offered" || delivery.Status == "accepted" {
+			done = false
+		}
+	}
+	fan.Mutex.Unlock()
+	if !done {
+		return
+	}
+
+	server.Mutex.Lock()
+	_, exists := server.FanOuts[fanOutKey(fan.SenderId, fan.TransferId)]
+	delete(server.FanOuts, fanOutKey(fan.SenderId, fan.TransferId))
+	server.Mutex.Unlock()
+	if exists {
+		os.Remove(fan.DataPath)
+	}
+}
+
+// DropFanOuts ends the part user plays in fan-outs when they disconnect:
+// their unfinished uploads fail and deliveries to them are given up
+func DropFanOuts(server *interfaces.Server, user *interfaces.User) {
+	server.Mutex.Lock()
+	fans := make([]*interfaces.FanOut, 0, len(server.FanOuts))
+	for _, fan := range server.FanOuts {
+		fans = append(fans, fan)
+	}
+	server.Mutex.Unlock()
+
+	for _, fan := range fans {
+		fan.Mutex.Lock()
+		uploading := fan.SenderId == user.UserId && !fan.Complete && !fan.Failed
+		delivery, receiving := fan.Deliveries[user.UserId]
+		receiving = receiving && (delivery.Status == "offered" || delivery.Status == "accepted")
+		if receiving && !uploading {
+			delivery.Status = "failed"
+		}
+		fan.Mutex.Unlock()
+
+		switch {
+		case uploading:
+			failFanOutUpload(server, user, fan, "sender disconnected", false)
+		case receiving:
+			server.Mutex.Lock()
+			sender := server.Connections[fan.SenderId]
+			online := sender != nil && sender.IsOnline
+			server.Mutex.Unlock()
+			if online {
+				notifyFanOut(server, sender, fan.TransferId, user.UserId, "failed", "user went offline")
+			}
+			releaseFanOut(server, fan)
+		}
+	}
+}
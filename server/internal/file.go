@@ -1,43 +1,182 @@
 package connection
 
 import (
+	"drizlink/protocol"
 	"drizlink/server/interfaces"
 	"fmt"
-	"io"
 	"net"
-	"strings"
+	"strconv"
 )
 
-func HandleFileTransfer(server *interfaces.Server, conn net.Conn, recipientId, fileName string, fileSize int64) {
-	// Extract checksum if present
-	checksum := ""
-	fileNameWithChecksum := fileName
-	
-	parts := strings.SplitN(fileName, "|", 2)
-	if len(parts) == 2 {
-		fileName = parts[0]
-		checksum = parts[1]
-		fmt.Println("Original checksum:", checksum)
-	}
-	
+func HandleFileTransfer(server *interfaces.Server, sender *interfaces.User, recipientId, fileName string, fileSize int64, checksum, transferId string) {
+	fmt.Fprintln(server.Log, "Original checksum:", checksum)
+	if refuseWhileDraining(server, sender, recipientId, transferId) {
+		return
+	}
+
+	server.Mutex.Lock()
 	recipient, exists := server.Connections[recipientId]
-	if exists {
-		// Include checksum in response if available
-		_, err := recipient.Conn.Write([]byte(fmt.Sprintf("/FILE_RESPONSE %s %s %d %s", 
-		    recipientId, fileNameWithChecksum, fileSize, recipient.StoreFilePath)))
-		if err != nil {
-			fmt.Printf("Error sending file response to %s: %v\n", recipientId, err)
-		}
-		n, err := io.CopyN(recipient.Conn, conn, fileSize)
-		if err != nil {
-			fmt.Printf("Error receiving file from %s: %v\n", recipientId, err)
-		}
-		fmt.Printf("Transferred %d bytes from %s\n", n, recipientId)
-		if err != nil {
-			fmt.Printf("Error sending file to %s: %v\n", recipientId, err)
-		}
-	} else {
-		fmt.Printf("User %s not found\n", recipientId)
+	var conn *protocol.Conn
+	var storePath string
+	if exists && recipient.IsOnline {
+		conn, storePath = recipient.Conn, recipient.StoreFilePath
+	}
+	server.Mutex.Unlock()
+	if !exists {
+		fmt.Fprintf(server.Log, "User %s not found\n", recipientId)
+		declineRequest(server, sender, recipientId, transferId, "user not found")
+		return
+	}
+	if conn == nil {
+		SpoolTransfer(server, sender, recipient, "file", fileName, fileSize, checksum, transferId)
+		return
+	}
+
+	// Announce the transfer; the data follows in /CHUNK frames relayed by HandleChunk
+	err := conn.WriteLine(protocol.Format("/FILE_RESPONSE",
+		sender.UserId, fileName, strconv.FormatInt(fileSize, 10), checksum, transferId, storePath))
+	if err != nil {
+		fmt.Fprintf(server.Log, "Error sending file response to %s: %v\n", recipientId, err)
+		declineRequest(server, sender, recipientId, transferId, "could not reach user")
+		return
+	}
+	trackRelay(server, sender, recipientId, transferId, "file", fileName, fileSize)
+}
+
+// HandleTransferReply relays a recipient's /TRANSFER_ACCEPT,
+// /TRANSFER_DECLINE, /TRANSFER_FAILED, /RECEIPT or /PROGRESS back to the sender,
+// replacing the peer ID with the recipient's own so the sender can match it
+// to the request
+func HandleTransferReply(server *interfaces.Server, recipient *interfaces.User, command string, args []string) {
+	senderId := args[0]
+	if senderId == SpoolPeerId {
+		HandleSpoolReply(server, recipient, command, args[1:])
+		return
+	}
+	if HandleFanOutReply(server, recipient, command, args) {
+		return
+	}
+	if status, final := relayOutcomes[command]; final {
+		finishRelay(server, senderId, args[1], status)
+	}
+
+	conn := onlineConn(server, senderId)
+	if conn == nil {
+		fmt.Fprintf(server.Log, "Dropping %s for transfer %s: user %s not available\n", command, args[1], senderId)
+		return
+	}
+
+	reply := append([]string{recipient.UserId}, args[1:]...)
+	if err := conn.WriteLine(protocol.Format(command, reply...)); err != nil {
+		fmt.Fprintf(server.Log, "Error relaying %s to %s: %v\n", command, senderId, err)
+	}
+}
+
+// HandleTransferAbort handles a sender's notice that it stopped sending a
+// transfer: the spool or a fan-out drops the upload, and otherwise the
+// recipient is told so it can keep what arrived
+func HandleTransferAbort(server *interfaces.Server, sender *interfaces.User, recipientId, transferId, reason string) {
+	if dropSpoolUploadOf(server, sender, transferId) {
+		return
+	}
+	if fan, exists := lookupFanOut(server, sender.UserId, transferId); exists {
+		stopFanOutUpload(server, sender, fan, reason)
+		return
+	}
+	finishRelay(server, sender.UserId, transferId, "failed")
+	abortDelivery(server, sender.UserId, recipientId, transferId, reason)
+}
+
+// abortDelivery tells recipient that the transfer senderId was sending it
+// stopped before all of its data arrived
+func abortDelivery(server *interfaces.Server, senderId, recipientId, transferId, reason string) {
+	conn := onlineConn(server, recipientId)
+	if conn == nil {
+		return
+	}
+	if err := conn.WriteLine(protocol.Format("/TRANSFER_ABORT", senderId, transferId, reason)); err != nil {
+		fmt.Fprintf(server.Log, "Error relaying abort of transfer %s to %s: %v\n", transferId, recipientId, err)
+	}
+}
+
+// declineRequest tells sender that its transfer request could not be delivered
+func declineRequest(server *interfaces.Server, sender *interfaces.User, recipientId, transferId, reason string) {
+	err := sender.Conn.WriteLine(protocol.Format("/TRANSFER_DECLINE", recipientId, transferId, reason))
+	if err != nil {
+		fmt.Fprintf(server.Log, "Error sending transfer decline to %s: %v\n", sender.UserId, err)
+	}
+}
+
+// HandleChunk relays one frame of transfer data from sender to recipient.
+// Frames are forwarded independently so several transfers can share a
+// connection; the recipient reassembles them by sender and transfer ID.
+func HandleChunk(server *interfaces.Server, sender *interfaces.User, recipientId, transferId string, payload []byte) {
+	if HandleSpoolChunk(server, sender, transferId, payload) || HandleFanOutChunk(server, sender, transferId, payload) {
+		return
+	}
+
+	conn := onlineConn(server, recipientId)
+	if conn == nil {
+		fmt.Fprintf(server.Log, "Dropping chunk of transfer %s: user %s not available\n", transferId, recipientId)
+		return
+	}
+
+	header := protocol.Format("/CHUNK", sender.UserId, transferId, strconv.Itoa(len(payload)))
+	if err := conn.WriteFrame(header, payload); err != nil {
+		fmt.Fprintf(server.Log, "Error relaying chunk to %s: %v\n", recipientId, err)
+	}
+}
+
+// HandleSignatures relays what a recipient answers a delta or chunk store
+// offer with to the sender: the block signatures of its older copy
+// (/SIGNATURES) or the chunks it holds (/HELD). The spool and fan-outs send
+// whole files, so they get neither.
+func HandleSignatures(server *interfaces.Server, recipient *interfaces.User, command, senderId, transferId string, payload []byte) {
+	if senderId == SpoolPeerId || isFanOut(server, senderId, transferId) {
+		return
+	}
+
+	conn := onlineConn(server, senderId)
+	if conn == nil {
+		fmt.Fprintf(server.Log, "Dropping %s of transfer %s: user %s not available\n", command, transferId, senderId)
+		return
+	}
+
+	header := protocol.Format(command, recipient.UserId, transferId, strconv.Itoa(len(payload)))
+	if err := conn.WriteFrame(header, payload); err != nil {
+		fmt.Fprintf(server.Log, "Error relaying %s to %s: %v\n", command, senderId, err)
+	}
+}
+
+// HandleRecipe relays a frame of the chunk list a sender describes a file
+// with to the recipient that offered its chunk store
+func HandleRecipe(server *interfaces.Server, sender *interfaces.User, recipientId string, args []string, payload []byte) {
+	conn := onlineConn(server, recipientId)
+	if conn == nil {
+		fmt.Fprintf(server.Log, "Dropping recipe of transfer %s: user %s not available\n", args[0], recipientId)
+		return
+	}
+
+	header := protocol.Format("/RECIPE", append([]string{sender.UserId}, args...)...)
+	if err := conn.WriteFrame(header, payload); err != nil {
+		fmt.Fprintf(server.Log, "Error relaying recipe to %s: %v\n", recipientId, err)
+	}
+}
+
+// HandleDeltaCopy relays an instruction to copy blocks from the recipient's
+// older copy (/DELTA_COPY) or chunks from its chunk store (/REUSE). It
+// travels the same connection as the transfer's chunks, so the recipient
+// sees both in the order they were sent.
+func HandleDeltaCopy(server *interfaces.Server, sender *interfaces.User, command, recipientId string, args []string) {
+	conn := onlineConn(server, recipientId)
+	if conn == nil {
+		fmt.Fprintf(server.Log, "Dropping copy instruction of transfer %s: user %s not available\n", args[0], recipientId)
+		return
+	}
+
+	line := protocol.Format(command, append([]string{sender.UserId}, args...)...)
+	if err := conn.WriteLine(line); err != nil {
+		fmt.Fprintf(server.Log, "Error relaying copy instruction to %s: %v\n", recipientId, err)
 	}
 }
 
@@ -47,37 +186,59 @@ func SendFile(server *interfaces.Server, senderId, recipientId, filePath string)
 
 	_, exists := server.Connections[recipientId]
 	if !exists {
-		fmt.Printf("User %s not found\n", recipientId)
+		fmt.Fprintf(server.Log, "User %s not found\n", recipientId)
 		return
 	}
 
 	sender, exists := server.Connections[senderId]
 	if !exists {
-		fmt.Printf("User %s not found\n", senderId)
+		fmt.Fprintf(server.Log, "User %s not found\n", senderId)
 		return
 	}
 
-	_, err := sender.Conn.Write([]byte(fmt.Sprintf("/sendfile %s %s\n", recipientId, filePath)))
+	err := sender.Conn.WriteLine(protocol.Format("/sendfile", recipientId, filePath))
 	if err != nil {
-		fmt.Printf("Error sending file to %s: %v\n", recipientId, err)
+		fmt.Fprintf(server.Log, "Error sending file to %s: %v\n", recipientId, err)
 	}
 }
 
 func HandleDownloadRequest(server *interfaces.Server, conn net.Conn, senderId, recipientId, filePath string) {
+	server.Mutex.Lock()
 	sender, exists := server.Connections[senderId]
+	online := exists && sender.IsOnline
+	var senderConn *protocol.Conn
+	if online {
+		senderConn = sender.Conn
+	}
+	server.Mutex.Unlock()
 	if !exists {
-		fmt.Printf("User %s not found\n", senderId)
+		fmt.Fprintf(server.Log, "User %s not found\n", senderId)
+		return
+	}
+
+	if !online {
+		fmt.Fprintf(server.Log, "User %s is not online\n", senderId)
 		return
 	}
 
-	if !sender.IsOnline {
-		fmt.Printf("User %s is not online\n", senderId)
+	err := senderConn.WriteLine(protocol.Format("/DOWNLOAD_REQUEST", recipientId, filePath))
+	if err != nil {
+		fmt.Fprintf(server.Log, "Error sending file request to %s: %v\n", senderId, err)
+	}
+	fmt.Fprintln(server.Log, "Download request sent successfully")
+}
+
+// HandleDownloadFailed tells a requester why owner cannot send the file
+// they asked for
+func HandleDownloadFailed(server *interfaces.Server, owner *interfaces.User, requesterId, filePath, reason string) {
+	conn := onlineConn(server, requesterId)
+	if conn == nil {
+		fmt.Fprintf(server.Log, "User %s is not available for download failure\n", requesterId)
 		return
 	}
 
-	_, err := sender.Conn.Write([]byte(fmt.Sprintf("/DOWNLOAD_REQUEST %s %s\n", recipientId, filePath)))
+	err := conn.WriteLine(protocol.Format("/DOWNLOAD_FAILED", owner.UserId, filePath, reason))
 	if err != nil {
-		fmt.Printf("Error sending file request to %s: %v\n", senderId, err)
+		fmt.Fprintf(server.Log, "Error relaying download failure to %s: %v\n", requesterId, err)
 	}
-	fmt.Println("Download request sent successfully")
 }
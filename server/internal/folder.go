@@ -1,75 +1,99 @@
 package connection
 
 import (
+	"drizlink/protocol"
 	"drizlink/server/interfaces"
 	"fmt"
-	"io"
 	"net"
-	"strings"
+	"strconv"
 )
 
-func HandleFolderTransfer(server *interfaces.Server, conn net.Conn, recipientId, folderName string, folderSize int64) {
+func HandleFolderTransfer(server *interfaces.Server, sender *interfaces.User, recipientId, folderName string, folderSize int64, checksum, transferId string) {
+	if refuseWhileDraining(server, sender, recipientId, transferId) {
+		return
+	}
+	server.Mutex.Lock()
 	recipient, exists := server.Connections[recipientId]
-	if exists {
-		// Send folder transfer response to recipient
-		_, err := recipient.Conn.Write([]byte(fmt.Sprintf("/FOLDER_RESPONSE %s %s %d %s", recipientId, folderName, folderSize, recipient.StoreFilePath)))
-		if err != nil {
-			fmt.Printf("Error sending folder response to %s: %v\n", recipientId, err)
-			return
-		}
+	var conn *protocol.Conn
+	var storePath string
+	if exists && recipient.IsOnline {
+		conn, storePath = recipient.Conn, recipient.StoreFilePath
+	}
+	server.Mutex.Unlock()
+	if !exists {
+		fmt.Fprintf(server.Log, "User %s not found\n", recipientId)
+		declineRequest(server, sender, recipientId, transferId, "user not found")
+		return
+	}
+	if conn == nil {
+		SpoolTransfer(server, sender, recipient, "folder", folderName, folderSize, checksum, transferId)
+		return
+	}
 
-		// Forward the zipped folder data from sender to recipient
-		n, err := io.CopyN(recipient.Conn, conn, folderSize)
-		if err != nil {
-			fmt.Printf("Error transferring folder data: %v\n", err)
-			return
-		}
-		fmt.Printf("Transferred %d bytes of folder data\n", n)
-	} else {
-		fmt.Printf("User %s not found\n", recipientId)
+	// Announce the folder transfer; the zipped data follows in /CHUNK frames
+	err := conn.WriteLine(protocol.Format("/FOLDER_RESPONSE",
+		sender.UserId, folderName, strconv.FormatInt(folderSize, 10), checksum, transferId, storePath))
+	if err != nil {
+		fmt.Fprintf(server.Log, "Error sending folder response to %s: %v\n", recipientId, err)
+		declineRequest(server, sender, recipientId, transferId, "could not reach user")
+		return
 	}
+	trackRelay(server, sender, recipientId, transferId, "folder", folderName, folderSize)
 }
 
-func HandleLookupRequest(server *interfaces.Server, conn net.Conn, userId string) {
+func HandleLookupRequest(server *interfaces.Server, conn net.Conn, requesterId, userId string) {
+	server.Mutex.Lock()
 	recipient, exists := server.Connections[userId]
-	fmt.Printf("StoreFilePath: %s\n", recipient.StoreFilePath)
+	online := exists && recipient.IsOnline
+	var recipientConn *protocol.Conn
+	var storePath string
+	if online {
+		recipientConn, storePath = recipient.Conn, recipient.StoreFilePath
+	}
+	server.Mutex.Unlock()
 	if !exists {
-		fmt.Printf("User %s not found\n", userId)
+		fmt.Fprintf(server.Log, "User %s not found\n", userId)
 		_, err := conn.Write([]byte(fmt.Sprintf("User %s not found\n", userId)))
 		if err != nil {
-			fmt.Printf("Error sending lookup response: %v\n", err)
+			fmt.Fprintf(server.Log, "Error sending lookup response: %v\n", err)
 		}
 		return
 	}
 
-	if !recipient.IsOnline {
-		fmt.Printf("User %s is not online\n", userId)
+	if !online {
+		fmt.Fprintf(server.Log, "User %s is not online\n", userId)
 		_, err := conn.Write([]byte(fmt.Sprintf("User %s is not online\n", userId)))
 		if err != nil {
-			fmt.Printf("Error sending lookup response: %v\n", err)
+			fmt.Fprintf(server.Log, "Error sending lookup response: %v\n", err)
 		}
 		return
 	}
 
 	// Send the lookup request to the recipient's connection
-	fmt.Printf("StoreFilePath: %s\n", recipient.StoreFilePath)
-	_, err := recipient.Conn.Write([]byte(fmt.Sprintf("/LOOK_REQUEST %s %s\n", userId, recipient.StoreFilePath)))
+	fmt.Fprintf(server.Log, "StoreFilePath: %s\n", storePath)
+	err := recipientConn.WriteLine(protocol.Format("/LOOK_REQUEST", requesterId, storePath))
 	if err != nil {
-		fmt.Printf("Error sending lookup request to recipient: %v\n", err)
+		fmt.Fprintf(server.Log, "Error sending lookup request to recipient: %v\n", err)
 		_, respErr := conn.Write([]byte(fmt.Sprintf("Error looking up user %s's directory\n", userId)))
 		if respErr != nil {
-			fmt.Printf("Error sending error response: %v\n", respErr)
+			fmt.Fprintf(server.Log, "Error sending error response: %v\n", respErr)
 		}
 		return
 	}
 
-	fmt.Printf("Lookup request sent to user %s\n", userId)
+	fmt.Fprintf(server.Log, "Lookup request sent to user %s\n", userId)
 }
 
-func HandleLookupResponse(server *interfaces.Server, conn net.Conn, userId string, files []string) {
-	_, err := conn.Write([]byte(fmt.Sprintf("LOOK_RESPONSE %s %s\n", userId, strings.Join(files, " "))))
+func HandleLookupResponse(server *interfaces.Server, owner *interfaces.User, requesterId string, files []string) {
+	conn := onlineConn(server, requesterId)
+	if conn == nil {
+		fmt.Fprintf(server.Log, "User %s is not available for lookup response\n", requesterId)
+		return
+	}
+
+	err := conn.WriteLine(protocol.Format("/LOOK_RESPONSE", append([]string{owner.UserId}, files...)...))
 	if err != nil {
-		fmt.Printf("Error sending lookup response: %v\n", err)
+		fmt.Fprintf(server.Log, "Error sending lookup response: %v\n", err)
 		return
 	}
 }
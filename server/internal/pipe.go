@@ -0,0 +1,58 @@
+package connection
+
+import (
+	"drizlink/protocol"
+	"drizlink/server/interfaces"
+	"fmt"
+)
+
+// HandlePipeRequest offers a stream of unknown length to the recipient. The
+// data follows in /CHUNK frames and ends with /PIPE_END. Streams cannot be
+// held for later, so an offline recipient declines at once.
+func HandlePipeRequest(server *interfaces.Server, sender *interfaces.User, recipientId, name, transferId string) {
+	if refuseWhileDraining(server, sender, recipientId, transferId) {
+		return
+	}
+	server.Mutex.Lock()
+	recipient, exists := server.Connections[recipientId]
+	var conn *protocol.Conn
+	var storePath string
+	if exists && recipient.IsOnline {
+		conn, storePath = recipient.Conn, recipient.StoreFilePath
+	}
+	server.Mutex.Unlock()
+
+	if !exists {
+		declineRequest(server, sender, recipientId, transferId, "user not found")
+		return
+	}
+	if conn == nil {
+		declineRequest(server, sender, recipientId, transferId, "user is not online")
+		return
+	}
+
+	err := conn.WriteLine(protocol.Format("/PIPE_OFFER",
+		sender.UserId, sender.Username, name, transferId, storePath))
+	if err != nil {
+		fmt.Fprintf(server.Log, "Error offering stream to %s: %v\n", recipientId, err)
+		declineRequest(server, sender, recipientId, transferId, "could not reach user")
+		return
+	}
+	trackRelay(server, sender, recipientId, transferId, "stream", name, 0)
+}
+
+// HandlePipeEnd relays the end of a stream with its size and checksum. It
+// follows the stream's chunks on the same connection, so it arrives after
+// all of them.
+func HandlePipeEnd(server *interfaces.Server, sender *interfaces.User, recipientId string, args []string) {
+	conn := onlineConn(server, recipientId)
+	if conn == nil {
+		fmt.Fprintf(server.Log, "Dropping end of stream %s: user %s not available\n", args[0], recipientId)
+		return
+	}
+
+	line := protocol.Format("/PIPE_END", append([]string{sender.UserId}, args...)...)
+	if err := conn.WriteLine(line); err != nil {
+		fmt.Fprintf(server.Log, "Error relaying end of stream to %s: %v\n", recipientId, err)
+	}
+}
@@ -0,0 +1,172 @@
+package connection
+
+import (
+	"drizlink/protocol"
+	"drizlink/server/interfaces"
+	"fmt"
+	"time"
+)
+
+// pausedDeliveryWait is how often a delivery the server streams itself
+// checks whether its recipient resumed it
+const pausedDeliveryWait = 500 * time.Millisecond
+
+// relayOutcomes maps the recipient's final answer to a transfer to the status
+// its relay finishes with
+var relayOutcomes = map[string]string{
+	"/RECEIPT":          "delivered",
+	"/TRANSFER_DECLINE": "declined",
+	"/TRANSFER_FAILED":  "failed",
+}
+
+func relayKey(senderId, transferId string) string {
+	return senderId + "/" + transferId
+}
+
+// emit hands event to the server's Events hook, if it has one
+func emit(server *interfaces.Server, event interfaces.Event) {
+	if server.Events == nil {
+		return
+	}
+	event.Time = time.Now()
+	server.Events(event)
+}
+
+// refuseWhileDraining declines a new transfer once the server is shutting
+// down, and reports whether it did
+func refuseWhileDraining(server *interfaces.Server, sender *interfaces.User, recipientId, transferId string) bool {
+	server.Mutex.Lock()
+	draining := server.Draining
+	server.Mutex.Unlock()
+	if draining {
+		declineRequest(server, sender, recipientId, transferId, "the server is shutting down")
+	}
+	return draining
+}
+
+// trackRelay records a transfer offered to an online recipient until the
+// recipient's final answer passes back
+func trackRelay(server *interfaces.Server, sender *interfaces.User, recipientId, transferId, kind, name string, size int64) {
+	relay := &interfaces.Relay{
+		SenderId:    sender.UserId,
+		RecipientId: recipientId,
+		TransferId:  transferId,
+		Kind:        kind,
+		Name:        name,
+		Size:        size,
+		Started:     time.Now(),
+	}
+	server.Mutex.Lock()
+	server.Relays[relayKey(sender.UserId, transferId)] = relay
+	server.Mutex.Unlock()
+	emit(server, interfaces.Event{Type: interfaces.TransferStartedEvent, UserId: sender.UserId, Username: sender.Username, Transfer: relay})
+}
+
+// finishRelay forgets a relay once it ended with status
+func finishRelay(server *interfaces.Server, senderId, transferId, status string) {
+	key := relayKey(senderId, transferId)
+	server.Mutex.Lock()
+	relay, exists := server.Relays[key]
+	delete(server.Relays, key)
+	var username string
+	if sender := server.Connections[senderId]; sender != nil {
+		username = sender.Username
+	}
+	server.Mutex.Unlock()
+	if exists {
+		emit(server, interfaces.Event{Type: interfaces.TransferFinishedEvent, UserId: senderId, Username: username, Transfer: relay, Status: status})
+	}
+}
+
+// dropRelays ends the relays user was sending or receiving when it went
+// offline. Recipients of what user was sending are told it stopped.
+func dropRelays(server *interfaces.Server, user *interfaces.User) {
+	server.Mutex.Lock()
+	var dropped []*interfaces.Relay
+	for _, relay := range server.Relays {
+		if relay.SenderId == user.UserId || relay.RecipientId == user.UserId {
+			dropped = append(dropped, relay)
+		}
+	}
+	server.Mutex.Unlock()
+	for _, relay := range dropped {
+		finishRelay(server, relay.SenderId, relay.TransferId, "dropped")
+		if relay.SenderId == user.UserId {
+			abortDelivery(server, relay.SenderId, relay.RecipientId, relay.TransferId, "sender went offline")
+		} else {
+			failDelivery(server, relay.SenderId, relay.RecipientId, relay.TransferId, "recipient went offline")
+		}
+	}
+}
+
+// onlineConn returns the connection userId is online on, or nil if the
+// user is unknown or offline. It reads the user under server.Mutex, so the
+// connection can be written to after a takeover or logout replaced it.
+func onlineConn(server *interfaces.Server, userId string) *protocol.Conn {
+	server.Mutex.Lock()
+	defer server.Mutex.Unlock()
+	if user, exists := server.Connections[userId]; exists && user.IsOnline {
+		return user.Conn
+	}
+	return nil
+}
+
+// failDelivery tells the sender of a relay that its recipient cannot take
+// the transfer any more, which also ends a pause the recipient asked for
+func failDelivery(server *interfaces.Server, senderId, recipientId, transferId, reason string) {
+	conn := onlineConn(server, senderId)
+	if conn == nil {
+		return
+	}
+	if err := conn.WriteLine(protocol.Format("/TRANSFER_FAILED", recipientId, transferId, reason, "false")); err != nil {
+		fmt.Fprintf(server.Log, "Error telling %s that transfer %s failed: %v\n", senderId, transferId, err)
+	}
+}
+
+// waitWhilePaused holds a delivery the server streams itself while its
+// recipient has it paused. It reports false once the recipient's connection
+// conn is gone.
+func waitWhilePaused(server *interfaces.Server, recipient *interfaces.User, conn *protocol.Conn, paused func() bool) bool {
+	for paused() {
+		server.Mutex.Lock()
+		connected := recipient.IsOnline && recipient.Conn == conn
+		server.Mutex.Unlock()
+		if !connected {
+			return false
+		}
+		time.Sleep(pausedDeliveryWait)
+	}
+	return true
+}
+
+// Busy reports whether transfers are still passing through the server:
+// relays, fan-outs, and spool uploads and deliveries. Uploads whose sender
+// went offline are not counted, since nothing more will arrive for them.
+func Busy(server *interfaces.Server) bool {
+	server.Mutex.Lock()
+	busy := len(server.Relays) > 0 || len(server.FanOuts) > 0
+	server.Mutex.Unlock()
+	if busy || server.Spool == nil {
+		return busy
+	}
+
+	server.Spool.Mutex.Lock()
+	streaming := server.Spool.Streams > 0
+	senders := make([]string, 0, len(server.Spool.Uploads))
+	for _, item := range server.Spool.Uploads {
+		senders = append(senders, item.SenderId)
+	}
+	server.Spool.Mutex.Unlock()
+	if streaming {
+		return true
+	}
+
+	server.Mutex.Lock()
+	defer server.Mutex.Unlock()
+	for _, senderId := range senders {
+		if sender, exists := server.Connections[senderId]; exists && sender.IsOnline {
+			return true
+		}
+	}
+	return false
+}
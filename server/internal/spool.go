@@ -0,0 +1,521 @@
+package connection
+
+import (
+	"context"
+	"drizlink/helper"
+	"drizlink/protocol"
+	"drizlink/server/interfaces"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// SpoolPeerId is the peer ID the server uses when it delivers spooled items
+// itself, so replies for those transfers come back to the server
+const SpoolPeerId = "server"
+
+// spoolChunkSize is the payload size of each /CHUNK frame sent from the spool
+const spoolChunkSize = 32768
+
+// spoolProgressInterval is how often the spool reports upload progress
+const spoolProgressInterval = 500 * time.Millisecond
+
+// NewSpool prepares dir for holding transfers to offline users. User IDs do
+// not survive a server restart, so items left from an earlier run are removed.
+func NewSpool(dir string, limit int64, ttl time.Duration) (*interfaces.Spool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	stale, err := filepath.Glob(filepath.Join(dir, "s[0-9]*"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range stale {
+		os.Remove(path)
+	}
+	return &interfaces.Spool{
+		Dir:     dir,
+		Limit:   limit,
+		TTL:     ttl,
+		Items:   make(map[string]*interfaces.SpoolItem),
+		Uploads: make(map[string]*interfaces.SpoolItem),
+	}, nil
+}
+
+// StartSpoolExpiry removes undelivered items once they are older than the
+// spool's TTL, until ctx is done. Items being delivered are left alone.
+func StartSpoolExpiry(ctx context.Context, interval time.Duration, server *interfaces.Server) {
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			spool := server.Spool
+			var expired []*interfaces.SpoolItem
+			spool.Mutex.Lock()
+			for _, item := range spool.Items {
+				if !item.Delivering && time.Since(item.Created) > spool.TTL {
+					delete(spool.Items, item.Id)
+					expired = append(expired, item)
+				}
+			}
+			spool.Mutex.Unlock()
+
+			for _, item := range expired {
+				fmt.Fprintf(server.Log, "Spooled item %s for %s expired\n", item.Name, item.RecipientId)
+				os.Remove(item.DataPath)
+				releaseSpoolSpace(spool, item.Size)
+				notifySpoolStatus(server, item, "expired", "not collected in time")
+			}
+		}
+	}()
+}
+
+// SpoolTransfer accepts a file or folder for a recipient who is offline and
+// stores it until they reconnect
+func SpoolTransfer(server *interfaces.Server, sender, recipient *interfaces.User, kind, name string, size int64, checksum, transferId string) {
+	spool := server.Spool
+	if spool == nil {
+		declineRequest(server, sender, recipient.UserId, transferId, "user is offline")
+		return
+	}
+
+	if size < 0 {
+		declineRequest(server, sender, recipient.UserId, transferId, "invalid size")
+		return
+	}
+
+	spool.Mutex.Lock()
+	if spool.Used+size > spool.Limit {
+		spool.Mutex.Unlock()
+		fmt.Fprintf(server.Log, "Spool full, declining %s for %s\n", name, recipient.UserId)
+		declineRequest(server, sender, recipient.UserId, transferId, "user is offline and the server spool is full")
+		return
+	}
+	spool.NextId++
+	item := &interfaces.SpoolItem{
+		Id:          "s" + strconv.Itoa(spool.NextId),
+		RecipientId: recipient.UserId,
+		SenderId:    sender.UserId,
+		SenderName:  sender.Username,
+		Kind:        kind,
+		Name:        name,
+		Size:        size,
+		Checksum:    checksum,
+		TransferId:  transferId,
+		Created:     time.Now(),
+	}
+	item.DataPath = filepath.Join(spool.Dir, item.Id)
+	spool.Used += size
+	spool.Mutex.Unlock()
+
+	file, err := os.Create(item.DataPath)
+	if err != nil {
+		fmt.Fprintf(server.Log, "Error creating spool file: %v\n", err)
+		releaseSpoolSpace(spool, size)
+		declineRequest(server, sender, recipient.UserId, transferId, "user is offline and the server could not hold the transfer")
+		return
+	}
+	item.File = file
+
+	spool.Mutex.Lock()
+	spool.Uploads[sender.UserId+"/"+transferId] = item
+	spool.Mutex.Unlock()
+
+	fmt.Fprintf(server.Log, "Spooling %s %s from %s for offline user %s\n", kind, name, sender.Username, recipient.Username)
+	savePath := fmt.Sprintf("server spool (delivered when %s reconnects)", recipient.Username)
+	err = sender.Conn.WriteLine(protocol.Format("/TRANSFER_ACCEPT", recipient.UserId, transferId, savePath, "0"))
+	if err != nil {
+		fmt.Fprintf(server.Log, "Error accepting spooled transfer from %s: %v\n", sender.UserId, err)
+	}
+
+	if size == 0 {
+		finishSpoolUpload(server, sender, item)
+	}
+}
+
+// HandleSpoolChunk stores a frame of data for a spooled upload. It reports
+// whether the frame belonged to one.
+func HandleSpoolChunk(server *interfaces.Server, sender *interfaces.User, transferId string, payload []byte) bool {
+	spool := server.Spool
+	if spool == nil {
+		return false
+	}
+	spool.Mutex.Lock()
+	item, exists := spool.Uploads[sender.UserId+"/"+transferId]
+	spool.Mutex.Unlock()
+	if !exists {
+		return false
+	}
+
+	if item.Received+int64(len(payload)) > item.Size {
+		abortSpoolUpload(server, spool, sender, item, "received more data than announced")
+		return true
+	}
+	if _, err := item.File.Write(payload); err != nil {
+		fmt.Fprintf(server.Log, "Error writing spool file: %v\n", err)
+		abortSpoolUpload(server, spool, sender, item, "server could not store the data")
+		return true
+	}
+	item.Received += int64(len(payload))
+
+	if item.Received == item.Size || time.Since(item.LastReport) >= spoolProgressInterval {
+		item.LastReport = time.Now()
+		sender.Conn.WriteLine(protocol.Format("/PROGRESS",
+			item.RecipientId, transferId, strconv.FormatInt(item.Received, 10)))
+	}
+
+	if item.Received == item.Size {
+		finishSpoolUpload(server, sender, item)
+	}
+	return true
+}
+
+// finishSpoolUpload verifies a completed upload, confirms it to the sender
+// and offers it right away if the recipient has come back meanwhile
+func finishSpoolUpload(server *interfaces.Server, sender *interfaces.User, item *interfaces.SpoolItem) {
+	spool := server.Spool
+	item.File.Close()
+
+	checksum, err := helper.CalculateFileChecksum(item.DataPath)
+	if err != nil || !helper.VerifyChecksum(item.Checksum, checksum) {
+		abortSpoolUpload(server, spool, sender, item, "checksum verification failed")
+		return
+	}
+
+	spool.Mutex.Lock()
+	delete(spool.Uploads, item.SenderId+"/"+item.TransferId)
+	spool.Items[item.Id] = item
+	spool.Mutex.Unlock()
+
+	savePath := "server spool"
+	err = sender.Conn.WriteLine(protocol.Format("/RECEIPT", item.RecipientId, item.TransferId, savePath, checksum))
+	if err != nil {
+		fmt.Fprintf(server.Log, "Error sending spool receipt to %s: %v\n", sender.UserId, err)
+	}
+
+	server.Mutex.Lock()
+	recipient, exists := server.Connections[item.RecipientId]
+	online := exists && recipient.IsOnline
+	server.Mutex.Unlock()
+	if online {
+		offerSpoolItem(server, recipient, item)
+	}
+}
+
+// abortSpoolUpload discards a failed upload and tells the sender
+func abortSpoolUpload(server *interfaces.Server, spool *interfaces.Spool, sender *interfaces.User, item *interfaces.SpoolItem, reason string) {
+	if !dropSpoolUpload(spool, item) {
+		return
+	}
+
+	retry := reason == "checksum verification failed"
+	err := sender.Conn.WriteLine(protocol.Format("/TRANSFER_FAILED",
+		item.RecipientId, item.TransferId, reason, strconv.FormatBool(retry)))
+	if err != nil {
+		fmt.Fprintf(server.Log, "Error reporting spool failure to %s: %v\n", sender.UserId, err)
+	}
+}
+
+// dropSpoolUpload forgets an unfinished upload, removes its data and frees
+// the space it reserved. It reports false when the upload already ended.
+func dropSpoolUpload(spool *interfaces.Spool, item *interfaces.SpoolItem) bool {
+	key := item.SenderId + "/" + item.TransferId
+	spool.Mutex.Lock()
+	if spool.Uploads[key] != item {
+		spool.Mutex.Unlock()
+		return false
+	}
+	delete(spool.Uploads, key)
+	spool.Mutex.Unlock()
+
+	item.File.Close()
+	os.Remove(item.DataPath)
+	releaseSpoolSpace(spool, item.Size)
+	return true
+}
+
+// dropSpoolUploadOf drops the upload of sender's transfer, if the spool is
+// taking it, and reports whether it was
+func dropSpoolUploadOf(server *interfaces.Server, sender *interfaces.User, transferId string) bool {
+	spool := server.Spool
+	if spool == nil {
+		return false
+	}
+	spool.Mutex.Lock()
+	item, exists := spool.Uploads[sender.UserId+"/"+transferId]
+	spool.Mutex.Unlock()
+	return exists && dropSpoolUpload(spool, item)
+}
+
+// DropSpoolUploads gives up the uploads user was making to the spool when
+// they disconnect, removing the partial data and freeing its space
+func DropSpoolUploads(server *interfaces.Server, user *interfaces.User) {
+	spool := server.Spool
+	if spool == nil {
+		return
+	}
+	var dropped []*interfaces.SpoolItem
+	spool.Mutex.Lock()
+	for _, item := range spool.Uploads {
+		if item.SenderId == user.UserId {
+			dropped = append(dropped, item)
+		}
+	}
+	spool.Mutex.Unlock()
+
+	for _, item := range dropped {
+		if dropSpoolUpload(spool, item) {
+			fmt.Fprintf(server.Log, "Dropped upload of %s for %s: sender disconnected\n", item.Name, item.RecipientId)
+		}
+	}
+}
+
+// EndSpoolDeliveries ends the deliveries to user when they disconnect, so
+// the items can expire or be accepted again once they are back
+func EndSpoolDeliveries(server *interfaces.Server, user *interfaces.User) {
+	spool := server.Spool
+	if spool == nil {
+		return
+	}
+	spool.Mutex.Lock()
+	for _, item := range spool.Items {
+		if item.RecipientId == user.UserId {
+			item.Delivering = false
+		}
+	}
+	spool.Mutex.Unlock()
+}
+
+// OfferSpooledItems tells a user who just reconnected what is waiting for them
+func OfferSpooledItems(server *interfaces.Server, user *interfaces.User) {
+	if server.Spool == nil {
+		return
+	}
+	spool := server.Spool
+	var pending []*interfaces.SpoolItem
+	spool.Mutex.Lock()
+	for _, item := range spool.Items {
+		if item.RecipientId == user.UserId {
+			pending = append(pending, item)
+		}
+	}
+	spool.Mutex.Unlock()
+
+	for _, item := range pending {
+		offerSpoolItem(server, user, item)
+	}
+}
+
+func offerSpoolItem(server *interfaces.Server, user *interfaces.User, item *interfaces.SpoolItem) {
+	err := user.Conn.WriteLine(protocol.Format("/SPOOL_OFFER",
+		item.Id, item.SenderName, item.Kind, item.Name, strconv.FormatInt(item.Size, 10)))
+	if err != nil {
+		fmt.Fprintf(server.Log, "Error offering spooled item to %s: %v\n", user.UserId, err)
+	}
+}
+
+// lookupSpoolItem returns a completed item held for user
+func lookupSpoolItem(server *interfaces.Server, user *interfaces.User, itemId string) (*interfaces.SpoolItem, bool) {
+	if server.Spool == nil {
+		return nil, false
+	}
+	server.Spool.Mutex.Lock()
+	defer server.Spool.Mutex.Unlock()
+	item, exists := server.Spool.Items[itemId]
+	if !exists || item.RecipientId != user.UserId {
+		return nil, false
+	}
+	return item, true
+}
+
+// HandleSpoolAccept starts delivering a spooled item to its recipient. An
+// item already being delivered is left alone, so a repeated accept does not
+// start a second delivery.
+func HandleSpoolAccept(server *interfaces.Server, user *interfaces.User, itemId string) {
+	item, exists := lookupSpoolItem(server, user, itemId)
+	if !exists {
+		fmt.Fprintf(server.Log, "Spooled item %s not found for %s\n", itemId, user.UserId)
+		return
+	}
+	server.Spool.Mutex.Lock()
+	delivering := item.Delivering
+	item.Delivering = true
+	server.Spool.Mutex.Unlock()
+	if delivering {
+		fmt.Fprintf(server.Log, "Spooled item %s is already being delivered to %s\n", itemId, user.UserId)
+		return
+	}
+
+	command := "/FILE_RESPONSE"
+	if item.Kind == "folder" {
+		command = "/FOLDER_RESPONSE"
+	}
+	err := user.Conn.WriteLine(protocol.Format(command,
+		SpoolPeerId, item.Name, strconv.FormatInt(item.Size, 10), item.Checksum, item.Id, user.StoreFilePath))
+	if err != nil {
+		fmt.Fprintf(server.Log, "Error delivering spooled item to %s: %v\n", user.UserId, err)
+	}
+}
+
+// HandleSpoolReject drops a spooled item its recipient does not want
+func HandleSpoolReject(server *interfaces.Server, user *interfaces.User, itemId string) {
+	item, exists := lookupSpoolItem(server, user, itemId)
+	if !exists {
+		return
+	}
+	removeSpoolItem(server.Spool, item)
+	notifySpoolStatus(server, item, "rejected", "refused by the recipient")
+}
+
+// HandleSpoolReply handles the recipient's answers for a spooled item the
+// server is delivering
+func HandleSpoolReply(server *interfaces.Server, user *interfaces.User, command string, args []string) {
+	item, exists := lookupSpoolItem(server, user, args[0])
+	if !exists {
+		return
+	}
+
+	switch command {
+	case "/TRANSFER_ACCEPT":
+		var offset int64
+		if len(args) > 2 {
+			offset, _ = strconv.ParseInt(args[2], 10, 64)
+		}
+		server.Spool.Mutex.Lock()
+		if !item.Delivering {
+			server.Spool.Mutex.Unlock()
+			return
+		}
+		server.Spool.Streams++
+		item.Paused = false
+		item.Delivery++
+		previous, done := item.Streamed, make(chan struct{})
+		item.Streamed = done
+		delivery := item.Delivery
+		server.Spool.Mutex.Unlock()
+		go streamSpoolItem(server, user, item, offset, delivery, previous, done)
+	case "/TRANSFER_PAUSE", "/TRANSFER_RESUME":
+		server.Spool.Mutex.Lock()
+		item.Paused = command == "/TRANSFER_PAUSE"
+		server.Spool.Mutex.Unlock()
+	case "/TRANSFER_DECLINE":
+		removeSpoolItem(server.Spool, item)
+		notifySpoolStatus(server, item, "declined", args[1])
+	case "/TRANSFER_FAILED":
+		server.Spool.Mutex.Lock()
+		item.Delivering = false
+		server.Spool.Mutex.Unlock()
+		if len(args) > 2 && args[2] == "true" {
+			HandleSpoolAccept(server, user, item.Id)
+		}
+	case "/RECEIPT":
+		fmt.Fprintf(server.Log, "Delivered spooled item %s to %s\n", item.Name, user.Username)
+		removeSpoolItem(server.Spool, item)
+		notifySpoolStatus(server, item, "delivered", args[1])
+	}
+}
+
+// streamSpoolItem sends a spooled item's data to its recipient from offset.
+// It waits for the previous stream of the item to end first, and stops once
+// a newer one is started or the delivery ends.
+func streamSpoolItem(server *interfaces.Server, user *interfaces.User, item *interfaces.SpoolItem, offset int64, delivery int, previous, done chan struct{}) {
+	defer func() {
+		server.Spool.Mutex.Lock()
+		server.Spool.Streams--
+		server.Spool.Mutex.Unlock()
+		close(done)
+	}()
+	if previous != nil {
+		<-previous
+	}
+	file, err := os.Open(item.DataPath)
+	if err != nil {
+		fmt.Fprintf(server.Log, "Error opening spooled item %s: %v\n", item.Id, err)
+		return
+	}
+	defer file.Close()
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		fmt.Fprintf(server.Log, "Error seeking spooled item %s: %v\n", item.Id, err)
+		return
+	}
+
+	server.Mutex.Lock()
+	conn := user.Conn
+	server.Mutex.Unlock()
+	current := func() bool {
+		return item.Delivering && item.Delivery == delivery
+	}
+	paused := func() bool {
+		server.Spool.Mutex.Lock()
+		defer server.Spool.Mutex.Unlock()
+		return item.Paused && current()
+	}
+	stopped := func() bool {
+		server.Spool.Mutex.Lock()
+		defer server.Spool.Mutex.Unlock()
+		return !current()
+	}
+
+	buffer := make([]byte, spoolChunkSize)
+	for {
+		if !waitWhilePaused(server, user, conn, paused) || stopped() {
+			return
+		}
+		n, err := file.Read(buffer)
+		if n > 0 {
+			header := protocol.Format("/CHUNK", SpoolPeerId, item.Id, strconv.Itoa(n))
+			if writeErr := conn.WriteFrame(header, buffer[:n]); writeErr != nil {
+				fmt.Fprintf(server.Log, "Error delivering spooled item to %s: %v\n", user.UserId, writeErr)
+				return
+			}
+		}
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			fmt.Fprintf(server.Log, "Error reading spooled item %s: %v\n", item.Id, err)
+			abortDelivery(server, SpoolPeerId, user.UserId, item.Id, "the server could not read the held transfer")
+			return
+		}
+	}
+}
+
+func removeSpoolItem(spool *interfaces.Spool, item *interfaces.SpoolItem) {
+	spool.Mutex.Lock()
+	_, exists := spool.Items[item.Id]
+	delete(spool.Items, item.Id)
+	spool.Mutex.Unlock()
+	if !exists {
+		return
+	}
+	os.Remove(item.DataPath)
+	releaseSpoolSpace(spool, item.Size)
+}
+
+func releaseSpoolSpace(spool *interfaces.Spool, size int64) {
+	spool.Mutex.Lock()
+	spool.Used -= size
+	spool.Mutex.Unlock()
+}
+
+// notifySpoolStatus tells the original sender, if online, what became of an item
+func notifySpoolStatus(server *interfaces.Server, item *interfaces.SpoolItem, status, detail string) {
+	conn := onlineConn(server, item.SenderId)
+	if conn == nil {
+		return
+	}
+
+	err := conn.WriteLine(protocol.Format("/SPOOL_STATUS", item.RecipientId, item.Name, status, detail))
+	if err != nil {
+		fmt.Fprintf(server.Log, "Error sending spool status to %s: %v\n", item.SenderId, err)
+	}
+}
@@ -0,0 +1,113 @@
+package connection
+
+import (
+	"drizlink/helper"
+	"drizlink/protocol"
+	"drizlink/server/interfaces"
+	"fmt"
+	"strconv"
+)
+
+// startSession gives user a new stream token and sends it, so the data
+// streams the client opens later can prove they belong to this session
+func startSession(server *interfaces.Server, user *interfaces.User) error {
+	token := helper.GenerateToken()
+	server.Mutex.Lock()
+	user.StreamToken = token
+	server.Mutex.Unlock()
+	return user.Conn.WriteLine(protocol.Format("/SESSION", token))
+}
+
+// streamOwner finds the online user whose session token is token
+func streamOwner(server *interfaces.Server, token string) *interfaces.User {
+	server.Mutex.Lock()
+	defer server.Mutex.Unlock()
+	for _, user := range server.Connections {
+		if user.IsOnline && user.StreamToken != "" && user.StreamToken == token {
+			return user
+		}
+	}
+	return nil
+}
+
+// HandleDataStream serves an extra connection user opened for parallel
+// transfers. It only carries /RANGE frames, which are relayed like chunks.
+func HandleDataStream(server *interfaces.Server, user *interfaces.User, conn *protocol.Conn) {
+	if err := conn.WriteLine("/STREAM_READY"); err != nil {
+		conn.Close()
+		return
+	}
+
+	server.Mutex.Lock()
+	user.Streams = append(user.Streams, conn)
+	server.Mutex.Unlock()
+	defer removeDataStream(server, user, conn)
+
+	for {
+		header, err := conn.ReadLine()
+		if err != nil {
+			return
+		}
+
+		args, err := protocol.SplitArgs(header)
+		if err != nil || len(args) != 5 || args[0] != "/RANGE" {
+			fmt.Fprintln(server.Log, "Invalid data stream frame from", user.Username)
+			// Without a valid length the stream can no longer be framed
+			return
+		}
+		size, err := protocol.ParseSize(args[4])
+		if err != nil {
+			fmt.Fprintln(server.Log, "Invalid range length:", err)
+			return
+		}
+		payload, err := conn.ReadPayload(size)
+		if err != nil {
+			fmt.Fprintf(server.Log, "Error reading range from %s: %v\n", user.Username, err)
+			return
+		}
+		HandleRange(server, user, args[1], args[2], args[3], payload)
+	}
+}
+
+// HandleRange relays one frame of a parallel transfer to the recipient,
+// spreading frames over the recipient's data streams
+func HandleRange(server *interfaces.Server, sender *interfaces.User, recipientId, transferId, offset string, payload []byte) {
+	if _, err := strconv.ParseInt(offset, 10, 64); err != nil {
+		fmt.Fprintf(server.Log, "Dropping range of transfer %s: invalid offset %q\n", transferId, offset)
+		return
+	}
+
+	server.Mutex.Lock()
+	recipient, exists := server.Connections[recipientId]
+	var conn *protocol.Conn
+	if exists && recipient.IsOnline {
+		conn = recipient.Conn
+		if len(recipient.Streams) > 0 {
+			conn = recipient.Streams[recipient.NextStream%len(recipient.Streams)]
+			recipient.NextStream++
+		}
+	}
+	server.Mutex.Unlock()
+	if conn == nil {
+		fmt.Fprintf(server.Log, "Dropping range of transfer %s: user %s not available\n", transferId, recipientId)
+		return
+	}
+
+	header := protocol.Format("/RANGE", sender.UserId, transferId, offset, strconv.Itoa(len(payload)))
+	if err := conn.WriteFrame(header, payload); err != nil {
+		fmt.Fprintf(server.Log, "Error relaying range to %s: %v\n", recipientId, err)
+	}
+}
+
+// removeDataStream forgets a closed data stream
+func removeDataStream(server *interfaces.Server, user *interfaces.User, conn *protocol.Conn) {
+	conn.Close()
+	server.Mutex.Lock()
+	defer server.Mutex.Unlock()
+	for i, stream := range user.Streams {
+		if stream == conn {
+			user.Streams = append(user.Streams[:i], user.Streams[i+1:]...)
+			break
+		}
+	}
+}
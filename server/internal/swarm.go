@@ -0,0 +1,119 @@
+package connection
+
+import (
+	"drizlink/protocol"
+	"drizlink/server/interfaces"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// RequestAdvertisement asks user to list the files in their store path that
+// other users can fetch by checksum. Anything advertised earlier is
+// forgotten, the client sends its full list again.
+func RequestAdvertisement(server *interfaces.Server, user *interfaces.User) {
+	server.Mutex.Lock()
+	user.Shared = make(map[string]interfaces.SharedFile)
+	storePath := user.StoreFilePath
+	server.Mutex.Unlock()
+
+	if err := user.Conn.WriteLine(protocol.Format("/SWARM_ADVERTISE", storePath)); err != nil {
+		fmt.Fprintf(server.Log, "Error asking %s for shared files: %v\n", user.UserId, err)
+	}
+}
+
+// HandleSwarmMessage handles the messages of content addressed downloads.
+// Advertisements and lookups are answered by the server, everything else is
+// relayed to the peer in args[0] with the sender's ID in its place.
+func HandleSwarmMessage(server *interfaces.Server, user *interfaces.User, command string, args []string, payload []byte) {
+	switch command {
+	case "/SWARM_HAVE":
+		if len(args)%3 != 0 {
+			fmt.Fprintln(server.Log, "Invalid arguments. Use: /SWARM_HAVE <checksum> <size> <name>...")
+			return
+		}
+		server.Mutex.Lock()
+		if user.Shared == nil {
+			user.Shared = make(map[string]interfaces.SharedFile)
+		}
+		for i := 0; i < len(args); i += 3 {
+			size, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil || size <= 0 {
+				continue
+			}
+			user.Shared[args[i]] = interfaces.SharedFile{Size: size, Name: args[i+2]}
+		}
+		server.Mutex.Unlock()
+	case "/SWARM_DROP":
+		server.Mutex.Lock()
+		for _, checksum := range args {
+			delete(user.Shared, checksum)
+		}
+		server.Mutex.Unlock()
+	case "/SWARM_QUERY":
+		handleSwarmQuery(server, user, args[0])
+	default:
+		relaySwarmMessage(server, user, command, args, payload)
+	}
+}
+
+// handleSwarmQuery tells user which online users advertise checksum, with
+// the size and a name the content was advertised under
+func handleSwarmQuery(server *interfaces.Server, user *interfaces.User, checksum string) {
+	var peers []string
+	var found interfaces.SharedFile
+	server.Mutex.Lock()
+	for _, peer := range server.Connections {
+		if peer == user || !peer.IsOnline {
+			continue
+		}
+		if shared, exists := peer.Shared[checksum]; exists {
+			peers = append(peers, peer.UserId)
+			found = shared
+		}
+	}
+	server.Mutex.Unlock()
+	sort.Strings(peers)
+
+	reply := []string{checksum}
+	if len(peers) > 0 {
+		reply = append(reply, strconv.FormatInt(found.Size, 10), found.Name)
+		reply = append(reply, peers...)
+	}
+	if err := user.Conn.WriteLine(protocol.Format("/SWARM_SOURCES", reply...)); err != nil {
+		fmt.Fprintf(server.Log, "Error sending sources to %s: %v\n", user.UserId, err)
+	}
+}
+
+// relaySwarmMessage passes a request for a piece map or a piece, or the
+// answer to one, on to the peer. Requests to a peer that is not online are
+// answered as missing so the downloader moves on.
+func relaySwarmMessage(server *interfaces.Server, sender *interfaces.User, command string, args []string, payload []byte) {
+	if len(args) < 2 {
+		fmt.Fprintf(server.Log, "Invalid arguments for %s\n", command)
+		return
+	}
+	peerId := args[0]
+
+	conn := onlineConn(server, peerId)
+	if conn == nil {
+		if command == "/SWARM_MAP" || command == "/SWARM_WANT" {
+			err := sender.Conn.WriteLine(protocol.Format("/SWARM_MISSING", peerId, args[1], "user is not online"))
+			if err != nil {
+				fmt.Fprintf(server.Log, "Error answering %s for %s: %v\n", command, sender.UserId, err)
+			}
+		}
+		return
+	}
+
+	header := protocol.Format(command, append([]string{sender.UserId}, args[1:]...)...)
+	var err error
+	if payload != nil {
+		err = conn.WriteFrame(header, payload)
+	} else {
+		err = conn.WriteLine(header)
+	}
+	if err != nil {
+		fmt.Fprintf(server.Log, "Error relaying %s to %s: %v\n", command, peerId, err)
+	}
+}
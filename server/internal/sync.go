@@ -0,0 +1,54 @@
+package connection
+
+import (
+	"drizlink/protocol"
+	"drizlink/server/interfaces"
+	"fmt"
+)
+
+// HandleSyncMessage relays a folder synchronization message to the peer in
+// args[0]. A sync request also carries the peer's store path, which the
+// synced folder must lie in. When the peer is not online, requests that
+// expect an answer are declined so the sender does not wait for nothing.
+func HandleSyncMessage(server *interfaces.Server, sender *interfaces.User, command string, args []string) {
+	peerId := args[0]
+
+	server.Mutex.Lock()
+	var conn *protocol.Conn
+	var storePath string
+	if peer, exists := server.Connections[peerId]; exists && peer.IsOnline {
+		conn, storePath = peer.Conn, peer.StoreFilePath
+	}
+	server.Mutex.Unlock()
+
+	if conn == nil {
+		fmt.Fprintf(server.Log, "Dropping %s for sync %s: user %s not available\n", command, args[1], peerId)
+		switch command {
+		case "/SYNC_REQUEST":
+			err := sender.Conn.WriteLine(protocol.Format("/SYNC_DECLINE", peerId, args[1], "user is not online"))
+			if err != nil {
+				fmt.Fprintf(server.Log, "Error declining sync for %s: %v\n", sender.UserId, err)
+			}
+		case "/SYNC_FILE":
+			if len(args) > 5 {
+				declineRequest(server, sender, peerId, args[5], "user is not online")
+			}
+		case "/SYNC_PULL":
+			if len(args) > 2 {
+				err := sender.Conn.WriteLine(protocol.Format("/SYNC_PULL_FAILED", peerId, args[1], args[2], "user is not online"))
+				if err != nil {
+					fmt.Fprintf(server.Log, "Error failing sync pull for %s: %v\n", sender.UserId, err)
+				}
+			}
+		}
+		return
+	}
+
+	relayed := append([]string{sender.UserId}, args[1:]...)
+	if command == "/SYNC_REQUEST" {
+		relayed = append(relayed, storePath)
+	}
+	if err := conn.WriteLine(protocol.Format(command, relayed...)); err != nil {
+		fmt.Fprintf(server.Log, "Error relaying %s to %s: %v\n", command, peerId, err)
+	}
+}
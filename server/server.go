@@ -0,0 +1,261 @@
+// Package server runs a DrizLink server inside another Go program: it
+// accepts clients on a listener, passes messages and transfers between them
+// and holds transfers for users who are offline.
+//
+//	srv, err := server.New(server.Options{Log: os.Stdout})
+//	if err != nil {
+//		return err
+//	}
+//	go srv.ListenAndServe(context.Background(), ":8080")
+//	...
+//	err = srv.Shutdown(ctx)
+package server
+
+import (
+	"context"
+	"drizlink/server/interfaces"
+	connection "drizlink/server/internal"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Defaults for the Options left zero
+const (
+	DefaultHeartbeatInterval = 100 * time.Second
+	DefaultSpoolTTL          = 72 * time.Hour
+)
+
+// spoolExpiryInterval is how often expired spool items are looked for
+const spoolExpiryInterval = time.Minute
+
+// drainPollInterval is how often Shutdown checks whether transfers finished
+const drainPollInterval = 100 * time.Millisecond
+
+// acceptRetryDelay is how long Serve waits after a failed accept
+const acceptRetryDelay = 50 * time.Millisecond
+
+// ErrServerClosed is returned by Serve once Shutdown was called
+var ErrServerClosed = errors.New("server closed")
+
+// Event is something that happened on the server, passed to Options.OnEvent
+type Event = interfaces.Event
+
+// Relay is a transfer passing between two online users
+type Relay = interfaces.Relay
+
+// Event types
+const (
+	UserJoinedEvent       = interfaces.UserJoinedEvent
+	UserRejoinedEvent     = interfaces.UserRejoinedEvent
+	UserLeftEvent         = interfaces.UserLeftEvent
+	MessageEvent          = interfaces.MessageEvent
+	TransferStartedEvent  = interfaces.TransferStartedEvent
+	TransferFinishedEvent = interfaces.TransferFinishedEvent
+)
+
+// Options configure a Server
+type Options struct {
+	// SpoolSize is the most bytes held for offline users at once. Zero
+	// disables holding transfers, so sending to an offline user fails.
+	SpoolSize int64
+	// SpoolDir holds those transfers, drizlink-spool in the temporary
+	// directory by default. Items left from an earlier run are removed.
+	SpoolDir string
+	// SpoolTTL is how long a held transfer waits for its recipient,
+	// DefaultSpoolTTL by default
+	SpoolTTL time.Duration
+	// HeartbeatInterval is how often clients are pinged to notice those that
+	// vanished, DefaultHeartbeatInterval by default
+	HeartbeatInterval time.Duration
+	// Log receives the server's log messages, which are discarded when nil
+	Log io.Writer
+	// OnEvent is called for every Event when set. It runs on the goroutine
+	// serving the client concerned, so it must not block.
+	OnEvent func(Event)
+}
+
+// Server is a DrizLink server
+type Server struct {
+	options      Options
+	state        *interfaces.Server
+	mutex        sync.Mutex
+	listener     net.Listener
+	conns        map[net.Conn]bool
+	handlers     sync.WaitGroup
+	shuttingDown bool
+}
+
+// New creates a server that is ready to Serve
+func New(options Options) (*Server, error) {
+	if options.Log == nil {
+		options.Log = io.Discard
+	}
+	if options.HeartbeatInterval <= 0 {
+		options.HeartbeatInterval = DefaultHeartbeatInterval
+	}
+	if options.SpoolTTL <= 0 {
+		options.SpoolTTL = DefaultSpoolTTL
+	}
+	if options.SpoolDir == "" {
+		options.SpoolDir = filepath.Join(os.TempDir(), "drizlink-spool")
+	}
+
+	state := &interfaces.Server{
+		Connections: make(map[string]*interfaces.User),
+		IpAddresses: make(map[string]*interfaces.User),
+		Messages:    make(chan interfaces.Message),
+		FanOuts:     make(map[string]*interfaces.FanOut),
+		Relays:      make(map[string]*interfaces.Relay),
+		Log:         options.Log,
+		Events:      options.OnEvent,
+	}
+	if options.SpoolSize > 0 {
+		spool, err := connection.NewSpool(options.SpoolDir, options.SpoolSize, options.SpoolTTL)
+		if err != nil {
+			return nil, err
+		}
+		state.Spool = spool
+	}
+	return &Server{options: options, state: state, conns: make(map[net.Conn]bool)}, nil
+}
+
+// ListenAndServe listens on the TCP address, in format host:port or :port,
+// and serves it like Serve
+func (s *Server) ListenAndServe(ctx context.Context, address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ctx, listener)
+}
+
+// Serve accepts clients on listener until ctx is done or Shutdown is
+// called, and closes listener. When ctx ends it also disconnects every
+// client at once and returns ctx's error once they are gone; after Shutdown
+// it returns ErrServerClosed straight away and Shutdown finishes the work.
+// A server serves one listener.
+func (s *Server) Serve(ctx context.Context, listener net.Listener) error {
+	s.mutex.Lock()
+	if s.shuttingDown {
+		s.mutex.Unlock()
+		listener.Close()
+		return ErrServerClosed
+	}
+	if s.listener != nil {
+		s.mutex.Unlock()
+		return errors.New("server is already serving")
+	}
+	s.listener = listener
+	s.mutex.Unlock()
+
+	background, stop := context.WithCancel(ctx)
+	defer stop()
+	connection.StartHeartBeat(background, s.options.HeartbeatInterval, s.state)
+	if s.state.Spool != nil {
+		connection.StartSpoolExpiry(background, spoolExpiryInterval, s.state)
+	}
+	go func() {
+		<-background.Done()
+		listener.Close()
+	}()
+
+	s.state.Address = listener.Addr().String()
+	fmt.Fprintln(s.options.Log, "Server started on", s.state.Address)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if s.isShuttingDown() {
+				return ErrServerClosed
+			}
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				s.closeConnections()
+				s.handlers.Wait()
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				return err
+			}
+			fmt.Fprintln(s.options.Log, "Error accepting connection:", err)
+			time.Sleep(acceptRetryDelay)
+			continue
+		}
+
+		s.mutex.Lock()
+		s.conns[conn] = true
+		s.mutex.Unlock()
+		s.handlers.Add(1)
+		go func() {
+			defer s.handlers.Done()
+			connection.HandleConnection(conn, s.state)
+			conn.Close()
+			s.mutex.Lock()
+			delete(s.conns, conn)
+			s.mutex.Unlock()
+		}()
+	}
+}
+
+// Shutdown stops accepting clients and refuses new transfers, waits for
+// the transfers in progress to finish, then disconnects every client. When
+// ctx ends first the clients are disconnected anyway, cutting those
+// transfers off, and ctx's error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mutex.Lock()
+	s.shuttingDown = true
+	listener := s.listener
+	s.mutex.Unlock()
+	s.state.Mutex.Lock()
+	s.state.Draining = true
+	s.state.Mutex.Unlock()
+	if listener != nil {
+		listener.Close()
+	}
+
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	if connection.Busy(s.state) {
+		fmt.Fprintln(s.options.Log, "Waiting for transfers to finish")
+	}
+	for connection.Busy(s.state) {
+		select {
+		case <-ctx.Done():
+			s.closeConnections()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+
+	s.closeConnections()
+	done := make(chan struct{})
+	go func() {
+		s.handlers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *Server) isShuttingDown() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.shuttingDown
+}
+
+// closeConnections disconnects every client, which ends their handlers
+func (s *Server) closeConnections() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
@@ -0,0 +1,323 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"drizlink/helper"
+	"drizlink/protocol"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// testTimeout bounds every wait for the server in these tests
+const testTimeout = 5 * time.Second
+
+// testPeer speaks the protocol to the server the way a client does
+type testPeer struct {
+	t    *testing.T
+	name string
+	conn *protocol.Conn
+	// seen counts the messages read so far by command
+	seen map[string]int
+}
+
+// startServer serves options on a loopback port until the test ends and
+// returns its address and what Serve returned, once it has
+func startServer(t *testing.T, options Options) (*Server, string, <-chan error) {
+	t.Helper()
+	srv, err := New(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(context.Background(), listener) }()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+		defer cancel()
+		srv.Shutdown(ctx)
+	})
+	return srv, listener.Addr().String(), served
+}
+
+// connectPeer logs in to the server at address as name with the login mode
+// "new" or "resume"
+func connectPeer(t *testing.T, address, mode, name string) *testPeer {
+	t.Helper()
+	netConn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := &testPeer{t: t, name: name, conn: protocol.NewConn(netConn), seen: make(map[string]int)}
+	t.Cleanup(func() { peer.conn.Close() })
+
+	peer.send("/LOGIN", mode)
+	if mode == "resume" {
+		if args, _ := peer.expect("/LOGIN_NEEDED", "/RECONNECT"); args[0] == "/RECONNECT" {
+			return peer
+		}
+	}
+	peer.conn.WriteLine(name)
+	peer.conn.WriteLine(t.TempDir())
+	peer.expect("/SESSION")
+	return peer
+}
+
+func (p *testPeer) send(command string, args ...string) {
+	p.t.Helper()
+	if err := p.conn.WriteLine(protocol.Format(command, args...)); err != nil {
+		p.t.Fatalf("%s: error sending %s: %v", p.name, command, err)
+	}
+}
+
+// sendData sends data as /CHUNK frames for the transfer with ID
+// transferId to recipientId
+func (p *testPeer) sendData(recipientId, transferId string, data []byte) {
+	p.t.Helper()
+	for len(data) > 0 {
+		n := min(len(data), 32768)
+		header := protocol.Format("/CHUNK", recipientId, transferId, strconv.Itoa(n))
+		if err := p.conn.WriteFrame(header, data[:n]); err != nil {
+			p.t.Fatalf("%s: error sending data: %v", p.name, err)
+		}
+		data = data[n:]
+	}
+}
+
+// expect reads messages until one with one of commands arrives and
+// returns its arguments, with the command first, and its payload
+func (p *testPeer) expect(commands ...string) ([]string, []byte) {
+	p.t.Helper()
+	p.conn.SetReadDeadline(time.Now().Add(testTimeout))
+	defer p.conn.SetReadDeadline(time.Time{})
+	for {
+		line, err := p.conn.ReadLine()
+		if err != nil {
+			p.t.Fatalf("%s: waiting for %v: %v", p.name, commands, err)
+		}
+		args, err := protocol.SplitArgs(line)
+		if err != nil || len(args) == 0 {
+			continue
+		}
+		var payload []byte
+		if args[0] == "/CHUNK" {
+			size, err := protocol.ParseSize(args[len(args)-1])
+			if err != nil {
+				p.t.Fatalf("%s: invalid chunk: %v", p.name, err)
+			}
+			if payload, err = p.conn.ReadPayload(size); err != nil {
+				p.t.Fatalf("%s: error reading chunk: %v", p.name, err)
+			}
+		}
+		p.seen[args[0]]++
+		for _, command := range commands {
+			if args[0] == command {
+				return args, payload
+			}
+		}
+	}
+}
+
+// receiveData reads /CHUNK frames of the transfer with ID transferId until
+// size bytes arrived
+func (p *testPeer) receiveData(transferId string, size int) []byte {
+	p.t.Helper()
+	var data []byte
+	for len(data) < size {
+		args, payload := p.expect("/CHUNK")
+		if args[2] != transferId {
+			p.t.Fatalf("%s: got data of transfer %s, want %s", p.name, args[2], transferId)
+		}
+		data = append(data, payload...)
+	}
+	return data
+}
+
+// userId asks the server for the ID of the online user name
+func (p *testPeer) userId(name string) string {
+	p.t.Helper()
+	p.send("/status")
+	args, _ := p.expect("/USERS")
+	for i := 1; i+1 < len(args); i += 2 {
+		if args[i] == name {
+			return args[i+1]
+		}
+	}
+	p.t.Fatalf("%s is not online", name)
+	return ""
+}
+
+// testData returns size bytes of random data and their checksum
+func testData(t *testing.T, seed int64, size int) ([]byte, string) {
+	t.Helper()
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	checksum, _, err := helper.CalculateDataChecksum(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data, checksum
+}
+
+// startRelay has alice offer a file to bob and bob accept it, and returns
+// their user IDs
+func startRelay(alice, bob *testPeer, transferId string, data []byte, checksum string) (string, string) {
+	alice.t.Helper()
+	bobId := alice.userId("bob")
+	alice.send("/FILE_REQUEST", bobId, "report.bin", strconv.Itoa(len(data)), checksum, transferId)
+	args, _ := bob.expect("/FILE_RESPONSE")
+	aliceId := args[1]
+	if args[2] != "report.bin" || args[3] != strconv.Itoa(len(data)) || args[5] != transferId {
+		alice.t.Fatalf("bob was offered %v", args)
+	}
+	bob.send("/TRANSFER_ACCEPT", aliceId, transferId, "report.bin", "0")
+	if args, _ := alice.expect("/TRANSFER_ACCEPT"); args[1] != bobId {
+		alice.t.Fatalf("alice got an accept from %s, want %s", args[1], bobId)
+	}
+	return aliceId, bobId
+}
+
+func TestSend(t *testing.T) {
+	_, address, _ := startServer(t, Options{})
+	alice := connectPeer(t, address, "new", "alice")
+	bob := connectPeer(t, address, "new", "bob")
+
+	data, checksum := testData(t, 1, 200<<10)
+	aliceId, bobId := startRelay(alice, bob, "t1", data, checksum)
+	alice.sendData(bobId, "t1", data)
+	if received := bob.receiveData("t1", len(data)); !bytes.Equal(received, data) {
+		t.Fatalf("bob received %d bytes that differ from the %d sent", len(received), len(data))
+	}
+
+	bob.send("/RECEIPT", aliceId, "t1", "report.bin", checksum)
+	if args, _ := alice.expect("/RECEIPT"); args[1] != bobId || args[4] != checksum {
+		t.Errorf("alice got receipt %v", args)
+	}
+}
+
+func TestSpooledDelivery(t *testing.T) {
+	spoolDir := t.TempDir()
+	_, address, _ := startServer(t, Options{SpoolSize: 1 << 20, SpoolDir: spoolDir})
+	alice := connectPeer(t, address, "new", "alice")
+	bob := connectPeer(t, address, "resume", "bob")
+	bobId := alice.userId("bob")
+	bob.send("/exit")
+	for deadline := time.Now().Add(testTimeout); ; {
+		alice.send("/status")
+		if args, _ := alice.expect("/USERS"); len(args) == 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("bob is still online after leaving")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	alice.send("/FILE_REQUEST", bobId, "bad.bin", "-1", "0", "t0")
+	if args, _ := alice.expect("/TRANSFER_DECLINE"); args[2] != "t0" || args[3] != "invalid size" {
+		t.Errorf("a negative size got %v", args)
+	}
+
+	data, checksum := testData(t, 2, 100<<10)
+	alice.send("/FILE_REQUEST", bobId, "report.bin", strconv.Itoa(len(data)), checksum, "t1")
+	alice.expect("/TRANSFER_ACCEPT")
+	alice.sendData(bobId, "t1", data)
+	if args, _ := alice.expect("/RECEIPT"); args[4] != checksum {
+		t.Fatalf("the spool confirmed checksum %s, want %s", args[4], checksum)
+	}
+
+	bob = connectPeer(t, address, "resume", "bob")
+	if bob.seen["/RECONNECT"] != 1 {
+		t.Fatal("bob did not continue his session")
+	}
+	args, _ := bob.expect("/SPOOL_OFFER")
+	itemId := args[1]
+	if args[4] != "report.bin" {
+		t.Fatalf("bob was offered %v", args)
+	}
+	// A repeated accept must not start a second delivery
+	bob.send("/SPOOL_ACCEPT", itemId)
+	bob.send("/SPOOL_ACCEPT", itemId)
+	if args, _ := bob.expect("/FILE_RESPONSE"); args[1] != "server" || args[5] != itemId {
+		t.Fatalf("bob got %v", args)
+	}
+	bob.send("/TRANSFER_ACCEPT", "server", itemId, "report.bin", "0")
+	if received := bob.receiveData(itemId, len(data)); !bytes.Equal(received, data) {
+		t.Fatalf("bob received %d bytes that differ from the %d sent", len(received), len(data))
+	}
+	bob.send("/RECEIPT", "server", itemId, "report.bin", checksum)
+
+	if args, _ := alice.expect("/SPOOL_STATUS"); args[1] != bobId || args[3] != "delivered" {
+		t.Errorf("alice got status %v", args)
+	}
+	bob.userId("bob")
+	if bob.seen["/FILE_RESPONSE"] != 1 {
+		t.Errorf("the item was offered for delivery %d times, want 1", bob.seen["/FILE_RESPONSE"])
+	}
+	if left, _ := filepath.Glob(filepath.Join(spoolDir, "s*")); len(left) != 0 {
+		t.Errorf("the spool still holds %v after delivery", left)
+	}
+}
+
+func TestShutdownWaitsForTransfers(t *testing.T) {
+	srv, address, served := startServer(t, Options{})
+	alice := connectPeer(t, address, "new", "alice")
+	bob := connectPeer(t, address, "new", "bob")
+
+	data, checksum := testData(t, 3, 100<<10)
+	aliceId, bobId := startRelay(alice, bob, "t1", data, checksum)
+
+	shutdown := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+		defer cancel()
+		shutdown <- srv.Shutdown(ctx)
+	}()
+	if err := <-served; err != ErrServerClosed {
+		t.Fatalf("Serve returned %v, want ErrServerClosed", err)
+	}
+	if _, err := net.Dial("tcp", address); err == nil {
+		t.Error("the server still accepts connections while shutting down")
+	}
+
+	alice.send("/FILE_REQUEST", bobId, "late.bin", "1", "0", "t2")
+	if args, _ := alice.expect("/TRANSFER_DECLINE"); args[2] != "t2" {
+		t.Fatalf("alice got %v", args)
+	}
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown returned %v before the transfer finished", err)
+	default:
+	}
+
+	alice.sendData(bobId, "t1", data)
+	bob.receiveData("t1", len(data))
+	bob.send("/RECEIPT", aliceId, "t1", "report.bin", checksum)
+	alice.expect("/RECEIPT")
+
+	select {
+	case err := <-shutdown:
+		if err != nil {
+			t.Fatalf("Shutdown returned %v", err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("Shutdown did not return once the transfer finished")
+	}
+	alice.conn.SetReadDeadline(time.Now().Add(testTimeout))
+	for {
+		if _, err := alice.conn.ReadLine(); err != nil {
+			if os.IsTimeout(err) {
+				t.Fatal("alice is still connected after Shutdown")
+			}
+			break
+		}
+	}
+}
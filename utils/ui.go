@@ -2,6 +2,7 @@ package utils
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"sync"
 	"time"
@@ -22,10 +23,36 @@ var (
 	PausedColor  = color.New(color.FgYellow, color.Bold).SprintFunc()
 )
 
+// Output receives the client's messages and progress bars. It is standard
+// output unless SetOutput says otherwise.
+var Output io.Writer = output
+
+var output = &switchWriter{target: os.Stdout}
+
+// SetOutput makes everything written to Output go to w from now on. It is
+// safe to call while messages are being written.
+func SetOutput(w io.Writer) {
+	output.mutex.Lock()
+	output.target = w
+	output.mutex.Unlock()
+}
+
+// switchWriter passes writes on to a target that can be replaced at any time
+type switchWriter struct {
+	mutex  sync.Mutex
+	target io.Writer
+}
+
+func (s *switchWriter) Write(p []byte) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.target.Write(p)
+}
+
 type ProgressBar struct {
-	Bar       *progressbar.ProgressBar
-	IsPaused  bool
-	Mutex     sync.Mutex
+	Bar        *progressbar.ProgressBar
+	IsPaused   bool
+	Mutex      sync.Mutex
 	TransferId string
 }
 
@@ -34,6 +61,7 @@ func CreateProgressBar(size int64, description string) *ProgressBar {
 	bar := progressbar.NewOptions64(
 		size,
 		progressbar.OptionSetDescription(description),
+		progressbar.OptionSetWriter(Output),
 		progressbar.OptionEnableColorCodes(true),
 		progressbar.OptionShowBytes(true),
 		progressbar.OptionSetWidth(50),
@@ -47,10 +75,10 @@ func CreateProgressBar(size int64, description string) *ProgressBar {
 			BarEnd:        "]",
 		}),
 		progressbar.OptionOnCompletion(func() {
-			fmt.Fprint(os.Stdout, "\n")
+			fmt.Fprint(Output, "\n")
 		}),
 	)
-	
+
 	return &ProgressBar{
 		Bar:      bar,
 		IsPaused: false,
@@ -60,20 +88,28 @@ func CreateProgressBar(size int64, description string) *ProgressBar {
 func (pb *ProgressBar) Write(p []byte) (n int, err error) {
 	pb.Mutex.Lock()
 	defer pb.Mutex.Unlock()
-	
+
 	if pb.IsPaused {
 		return len(p), nil
 	}
-	
+
 	return pb.Bar.Write(p)
 }
 
+// Add64 advances the bar by n bytes that were transferred earlier
+func (pb *ProgressBar) Add64(n int64) {
+	pb.Mutex.Lock()
+	defer pb.Mutex.Unlock()
+
+	pb.Bar.Add64(n)
+}
+
 func (pb *ProgressBar) SetPaused(paused bool) {
 	pb.Mutex.Lock()
 	defer pb.Mutex.Unlock()
-	
+
 	pb.IsPaused = paused
-	
+
 	description := pb.Bar.String()
 	if paused {
 		pb.Bar.Describe(fmt.Sprintf("%s %s", description, PausedColor("[PAUSED]")))
@@ -94,23 +130,43 @@ func (pb *ProgressBar) SetTransferId(id string) {
 func PrintHelp() {
 	fmt.Println(HeaderColor("\n📚 DrizLink Help - Available Commands 📚"))
 	fmt.Println(InfoColor("------------------------------------------------"))
-	
+
 	fmt.Println(HeaderColor("\n🌐 General Commands:"))
 	fmt.Printf("  %s - Show online users\n", CommandColor("/status"))
 	fmt.Printf("  %s - Show this help message\n", CommandColor("/help"))
 	fmt.Printf("  %s - Disconnect and exit\n", CommandColor("exit"))
-	
+
 	fmt.Println(HeaderColor("\n📁 File Operations:"))
 	fmt.Printf("  %s - Browse user's shared files\n", CommandColor("/lookup <userId>"))
-	fmt.Printf("  %s - Send a file to user\n", CommandColor("/sendfile <userId> <filePath>"))
+	fmt.Printf("  %s - Send files to one or more users (globs like *.log or reports/**/*.pdf allowed)\n", CommandColor("/sendfile <userId>[,<userId>...]|@all <filePath>..."))
 	fmt.Printf("  %s - Send a folder to user\n", CommandColor("/sendfolder <userId> <folderPath>"))
 	fmt.Printf("  %s - Download a file from user\n", CommandColor("/download <userId> <fileName>"))
-	
+	fmt.Printf("  %s - Fetch a file by its MD5 checksum from every online user who has it\n", CommandColor("/get <checksum> [fileName]"))
+	fmt.Printf("  %s - Exchange new and changed files with a folder in user's store path\n", CommandColor("/sync <userId> <localFolder> <remoteFolder>"))
+	fmt.Printf("  %s - List, accept or reject requests to sync or mirror your folders\n", CommandColor("/sync [accept|reject <id>|all]"))
+	fmt.Printf("  %s - Keep downloading new and changed files of a folder in user's store path\n", CommandColor("/mirror <userId> <remotePath> <localPath> [--delete] [--every <duration>]"))
+	fmt.Printf("  %s - Stop a mirror\n", CommandColor("/unmirror <mirrorId>|all"))
+	fmt.Printf("  %s - Send new and modified files in a folder automatically\n", CommandColor("/watch <userId> <folder>"))
+	fmt.Printf("  %s - List watched folders\n", CommandColor("/watches"))
+	fmt.Printf("  %s - Stop watching a folder\n", CommandColor("/unwatch <watchId>|all"))
+
 	fmt.Println(HeaderColor("\n📡 Transfer Controls:"))
 	fmt.Printf("  %s - Show all active transfers\n", CommandColor("/transfers"))
+	fmt.Printf("  %s - Show finished transfers matching a filter\n", CommandColor("/history [filter]"))
+	fmt.Printf("  %s - Export transfer history as CSV or JSON\n", CommandColor("/history export <file> [filter]"))
 	fmt.Printf("  %s - Pause an active transfer\n", CommandColor("/pause <transferId>"))
 	fmt.Printf("  %s - Resume a paused transfer\n", CommandColor("/resume <transferId>"))
-	
+	fmt.Printf("  %s - Stop a queued or running transfer\n", CommandColor("/cancel <transferId>"))
+	fmt.Printf("  %s - Change a queued transfer's priority\n", CommandColor("/priority <transferId> high|normal|low"))
+	fmt.Printf("  %s - Move a queued transfer in the queue\n", CommandColor("/move <transferId> <position>"))
+	fmt.Printf("  %s - List, resume or drop transfers interrupted when DrizLink last stopped\n", CommandColor("/journal [resume|drop <id>|all]"))
+	fmt.Printf("  %s - List, accept or reject transfers held while you were offline\n", CommandColor("/spool [accept|reject <id>|all]"))
+	fmt.Printf("  %s - Show the chunk store, or forget received files that changed\n", CommandColor("/chunks [gc]"))
+
+	fmt.Println(HeaderColor("\n⚙ Settings:"))
+	fmt.Printf("  %s - Show current settings\n", CommandColor("/settings"))
+	fmt.Printf("  %s - Change a setting (max-transfers, on-conflict, retry-attempts, offline-delivery, streams, delta, chunk-store, on-duplicate)\n", CommandColor("/set <key> <value>"))
+
 	fmt.Println(InfoColor("------------------------------------------------"))
 	fmt.Println(InfoColor("Type a message and press Enter to send to everyone\n"))
 }